@@ -0,0 +1,584 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"gopkg.in/yaml.v3"
+)
+
+// allowlistDescriptionPrefix starts the description of every security group
+// rule created for an allowlist entry. It is how allowlist rules are told
+// apart from the session's other rules.
+const allowlistDescriptionPrefix = "bastion allowlist "
+
+// maxRuleDescriptionLength is the longest description AWS accepts for a
+// security group rule.
+const maxRuleDescriptionLength = 255
+
+// AllowlistEntry is a single named network range in an allowlist.
+type AllowlistEntry struct {
+	_ struct{}
+
+	// The name of the range (for example, "vancouver-office").
+	Name string `json:"name" yaml:"name"`
+
+	// The network range, in CIDR notation. This may be an IPv4 or IPv6
+	// range.
+	CIDR string `json:"cidr" yaml:"cidr"`
+}
+
+// Allowlist is a list of named network ranges that SSH access to the
+// bastion host is allowed from, such as office ranges and VPN egress
+// addresses.
+type Allowlist struct {
+	_ struct{}
+
+	// The file or URL the allowlist was loaded from.
+	Source string `json:"source" yaml:"-"`
+
+	// The entries in the allowlist.
+	Entries []AllowlistEntry `json:"entries" yaml:"entries"`
+}
+
+// ParseAllowlist parses an allowlist document. Both YAML and JSON are
+// accepted, in the form:
+//
+//	entries:
+//	  - name: vancouver-office
+//	    cidr: 203.0.113.0/24
+//
+// Names must be unique and non-empty. CIDR blocks are normalized, and may
+// not appear more than once.
+func ParseAllowlist(data []byte, source string) (Allowlist, error) {
+	var list Allowlist
+
+	// YAML is a superset of JSON, so one parser handles both.
+	err := yaml.Unmarshal(data, &list)
+	if err != nil {
+		return list, fmt.Errorf("Unable to parse allowlist %s: %s", source, err)
+	}
+	list.Source = source
+
+	names := make(map[string]bool)
+	cidrs := make(map[string]string)
+	for i, v := range list.Entries {
+		if v.Name == "" {
+			return list, fmt.Errorf("Allowlist %s entry %d has no name.", source, i+1)
+		}
+		if names[v.Name] == true {
+			return list, fmt.Errorf("Allowlist %s has more than one entry named %q.", source, v.Name)
+		}
+		names[v.Name] = true
+
+		cidr, err := normalizeCIDR(v.CIDR)
+		if err != nil {
+			return list, fmt.Errorf("Allowlist %s entry %q: %s", source, v.Name, err)
+		}
+		if other, ok := cidrs[cidr]; ok {
+			return list, fmt.Errorf("Allowlist %s entries %q and %q are both for %s.", source, other, v.Name, cidr)
+		}
+		cidrs[cidr] = v.Name
+		list.Entries[i].CIDR = cidr
+	}
+
+	return list, nil
+}
+
+// LoadAllowlist reads an allowlist from a local file, or from an http or
+// https URL. See ParseAllowlist for the format.
+func LoadAllowlist(ctx context.Context, source string) (Allowlist, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = fetchAllowlist(ctx, source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return Allowlist{}, fmt.Errorf("Unable to read allowlist %s: %s", source, err)
+	}
+
+	return ParseAllowlist(data, source)
+}
+
+// fetchAllowlist downloads an allowlist document.
+func fetchAllowlist(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// allowlistDescription returns the security group rule description for an
+// allowlist entry, naming the entry and the allowlist it came from.
+// Characters that AWS does not accept in descriptions are replaced, and the
+// description is truncated to the maximum length.
+func allowlistDescription(source, name string) string {
+	desc := fmt.Sprintf("%s%s from %s", allowlistDescriptionPrefix, name, source)
+
+	desc = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" ._-:/()#,@[]+=&;{}!$*", r):
+			return r
+		}
+		return '_'
+	}, desc)
+
+	if len(desc) > maxRuleDescriptionLength {
+		desc = desc[:maxRuleDescriptionLength]
+	}
+	return desc
+}
+
+// isAllowlistRule returns true if a security group rule was created for an
+// allowlist entry.
+func isAllowlistRule(rule SecurityGroupRule) bool {
+	return strings.HasPrefix(rule.Description, allowlistDescriptionPrefix)
+}
+
+// allowlistRule returns the security group rule that allows SSH access from
+// an allowlist entry.
+func allowlistRule(group, source string, entry AllowlistEntry) SecurityGroupRule {
+	return SecurityGroupRule{
+		GroupID:     group,
+		Peer:        clientPeer(entry.CIDR),
+		StartPort:   sshPort,
+		EndPort:     sshPort,
+		Description: allowlistDescription(source, entry.Name),
+	}
+}
+
+// isAllowlistNetworkACLRulePair returns true if a network ACL rule pair was
+// created for an allowlist entry.
+func isAllowlistNetworkACLRulePair(pair NetworkACLRulePair) bool {
+	return strings.HasPrefix(pair.Description, allowlistDescriptionPrefix)
+}
+
+// allowlistNetworkACLRulePair returns the network ACL rule pair that allows
+// SSH access from an allowlist entry, and its return traffic.
+func allowlistNetworkACLRulePair(acl, source string, entry AllowlistEntry, ephemeral EphemeralPortRange) NetworkACLRulePair {
+	forward := NetworkACLRule{
+		NetworkAclID: acl,
+		StartPort:    sshPort,
+		EndPort:      sshPort,
+	}
+	if isIPv6CIDR(entry.CIDR) == true {
+		forward.Ipv6CidrBlock = entry.CIDR
+	} else {
+		forward.CidrBlock = entry.CIDR
+	}
+
+	pair := NewNetworkACLRulePair(forward, ephemeral)
+	pair.Description = allowlistDescription(source, entry.Name)
+	return pair
+}
+
+// networkACLRulePairCIDR returns the CIDR block a network ACL rule pair is
+// for.
+func networkACLRulePairCIDR(pair NetworkACLRulePair) string {
+	if pair.Forward.Ipv6CidrBlock != "" {
+		return pair.Forward.Ipv6CidrBlock
+	}
+	return pair.Forward.CidrBlock
+}
+
+// allowlistTransientRules returns the session's allowlist rules as transient
+// rules for opening client access to cidr: client access must not rely on
+// them, as they are removed when their entries leave the allowlist. The
+// security group rule for exactly cidr is the exception, as a group cannot
+// hold the same permission twice. The client's rule is then recorded as
+// pre-existing, and SyncAllowlist hands the rule over to the client access
+// if the entry is removed.
+func allowlistTransientRules(s Session, cidr string) ([]SecurityGroupRule, []NetworkACLRule) {
+	var sgrs []SecurityGroupRule
+	for _, v := range s.SecurityGroupRules {
+		if isAllowlistRule(v) == true && v.Peer != clientPeer(cidr) {
+			sgrs = append(sgrs, v)
+		}
+	}
+
+	var rules []NetworkACLRule
+	for _, v := range s.NetworkACLRulePairs {
+		if isAllowlistNetworkACLRulePair(v) == true {
+			rules = append(rules, v.Forward, v.Return)
+		}
+	}
+	return sgrs, rules
+}
+
+// allowlistHandover checks that the session's client access does not rely
+// on the allowlist rules that are about to be removed, as their entries are
+// not wanted. A pre-existing client security group rule for exactly the range
+// of a removed rule is the same permission, so that rule is handed over to
+// the client access instead of being removed: the returned map is from the
+// index of the allowlist rule to the index of the client rule. Client access
+// that relies on a removed rule in any other way is an error.
+func allowlistHandover(conn *ec2.EC2, s Session, wanted map[string]bool) (map[int]int, error) {
+	handover := make(map[int]int)
+	var removedSGRs []SecurityGroupRule
+	for i, v := range s.SecurityGroupRules {
+		if v.Created == false || v.PreExisting == true || isAllowlistRule(v) == false || wanted[v.Peer.Value] == true {
+			continue
+		}
+		removedSGRs = append(removedSGRs, v)
+		for j, c := range s.SecurityGroupRules {
+			if isClientSecurityGroupRule(s, c) == true && c.PreExisting == true && c.GroupID == v.GroupID && c.Peer == v.Peer {
+				handover[i] = j
+			}
+		}
+	}
+
+	var removedRules []NetworkACLRule
+	for _, v := range s.NetworkACLRulePairs {
+		if v.Created() == true && isAllowlistNetworkACLRulePair(v) == true && wanted[networkACLRulePairCIDR(v)] == false {
+			removedRules = append(removedRules, v.Forward, v.Return)
+		}
+	}
+
+	handedOver := make(map[int]bool)
+	for _, j := range handover {
+		handedOver[j] = true
+	}
+
+	relies := func(cidr string) error {
+		return fmt.Errorf("The session's client access to %s relies on an allowlist entry that is being removed. Move the client access first.", cidr)
+	}
+
+	for j, c := range s.SecurityGroupRules {
+		if len(removedSGRs) < 1 || isClientSecurityGroupRule(s, c) == false || c.PreExisting == false || handedOver[j] == true {
+			continue
+		}
+		perms, err := describeSecurityGroupPermissions(conn, c.GroupID, c.Egress)
+		if err != nil {
+			return nil, err
+		}
+		k := securityGroupBatch{group: c.GroupID, egress: c.Egress}
+		if permissionsCoverRule(withoutTransientPermissions(perms, k, removedSGRs), c) == false {
+			return nil, relies(s.ClientCIDR)
+		}
+	}
+
+	for _, p := range s.NetworkACLRulePairs {
+		if len(removedRules) < 1 || isClientNetworkACLRulePair(s, p) == false {
+			continue
+		}
+		for _, c := range []NetworkACLRule{p.Forward, p.Return} {
+			if c.PreExisting == false {
+				continue
+			}
+			acl, err := describeNetworkACL(conn, c.NetworkAclID)
+			if err != nil {
+				return nil, err
+			}
+			eval, err := EvaluateNetworkACL(withoutTransientEntries(acl, c.NetworkAclID, removedRules), c)
+			if err != nil {
+				return nil, err
+			}
+			if eval.Allowed() == false {
+				return nil, relies(s.ClientCIDR)
+			}
+		}
+	}
+
+	return handover, nil
+}
+
+// updateSecurityGroupRuleDescription changes the description of an existing
+// ingress or egress security group rule.
+func updateSecurityGroupRuleDescription(conn *ec2.EC2, rule SecurityGroupRule) error {
+	perm, err := securityGroupRulePermission(rule)
+	if err != nil {
+		return err
+	}
+
+	if rule.Egress == true {
+		_, err = conn.UpdateSecurityGroupRuleDescriptionsEgress(&ec2.UpdateSecurityGroupRuleDescriptionsEgressInput{
+			GroupId:       aws.String(rule.GroupID),
+			IpPermissions: []*ec2.IpPermission{perm},
+		})
+		return err
+	}
+
+	_, err = conn.UpdateSecurityGroupRuleDescriptionsIngress(&ec2.UpdateSecurityGroupRuleDescriptionsIngressInput{
+		GroupId:       aws.String(rule.GroupID),
+		IpPermissions: []*ec2.IpPermission{perm},
+	})
+	return err
+}
+
+// AllowlistOptions describes how SyncAllowlist opens the bastion subnet's
+// network ACL to allowlist entries.
+type AllowlistOptions struct {
+	_ struct{}
+
+	// The network ACL of the bastion subnet. If empty, it is looked up from
+	// the subnet of the session's bastion host, and if the session has no
+	// bastion host yet, no network ACL rules are created.
+	NetworkACLID string
+
+	// The operating system of the clients in the allowlisted ranges, which
+	// decides the ephemeral port range return traffic is allowed to. See
+	// EphemeralPortsForOS.
+	ClientOS string
+
+	// The placement strategy for new network ACL entries. Defaults to
+	// DefaultRulePlacement.
+	Placement RulePlacement
+
+	// The policy new rules are checked against. Defaults to DefaultPolicy.
+	Policy *Policy
+}
+
+// AllowlistSyncResult describes the changes made by SyncAllowlist.
+type AllowlistSyncResult struct {
+	_ struct{}
+
+	// The names of the entries that access was added for.
+	Added []string `json:"added"`
+
+	// The descriptions of the rules that were removed, as the entries they
+	// were created for are no longer in the allowlist.
+	Removed []string `json:"removed"`
+
+	// The names of the entries whose rules were kept, with their
+	// descriptions updated if the entry was renamed.
+	Unchanged []string `json:"unchanged"`
+
+	// The policy violations that were allowed through, as the policy is
+	// overridden. They are also added to the session's PolicyOverrides.
+	PolicyOverrides []PolicyViolation `json:"policy_overrides,omitempty"`
+}
+
+// SyncAllowlist reconciles the session's allowlist rules with an allowlist:
+// a security group rule and a network ACL rule pair are created for every
+// entry that does not have them, and rules for ranges that are no longer in
+// the list are removed. Entries are matched to existing rules by CIDR block,
+// so renaming an entry only updates the rules' descriptions. New rules are
+// created before old ones are removed, as a single RuleSet, so if any of
+// them fails, the others are rolled back.
+//
+// The session's client access rules do not count as allowing an entry, as
+// they move with the client (see UpdateClientCIDR), so an entry inside the
+// client range still gets rules of its own. An entry for exactly the client
+// range cannot, so it is rejected; move the client access first. To have
+// both from the start, sync the allowlist before opening client access, as
+// LaunchSession does.
+//
+// Likewise, client access gets rules of its own even inside an allowlisted
+// range, except for a security group rule for exactly an entry's range,
+// which is recorded as pre-existing. If that entry is removed, its rule is
+// handed over to the client access rather than removed. If the client access
+// relies on a removed entry's rules in any other way (as it can in sessions
+// saved by earlier versions), nothing is changed, and an error is returned.
+//
+// The returned session reflects the rules that exist, even in the event of
+// errors.
+func SyncAllowlist(conn *ec2.EC2, s Session, list Allowlist, opts AllowlistOptions) (Session, AllowlistSyncResult, error) {
+	var result AllowlistSyncResult
+
+	// Copy the rule slices so that the caller's session is left untouched.
+	s.SecurityGroupRules = append([]SecurityGroupRule(nil), s.SecurityGroupRules...)
+	s.NetworkACLRulePairs = append([]NetworkACLRulePair(nil), s.NetworkACLRulePairs...)
+
+	var err error
+	acl := opts.NetworkACLID
+	if acl == "" && s.Instance.SubnetID != "" {
+		acl, err = FindNetworkACLForSubnet(conn, s.Instance.SubnetID)
+		if err != nil {
+			return s, result, err
+		}
+	}
+
+	ephemeral, err := EphemeralPortsForOS(opts.ClientOS)
+	if err != nil {
+		return s, result, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, entry := range list.Entries {
+		wanted[entry.CIDR] = true
+	}
+
+	handover, err := allowlistHandover(conn, s, wanted)
+	if err != nil {
+		return s, result, err
+	}
+
+	set := RuleSet{Placement: opts.Placement, Policy: opts.Policy}
+	var ownedClientSGR bool
+	currentSGRs := make(map[RulePeer]int)
+	for i, v := range s.SecurityGroupRules {
+		if v.Created == true && isAllowlistRule(v) == true {
+			currentSGRs[v.Peer] = i
+		}
+		if isClientSecurityGroupRule(s, v) == true {
+			set.TransientSecurityGroupRules = append(set.TransientSecurityGroupRules, v)
+			ownedClientSGR = ownedClientSGR || v.PreExisting == false
+		}
+	}
+	currentPairs := make(map[string]int)
+	for i, v := range s.NetworkACLRulePairs {
+		if v.Created() == true && isAllowlistNetworkACLRulePair(v) == true {
+			currentPairs[networkACLRulePairCIDR(v)] = i
+		}
+		if isClientNetworkACLRulePair(s, v) == true {
+			set.TransientNetworkACLRules = append(set.TransientNetworkACLRules, v.Forward, v.Return)
+		}
+	}
+
+	var added []string
+	var descriptions []string
+	for _, entry := range list.Entries {
+		rule := allowlistRule(s.SecurityGroup.GroupID, list.Source, entry)
+
+		i, haveSGR := currentSGRs[rule.Peer]
+		_, havePair := currentPairs[entry.CIDR]
+		if haveSGR == false && ownedClientSGR == true && entry.CIDR == s.ClientCIDR {
+			return s, result, fmt.Errorf("Allowlist entry %q is for %s, which the session's client access is already open to. Move the client access first.", entry.Name, entry.CIDR)
+		}
+
+		if haveSGR == true {
+			existing := s.SecurityGroupRules[i]
+			if existing.Description != rule.Description && existing.PreExisting == false {
+				existing.Description = rule.Description
+				err := updateSecurityGroupRuleDescription(conn, existing)
+				if err != nil {
+					return s, result, err
+				}
+			}
+			s.SecurityGroupRules[i].Description = rule.Description
+		} else {
+			set.SecurityGroupRules = append(set.SecurityGroupRules, rule)
+		}
+
+		if havePair == true {
+			s.NetworkACLRulePairs[currentPairs[entry.CIDR]].Description = rule.Description
+		} else if acl != "" {
+			pair := allowlistNetworkACLRulePair(acl, list.Source, entry, ephemeral)
+			set.NetworkACLRules = append(set.NetworkACLRules, pair.Forward, pair.Return)
+			descriptions = append(descriptions, pair.Description)
+		}
+
+		if haveSGR == true && (havePair == true || acl == "") {
+			result.Unchanged = append(result.Unchanged, entry.Name)
+		} else {
+			added = append(added, entry.Name)
+		}
+	}
+
+	if len(set.NetworkACLRules) > 0 {
+		s.Snapshot, err = SnapshotNetworkACL(conn, s.Snapshot, acl)
+		if err != nil {
+			return s, result, err
+		}
+	}
+
+	if len(set.SecurityGroupRules) > 0 || len(set.NetworkACLRules) > 0 {
+		var applied RuleSetResult
+		set, applied, err = ApplyRuleSet(conn, set)
+		result.PolicyOverrides = applied.PolicyOverrides
+		s.PolicyOverrides = append(append([]PolicyViolation(nil), s.PolicyOverrides...), applied.PolicyOverrides...)
+		for _, v := range set.SecurityGroupRules {
+			if v.Created == true {
+				s.SecurityGroupRules = append(s.SecurityGroupRules, v)
+			}
+		}
+		for i := 0; i+1 < len(set.NetworkACLRules); i += 2 {
+			pair := NetworkACLRulePair{
+				Forward:     set.NetworkACLRules[i],
+				Return:      set.NetworkACLRules[i+1],
+				Description: descriptions[i/2],
+			}
+			if pair.Created() == true {
+				s.NetworkACLRulePairs = append(s.NetworkACLRulePairs, pair)
+			}
+		}
+		if err != nil {
+			return s, result, err
+		}
+		result.Added = added
+	}
+
+	var errs []error
+	handedOver := make(map[int]bool)
+	for i, j := range handover {
+		rule := s.SecurityGroupRules[i]
+		rule.Description = ""
+		err := updateSecurityGroupRuleDescription(conn, rule)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.SecurityGroupRules[j].PreExisting = false
+		handedOver[i] = true
+	}
+
+	var keepSGRs []SecurityGroupRule
+	for i, v := range s.SecurityGroupRules {
+		if v.Created == false || isAllowlistRule(v) == false || wanted[v.Peer.Value] == true {
+			keepSGRs = append(keepSGRs, v)
+			continue
+		}
+
+		// Rules being handed over are never removed, even if the handover
+		// failed, as the client access relies on them.
+		if _, ok := handover[i]; ok == true {
+			if handedOver[i] == true {
+				result.Removed = append(result.Removed, v.Description)
+			} else {
+				keepSGRs = append(keepSGRs, v)
+			}
+			continue
+		}
+
+		_, err := DeleteSecurityGroupRule(conn, v)
+		if err != nil {
+			keepSGRs = append(keepSGRs, v)
+			errs = append(errs, err)
+			continue
+		}
+		result.Removed = append(result.Removed, v.Description)
+	}
+	s.SecurityGroupRules = keepSGRs
+
+	var keepPairs []NetworkACLRulePair
+	for _, v := range s.NetworkACLRulePairs {
+		if v.Created() == false || isAllowlistNetworkACLRulePair(v) == false || wanted[networkACLRulePairCIDR(v)] == true {
+			keepPairs = append(keepPairs, v)
+			continue
+		}
+
+		out, err := DeleteNetworkACLRulePair(conn, v)
+		if err != nil {
+			keepPairs = append(keepPairs, out)
+			errs = append(errs, err)
+		}
+	}
+	s.NetworkACLRulePairs = keepPairs
+
+	if len(errs) > 0 {
+		return s, result, fmt.Errorf("Unable to remove %d allowlist rule(s): %s", len(errs), errs[0])
+	}
+	return s, result, nil
+}
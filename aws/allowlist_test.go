@@ -0,0 +1,480 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testAllowlistYAML is a test allowlist in YAML.
+const testAllowlistYAML = `
+entries:
+  - name: vancouver-office
+    cidr: 203.0.113.5/24
+  - name: vpn
+    cidr: 2001:db8:1::/48
+`
+
+// testAllowlistJSON is the same test allowlist, in JSON.
+const testAllowlistJSON = `{"entries": [
+  {"name": "vancouver-office", "cidr": "203.0.113.5/24"},
+  {"name": "vpn", "cidr": "2001:db8:1::/48"}
+]}`
+
+// testAllowlistEntries are the entries that the test allowlists parse to.
+func testAllowlistEntries() []AllowlistEntry {
+	return []AllowlistEntry{
+		AllowlistEntry{Name: "vancouver-office", CIDR: "203.0.113.0/24"},
+		AllowlistEntry{Name: "vpn", CIDR: "2001:db8:1::/48"},
+	}
+}
+
+// testUpdateSecurityGroupRuleDescriptionsIngress is a stub function for
+// testing the ec2.UpdateSecurityGroupRuleDescriptionsIngress function.
+func testUpdateSecurityGroupRuleDescriptionsIngress(input *ec2.UpdateSecurityGroupRuleDescriptionsIngressInput) (*ec2.UpdateSecurityGroupRuleDescriptionsIngressOutput, error) {
+	if *input.GroupId == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.UpdateSecurityGroupRuleDescriptionsIngressOutput{}, nil
+}
+
+// createTestEC2AllowlistMock returns a mock EC2 service to use with the
+// allowlist test functions. Mutating calls are recorded in calls.
+func createTestEC2AllowlistMock(calls *[]string) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	peer := func(perm *ec2.IpPermission) string {
+		if len(perm.Ipv6Ranges) > 0 {
+			return *perm.Ipv6Ranges[0].CidrIpv6
+		}
+		return *perm.IpRanges[0].CidrIp
+	}
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeSecurityGroupsInput:
+			out, err := testDescribeSecurityGroups(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeSecurityGroupsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.AuthorizeSecurityGroupIngressInput:
+			*calls = append(*calls, "authorize "+peer(p.IpPermissions[0]))
+			_, r.Error = testAuthorizeSecurityGroupIngress(p)
+		case *ec2.RevokeSecurityGroupIngressInput:
+			*calls = append(*calls, "revoke "+peer(p.IpPermissions[0]))
+			_, r.Error = testRevokeSecurityGroupIngress(p)
+		case *ec2.UpdateSecurityGroupRuleDescriptionsIngressInput:
+			*calls = append(*calls, "describe "+peer(p.IpPermissions[0]))
+			_, r.Error = testUpdateSecurityGroupRuleDescriptionsIngress(p)
+		case *ec2.DescribeNetworkAclsInput:
+			out, err := testDescribeNetworkAcls(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeNetworkAclsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.CreateNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("create entry %s %v", *p.CidrBlock, *p.Egress))
+			_, r.Error = testCreateNetworkAclEntry(p)
+		case *ec2.DeleteNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("delete entry %d %v", *p.RuleNumber, *p.Egress))
+			_, r.Error = testDeleteNetworkAclEntry(p)
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+func TestParseAllowlist(t *testing.T) {
+	for name, doc := range map[string]string{"yaml": testAllowlistYAML, "json": testAllowlistJSON} {
+		list, err := ParseAllowlist([]byte(doc), "teams.yml")
+		if err != nil {
+			t.Fatalf("Bad (%s): %s", name, err.Error())
+		}
+
+		expected := testAllowlistEntries()
+		if reflect.DeepEqual(expected, list.Entries) == false {
+			t.Fatalf("Expected %v, got %v", expected, list.Entries)
+		}
+		if list.Source != "teams.yml" {
+			t.Fatalf("Expected %v, got %v", "teams.yml", list.Source)
+		}
+	}
+}
+
+func TestParseAllowlistInvalid(t *testing.T) {
+	cases := []string{
+		"entries: [",
+		"entries:\n  - cidr: 10.0.0.0/8\n",
+		"entries:\n  - name: office\n    cidr: bad\n",
+		"entries:\n  - name: office\n    cidr: 10.0.0.0/8\n  - name: office\n    cidr: 10.1.0.0/16\n",
+		"entries:\n  - name: office\n    cidr: 10.0.0.0/8\n  - name: vpn\n    cidr: 10.0.0.1/8\n",
+	}
+
+	for _, doc := range cases {
+		_, err := ParseAllowlist([]byte(doc), "teams.yml")
+		if err == nil {
+			t.Fatalf("Expected error for %q", doc)
+		}
+	}
+}
+
+func TestLoadAllowlistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "teams.yml")
+	err := os.WriteFile(path, []byte(testAllowlistYAML), 0600)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	list, err := LoadAllowlist(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if reflect.DeepEqual(testAllowlistEntries(), list.Entries) == false {
+		t.Fatalf("Expected %v, got %v", testAllowlistEntries(), list.Entries)
+	}
+}
+
+func TestLoadAllowlistURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/teams.json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testAllowlistJSON)
+	}))
+	defer ts.Close()
+
+	list, err := LoadAllowlist(context.Background(), ts.URL+"/teams.json")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if reflect.DeepEqual(testAllowlistEntries(), list.Entries) == false {
+		t.Fatalf("Expected %v, got %v", testAllowlistEntries(), list.Entries)
+	}
+
+	_, err = LoadAllowlist(context.Background(), ts.URL+"/missing.json")
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestAllowlistDescription(t *testing.T) {
+	expected := "bastion allowlist vpn from https://example.com/teams.yml_ref=main"
+	actual := allowlistDescription("https://example.com/teams.yml?ref=main", "vpn")
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	long := allowlistDescription(strings.Repeat("a", 300), "vpn")
+	if len(long) != maxRuleDescriptionLength {
+		t.Fatalf("Expected %v, got %v", maxRuleDescriptionLength, len(long))
+	}
+}
+
+func TestSyncAllowlist(t *testing.T) {
+	var calls []string
+	conn := createTestEC2AllowlistMock(&calls)
+
+	s := Session{SecurityGroup: testSecurityGroup()}
+	s.SecurityGroupRules = []SecurityGroupRule{
+		testSecurityGroupRule(),
+		// Kept, but renamed.
+		allowlistRule("sg-123456", "teams.yml", AllowlistEntry{Name: "vpn-old", CIDR: "2001:db8:1::/48"}),
+		// Removed.
+		allowlistRule("sg-123456", "teams.yml", AllowlistEntry{Name: "seattle-office", CIDR: "198.51.100.0/24"}),
+	}
+	s.SecurityGroupRules[1].Created = true
+	s.SecurityGroupRules[2].Created = true
+
+	list := Allowlist{Source: "teams.yml", Entries: testAllowlistEntries()}
+	out, result, err := SyncAllowlist(conn, s, list, AllowlistOptions{})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := fmt.Sprintf("%v", []string{
+		"describe 2001:db8:1::/48",
+		"authorize 203.0.113.0/24",
+		"revoke 198.51.100.0/24",
+	})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	if reflect.DeepEqual(result.Added, []string{"vancouver-office"}) == false ||
+		reflect.DeepEqual(result.Unchanged, []string{"vpn"}) == false ||
+		len(result.Removed) != 1 {
+		t.Fatalf("Unexpected result %#v", result)
+	}
+
+	if len(out.SecurityGroupRules) != 3 {
+		t.Fatalf("Expected 3 rules, got %#v", out.SecurityGroupRules)
+	}
+	if out.SecurityGroupRules[1].Description != allowlistDescription("teams.yml", "vpn") {
+		t.Fatalf("Expected renamed description, got %v", out.SecurityGroupRules[1].Description)
+	}
+	if out.SecurityGroupRules[2].Peer != IPv4CIDRPeer("203.0.113.0/24") || isAllowlistRule(out.SecurityGroupRules[2]) == false {
+		t.Fatalf("Unexpected new rule %#v", out.SecurityGroupRules[2])
+	}
+
+	// The caller's session is left untouched.
+	if s.SecurityGroupRules[1].Description != allowlistDescription("teams.yml", "vpn-old") {
+		t.Fatalf("Expected input session to be unchanged")
+	}
+
+	// Syncing again changes nothing.
+	calls = nil
+	_, result, err = SyncAllowlist(conn, out, list, AllowlistOptions{})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if len(calls) != 0 || len(result.Added) != 0 || len(result.Removed) != 0 {
+		t.Fatalf("Expected no changes, got %v %#v", calls, result)
+	}
+}
+
+func TestSyncAllowlistNetworkACL(t *testing.T) {
+	var calls []string
+	conn := createTestEC2AllowlistMock(&calls)
+	conn.Handlers.Send.PushBack(testRoamingLiveState)
+
+	// The entry is inside the client range, but still gets rules of its own.
+	s := testRoamingSession()
+	list := Allowlist{
+		Source:  "teams.yml",
+		Entries: []AllowlistEntry{AllowlistEntry{Name: "office", CIDR: "10.0.1.0/25"}},
+	}
+	opts := AllowlistOptions{NetworkACLID: "nacl-123456", ClientOS: "linux"}
+	out, result, err := SyncAllowlist(conn, s, list, opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := fmt.Sprintf("%v", []string{
+		"authorize 10.0.1.0/25",
+		"create entry 10.0.1.0/25 false",
+		"create entry 10.0.1.0/25 true",
+	})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	if reflect.DeepEqual(result.Added, []string{"office"}) == false {
+		t.Fatalf("Unexpected result %#v", result)
+	}
+	if len(out.NetworkACLRulePairs) != 2 {
+		t.Fatalf("Expected 2 pairs, got %#v", out.NetworkACLRulePairs)
+	}
+	pair := out.NetworkACLRulePairs[1]
+	if isAllowlistNetworkACLRulePair(pair) == false || pair.PreExisting() == true || pair.Return.StartPort != 32768 {
+		t.Fatalf("Unexpected new pair %#v", pair)
+	}
+	if isClientNetworkACLRulePair(out, pair) == true {
+		t.Fatalf("Expected the allowlist pair not to be treated as client access")
+	}
+	if len(out.Snapshot.NetworkACLs) != 1 {
+		t.Fatalf("Expected the network ACL to be snapshotted, got %#v", out.Snapshot)
+	}
+
+	// Removing the entry removes both its rules.
+	calls = nil
+	out, result, err = SyncAllowlist(conn, out, Allowlist{Source: "teams.yml"}, opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	expected = fmt.Sprintf("%v", []string{
+		"revoke 10.0.1.0/25",
+		fmt.Sprintf("delete entry %d false", pair.Forward.RuleNumber),
+		fmt.Sprintf("delete entry %d true", pair.Return.RuleNumber),
+	})
+	actual = fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	if len(out.SecurityGroupRules) != 2 || len(out.NetworkACLRulePairs) != 1 {
+		t.Fatalf("Expected only the client and target rules to be left, got %#v", out)
+	}
+}
+
+func TestSyncAllowlistClientRange(t *testing.T) {
+	var calls []string
+	conn := createTestEC2AllowlistMock(&calls)
+
+	list := Allowlist{
+		Source:  "teams.yml",
+		Entries: []AllowlistEntry{AllowlistEntry{Name: "office", CIDR: "10.0.1.0/24"}},
+	}
+	_, _, err := SyncAllowlist(conn, testRoamingSession(), list, AllowlistOptions{NetworkACLID: "nacl-123456"})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls, got %v", calls)
+	}
+}
+
+// testAllowlistLiveState pushes the rules of an allowlist entry for
+// 10.0.0.0/16 into the mock's live security group and network ACL.
+func testAllowlistLiveState(r *request.Request) {
+	switch r.Params.(type) {
+	case *ec2.DescribeSecurityGroupsInput:
+		group := r.Data.(*ec2.DescribeSecurityGroupsOutput).SecurityGroups[0]
+		group.IpPermissions = append(group.IpPermissions, &ec2.IpPermission{
+			FromPort:   aws.Int64(22),
+			IpProtocol: aws.String("tcp"),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.0.0/16")}},
+			ToPort:     aws.Int64(22),
+		})
+	case *ec2.DescribeNetworkAclsInput:
+		acl := r.Data.(*ec2.DescribeNetworkAclsOutput).NetworkAcls[0]
+		acl.Entries = append(acl.Entries,
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("10.0.0.0/16"),
+				Egress:     aws.Bool(false),
+				PortRange:  &ec2.PortRange{From: aws.Int64(22), To: aws.Int64(22)},
+				Protocol:   aws.String("6"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(1),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("10.0.0.0/16"),
+				Egress:     aws.Bool(true),
+				PortRange:  &ec2.PortRange{From: aws.Int64(32768), To: aws.Int64(60999)},
+				Protocol:   aws.String("6"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(2),
+			},
+		)
+	}
+}
+
+// testAllowlistSession returns a session with client access for 10.0.1.0/24
+// that is recorded as pre-existing, and the rules of an allowlist entry for
+// cidr.
+func testAllowlistSession(cidr string) Session {
+	s := testRoamingSession()
+	s.SecurityGroupRules[0].PreExisting = true
+
+	entry := AllowlistEntry{Name: "office", CIDR: cidr}
+	rule := allowlistRule("sg-123456", "teams.yml", entry)
+	rule.Created = true
+	s.SecurityGroupRules = append(s.SecurityGroupRules, rule)
+	return s
+}
+
+func TestOpenLaunchClientAccessAllowlist(t *testing.T) {
+	var calls []string
+	conn := createTestEC2AllowlistMock(&calls)
+	conn.Handlers.Send.PushBack(testAllowlistLiveState)
+
+	// The allowlist rules cover the client, but do not count as allowing it.
+	entry := AllowlistEntry{Name: "office", CIDR: "10.0.0.0/16"}
+	rule := allowlistRule("sg-123456", "teams.yml", entry)
+	rule.Created = true
+	pair := allowlistNetworkACLRulePair("nacl-123456", "teams.yml", entry, EphemeralPortsLinux)
+	pair.Forward.RuleNumber = 1
+	pair.Forward.Created = true
+	pair.Return.RuleNumber = 2
+	pair.Return.Created = true
+	s := Session{
+		ID:                  "abcdef0123456789",
+		ClientCIDR:          "10.0.1.0/24",
+		SecurityGroup:       testSecurityGroup(),
+		SecurityGroupRules:  []SecurityGroupRule{rule},
+		NetworkACLRulePairs: []NetworkACLRulePair{pair},
+	}
+
+	out, err := openLaunchClientAccess(conn, s, LaunchOptions{NetworkACLID: "nacl-123456", ClientOS: "linux"})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := fmt.Sprintf("%v", []string{
+		"authorize 10.0.1.0/24",
+		"create entry 10.0.1.0/24 false",
+		"create entry 10.0.1.0/24 true",
+	})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	if len(out.SecurityGroupRules) != 2 || out.SecurityGroupRules[1].PreExisting == true {
+		t.Fatalf("Expected the client rule to be created, got %#v", out.SecurityGroupRules)
+	}
+	if len(out.NetworkACLRulePairs) != 2 || out.NetworkACLRulePairs[1].PreExisting() == true {
+		t.Fatalf("Expected the client pair to be created, got %#v", out.NetworkACLRulePairs)
+	}
+}
+
+func TestSyncAllowlistHandover(t *testing.T) {
+	var calls []string
+	conn := createTestEC2AllowlistMock(&calls)
+	conn.Handlers.Send.PushBack(testRoamingLiveState)
+
+	// The client access relies on the entry's security group rule, which is
+	// handed over to it rather than removed.
+	s := testAllowlistSession("10.0.1.0/24")
+	out, result, err := SyncAllowlist(conn, s, Allowlist{Source: "teams.yml"}, AllowlistOptions{NetworkACLID: "nacl-123456"})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := fmt.Sprintf("%v", []string{"describe 10.0.1.0/24"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	if reflect.DeepEqual(result.Removed, []string{s.SecurityGroupRules[2].Description}) == false {
+		t.Fatalf("Unexpected result %#v", result)
+	}
+	if len(out.SecurityGroupRules) != 2 || out.SecurityGroupRules[0].PreExisting == true {
+		t.Fatalf("Expected the client rule to be owned by the session, got %#v", out.SecurityGroupRules)
+	}
+	if isClientSecurityGroupRule(out, out.SecurityGroupRules[0]) == false {
+		t.Fatalf("Expected the rule to be treated as client access")
+	}
+}
+
+func TestSyncAllowlistClientReliesOnEntry(t *testing.T) {
+	var calls []string
+	conn := createTestEC2AllowlistMock(&calls)
+	conn.Handlers.Send.PushBack(testAllowlistLiveState)
+
+	s := testAllowlistSession("10.0.0.0/16")
+	_, _, err := SyncAllowlist(conn, s, Allowlist{Source: "teams.yml"}, AllowlistOptions{NetworkACLID: "nacl-123456"})
+	if err == nil || strings.Contains(err.Error(), "relies on an allowlist entry") == false {
+		t.Fatalf("Expected the removal to be refused, got %v", err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls, got %v", calls)
+	}
+}
+
+func TestSecurityGroupRulePermissionDescription(t *testing.T) {
+	rule := testSecurityGroupRule()
+	rule.Description = "office"
+
+	perm, err := securityGroupRulePermission(rule)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if *perm.IpRanges[0].Description != "office" {
+		t.Fatalf("Expected %v, got %v", "office", *perm.IpRanges[0].Description)
+	}
+}
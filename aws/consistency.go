@@ -0,0 +1,44 @@
+package aws
+
+import (
+	"time"
+)
+
+// consistencyWindow is how long an eventually consistent "not found" error is
+// retried for before it is treated as a real failure.
+var consistencyWindow = 30 * time.Second
+
+// consistencyInterval is the delay between retries of an eventually
+// consistent call.
+var consistencyInterval = time.Second
+
+// eventualConsistencyCodes are the error codes that EC2 can return for a
+// resource that has just been created, but has not yet propagated through
+// the API.
+var eventualConsistencyCodes = []string{
+	"InvalidInstanceID.NotFound",
+	"InvalidGroup.NotFound",
+	"InvalidGroupId.NotFound",
+	"InvalidKeyPair.NotFound",
+}
+
+// isEventualConsistencyError returns true if err is one of the not found
+// errors that EC2 returns for freshly created resources.
+func isEventualConsistencyError(err error) bool {
+	return isAWSErrorCode(err, eventualConsistencyCodes...)
+}
+
+// retryEventualConsistency runs fn, retrying it for up to consistencyWindow
+// while it returns one of the eventualConsistencyCodes errors. Any other
+// error, or the last not found error once the window has elapsed, is
+// returned as-is.
+func retryEventualConsistency(fn func() error) error {
+	deadline := time.Now().Add(consistencyWindow)
+	for {
+		err := fn()
+		if isEventualConsistencyError(err) == false || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(consistencyInterval)
+	}
+}
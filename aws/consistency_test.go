@@ -0,0 +1,68 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// shortenConsistencyDelays shortens the eventual consistency window and retry
+// interval, and returns a function that restores them.
+func shortenConsistencyDelays(window time.Duration) func() {
+	w := consistencyWindow
+	i := consistencyInterval
+	consistencyWindow = window
+	consistencyInterval = time.Millisecond
+	return func() {
+		consistencyWindow = w
+		consistencyInterval = i
+	}
+}
+
+func TestRetryEventualConsistency(t *testing.T) {
+	defer shortenConsistencyDelays(time.Second)()
+	attempts := 0
+
+	err := retryEventualConsistency(func() error {
+		attempts++
+		if attempts < 3 {
+			return awserr.New("InvalidInstanceID.NotFound", "not found", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryEventualConsistencyOtherError(t *testing.T) {
+	defer shortenConsistencyDelays(time.Second)()
+	attempts := 0
+
+	err := retryEventualConsistency(func() error {
+		attempts++
+		return fmt.Errorf("error")
+	})
+	if err == nil {
+		t.Fatalf("Expected error, got none")
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestRetryEventualConsistencyWindowElapsed(t *testing.T) {
+	defer shortenConsistencyDelays(10 * time.Millisecond)()
+
+	err := retryEventualConsistency(func() error {
+		return awserr.New("InvalidGroup.NotFound", "not found", nil)
+	})
+	if isAWSErrorCode(err, "InvalidGroup.NotFound") == false {
+		t.Fatalf("Expected InvalidGroup.NotFound, got %v", err)
+	}
+}
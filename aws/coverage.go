@@ -0,0 +1,77 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+)
+
+// normalizeCIDR returns the canonical form of a CIDR block, with the host
+// bits cleared (for example, 10.0.1.5/24 becomes 10.0.1.0/24).
+func normalizeCIDR(cidr string) (string, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("Invalid CIDR block %q.", cidr)
+	}
+	return n.String(), nil
+}
+
+// cidrCovers returns true if every address in inner is also in outer. CIDR
+// blocks of different address families never cover each other, and invalid
+// CIDR blocks cover nothing.
+func cidrCovers(outer, inner string) bool {
+	_, o, err := net.ParseCIDR(outer)
+	if err != nil {
+		return false
+	}
+	_, i, err := net.ParseCIDR(inner)
+	if err != nil {
+		return false
+	}
+
+	oOnes, oBits := o.Mask.Size()
+	iOnes, iBits := i.Mask.Size()
+	if oBits != iBits || oOnes > iOnes {
+		return false
+	}
+
+	return o.Contains(i.IP)
+}
+
+// portRangeCovers returns true if the port range from-to includes all of
+// the ports in start-end.
+func portRangeCovers(from, to, start, end int) bool {
+	return from <= start && to >= end
+}
+
+// icmpValueCovers returns true if an existing ICMP type or code covers a
+// requested one. -1 matches all types or codes.
+func icmpValueCovers(existing, requested int) bool {
+	return existing == -1 || existing == requested
+}
+
+// protocolCovers returns true if traffic for the requested protocol can be
+// matched by a rule for the existing protocol: either they are the same, or
+// the existing rule applies to all protocols. Both protocols must be
+// normalized.
+func protocolCovers(existing, requested string) bool {
+	return existing == ProtocolAll || existing == requested
+}
+
+// normalizeRulePeer returns a copy of a peer with its CIDR block normalized.
+// Peers that are not CIDR blocks are returned unchanged.
+func normalizeRulePeer(peer RulePeer) (RulePeer, error) {
+	if peer.Type != RulePeerIPv4CIDR && peer.Type != RulePeerIPv6CIDR {
+		return peer, nil
+	}
+
+	cidr, err := normalizeCIDR(peer.Value)
+	if err != nil {
+		return peer, err
+	}
+	if isIPv6CIDR(cidr) != (peer.Type == RulePeerIPv6CIDR) {
+		return peer, fmt.Errorf("CIDR block %s does not match peer type %s.", peer.Value, peer.Type)
+	}
+
+	peer.Value = cidr
+	return peer, nil
+}
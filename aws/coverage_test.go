@@ -0,0 +1,76 @@
+package aws
+
+import (
+	"testing"
+)
+
+func TestNormalizeCIDR(t *testing.T) {
+	cases := map[string]string{
+		"10.0.1.5/24":      "10.0.1.0/24",
+		"10.0.1.0/24":      "10.0.1.0/24",
+		"2001:db8::1/64":   "2001:db8::/64",
+		"192.168.100.1/32": "192.168.100.1/32",
+	}
+
+	for in, expected := range cases {
+		actual, err := normalizeCIDR(in)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if expected != actual {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+	}
+
+	_, err := normalizeCIDR("10.0.1.5")
+	if err == nil {
+		t.Fatalf("Expected error for address without prefix length")
+	}
+}
+
+func TestCIDRCovers(t *testing.T) {
+	cases := []struct {
+		outer    string
+		inner    string
+		expected bool
+	}{
+		{outer: "10.0.0.0/16", inner: "10.0.1.0/24", expected: true},
+		{outer: "10.0.1.0/24", inner: "10.0.1.5/24", expected: true},
+		{outer: "10.0.1.0/24", inner: "10.0.0.0/16", expected: false},
+		{outer: "10.0.1.0/24", inner: "10.0.2.0/24", expected: false},
+		{outer: "0.0.0.0/0", inner: "192.168.100.1/32", expected: true},
+		{outer: "0.0.0.0/0", inner: "2001:db8::/64", expected: false},
+		{outer: "::/0", inner: "2001:db8::/64", expected: true},
+		{outer: "bad", inner: "10.0.1.0/24", expected: false},
+	}
+
+	for _, c := range cases {
+		actual := cidrCovers(c.outer, c.inner)
+		if c.expected != actual {
+			t.Fatalf("Expected %v for %s covering %s, got %v", c.expected, c.outer, c.inner, actual)
+		}
+	}
+}
+
+func TestNormalizeRulePeer(t *testing.T) {
+	peer, err := normalizeRulePeer(IPv4CIDRPeer("10.0.1.5/24"))
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if peer.Value != "10.0.1.0/24" {
+		t.Fatalf("Expected %v, got %v", "10.0.1.0/24", peer.Value)
+	}
+
+	_, err = normalizeRulePeer(IPv4CIDRPeer("2001:db8::/64"))
+	if err == nil {
+		t.Fatalf("Expected error for IPv6 CIDR block in IPv4 peer")
+	}
+
+	peer, err = normalizeRulePeer(SecurityGroupPeer("sg-654321", ""))
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if peer.Value != "sg-654321" {
+		t.Fatalf("Expected %v, got %v", "sg-654321", peer.Value)
+	}
+}
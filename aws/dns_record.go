@@ -0,0 +1,184 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// dnsRecordTTL is the TTL, in seconds, of the DNS records that bastion
+// creates. This is kept short as the address changes every session.
+const dnsRecordTTL = 60
+
+// dnsRecordComment is the comment that is attached to DNS record changes.
+const dnsRecordComment = "Managed by bastion"
+
+// Route53API is the subset of the Route 53 API that bastion uses. It is
+// satisfied by *route53.Route53.
+type Route53API interface {
+	ChangeResourceRecordSets(*route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+	ListResourceRecordSets(*route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error)
+}
+
+// DNSRecord describes an AWS Route 53 A record for the bastion host.
+type DNSRecord struct {
+	_ struct{}
+
+	// true if the record has been created, or is accounted for (ie: the
+	// PreExisting flag is set).
+	Created bool `json:"created"`
+
+	// The ID of the hosted zone the record is in.
+	HostedZoneID string `json:"hosted_zone_id"`
+
+	// The fully qualified name of the record (for example,
+	// bastion.staging.internal).
+	Name string `json:"name"`
+
+	// The IP address the record points to.
+	Value string `json:"value"`
+
+	// "true" if the record was pre-existing in the exact form that it was
+	// going to be created in (ie: name and address). Pre-existing records are
+	// not deleted.
+	PreExisting bool `json:"pre_existing"`
+}
+
+// canonicalDNSName lower-cases a DNS name and adds the trailing dot, so that
+// names can be compared with the ones returned by Route 53.
+func canonicalDNSName(name string) string {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".") == false {
+		name += "."
+	}
+	return name
+}
+
+// findDNSRecord returns the A record with the supplied name in a hosted
+// zone, or nil if there is none.
+func findDNSRecord(conn Route53API, zone, name string) (*route53.ResourceRecordSet, error) {
+	params := &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zone),
+		MaxItems:        aws.String("1"),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String(route53.RRTypeA),
+	}
+
+	resp, err := conn.ListResourceRecordSets(params)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range resp.ResourceRecordSets {
+		if canonicalDNSName(*v.Name) == canonicalDNSName(name) && *v.Type == route53.RRTypeA {
+			return v, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// dnsRecordValues returns the values of a record set.
+func dnsRecordValues(rs *route53.ResourceRecordSet) []string {
+	var out []string
+	for _, v := range rs.ResourceRecords {
+		out = append(out, aws.StringValue(v.Value))
+	}
+	return out
+}
+
+// FindPreExistingDNSRecord will check to see if an A record with the supplied
+// name already exists in the hosted zone, pointing only to the supplied
+// address.
+func FindPreExistingDNSRecord(conn Route53API, zone, name, addr string) (bool, error) {
+	rs, err := findDNSRecord(conn, zone, name)
+	if err != nil || rs == nil {
+		return false, err
+	}
+
+	values := dnsRecordValues(rs)
+	return len(values) == 1 && values[0] == addr, nil
+}
+
+// dnsRecordChange returns the change batch for an action on a record.
+func dnsRecordChange(action string, record DNSRecord) *route53.ChangeResourceRecordSetsInput {
+	return &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(record.HostedZoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String(dnsRecordComment),
+			Changes: []*route53.Change{
+				&route53.Change{
+					Action: aws.String(action),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name: aws.String(record.Name),
+						Type: aws.String(route53.RRTypeA),
+						TTL:  aws.Int64(dnsRecordTTL),
+						ResourceRecords: []*route53.ResourceRecord{
+							&route53.ResourceRecord{Value: aws.String(record.Value)},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// CreateDNSRecord creates an A record in a Route 53 hosted zone, and returns a
+// DNSRecord struct.
+//
+// If the record already exists pointing to the same address, the struct will
+// still be populated, however the PreExisting flag will be set to true. If a
+// record with the name exists pointing anywhere else (for example, at
+// another session's bastion host), it is left alone and an error is
+// returned.
+//
+// Note that in the event of errors, DNSRecord will be in an inconsistent
+// state and should not be used.
+func CreateDNSRecord(conn Route53API, zone, name, addr string) (DNSRecord, error) {
+	record := DNSRecord{
+		HostedZoneID: zone,
+		Name:         name,
+		Value:        addr,
+	}
+
+	// Check for pre-existing records first
+	rs, err := findDNSRecord(conn, zone, name)
+	if err != nil {
+		return record, err
+	}
+	if rs != nil {
+		values := dnsRecordValues(rs)
+		if len(values) == 1 && values[0] == addr {
+			record.PreExisting = true
+			record.Created = true
+			return record, nil
+		}
+		return record, fmt.Errorf("DNS record %s already exists in hosted zone %s, pointing to %s. Remove it or choose another name.", name, zone, strings.Join(values, ", "))
+	}
+
+	// CREATE rather than UPSERT, so that a record that appeared since the
+	// check above is never overwritten.
+	_, err = conn.ChangeResourceRecordSets(dnsRecordChange(route53.ChangeActionCreate, record))
+	if err != nil {
+		return record, err
+	}
+
+	record.Created = true
+	return record, nil
+}
+
+// DeleteDNSRecord deletes a DNS record, if it was not pre-existing.
+func DeleteDNSRecord(conn Route53API, record DNSRecord) (DNSRecord, error) {
+	// do nothing if the record was pre-existing.
+	if record.PreExisting == false {
+		_, err := conn.ChangeResourceRecordSets(dnsRecordChange(route53.ChangeActionDelete, record))
+		if err != nil {
+			return record, err
+		}
+	}
+
+	record.Created = false
+	return record, nil
+}
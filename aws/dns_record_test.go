@@ -0,0 +1,189 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// testDNSRecord provides a test DNS record.
+func testDNSRecord() DNSRecord {
+	return DNSRecord{
+		Created:      true,
+		HostedZoneID: "Z123456",
+		Name:         "bastion.staging.internal",
+		Value:        "54.0.0.1",
+		PreExisting:  false,
+	}
+}
+
+// testRoute53 is a fake Route 53 service for use with the DNS record test
+// functions. Records are stored by canonical name.
+type testRoute53 struct {
+	// The A records in the zone, keyed by name.
+	records map[string]string
+
+	// The change actions that have been made, in order.
+	changes []string
+}
+
+// newTestRoute53 returns a testRoute53 with a single record in it.
+func newTestRoute53() *testRoute53 {
+	return &testRoute53{
+		records: map[string]string{
+			"existing.staging.internal.": "54.0.0.2",
+		},
+	}
+}
+
+// ListResourceRecordSets is the fake implementation of
+// route53.ListResourceRecordSets.
+func (r *testRoute53) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	if *input.HostedZoneId == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+
+	out := &route53.ListResourceRecordSetsOutput{}
+	name := canonicalDNSName(*input.StartRecordName)
+	if v, ok := r.records[name]; ok {
+		out.ResourceRecordSets = []*route53.ResourceRecordSet{
+			&route53.ResourceRecordSet{
+				Name:            aws.String(name),
+				Type:            aws.String(route53.RRTypeA),
+				TTL:             aws.Int64(300),
+				ResourceRecords: []*route53.ResourceRecord{&route53.ResourceRecord{Value: aws.String(v)}},
+			},
+		}
+	}
+	return out, nil
+}
+
+// ChangeResourceRecordSets is the fake implementation of
+// route53.ChangeResourceRecordSets.
+func (r *testRoute53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	if *input.HostedZoneId == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+
+	for _, c := range input.ChangeBatch.Changes {
+		name := canonicalDNSName(*c.ResourceRecordSet.Name)
+		r.changes = append(r.changes, *c.Action+" "+name)
+		switch *c.Action {
+		case route53.ChangeActionCreate:
+			if _, ok := r.records[name]; ok == true {
+				return nil, fmt.Errorf("record %s already exists", name)
+			}
+			r.records[name] = *c.ResourceRecordSet.ResourceRecords[0].Value
+		case route53.ChangeActionUpsert:
+			r.records[name] = *c.ResourceRecordSet.ResourceRecords[0].Value
+		case route53.ChangeActionDelete:
+			if _, ok := r.records[name]; ok == false {
+				return nil, fmt.Errorf("record %s not found", name)
+			}
+			delete(r.records, name)
+		}
+	}
+	return &route53.ChangeResourceRecordSetsOutput{}, nil
+}
+
+func TestFindPreExistingDNSRecord(t *testing.T) {
+	conn := newTestRoute53()
+
+	expected := true
+	actual, err := FindPreExistingDNSRecord(conn, "Z123456", "Existing.staging.internal", "54.0.0.2")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestCreateDNSRecord(t *testing.T) {
+	conn := newTestRoute53()
+	expected := testDNSRecord()
+
+	actual, err := CreateDNSRecord(conn, expected.HostedZoneID, expected.Name, expected.Value)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+	if conn.records["bastion.staging.internal."] != expected.Value {
+		t.Fatalf("Expected record to be created, got %v", conn.records)
+	}
+	if reflect.DeepEqual(conn.changes, []string{"CREATE bastion.staging.internal."}) == false {
+		t.Fatalf("Expected a single CREATE, got %v", conn.changes)
+	}
+}
+
+func TestCreateDNSRecordConflict(t *testing.T) {
+	conn := newTestRoute53()
+
+	// Another session's bastion host already has the name.
+	_, err := CreateDNSRecord(conn, "Z123456", "existing.staging.internal", "54.0.0.9")
+	if err == nil {
+		t.Fatalf("Expected an error for a record pointing elsewhere")
+	}
+
+	if len(conn.changes) != 0 {
+		t.Fatalf("Expected no changes, got %v", conn.changes)
+	}
+	if conn.records["existing.staging.internal."] != "54.0.0.2" {
+		t.Fatalf("Expected the existing record to be left alone, got %v", conn.records)
+	}
+}
+
+func TestCreateDNSRecordPreExisting(t *testing.T) {
+	conn := newTestRoute53()
+
+	out, err := CreateDNSRecord(conn, "Z123456", "existing.staging.internal", "54.0.0.2")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if out.PreExisting != true {
+		t.Fatalf("Expected pre-existing flag to be true, got %v", out.PreExisting)
+	}
+	if len(conn.changes) != 0 {
+		t.Fatalf("Expected no changes, got %v", conn.changes)
+	}
+}
+
+func TestDeleteDNSRecord(t *testing.T) {
+	conn := newTestRoute53()
+	record := testDNSRecord()
+	conn.records["bastion.staging.internal."] = record.Value
+
+	out, err := DeleteDNSRecord(conn, record)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if out.Created != false {
+		t.Fatalf("Expected created flag to be false, got %v", out.Created)
+	}
+	if _, ok := conn.records["bastion.staging.internal."]; ok {
+		t.Fatalf("Expected record to be deleted, got %v", conn.records)
+	}
+}
+
+func TestDeleteDNSRecordPreExisting(t *testing.T) {
+	conn := newTestRoute53()
+	record := testDNSRecord()
+	record.PreExisting = true
+
+	_, err := DeleteDNSRecord(conn, record)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if len(conn.changes) != 0 {
+		t.Fatalf("Expected no changes, got %v", conn.changes)
+	}
+}
@@ -0,0 +1,202 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ElasticIP describes an AWS VPC Elastic IP address.
+type ElasticIP struct {
+	_ struct{}
+
+	// true if the address has been allocated, or is accounted for (ie: the
+	// PreExisting flag is set).
+	Created bool `json:"created"`
+
+	// "true" if an existing, tagged allocation was reused. Pre-existing
+	// addresses are disassociated on teardown, but not released.
+	PreExisting bool `json:"pre_existing"`
+
+	// The allocation ID of the address.
+	AllocationID string `json:"allocation_id"`
+
+	// The association ID of the address, if it has been associated with the
+	// bastion host.
+	AssociationID string `json:"association_id"`
+
+	// The public IP address.
+	PublicIP string `json:"public_ip"`
+}
+
+// findTaggedElasticIP looks for an unassociated VPC Elastic IP address with
+// the supplied tag. If more than one is found, the one with the lowest
+// allocation ID is returned, so that the choice is stable. nil is returned if
+// none is found.
+func findTaggedElasticIP(conn *ec2.EC2, tagKey, tagValue string) (*ec2.Address, error) {
+	params := &ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("domain"),
+				Values: aws.StringSlice([]string{"vpc"}),
+			},
+			&ec2.Filter{
+				Name:   aws.String("tag:" + tagKey),
+				Values: aws.StringSlice([]string{tagValue}),
+			},
+		},
+	}
+
+	resp, err := conn.DescribeAddresses(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var free []*ec2.Address
+	for _, v := range resp.Addresses {
+		if v.AssociationId == nil {
+			free = append(free, v)
+		}
+	}
+
+	if len(free) < 1 {
+		return nil, nil
+	}
+
+	sort.Slice(free, func(i, j int) bool {
+		return *free[i].AllocationId < *free[j].AllocationId
+	})
+
+	return free[0], nil
+}
+
+// AllocateElasticIP allocates a VPC Elastic IP address for the bastion host.
+//
+// If tagKey is supplied, an unassociated address tagged with tagKey and
+// tagValue is reused if one exists, in which case the PreExisting flag will
+// be set. Otherwise, a new address is allocated and given the tag, so that it
+// can be found again.
+//
+// Note that in the event of errors, ElasticIP will be in an inconsistent
+// state and should not be used.
+func AllocateElasticIP(conn *ec2.EC2, tagKey, tagValue string) (ElasticIP, error) {
+	var eip ElasticIP
+
+	if tagKey != "" {
+		addr, err := findTaggedElasticIP(conn, tagKey, tagValue)
+		if err != nil {
+			return eip, err
+		}
+		if addr != nil {
+			eip.AllocationID = *addr.AllocationId
+			eip.PublicIP = *addr.PublicIp
+			eip.PreExisting = true
+			eip.Created = true
+			return eip, nil
+		}
+	}
+
+	params := &ec2.AllocateAddressInput{
+		Domain: aws.String("vpc"),
+	}
+
+	resp, err := conn.AllocateAddress(params)
+	if err != nil {
+		return eip, err
+	}
+
+	eip.AllocationID = *resp.AllocationId
+	eip.PublicIP = *resp.PublicIp
+	eip.Created = true
+
+	if tagKey != "" {
+		req := &ec2.CreateTagsInput{
+			Resources: aws.StringSlice([]string{eip.AllocationID}),
+			Tags: []*ec2.Tag{
+				&ec2.Tag{
+					Key:   aws.String(tagKey),
+					Value: aws.String(tagValue),
+				},
+			},
+		}
+		err = retryEventualConsistency(func() error {
+			_, err := conn.CreateTags(req)
+			return err
+		})
+		if err != nil {
+			return eip, err
+		}
+	}
+
+	return eip, nil
+}
+
+// AssociateElasticIP associates an Elastic IP address with a running
+// instance, and updates the instance's public IP address to match.
+func AssociateElasticIP(conn *ec2.EC2, eip ElasticIP, instance Instance) (ElasticIP, Instance, error) {
+	params := &ec2.AssociateAddressInput{
+		AllocationId: aws.String(eip.AllocationID),
+		InstanceId:   aws.String(instance.InstanceID),
+	}
+
+	var resp *ec2.AssociateAddressOutput
+	err := retryEventualConsistency(func() error {
+		var err error
+		resp, err = conn.AssociateAddress(params)
+		return err
+	})
+	if err != nil {
+		return eip, instance, err
+	}
+
+	if resp.AssociationId == nil {
+		return eip, instance, fmt.Errorf("No association ID returned for Elastic IP %s.", eip.AllocationID)
+	}
+
+	eip.AssociationID = *resp.AssociationId
+	instance.PublicIPAddress = eip.PublicIP
+	return eip, instance, nil
+}
+
+// runElasticIPRelease runs most of the logic for ReleaseElasticIP, but does
+// not set Created to false.
+func runElasticIPRelease(conn *ec2.EC2, eip ElasticIP) error {
+	if eip.AssociationID != "" {
+		req := &ec2.DisassociateAddressInput{
+			AssociationId: aws.String(eip.AssociationID),
+		}
+		// The association is removed on its own when the instance is
+		// terminated, so a missing association is not an error.
+		_, err := conn.DisassociateAddress(req)
+		if err != nil && isAWSErrorCode(err, "InvalidAssociationID.NotFound") == false {
+			return err
+		}
+	}
+
+	// do not release the address if it was pre-existing.
+	if eip.PreExisting == true {
+		return nil
+	}
+
+	req := &ec2.ReleaseAddressInput{
+		AllocationId: aws.String(eip.AllocationID),
+	}
+
+	_, err := conn.ReleaseAddress(req)
+	return err
+}
+
+// ReleaseElasticIP disassociates an Elastic IP address, and releases it if
+// it was allocated by bastion.
+func ReleaseElasticIP(conn *ec2.EC2, eip ElasticIP) (ElasticIP, error) {
+	err := runElasticIPRelease(conn, eip)
+	if err != nil {
+		return eip, err
+	}
+
+	eip.AssociationID = ""
+	eip.Created = false
+	return eip, nil
+}
@@ -0,0 +1,264 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testElasticIP provides a test Elastic IP address.
+func testElasticIP() ElasticIP {
+	return ElasticIP{
+		Created:       true,
+		PreExisting:   false,
+		AllocationID:  "eipalloc-123456",
+		AssociationID: "eipassoc-123456",
+		PublicIP:      "54.0.0.10",
+	}
+}
+
+// testDescribeAddressesOutput provides test data for the stub
+// DescribeAddresses function. One address is associated, and two are free.
+func testDescribeAddressesOutput() *ec2.DescribeAddressesOutput {
+	return &ec2.DescribeAddressesOutput{
+		Addresses: []*ec2.Address{
+			&ec2.Address{
+				AllocationId:  aws.String("eipalloc-000001"),
+				AssociationId: aws.String("eipassoc-000001"),
+				Domain:        aws.String("vpc"),
+				PublicIp:      aws.String("54.0.0.1"),
+			},
+			&ec2.Address{
+				AllocationId: aws.String("eipalloc-000003"),
+				Domain:       aws.String("vpc"),
+				PublicIp:     aws.String("54.0.0.3"),
+			},
+			&ec2.Address{
+				AllocationId: aws.String("eipalloc-000002"),
+				Domain:       aws.String("vpc"),
+				PublicIp:     aws.String("54.0.0.2"),
+			},
+		},
+	}
+}
+
+// testDescribeAddresses is a stub function for testing the
+// ec2.DescribeAddresses function. Addresses are only returned when searching
+// for the tag value "reuse".
+func testDescribeAddresses(input *ec2.DescribeAddressesInput) (*ec2.DescribeAddressesOutput, error) {
+	for _, f := range input.Filters {
+		if *f.Name == "tag:bad" {
+			return nil, fmt.Errorf("error")
+		}
+		if *f.Name == "tag:bastion" && *f.Values[0] == "reuse" {
+			return testDescribeAddressesOutput(), nil
+		}
+	}
+	return &ec2.DescribeAddressesOutput{}, nil
+}
+
+// testAllocateAddress is a stub function for testing the
+// ec2.AllocateAddress function.
+func testAllocateAddress(input *ec2.AllocateAddressInput) (*ec2.AllocateAddressOutput, error) {
+	if *input.Domain != "vpc" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.AllocateAddressOutput{
+		AllocationId: aws.String("eipalloc-123456"),
+		Domain:       aws.String("vpc"),
+		PublicIp:     aws.String("54.0.0.10"),
+	}, nil
+}
+
+// testCreateTags is a stub function for testing the ec2.CreateTags function.
+func testCreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	if *input.Resources[0] == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// testAssociateAddress is a stub function for testing the
+// ec2.AssociateAddress function.
+func testAssociateAddress(input *ec2.AssociateAddressInput) (*ec2.AssociateAddressOutput, error) {
+	if *input.AllocationId == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.AssociateAddressOutput{
+		AssociationId: aws.String("eipassoc-123456"),
+	}, nil
+}
+
+// testDisassociateAddress is a stub function for testing the
+// ec2.DisassociateAddress function.
+func testDisassociateAddress(input *ec2.DisassociateAddressInput) (*ec2.DisassociateAddressOutput, error) {
+	if *input.AssociationId == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.DisassociateAddressOutput{}, nil
+}
+
+// testReleaseAddress is a stub function for testing the
+// ec2.ReleaseAddress function.
+func testReleaseAddress(input *ec2.ReleaseAddressInput) (*ec2.ReleaseAddressOutput, error) {
+	if *input.AllocationId == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.ReleaseAddressOutput{}, nil
+}
+
+// createTestEC2EIPMock returns a mock EC2 service to use with the Elastic IP
+// test functions. The names of the operations called are appended to calls.
+func createTestEC2EIPMock(calls *[]string) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		*calls = append(*calls, r.Operation.Name)
+		switch p := r.Params.(type) {
+		case *ec2.DescribeAddressesInput:
+			out, err := testDescribeAddresses(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeAddressesOutput) = *out
+			}
+			r.Error = err
+		case *ec2.AllocateAddressInput:
+			out, err := testAllocateAddress(p)
+			if out != nil {
+				*r.Data.(*ec2.AllocateAddressOutput) = *out
+			}
+			r.Error = err
+		case *ec2.CreateTagsInput:
+			out, err := testCreateTags(p)
+			if out != nil {
+				*r.Data.(*ec2.CreateTagsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.AssociateAddressInput:
+			out, err := testAssociateAddress(p)
+			if out != nil {
+				*r.Data.(*ec2.AssociateAddressOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DisassociateAddressInput:
+			out, err := testDisassociateAddress(p)
+			if out != nil {
+				*r.Data.(*ec2.DisassociateAddressOutput) = *out
+			}
+			r.Error = err
+		case *ec2.ReleaseAddressInput:
+			out, err := testReleaseAddress(p)
+			if out != nil {
+				*r.Data.(*ec2.ReleaseAddressOutput) = *out
+			}
+			r.Error = err
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+func TestAllocateElasticIP(t *testing.T) {
+	var calls []string
+	conn := createTestEC2EIPMock(&calls)
+
+	expected := ElasticIP{
+		Created:      true,
+		AllocationID: "eipalloc-123456",
+		PublicIP:     "54.0.0.10",
+	}
+	actual, err := AllocateElasticIP(conn, "bastion", "new")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+
+	expectedCalls := []string{"DescribeAddresses", "AllocateAddress", "CreateTags"}
+	if reflect.DeepEqual(expectedCalls, calls) == false {
+		t.Fatalf("Expected calls %v, got %v", expectedCalls, calls)
+	}
+}
+
+func TestAllocateElasticIPReuse(t *testing.T) {
+	var calls []string
+	conn := createTestEC2EIPMock(&calls)
+
+	expected := ElasticIP{
+		Created:      true,
+		PreExisting:  true,
+		AllocationID: "eipalloc-000002",
+		PublicIP:     "54.0.0.2",
+	}
+	actual, err := AllocateElasticIP(conn, "bastion", "reuse")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+}
+
+func TestAssociateElasticIP(t *testing.T) {
+	var calls []string
+	conn := createTestEC2EIPMock(&calls)
+	eip := testElasticIP()
+	eip.AssociationID = ""
+
+	outEIP, outInstance, err := AssociateElasticIP(conn, eip, testInstance())
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if outEIP.AssociationID != "eipassoc-123456" {
+		t.Fatalf("Expected association ID to be eipassoc-123456, got %v", outEIP.AssociationID)
+	}
+	if outInstance.PublicIPAddress != eip.PublicIP {
+		t.Fatalf("Expected public IP address to be %v, got %v", eip.PublicIP, outInstance.PublicIPAddress)
+	}
+}
+
+func TestReleaseElasticIP(t *testing.T) {
+	var calls []string
+	conn := createTestEC2EIPMock(&calls)
+
+	out, err := ReleaseElasticIP(conn, testElasticIP())
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if out.Created != false {
+		t.Fatalf("Expected created flag to be false, got %v", out.Created)
+	}
+
+	expectedCalls := []string{"DisassociateAddress", "ReleaseAddress"}
+	if reflect.DeepEqual(expectedCalls, calls) == false {
+		t.Fatalf("Expected calls %v, got %v", expectedCalls, calls)
+	}
+}
+
+func TestReleaseElasticIPPreExisting(t *testing.T) {
+	var calls []string
+	conn := createTestEC2EIPMock(&calls)
+	eip := testElasticIP()
+	eip.PreExisting = true
+
+	_, err := ReleaseElasticIP(conn, eip)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expectedCalls := []string{"DisassociateAddress"}
+	if reflect.DeepEqual(expectedCalls, calls) == false {
+		t.Fatalf("Expected calls %v, got %v", expectedCalls, calls)
+	}
+}
@@ -1,9 +1,12 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"sort"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -21,6 +24,10 @@ const instanceType = "t2.nano"
 // The SSH user that is used to log into the default image.
 const sshUser = "ec2-user"
 
+// instancePollInterval is the interval at which instance state is polled
+// while waiting for a state change.
+var instancePollInterval = 5 * time.Second
+
 // amiSearchParameters returns a DescribeImagesInput struct with the details
 // necessary to locate the image that the bastion host will launch. The code
 // describes an Amazon Linux AMI, which is the default that gets launched.
@@ -78,10 +85,29 @@ type Instance struct {
 	// The private IP address.
 	PrivateIPAddress string `json:"private_ip_address"`
 
+	// The IPv6 address, if one was assigned.
+	IPv6Address string `json:"ipv6_address,omitempty"`
+
 	// The SSH user to connect to the instance with.
 	SSHUser string `json:"ssh_user"`
 }
 
+// InstanceOptions describes the optional settings for launching an instance.
+type InstanceOptions struct {
+	_ struct{}
+
+	// true if an IPv6 address should be assigned to the instance's network
+	// interface. The subnet must have an IPv6 CIDR block.
+	AssignIPv6 bool
+
+	// true if SSH availability should be checked over the IPv6 address,
+	// rather than the public IPv4 address. This implies AssignIPv6.
+	ConnectIPv6 bool
+
+	// The AMI to launch. If this is empty, one is found with LocateImage.
+	ImageID string
+}
+
 // imageSort is an alias type for []*ec2.Image, used for sorting.
 type imageSort []*ec2.Image
 
@@ -107,14 +133,12 @@ func mostRecentAmi(images []*ec2.Image) *ec2.Image {
 
 // waitForInstanceStart waits for the instance to start, and returns the
 // properly updated *ec2.Instance object.
+//
+// As the instance has just been launched, not found errors are retried for
+// a short period, to allow the instance ID to propagate through EC2.
 func waitForInstanceStart(conn *ec2.EC2, instanceID string, timeout int) (*ec2.Instance, error) {
 	params := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name:   aws.String("instance-id"),
-				Values: aws.StringSlice([]string{instanceID}),
-			},
-		},
+		InstanceIds: aws.StringSlice([]string{instanceID}),
 	}
 
 	start := time.Now()
@@ -122,7 +146,12 @@ func waitForInstanceStart(conn *ec2.EC2, instanceID string, timeout int) (*ec2.I
 	max := start.Add(d)
 
 	for time.Now().After(max) == false {
-		resp, err := conn.DescribeInstances(params)
+		var resp *ec2.DescribeInstancesOutput
+		err := retryEventualConsistency(func() error {
+			var err error
+			resp, err = conn.DescribeInstances(params)
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -143,14 +172,36 @@ func waitForInstanceStart(conn *ec2.EC2, instanceID string, timeout int) (*ec2.I
 		if *instance.State.Name == "running" {
 			return instance, nil
 		}
+
+		time.Sleep(instancePollInterval)
 	}
 
 	return nil, fmt.Errorf("Instance was not started after %d seconds", timeout)
 }
 
+// sshAddress returns the address to dial for SSH on a host, bracketing IPv6
+// addresses as necessary.
+func sshAddress(host string) string {
+	return net.JoinHostPort(host, strconv.Itoa(sshPort))
+}
+
+// instanceIPv6Address returns the first IPv6 address of an instance's
+// network interfaces, or an empty string if it has none.
+func instanceIPv6Address(instance *ec2.Instance) string {
+	for _, eni := range instance.NetworkInterfaces {
+		for _, v := range eni.Ipv6Addresses {
+			if v.Ipv6Address != nil {
+				return *v.Ipv6Address
+			}
+		}
+	}
+	return ""
+}
+
 // waitForSSH waits not only for SSH to be running and open, but also ensures
-// that the IP address can be reached via the configured SSH user.
-func waitForSSH(addr, user string, key KeyPair, timeout int) error {
+// that the IP address (IPv4 or IPv6) can be reached via the configured SSH
+// user.
+func waitForSSH(host, user string, key KeyPair, timeout int) error {
 	signer, err := ssh.ParsePrivateKey([]byte(key.PrivateKeyPEM))
 	if err != nil {
 		log.Fatalf("Unable to parse private key: %s", err.Error())
@@ -161,16 +212,22 @@ func waitForSSH(addr, user string, key KeyPair, timeout int) error {
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
+		// The host has just been launched, so there is no known host key to
+		// check against.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         instancePollInterval,
 	}
 	start := time.Now()
 	d := time.Duration(timeout) * time.Second
 	max := start.Add(d)
 
 	for time.Now().After(max) == false {
-		_, err := ssh.Dial("tcp", addr, config)
+		client, err := ssh.Dial("tcp", sshAddress(host), config)
 		if err == nil {
+			client.Close()
 			return nil
 		}
+		time.Sleep(instancePollInterval)
 	}
 
 	return fmt.Errorf("SSH could not be connected after %d seconds", timeout)
@@ -198,7 +255,7 @@ func LocateImage(conn *ec2.EC2) (string, error) {
 
 // CreateInstance creates an Amazon EC2 insatnce, and returns an Instance
 // struct.
-func CreateInstance(conn *ec2.EC2, subnet, securityGroup string, keyPair KeyPair) (Instance, error) {
+func CreateInstance(conn *ec2.EC2, subnet, securityGroup string, keyPair KeyPair, opts InstanceOptions) (Instance, error) {
 	instance := Instance{
 		SubnetID:        subnet,
 		KeyPairName:     keyPair.KeyName,
@@ -206,10 +263,14 @@ func CreateInstance(conn *ec2.EC2, subnet, securityGroup string, keyPair KeyPair
 		InstanceType:    instanceType,
 		SSHUser:         sshUser,
 	}
-	// Locate an AMI for the instance
-	ami, err := LocateImage(conn)
-	if err != nil {
-		return instance, err
+	// Locate an AMI for the instance, unless one was supplied.
+	var err error
+	ami := opts.ImageID
+	if ami == "" {
+		ami, err = LocateImage(conn)
+		if err != nil {
+			return instance, err
+		}
 	}
 
 	// Attempt to launch the instance.
@@ -230,7 +291,18 @@ func CreateInstance(conn *ec2.EC2, subnet, securityGroup string, keyPair KeyPair
 		},
 	}
 
-	resp, err := conn.RunInstances(params)
+	if opts.AssignIPv6 == true || opts.ConnectIPv6 == true {
+		params.NetworkInterfaces[0].Ipv6AddressCount = aws.Int64(1)
+	}
+
+	// The key pair and security group may have only just been created, so
+	// retry on not found errors for them.
+	var resp *ec2.Reservation
+	err = retryEventualConsistency(func() error {
+		var err error
+		resp, err = conn.RunInstances(params)
+		return err
+	})
 	if err != nil {
 		return instance, err
 	}
@@ -249,20 +321,31 @@ func CreateInstance(conn *ec2.EC2, subnet, securityGroup string, keyPair KeyPair
 		return instance, err
 	}
 
-	// Wait for SSH off the new instance public IP address
-	if newInstance.PublicIpAddress == nil {
+	ipv6 := instanceIPv6Address(newInstance)
+
+	// Wait for SSH off the new instance public IP address, or its IPv6
+	// address if requested.
+	host := aws.StringValue(newInstance.PublicIpAddress)
+	if opts.ConnectIPv6 == true {
+		if ipv6 == "" {
+			return instance, fmt.Errorf("Instance ID %s does not have an IPv6 address. Check that subnet %s has an IPv6 CIDR block.", *newInstance.InstanceId, subnet)
+		}
+		host = ipv6
+	}
+	if host == "" {
 		return instance, fmt.Errorf("Instance ID %s does not have a public IP address.", *newInstance.InstanceId)
 	}
 
-	err = waitForSSH(*newInstance.PublicIpAddress, sshUser, keyPair, startTimeout)
+	err = waitForSSH(host, sshUser, keyPair, startTimeout)
 	if err != nil {
 		return instance, err
 	}
 
 	// Done
 	instance.InstanceID = *newInstance.InstanceId
-	instance.PublicIPAddress = *newInstance.PublicIpAddress
+	instance.PublicIPAddress = aws.StringValue(newInstance.PublicIpAddress)
 	instance.PrivateIPAddress = *newInstance.PrivateIpAddress
+	instance.IPv6Address = ipv6
 	instance.Created = true
 
 	return instance, nil
@@ -282,3 +365,40 @@ func DeleteInstance(conn *ec2.EC2, instance Instance) (Instance, error) {
 	instance.Created = false
 	return instance, nil
 }
+
+// WaitForInstanceTermination waits for an instance to reach the terminated
+// state, or for ctx to be done, whichever comes first. An instance that can
+// no longer be found is considered terminated.
+func WaitForInstanceTermination(ctx context.Context, conn *ec2.EC2, instanceID string) error {
+	params := &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	}
+
+	for {
+		resp, err := conn.DescribeInstancesWithContext(ctx, params)
+		switch {
+		case isAWSErrorCode(err, "InvalidInstanceID.NotFound"):
+			return nil
+		case err != nil:
+			return err
+		}
+
+		terminated := true
+		for _, r := range resp.Reservations {
+			for _, i := range r.Instances {
+				if *i.State.Name != ec2.InstanceStateNameTerminated {
+					terminated = false
+				}
+			}
+		}
+		if terminated == true {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Instance %s was not terminated: %s", instanceID, ctx.Err())
+		case <-time.After(instancePollInterval):
+		}
+	}
+}
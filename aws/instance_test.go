@@ -2,6 +2,7 @@ package aws
 
 import (
 	"fmt"
+	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
@@ -230,3 +231,54 @@ func createTestEC2InstanceMock() *ec2.EC2 {
 	})
 	return conn
 }
+
+func TestWaitForInstanceStart(t *testing.T) {
+	conn := createTestEC2InstanceMock()
+
+	expected := "i-1234567890abcdef0"
+	out, err := waitForInstanceStart(conn, expected, 1)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	actual := *out.InstanceId
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestSSHAddress(t *testing.T) {
+	cases := map[string]string{
+		"54.0.0.1":    "54.0.0.1:22",
+		"2001:db8::1": "[2001:db8::1]:22",
+	}
+
+	for host, expected := range cases {
+		actual := sshAddress(host)
+		if expected != actual {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestInstanceIPv6Address(t *testing.T) {
+	instance := testEC2Reservation().Instances[0]
+
+	if actual := instanceIPv6Address(instance); actual != "" {
+		t.Fatalf("Expected no IPv6 address, got %v", actual)
+	}
+
+	instance.NetworkInterfaces = []*ec2.InstanceNetworkInterface{
+		&ec2.InstanceNetworkInterface{
+			Ipv6Addresses: []*ec2.InstanceIpv6Address{
+				&ec2.InstanceIpv6Address{Ipv6Address: aws.String("2001:db8::1")},
+			},
+		},
+	}
+
+	expected := "2001:db8::1"
+	actual := instanceIPv6Address(instance)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
@@ -1,16 +1,13 @@
 package aws
 
 import (
-	"fmt"
-	"math/rand"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
-// keyPairNamePrefix is the prefix that is applied to auto-generated
-// key pairs.
-const keyPairNamePrefix = "bastion-"
+// keyPairDuplicateCode is the error code returned by AWS when a key pair name
+// is already taken.
+const keyPairDuplicateCode = "InvalidKeyPair.Duplicate"
 
 // KeyPair describes an AWS EC2 key pair.
 type KeyPair struct {
@@ -30,25 +27,41 @@ type KeyPair struct {
 	PrivateKeyPEM string `json:"private_key_pem"`
 }
 
-// generateKeyPairName creates an randomly-generated key pair name.
-func generateKeyPairName() string {
-	id := fmt.Sprintf("%x", rand.Int())
-	return securityGroupNamePrefix + id
-}
-
-// CreateKeyPair creates an AWS EC2 key pair.
+// CreateKeyPair creates an AWS EC2 key pair, named by namer. If the name is
+// already taken, a new name is tried.
 //
 // Note that in the event of errors, KeyPair will be in an inconsistent
 // state and should not be used.
-func CreateKeyPair(conn *ec2.EC2) (KeyPair, error) {
-	name := generateKeyPairName()
+func CreateKeyPair(conn *ec2.EC2, namer Namer) (KeyPair, error) {
 	var kp KeyPair
+	name, err := createWithUniqueName(namer, keyPairDuplicateCode, func(name string) error {
+		var err error
+		kp, err = createKeyPair(conn, name)
+		return err
+	})
 	kp.KeyName = name
+	return kp, err
+}
 
+// createPlannedKeyPair creates a key pair with the name from a plan (see
+// createWithPlannedName).
+func createPlannedKeyPair(conn *ec2.EC2, name string) (KeyPair, error) {
+	var kp KeyPair
+	err := createWithPlannedName(name, "key pair", keyPairDuplicateCode, func(name string) error {
+		var err error
+		kp, err = createKeyPair(conn, name)
+		return err
+	})
+	kp.KeyName = name
+	return kp, err
+}
+
+// createKeyPair creates a key pair with exactly the supplied name.
+func createKeyPair(conn *ec2.EC2, name string) (KeyPair, error) {
+	kp := KeyPair{KeyName: name}
 	params := &ec2.CreateKeyPairInput{
 		KeyName: aws.String(name),
 	}
-
 	resp, err := conn.CreateKeyPair(params)
 	if err != nil {
 		return kp, err
@@ -61,6 +74,20 @@ func CreateKeyPair(conn *ec2.EC2) (KeyPair, error) {
 	return kp, nil
 }
 
+// keyPairNameInUse returns true if a key pair with the supplied name exists.
+func keyPairNameInUse(conn *ec2.EC2, name string) (bool, error) {
+	_, err := conn.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{
+		KeyNames: aws.StringSlice([]string{name}),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if isAWSErrorCode(err, "InvalidKeyPair.NotFound") == true {
+		return false, nil
+	}
+	return false, err
+}
+
 // DeleteKeyPair deletes an AWS EC2 key pair.
 func DeleteKeyPair(conn *ec2.EC2, kp KeyPair) (KeyPair, error) {
 	params := &ec2.DeleteKeyPairInput{
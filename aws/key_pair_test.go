@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -37,6 +38,9 @@ func testCreateKeyPair(input *ec2.CreateKeyPairInput) (*ec2.CreateKeyPairOutput,
 	if *input.KeyName == "bad" {
 		return nil, fmt.Errorf("error")
 	}
+	if *input.KeyName == "bastion-duplicate" {
+		return nil, awserr.New("InvalidKeyPair.Duplicate", "duplicate", nil)
+	}
 	return testCreateKeyPairOutput(), nil
 }
 
@@ -84,7 +88,7 @@ func TestCreateKeyPair(t *testing.T) {
 	expectedPrivateKeyPEM := "PrivateKeyPEM"
 	expectedKeyNameStart := "bastion-"
 
-	out, err := CreateKeyPair(conn)
+	out, err := CreateKeyPair(conn, Namer{SessionID: "abcdef0123456789"})
 	if err != nil {
 		t.Fatalf("Bad: %s", err.Error())
 	}
@@ -109,6 +113,23 @@ func TestCreateKeyPair(t *testing.T) {
 	}
 }
 
+func TestCreateKeyPairDuplicate(t *testing.T) {
+	conn := createTestEC2KPMock()
+
+	expectedKeyNameStart := "bastion-duplicate-"
+
+	out, err := CreateKeyPair(conn, Namer{SessionID: "duplicate"})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	actualKeyName := out.KeyName
+	matched, _ := regexp.MatchString("^"+expectedKeyNameStart+"[0-9a-f]+$", actualKeyName)
+	if matched != true {
+		t.Fatalf("Expected name to start with %v, but name is %v", expectedKeyNameStart, actualKeyName)
+	}
+}
+
 func TestDeleteKeyPair(t *testing.T) {
 	conn := createTestEC2KPMock()
 	kp := testKeyPair()
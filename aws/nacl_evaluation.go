@@ -0,0 +1,170 @@
+package aws
+
+import (
+	"net"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// NetworkACLEvaluation is the result of evaluating traffic against the
+// entries of a network ACL.
+type NetworkACLEvaluation struct {
+	_ struct{}
+
+	// true if an entry applies to any of the traffic. ACLs returned by the
+	// EC2 API always end in a deny all entry, so this is normally true.
+	Matched bool `json:"matched"`
+
+	// The rule number of the first entry that applies to any of the traffic.
+	RuleNumber int `json:"rule_number"`
+
+	// The action of that entry: allow or deny.
+	Action string `json:"action"`
+
+	// true if that entry applies to all of the traffic, and its action is the
+	// verdict for all of it. If false, the entry only decides part of the
+	// traffic.
+	Covered bool `json:"covered"`
+}
+
+// Allowed returns true if the evaluated traffic is allowed in its entirety.
+func (e NetworkACLEvaluation) Allowed() bool {
+	return e.Matched == true && e.Covered == true && e.Action == ec2.RuleActionAllow
+}
+
+// cidrOverlaps returns true if two CIDR blocks have any addresses in common.
+func cidrOverlaps(a, b string) bool {
+	_, x, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+	_, y, err := net.ParseCIDR(b)
+	if err != nil {
+		return false
+	}
+	if len(x.IP) != len(y.IP) {
+		return false
+	}
+	return x.Contains(y.IP) || y.Contains(x.IP)
+}
+
+// entryCIDR returns the CIDR block of an entry that corresponds to the
+// address family of a rule, or an empty string if the entry is for the other
+// address family.
+func entryCIDR(entry *ec2.NetworkAclEntry, rule NetworkACLRule) (string, string) {
+	if rule.Ipv6CidrBlock != "" {
+		return aws.StringValue(entry.Ipv6CidrBlock), rule.Ipv6CidrBlock
+	}
+	return aws.StringValue(entry.CidrBlock), rule.CidrBlock
+}
+
+// entryApplies returns whether a network ACL entry applies to any of the
+// traffic a rule describes, and whether it applies to all of it. protocol is
+// the normalized protocol of the rule.
+func entryApplies(entry *ec2.NetworkAclEntry, rule NetworkACLRule, protocol string) (bool, bool) {
+	if aws.BoolValue(entry.Egress) != rule.Egress {
+		return false, false
+	}
+
+	entryBlock, ruleBlock := entryCIDR(entry, rule)
+	if entryBlock == "" || cidrOverlaps(entryBlock, ruleBlock) == false {
+		return false, false
+	}
+	covers := cidrCovers(entryBlock, ruleBlock)
+
+	entryProtocol, err := NormalizeProtocol(aws.StringValue(entry.Protocol))
+	if err != nil {
+		// A protocol bastion doesn't manage, which only overlaps with rules for
+		// all protocols, and never covers them.
+		return protocol == ProtocolAll, false
+	}
+
+	switch {
+	case entryProtocol == ProtocolAll:
+		return true, covers
+	case protocol == ProtocolAll:
+		return true, false
+	case entryProtocol != protocol:
+		return false, false
+	}
+
+	switch {
+	case protocolUsesPorts(protocol):
+		if entry.PortRange == nil {
+			// No port range on a tcp or udp entry means all ports.
+			return true, covers
+		}
+		from := int(aws.Int64Value(entry.PortRange.From))
+		to := int(aws.Int64Value(entry.PortRange.To))
+		if from > rule.EndPort || to < rule.StartPort {
+			return false, false
+		}
+		return true, covers && portRangeCovers(from, to, rule.StartPort, rule.EndPort)
+	case protocolUsesICMP(protocol):
+		if entry.IcmpTypeCode == nil {
+			return true, covers
+		}
+		t := int(aws.Int64Value(entry.IcmpTypeCode.Type))
+		c := int(aws.Int64Value(entry.IcmpTypeCode.Code))
+		if (icmpValueCovers(t, rule.ICMPType) || icmpValueCovers(rule.ICMPType, t)) == false {
+			return false, false
+		}
+		if (icmpValueCovers(c, rule.ICMPCode) || icmpValueCovers(rule.ICMPCode, c)) == false {
+			return false, false
+		}
+		return true, covers && icmpValueCovers(t, rule.ICMPType) && icmpValueCovers(c, rule.ICMPCode)
+	}
+
+	return true, covers
+}
+
+// evaluateNetworkACLEntries evaluates the traffic described by a rule against
+// the entries of a network ACL, and returns every entry that applies to any
+// of that traffic, in rule number order.
+func evaluateNetworkACLEntries(acl *ec2.NetworkAcl, rule NetworkACLRule) ([]NetworkACLEvaluation, error) {
+	var evals []NetworkACLEvaluation
+
+	protocol, err := NormalizeProtocol(rule.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*ec2.NetworkAclEntry, len(acl.Entries))
+	copy(entries, acl.Entries)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return aws.Int64Value(entries[i].RuleNumber) < aws.Int64Value(entries[j].RuleNumber)
+	})
+
+	for _, v := range entries {
+		applies, covers := entryApplies(v, rule, protocol)
+		if applies == false {
+			continue
+		}
+		evals = append(evals, NetworkACLEvaluation{
+			Matched:    true,
+			RuleNumber: int(aws.Int64Value(v.RuleNumber)),
+			Action:     aws.StringValue(v.RuleAction),
+			Covered:    covers,
+		})
+	}
+
+	return evals, nil
+}
+
+// EvaluateNetworkACL evaluates the traffic described by a rule's direction,
+// CIDR block, protocol and port range (or ICMP type and code) against the
+// entries of a network ACL, in rule number order, and returns the first entry
+// that applies to any of that traffic.
+//
+// Network ACLs stop at the first matching entry, so a new entry for the
+// traffic only takes effect if it is numbered lower than the returned one.
+func EvaluateNetworkACL(acl *ec2.NetworkAcl, rule NetworkACLRule) (NetworkACLEvaluation, error) {
+	evals, err := evaluateNetworkACLEntries(acl, rule)
+	if err != nil || len(evals) < 1 {
+		return NetworkACLEvaluation{}, err
+	}
+
+	return evals[0], nil
+}
@@ -0,0 +1,153 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testEvaluationNetworkACL provides a network ACL with a mix of allow and
+// deny entries, ending in the default deny all entry, for evaluation tests.
+func testEvaluationNetworkACL() *ec2.NetworkAcl {
+	return &ec2.NetworkAcl{
+		NetworkAclId: aws.String("nacl-123456"),
+		Entries: []*ec2.NetworkAclEntry{
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("0.0.0.0/0"),
+				Egress:     aws.Bool(false),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("deny"),
+				RuleNumber: aws.Int64(32767),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("10.0.0.0/16"),
+				Egress:     aws.Bool(false),
+				PortRange:  &ec2.PortRange{From: aws.Int64(22), To: aws.Int64(22)},
+				Protocol:   aws.String("6"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(200),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("10.0.9.0/24"),
+				Egress:     aws.Bool(false),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("deny"),
+				RuleNumber: aws.Int64(100),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("0.0.0.0/0"),
+				Egress:     aws.Bool(true),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(100),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:    aws.String("0.0.0.0/0"),
+				Egress:       aws.Bool(false),
+				IcmpTypeCode: &ec2.IcmpTypeCode{Type: aws.Int64(3), Code: aws.Int64(-1)},
+				Protocol:     aws.String("1"),
+				RuleAction:   aws.String("allow"),
+				RuleNumber:   aws.Int64(300),
+			},
+		},
+	}
+}
+
+func TestEvaluateNetworkACL(t *testing.T) {
+	acl := testEvaluationNetworkACL()
+
+	cases := []struct {
+		name     string
+		rule     NetworkACLRule
+		number   int
+		action   string
+		covered  bool
+		expected bool
+	}{
+		{
+			name:     "broader allow",
+			rule:     NetworkACLRule{CidrBlock: "10.0.1.0/24", StartPort: 22, EndPort: 22},
+			number:   200,
+			action:   "allow",
+			covered:  true,
+			expected: true,
+		},
+		{
+			name:    "shadowed by deny",
+			rule:    NetworkACLRule{CidrBlock: "10.0.9.0/24", StartPort: 22, EndPort: 22},
+			number:  100,
+			action:  "deny",
+			covered: true,
+		},
+		{
+			name:   "partial deny",
+			rule:   NetworkACLRule{CidrBlock: "10.0.8.0/23", StartPort: 22, EndPort: 22},
+			number: 100,
+			action: "deny",
+		},
+		{
+			name:    "other port",
+			rule:    NetworkACLRule{CidrBlock: "10.0.1.0/24", StartPort: 443, EndPort: 443},
+			number:  32767,
+			action:  "deny",
+			covered: true,
+		},
+		{
+			name:   "port range partially allowed",
+			rule:   NetworkACLRule{CidrBlock: "10.0.1.0/24", StartPort: 20, EndPort: 22},
+			number: 200,
+			action: "allow",
+		},
+		{
+			name:     "egress",
+			rule:     NetworkACLRule{CidrBlock: "10.0.9.0/24", Egress: true, Protocol: ProtocolUDP, StartPort: 1024, EndPort: 65535},
+			number:   100,
+			action:   "allow",
+			covered:  true,
+			expected: true,
+		},
+		{
+			name:     "icmp code wildcard",
+			rule:     NetworkACLRule{CidrBlock: "192.168.0.0/16", Protocol: ProtocolICMP, ICMPType: 3, ICMPCode: 4},
+			number:   300,
+			action:   "allow",
+			covered:  true,
+			expected: true,
+		},
+		{
+			name:   "icmp type wildcard",
+			rule:   NetworkACLRule{CidrBlock: "192.168.0.0/16", Protocol: ProtocolICMP, ICMPType: -1, ICMPCode: -1},
+			number: 300,
+			action: "allow",
+		},
+	}
+
+	for _, c := range cases {
+		eval, err := EvaluateNetworkACL(acl, c.rule)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if eval.Matched == false {
+			t.Fatalf("%s: Expected a match", c.name)
+		}
+		if eval.RuleNumber != c.number || eval.Action != c.action || eval.Covered != c.covered {
+			t.Fatalf("%s: Expected rule %d %s (covered %v), got rule %d %s (covered %v)", c.name, c.number, c.action, c.covered, eval.RuleNumber, eval.Action, eval.Covered)
+		}
+		if eval.Allowed() != c.expected {
+			t.Fatalf("%s: Expected allowed to be %v, got %v", c.name, c.expected, eval.Allowed())
+		}
+	}
+}
+
+func TestEvaluateNetworkACLIPv6(t *testing.T) {
+	acl := testEvaluationNetworkACL()
+
+	eval, err := EvaluateNetworkACL(acl, NetworkACLRule{Ipv6CidrBlock: "2001:db8::/64", StartPort: 22, EndPort: 22})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if eval.Matched == true {
+		t.Fatalf("Expected IPv4 entries not to match IPv6 traffic, got rule %d", eval.RuleNumber)
+	}
+}
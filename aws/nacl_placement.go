@@ -0,0 +1,167 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// NetworkACLEntryQuota is the maximum number of entries that a network ACL
+// can have per direction, not counting the default deny entries. 20 is the
+// AWS default. Raise this if the quota has been increased for the account.
+var NetworkACLEntryQuota = 20
+
+// RulePlacement chooses the rule number for a new network ACL entry.
+type RulePlacement interface {
+	// PlaceRule returns the rule number to use for a new entry for rule in
+	// acl. Only rule numbers in the same direction as the rule are
+	// considered, as ingress and egress entries are numbered separately.
+	PlaceRule(acl *ec2.NetworkAcl, rule NetworkACLRule) (int, error)
+}
+
+// LowestFreePlacement places new entries at the lowest vacant rule number,
+// regardless of the entries around it.
+type LowestFreePlacement struct{}
+
+// BeforeDenyPlacement places new entries at the lowest vacant rule number
+// that comes before the first deny entry that applies to the traffic, so
+// that the new entry takes effect. This is the default.
+type BeforeDenyPlacement struct{}
+
+// ReservedBlockPlacement places new entries at the lowest vacant rule number
+// within a block of rule numbers reserved for bastion, for ACLs where other
+// tooling manages the rest of the numbers.
+type ReservedBlockPlacement struct {
+	_ struct{}
+
+	// The first rule number of the block.
+	Start int
+
+	// The last rule number of the block, inclusive.
+	End int
+}
+
+// DefaultRulePlacement is the placement strategy used by
+// CreateNetworkACLRule.
+var DefaultRulePlacement RulePlacement = BeforeDenyPlacement{}
+
+// ruleDirection returns a human-readable name for the direction of a rule.
+func ruleDirection(egress bool) string {
+	if egress == true {
+		return "egress"
+	}
+	return "ingress"
+}
+
+// usedNetworkACLRuleNumbers returns the rule numbers in use for a direction
+// in a network ACL.
+func usedNetworkACLRuleNumbers(acl *ec2.NetworkAcl, egress bool) map[int]bool {
+	used := make(map[int]bool)
+	for _, v := range acl.Entries {
+		if aws.BoolValue(v.Egress) == egress {
+			used[int(aws.Int64Value(v.RuleNumber))] = true
+		}
+	}
+	return used
+}
+
+// lowestFreeRuleNumber returns the lowest rule number from start to end,
+// inclusive, that is not in used, or -1 if there is none.
+func lowestFreeRuleNumber(used map[int]bool, start, end int) int {
+	if start < 1 {
+		start = 1
+	}
+	if end > maxNetworkACLRuleNumber {
+		end = maxNetworkACLRuleNumber
+	}
+
+	for n := start; n <= end; n++ {
+		if used[n] == false {
+			return n
+		}
+	}
+	return -1
+}
+
+// firstDenyRuleNumber returns the rule number of the first deny entry that
+// applies to any of a rule's traffic, or one past the highest usable rule
+// number if there is none.
+func firstDenyRuleNumber(acl *ec2.NetworkAcl, rule NetworkACLRule) (int, error) {
+	evals, err := evaluateNetworkACLEntries(acl, rule)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, v := range evals {
+		if v.Action == ec2.RuleActionDeny {
+			return v.RuleNumber, nil
+		}
+	}
+	return maxNetworkACLRuleNumber + 1, nil
+}
+
+// checkNetworkACLQuota returns an error if a direction of a network ACL
+// already has as many entries as the quota allows.
+func checkNetworkACLQuota(acl *ec2.NetworkAcl, egress bool) error {
+	n := 0
+	for k := range usedNetworkACLRuleNumbers(acl, egress) {
+		if k <= maxNetworkACLRuleNumber {
+			n++
+		}
+	}
+
+	if n >= NetworkACLEntryQuota {
+		return fmt.Errorf("Network ACL %s already has %d %s entries, which is the quota of %d. Remove unused entries or request a quota increase.", aws.StringValue(acl.NetworkAclId), n, ruleDirection(egress), NetworkACLEntryQuota)
+	}
+	return nil
+}
+
+// PlaceRule implements RulePlacement for LowestFreePlacement.
+func (p LowestFreePlacement) PlaceRule(acl *ec2.NetworkAcl, rule NetworkACLRule) (int, error) {
+	n := lowestFreeRuleNumber(usedNetworkACLRuleNumbers(acl, rule.Egress), 1, maxNetworkACLRuleNumber)
+	if n == -1 {
+		return 0, fmt.Errorf("Network ACL %s has no vacant %s rule numbers.", aws.StringValue(acl.NetworkAclId), ruleDirection(rule.Egress))
+	}
+	return n, nil
+}
+
+// PlaceRule implements RulePlacement for BeforeDenyPlacement.
+func (p BeforeDenyPlacement) PlaceRule(acl *ec2.NetworkAcl, rule NetworkACLRule) (int, error) {
+	deny, err := firstDenyRuleNumber(acl, rule)
+	if err != nil {
+		return 0, err
+	}
+
+	n := lowestFreeRuleNumber(usedNetworkACLRuleNumbers(acl, rule.Egress), 1, deny-1)
+	if n == -1 {
+		return 0, fmt.Errorf("Network ACL %s has no vacant %s rule number before rule %d, which denies the traffic. Free up a lower rule number and try again.", aws.StringValue(acl.NetworkAclId), ruleDirection(rule.Egress), deny)
+	}
+	return n, nil
+}
+
+// PlaceRule implements RulePlacement for ReservedBlockPlacement.
+func (p ReservedBlockPlacement) PlaceRule(acl *ec2.NetworkAcl, rule NetworkACLRule) (int, error) {
+	if p.Start < 1 || p.End > maxNetworkACLRuleNumber || p.Start > p.End {
+		return 0, fmt.Errorf("Invalid reserved rule number block %d-%d. Rule numbers must be from 1 to %d.", p.Start, p.End, maxNetworkACLRuleNumber)
+	}
+
+	deny, err := firstDenyRuleNumber(acl, rule)
+	if err != nil {
+		return 0, err
+	}
+	if deny < p.Start {
+		return 0, fmt.Errorf("Network ACL %s %s rule %d denies the traffic before the reserved block %d-%d, so an entry in the block would not take effect.", aws.StringValue(acl.NetworkAclId), ruleDirection(rule.Egress), deny, p.Start, p.End)
+	}
+
+	end := p.End
+	if deny <= end {
+		end = deny - 1
+	}
+
+	n := lowestFreeRuleNumber(usedNetworkACLRuleNumbers(acl, rule.Egress), p.Start, end)
+	if n == -1 {
+		return 0, fmt.Errorf("Network ACL %s has no vacant %s rule number in the reserved block %d-%d.", aws.StringValue(acl.NetworkAclId), ruleDirection(rule.Egress), p.Start, end)
+	}
+	return n, nil
+}
@@ -0,0 +1,142 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testPlacementNetworkACL provides a network ACL for placement tests. Ingress
+// rule numbers 1 and 2 are taken, with a deny for 10.0.9.0/24 at 5, and the
+// default deny all entry at 32767. Egress rule number 3 is taken.
+func testPlacementNetworkACL() *ec2.NetworkAcl {
+	return &ec2.NetworkAcl{
+		NetworkAclId: aws.String("nacl-123456"),
+		Entries: []*ec2.NetworkAclEntry{
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("172.16.0.0/24"),
+				Egress:     aws.Bool(false),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(1),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("172.16.1.0/24"),
+				Egress:     aws.Bool(false),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(2),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("10.0.9.0/24"),
+				Egress:     aws.Bool(false),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("deny"),
+				RuleNumber: aws.Int64(5),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("0.0.0.0/0"),
+				Egress:     aws.Bool(true),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(3),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("0.0.0.0/0"),
+				Egress:     aws.Bool(false),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("deny"),
+				RuleNumber: aws.Int64(32767),
+			},
+		},
+	}
+}
+
+func TestRulePlacement(t *testing.T) {
+	acl := testPlacementNetworkACL()
+	denied := NetworkACLRule{CidrBlock: "10.0.9.0/24", StartPort: 22, EndPort: 22}
+	other := NetworkACLRule{CidrBlock: "10.0.1.0/24", StartPort: 22, EndPort: 22}
+
+	cases := []struct {
+		name      string
+		placement RulePlacement
+		rule      NetworkACLRule
+		expected  int
+	}{
+		{name: "lowest free ingress", placement: LowestFreePlacement{}, rule: other, expected: 3},
+		{name: "lowest free egress", placement: LowestFreePlacement{}, rule: NetworkACLRule{CidrBlock: "10.0.1.0/24", Egress: true}, expected: 1},
+		{name: "before deny", placement: BeforeDenyPlacement{}, rule: denied, expected: 3},
+		{name: "reserved block", placement: ReservedBlockPlacement{Start: 100, End: 199}, rule: other, expected: 100},
+	}
+
+	for _, c := range cases {
+		actual, err := c.placement.PlaceRule(acl, c.rule)
+		if err != nil {
+			t.Fatalf("%s: Bad: %s", c.name, err.Error())
+		}
+		if c.expected != actual {
+			t.Fatalf("%s: Expected %v, got %v", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestRulePlacementErrors(t *testing.T) {
+	acl := testPlacementNetworkACL()
+	denied := NetworkACLRule{CidrBlock: "10.0.9.0/24", StartPort: 22, EndPort: 22}
+
+	acl.Entries = append(acl.Entries,
+		&ec2.NetworkAclEntry{
+			CidrBlock:  aws.String("172.16.2.0/24"),
+			Egress:     aws.Bool(false),
+			Protocol:   aws.String("-1"),
+			RuleAction: aws.String("allow"),
+			RuleNumber: aws.Int64(3),
+		},
+		&ec2.NetworkAclEntry{
+			CidrBlock:  aws.String("172.16.3.0/24"),
+			Egress:     aws.Bool(false),
+			Protocol:   aws.String("-1"),
+			RuleAction: aws.String("allow"),
+			RuleNumber: aws.Int64(4),
+		},
+	)
+
+	cases := []struct {
+		name      string
+		placement RulePlacement
+	}{
+		{name: "before deny full", placement: BeforeDenyPlacement{}},
+		{name: "reserved block after deny", placement: ReservedBlockPlacement{Start: 100, End: 199}},
+		{name: "reserved block full", placement: ReservedBlockPlacement{Start: 1, End: 4}},
+		{name: "reserved block invalid", placement: ReservedBlockPlacement{Start: 0, End: 40000}},
+	}
+
+	for _, c := range cases {
+		_, err := c.placement.PlaceRule(acl, denied)
+		if err == nil {
+			t.Fatalf("%s: Expected error", c.name)
+		}
+	}
+}
+
+func TestCheckNetworkACLQuota(t *testing.T) {
+	acl := testPlacementNetworkACL()
+
+	old := NetworkACLEntryQuota
+	defer func() { NetworkACLEntryQuota = old }()
+
+	// The default deny entry does not count towards the quota.
+	NetworkACLEntryQuota = 4
+	if err := checkNetworkACLQuota(acl, false); err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	NetworkACLEntryQuota = 3
+	if err := checkNetworkACLQuota(acl, false); err == nil {
+		t.Fatalf("Expected quota error for ingress")
+	}
+	if err := checkNetworkACLQuota(acl, true); err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+}
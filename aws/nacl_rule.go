@@ -2,7 +2,6 @@ package aws
 
 import (
 	"fmt"
-	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -12,9 +11,14 @@ import (
 type NetworkACLRule struct {
 	_ struct{}
 
-	// The network range to allow or deny, in CIDR notation (for example 172.16.0.0/24).
+	// The IPv4 network range to allow or deny, in CIDR notation (for example
+	// 172.16.0.0/24). Exactly one of CidrBlock or Ipv6CidrBlock is set.
 	CidrBlock string `json:"cidr_block"`
 
+	// The IPv6 network range to allow or deny, in CIDR notation (for example
+	// 2001:db8::/64). Exactly one of CidrBlock or Ipv6CidrBlock is set.
+	Ipv6CidrBlock string `json:"ipv6_cidr_block,omitempty"`
+
 	// true if the network ACL rule has been created, or is accounted for (ie: the
 	// PreExisting flag is set).
 	Created bool `json:"created"`
@@ -34,6 +38,19 @@ type NetworkACLRule struct {
 	// will be the same as StartPort, with the exception of ephemeral rules.
 	EndPort int `json:"end_port"`
 
+	// The protocol the rule applies to: one of tcp, udp, icmp, icmpv6, or
+	// all. An empty protocol is treated as tcp. StartPort and EndPort are only
+	// used for tcp and udp.
+	Protocol string `json:"protocol"`
+
+	// The ICMP type the rule applies to, or -1 for all types. Only used for
+	// icmp and icmpv6.
+	ICMPType int `json:"icmp_type"`
+
+	// The ICMP code the rule applies to, or -1 for all codes. Only used for
+	// icmp and icmpv6.
+	ICMPCode int `json:"icmp_code"`
+
 	// "true" if the rule was pre-existing in the exact form that it was going
 	// to be created in (ie: direction and port). This is necessary to prevent
 	// API errors for duplicate ACL entries. Pre-existing rules are not deleted.
@@ -47,132 +64,260 @@ type NetworkACLRule struct {
 	RuleNumber int `json:"rule_number"`
 }
 
-// FindVacantNetworkACLRule will find the highest priority entry (that is,
-// the lowest rule number) available in a network ACL to use to add the
-// bastion allow rule to.
-func FindVacantNetworkACLRule(conn *ec2.EC2, acl string) (int, error) {
+// FindNetworkACLForSubnet finds the network ACL that is in effect for a
+// subnet. Subnets without an explicit association use the default network ACL
+// for their VPC.
+func FindNetworkACLForSubnet(conn *ec2.EC2, subnet string) (string, error) {
+	req := &ec2.DescribeNetworkAclsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("association.subnet-id"),
+				Values: aws.StringSlice([]string{subnet}),
+			},
+		},
+	}
+
+	resp, err := conn.DescribeNetworkAcls(req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.NetworkAcls) > 1 {
+		panic(fmt.Errorf("More than one network ACL associated with subnet %s", subnet))
+	}
+
+	if len(resp.NetworkAcls) == 1 {
+		return *resp.NetworkAcls[0].NetworkAclId, nil
+	}
+
+	// No explicit association, fall back to the default for the VPC.
+	vpc, err := findVpcIDFromSubnet(conn, subnet)
+	if err != nil {
+		return "", err
+	}
+
+	req = &ec2.DescribeNetworkAclsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{vpc}),
+			},
+			&ec2.Filter{
+				Name:   aws.String("default"),
+				Values: aws.StringSlice([]string{"true"}),
+			},
+		},
+	}
+
+	resp, err = conn.DescribeNetworkAcls(req)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.NetworkAcls) < 1 {
+		return "", fmt.Errorf("No network ACL found for subnet %s, and VPC %s has no default network ACL.", subnet, vpc)
+	}
+
+	return *resp.NetworkAcls[0].NetworkAclId, nil
+}
+
+// maxNetworkACLRuleNumber is the highest rule number that can be used for
+// network ACL entries. Higher numbers are reserved for internal use.
+const maxNetworkACLRuleNumber = 32766
+
+// describeNetworkACL returns a network ACL by ID.
+func describeNetworkACL(conn *ec2.EC2, acl string) (*ec2.NetworkAcl, error) {
 	req := &ec2.DescribeNetworkAclsInput{
 		NetworkAclIds: aws.StringSlice([]string{acl}),
 	}
 
 	resp, err := conn.DescribeNetworkAcls(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	if len(resp.NetworkAcls) < 1 {
-		return 0, fmt.Errorf("Network ACL %s not found.", acl)
+		return nil, fmt.Errorf("Network ACL %s not found.", acl)
 	}
 
 	if len(resp.NetworkAcls) > 1 {
 		panic(fmt.Errorf("More than one network ACL found for newtork ACL search %s", acl))
 	}
 
-	nums := []int{}
-	for _, v := range resp.NetworkAcls[0].Entries {
-		nums = append(nums, int(*v.RuleNumber))
-	}
-	sort.Ints(nums)
+	return resp.NetworkAcls[0], nil
+}
 
-	n := 0
-	for _, v := range nums {
-		if v != n {
-			break
-		}
-		n++
+// FindVacantNetworkACLRule will find the highest priority entry (that is,
+// the lowest rule number) available for a direction in a network ACL to use
+// to add the bastion allow rule to.
+func FindVacantNetworkACLRule(conn *ec2.EC2, acl string, egress bool) (int, error) {
+	resp, err := describeNetworkACL(conn, acl)
+	if err != nil {
+		return 0, err
 	}
 
-	return n, nil
+	return LowestFreePlacement{}.PlaceRule(resp, NetworkACLRule{NetworkAclID: acl, Egress: egress})
 }
 
-// FindPreExistingNetworkACLRule will check to see if a rule already exists in
-// an ACL for a specific direction and port range. If the rule exists, the
-// rule number is returned, otherwise the result is -1.
+// FindPreExistingNetworkACLRule will check to see if the traffic a rule
+// describes is already allowed by the rule's ACL, for a specific direction,
+// CIDR block, protocol and port range. If the first entry to apply to the
+// traffic allows all of it, its rule number is returned, otherwise the
+// result is -1. This means an identical entry that is shadowed by a lower
+// numbered deny does not count, and a broader allow does.
 //
 // Note that error needs to be checked for errors, as the zero value returned
 // during errors could be interpreted as rule number 0 as well.
-func FindPreExistingNetworkACLRule(conn *ec2.EC2, acl, cidr string, start, end int, egress bool) (int, error) {
-	req := &ec2.DescribeNetworkAclsInput{
-		NetworkAclIds: aws.StringSlice([]string{acl}),
+func FindPreExistingNetworkACLRule(conn *ec2.EC2, rule NetworkACLRule) (int, error) {
+	acl, err := describeNetworkACL(conn, rule.NetworkAclID)
+	if err != nil {
+		return 0, err
 	}
 
-	resp, err := conn.DescribeNetworkAcls(req)
+	eval, err := EvaluateNetworkACL(acl, rule)
 	if err != nil {
 		return 0, err
 	}
+	if eval.Allowed() == true {
+		return eval.RuleNumber, nil
+	}
 
-	if len(resp.NetworkAcls) < 1 {
-		return 0, fmt.Errorf("Network ACL %s not found.", acl)
+	return -1, nil
+}
+
+// networkACLEntryInput returns the CreateNetworkAclEntry request for a rule,
+// using the supplied rule number.
+func networkACLEntryInput(rule NetworkACLRule, n int) (*ec2.CreateNetworkAclEntryInput, error) {
+	protocol, err := NormalizeProtocol(rule.Protocol)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(resp.NetworkAcls) > 1 {
-		panic(fmt.Errorf("More than one network ACL found for newtork ACL search %s", acl))
+	req := &ec2.CreateNetworkAclEntryInput{
+		Egress:       aws.Bool(rule.Egress),
+		NetworkAclId: aws.String(rule.NetworkAclID),
+		Protocol:     aws.String(protocolNumbers[protocol]),
+		RuleAction:   aws.String(ec2.RuleActionAllow),
+		RuleNumber:   aws.Int64(int64(n)),
+	}
+
+	switch {
+	case rule.CidrBlock != "" && rule.Ipv6CidrBlock != "":
+		return nil, fmt.Errorf("Network ACL rule has both an IPv4 and an IPv6 CIDR block. Only one may be set.")
+	case rule.CidrBlock != "":
+		req.CidrBlock = aws.String(rule.CidrBlock)
+	case rule.Ipv6CidrBlock != "":
+		req.Ipv6CidrBlock = aws.String(rule.Ipv6CidrBlock)
+	default:
+		return nil, fmt.Errorf("Network ACL rule requires an IPv4 or IPv6 CIDR block.")
 	}
 
-	for _, v := range resp.NetworkAcls[0].Entries {
-		if *v.CidrBlock == cidr && int(*v.PortRange.From) == start && int(*v.PortRange.To) == end && *v.Egress == egress {
-			return int(*v.RuleNumber), nil
+	switch {
+	case protocolUsesPorts(protocol):
+		req.PortRange = &ec2.PortRange{
+			From: aws.Int64(int64(rule.StartPort)),
+			To:   aws.Int64(int64(rule.EndPort)),
+		}
+	case protocolUsesICMP(protocol):
+		req.IcmpTypeCode = &ec2.IcmpTypeCode{
+			Type: aws.Int64(int64(rule.ICMPType)),
+			Code: aws.Int64(int64(rule.ICMPCode)),
 		}
 	}
 
-	return -1, nil
+	return req, nil
 }
 
-// CreateNetworkACLRule creates a network ACL rule, and returns a
-// NetworkACLRule struct.
+// CreateNetworkACLRule creates a network ACL rule from the rule's
+// NetworkAclID, CidrBlock or Ipv6CidrBlock, Egress, Protocol, and port range
+// (or ICMP type and code), and returns the updated NetworkACLRule struct.
+//
+// Rules that break DefaultPolicy are rejected with a PolicyError, unless the
+// policy is overridden, in which case the violations are logged. Use
+// ApplyRuleSet to enforce another policy.
 //
-// If the rule already exists, the struct wiil still be populated, however the
-// PreExisting flag will be set to true.
+// The ACL is then evaluated (see EvaluateNetworkACL). If the traffic is
+// already allowed, the struct wiil still be populated, however the
+// PreExisting flag will be set to true. Otherwise, the entry is added using
+// DefaultRulePlacement: at the lowest vacant rule number before the first
+// entry that denies the traffic.
 //
 // Note that in the event of errors, NetworkACLRule will be in an inconsistent
 // state and should not be used.
-func CreateNetworkACLRule(conn *ec2.EC2, acl, cidr string, start, end int, egress bool) (NetworkACLRule, error) {
-	rule := NetworkACLRule{
-		CidrBlock:    cidr,
-		Egress:       egress,
-		NetworkAclID: acl,
-		StartPort:    start,
-		EndPort:      end,
+func CreateNetworkACLRule(conn *ec2.EC2, rule NetworkACLRule) (NetworkACLRule, error) {
+	return CreateNetworkACLRuleWithPlacement(conn, rule, DefaultRulePlacement)
+}
+
+// CreateNetworkACLRuleWithPlacement is the same as CreateNetworkACLRule, but
+// the rule number of a new entry is chosen by the supplied placement
+// strategy. A nil placement uses DefaultRulePlacement.
+func CreateNetworkACLRuleWithPlacement(conn *ec2.EC2, rule NetworkACLRule, placement RulePlacement) (NetworkACLRule, error) {
+	rule, overrides, err := createNetworkACLRule(conn, rule, placement, nil, DefaultPolicy)
+	logPolicyOverrides(overrides)
+	return rule, err
+}
+
+// createNetworkACLRule runs the logic for CreateNetworkACLRuleWithPlacement.
+// If baseline is not nil, whether the traffic is already allowed is decided
+// by it rather than by the live ACL, so that entries created since the
+// baseline was described are not counted. The rule number is always chosen
+// from the live ACL. The supplied policy is enforced, and any violations it
+// overrode are returned.
+func createNetworkACLRule(conn *ec2.EC2, rule NetworkACLRule, placement RulePlacement, baseline *ec2.NetworkAcl, policy Policy) (NetworkACLRule, []PolicyViolation, error) {
+	if placement == nil {
+		placement = DefaultRulePlacement
 	}
 
-	// Check for pre-existing rules first
-	n, err := FindPreExistingNetworkACLRule(conn, acl, cidr, start, end, egress)
+	acl, err := describeNetworkACL(conn, rule.NetworkAclID)
 	if err != nil {
-		return rule, err
+		return rule, nil, err
+	}
+
+	overrides, err := policy.enforce(policy.CheckNetworkACLRule(acl, rule))
+	if err != nil {
+		return rule, nil, err
+	}
+
+	if baseline == nil {
+		baseline = acl
+	}
+
+	// Check to see if the traffic is already allowed first
+	eval, err := EvaluateNetworkACL(baseline, rule)
+	if err != nil {
+		return rule, nil, err
 	}
-	if n != -1 {
+	if eval.Allowed() == true {
 		rule.PreExisting = true
-		rule.RuleNumber = n
+		rule.RuleNumber = eval.RuleNumber
 		rule.Created = true
-		return rule, nil
+		return rule, overrides, nil
 	}
 
-	// No pre-existing rule, look for first vacant rule number.
-	n, err = FindVacantNetworkACLRule(conn, acl)
+	err = checkNetworkACLQuota(acl, rule.Egress)
 	if err != nil {
-		return rule, err
+		return rule, nil, err
+	}
+
+	n, err := placement.PlaceRule(acl, rule)
+	if err != nil {
+		return rule, nil, err
 	}
 
 	// Create the rule
-	req := &ec2.CreateNetworkAclEntryInput{
-		// The network range to allow or deny, in CIDR notation (for example 172.16.0.0/24).
-		CidrBlock:    aws.String(cidr),
-		Egress:       aws.Bool(egress),
-		NetworkAclId: aws.String(acl),
-		PortRange:    &ec2.PortRange{From: aws.Int64(int64(start)), To: aws.Int64(int64(end))},
-		Protocol:     aws.String("TCP"),
-		RuleAction:   aws.String("allow"),
-		RuleNumber:   aws.Int64(int64(n)),
+	req, err := networkACLEntryInput(rule, n)
+	if err != nil {
+		return rule, nil, err
 	}
 
 	_, err = conn.CreateNetworkAclEntry(req)
 	if err != nil {
-		return rule, err
+		return rule, nil, err
 	}
 
 	rule.RuleNumber = n
 	rule.Created = true
-	return rule, nil
+	return rule, overrides, nil
 }
 
 // runNetworkACLRuleDelete runs most of the logic for DeleteNetworkACLRule,
@@ -0,0 +1,210 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ephemeralPortStart is the start of the widest ephemeral port range that
+// return traffic is allowed on.
+const ephemeralPortStart = 1024
+
+// ephemeralPortEnd is the end of the widest ephemeral port range that return
+// traffic is allowed on.
+const ephemeralPortEnd = 65535
+
+// EphemeralPortRange is the range of source ports an operating system uses
+// for outbound connections. Network ACLs are stateless, so return traffic to
+// these ports has to be allowed explicitly.
+type EphemeralPortRange struct {
+	_ struct{}
+
+	// The first port in the range.
+	Start int `json:"start"`
+
+	// The last port in the range, inclusive.
+	End int `json:"end"`
+}
+
+var (
+	// EphemeralPortsAny covers the ephemeral ports of all common operating
+	// systems, and NAT devices. This is the default.
+	EphemeralPortsAny = EphemeralPortRange{Start: ephemeralPortStart, End: ephemeralPortEnd}
+
+	// EphemeralPortsLinux is the default ephemeral port range for Linux,
+	// including Amazon Linux.
+	EphemeralPortsLinux = EphemeralPortRange{Start: 32768, End: 60999}
+
+	// EphemeralPortsWindows is the default ephemeral port range for Windows
+	// Server 2008 and later.
+	EphemeralPortsWindows = EphemeralPortRange{Start: 49152, End: 65535}
+
+	// EphemeralPortsMacOS is the default ephemeral port range for macOS.
+	EphemeralPortsMacOS = EphemeralPortRange{Start: 49152, End: 65535}
+)
+
+// EphemeralPortsForOS returns the ephemeral port range for a client
+// operating system: linux, windows, or macos. An empty name returns
+// EphemeralPortsAny.
+func EphemeralPortsForOS(name string) (EphemeralPortRange, error) {
+	switch strings.ToLower(name) {
+	case "", "any":
+		return EphemeralPortsAny, nil
+	case "linux":
+		return EphemeralPortsLinux, nil
+	case "windows":
+		return EphemeralPortsWindows, nil
+	case "macos", "darwin", "osx":
+		return EphemeralPortsMacOS, nil
+	}
+
+	return EphemeralPortRange{}, fmt.Errorf("Unknown client operating system %q. Supported values are linux, windows, macos, and any.", name)
+}
+
+// NetworkACLRulePair is a network ACL rule along with the rule that allows
+// its return traffic. The two are created and deleted together.
+type NetworkACLRulePair struct {
+	_ struct{}
+
+	// The rule that allows the traffic being opened (for example, inbound SSH
+	// from a client).
+	Forward NetworkACLRule `json:"forward"`
+
+	// The rule that allows return traffic for Forward, in the opposite
+	// direction, to the ephemeral ports of the peer.
+	Return NetworkACLRule `json:"return"`
+
+	// What the pair was created for, if it is not the client's own access.
+	// Pairs for allowlist entries have the same description as the entry's
+	// security group rule.
+	Description string `json:"description,omitempty"`
+}
+
+// icmpReplyTypes maps the ICMP and ICMPv6 types of request messages to the
+// types of their replies.
+var icmpReplyTypes = map[string]map[int]int{
+	ProtocolICMP: {
+		8:  0,  // Echo request, echo reply.
+		13: 14, // Timestamp request, timestamp reply.
+		15: 16, // Information request, information reply.
+		17: 18, // Address mask request, address mask reply.
+	},
+	ProtocolICMPv6: {
+		128: 129, // Echo request, echo reply.
+	},
+}
+
+// icmpReplyType returns the ICMP type that replies to messages of the
+// supplied type are sent with. All types (-1), and types that are not
+// requests, are returned unchanged.
+func icmpReplyType(protocol string, icmpType int) int {
+	p, err := NormalizeProtocol(protocol)
+	if err != nil {
+		return icmpType
+	}
+	if reply, ok := icmpReplyTypes[p][icmpType]; ok == true {
+		return reply
+	}
+	return icmpType
+}
+
+// NewNetworkACLRulePair returns a rule pair for a forward rule. The return
+// rule is in the same network ACL, for the same CIDR block and protocol, in
+// the opposite direction. For tcp and udp, it applies to the supplied
+// ephemeral port range. For icmp and icmpv6, a forward rule for a request
+// type (such as echo request) gets a return rule for the matching reply type
+// (such as echo reply).
+func NewNetworkACLRulePair(forward NetworkACLRule, ephemeral EphemeralPortRange) NetworkACLRulePair {
+	ret := NetworkACLRule{
+		NetworkAclID:  forward.NetworkAclID,
+		CidrBlock:     forward.CidrBlock,
+		Ipv6CidrBlock: forward.Ipv6CidrBlock,
+		Egress:        !forward.Egress,
+		Protocol:      forward.Protocol,
+		ICMPType:      icmpReplyType(forward.Protocol, forward.ICMPType),
+		ICMPCode:      forward.ICMPCode,
+		StartPort:     ephemeral.Start,
+		EndPort:       ephemeral.End,
+	}
+
+	return NetworkACLRulePair{Forward: forward, Return: ret}
+}
+
+// Created returns true if either rule in the pair is created, or accounted
+// for.
+func (p NetworkACLRulePair) Created() bool {
+	return p.Forward.Created == true || p.Return.Created == true
+}
+
+// PreExisting returns true if both rules in the pair were pre-existing.
+func (p NetworkACLRulePair) PreExisting() bool {
+	return p.Forward.PreExisting == true && p.Return.PreExisting == true
+}
+
+// CreateNetworkACLRulePair creates both rules of a pair, using the supplied
+// placement strategy, and returns the updated pair. Either rule can be
+// pre-existing, and is then left alone.
+//
+// If the return rule cannot be created, the forward rule is deleted again so
+// that the pair is never left half-open. Note that in the event of errors,
+// the pair should still be checked for rules that could not be cleaned up.
+func CreateNetworkACLRulePair(conn *ec2.EC2, pair NetworkACLRulePair, placement RulePlacement) (NetworkACLRulePair, error) {
+	var err error
+	pair.Forward, err = CreateNetworkACLRuleWithPlacement(conn, pair.Forward, placement)
+	if err != nil {
+		return pair, err
+	}
+
+	pair.Return, err = CreateNetworkACLRuleWithPlacement(conn, pair.Return, placement)
+	if err != nil {
+		out, rerr := DeleteNetworkACLRule(conn, pair.Forward)
+		if rerr != nil {
+			return pair, fmt.Errorf("%s (additionally, rolling back forward rule %d failed: %s)", err, pair.Forward.RuleNumber, rerr)
+		}
+		pair.Forward = out
+		return pair, err
+	}
+
+	return pair, nil
+}
+
+// restoreNetworkACLRule re-creates a rule that was deleted, with the same
+// rule number.
+func restoreNetworkACLRule(conn *ec2.EC2, rule NetworkACLRule) error {
+	req, err := networkACLEntryInput(rule, rule.RuleNumber)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.CreateNetworkAclEntry(req)
+	return err
+}
+
+// DeleteNetworkACLRulePair deletes both rules of a pair, if they were not
+// pre-existing. The forward rule is deleted first. If the return rule then
+// cannot be deleted, the forward rule is restored, so that the pair is
+// either deleted in full or left as it was.
+func DeleteNetworkACLRulePair(conn *ec2.EC2, pair NetworkACLRulePair) (NetworkACLRulePair, error) {
+	forward, err := DeleteNetworkACLRule(conn, pair.Forward)
+	if err != nil {
+		return pair, err
+	}
+
+	ret, err := DeleteNetworkACLRule(conn, pair.Return)
+	if err != nil {
+		if pair.Forward.PreExisting == false {
+			rerr := restoreNetworkACLRule(conn, pair.Forward)
+			if rerr != nil {
+				pair.Forward = forward
+				return pair, fmt.Errorf("%s (additionally, restoring forward rule %d failed: %s)", err, pair.Forward.RuleNumber, rerr)
+			}
+		}
+		return pair, err
+	}
+
+	pair.Forward = forward
+	pair.Return = ret
+	return pair, nil
+}
@@ -0,0 +1,200 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// createTestEC2RulePairMock returns a mock EC2 service to use with the rule
+// pair test functions. Entries created or deleted are recorded in calls, and
+// creating or deleting an egress entry fails if failEgress is set.
+func createTestEC2RulePairMock(calls *[]string, failEgress bool) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeNetworkAclsInput:
+			out, err := testDescribeNetworkAcls(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeNetworkAclsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.CreateNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("create %v %d", *p.Egress, *p.RuleNumber))
+			if failEgress == true && *p.Egress == true {
+				r.Error = fmt.Errorf("error")
+			}
+		case *ec2.DeleteNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("delete %v %d", *p.Egress, *p.RuleNumber))
+			if failEgress == true && *p.Egress == true {
+				r.Error = fmt.Errorf("error")
+			}
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+// testNetworkACLRulePair provides a test rule pair for inbound SSH.
+func testNetworkACLRulePair() NetworkACLRulePair {
+	return NewNetworkACLRulePair(NetworkACLRule{
+		NetworkAclID: "nacl-123456",
+		CidrBlock:    "10.0.1.0/24",
+		StartPort:    22,
+		EndPort:      22,
+	}, EphemeralPortsLinux)
+}
+
+func TestNewNetworkACLRulePair(t *testing.T) {
+	pair := testNetworkACLRulePair()
+
+	if pair.Return.Egress != true || pair.Return.CidrBlock != "10.0.1.0/24" || pair.Return.NetworkAclID != "nacl-123456" {
+		t.Fatalf("Unexpected return rule %#v", pair.Return)
+	}
+	if pair.Return.StartPort != 32768 || pair.Return.EndPort != 60999 {
+		t.Fatalf("Expected return ports 32768-60999, got %d-%d", pair.Return.StartPort, pair.Return.EndPort)
+	}
+}
+
+func TestNewNetworkACLRulePairICMP(t *testing.T) {
+	cases := []struct {
+		protocol string
+		icmpType int
+		expected int
+	}{
+		{protocol: "icmp", icmpType: 8, expected: 0},
+		{protocol: "1", icmpType: 13, expected: 14},
+		{protocol: "icmpv6", icmpType: 128, expected: 129},
+		{protocol: "icmp", icmpType: -1, expected: -1},
+		{protocol: "icmp", icmpType: 3, expected: 3},
+	}
+
+	for _, c := range cases {
+		pair := NewNetworkACLRulePair(NetworkACLRule{
+			NetworkAclID: "nacl-123456",
+			CidrBlock:    "10.0.1.0/24",
+			Protocol:     c.protocol,
+			ICMPType:     c.icmpType,
+			ICMPCode:     0,
+		}, EphemeralPortsLinux)
+		if pair.Return.ICMPType != c.expected || pair.Return.ICMPCode != 0 {
+			t.Fatalf("Expected return type %d for %s type %d, got %#v", c.expected, c.protocol, c.icmpType, pair.Return)
+		}
+	}
+}
+
+func TestEphemeralPortsForOS(t *testing.T) {
+	cases := map[string]EphemeralPortRange{
+		"":        EphemeralPortsAny,
+		"Linux":   EphemeralPortsLinux,
+		"windows": EphemeralPortsWindows,
+		"darwin":  EphemeralPortsMacOS,
+	}
+
+	for name, expected := range cases {
+		actual, err := EphemeralPortsForOS(name)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if expected != actual {
+			t.Fatalf("Expected %v for %q, got %v", expected, name, actual)
+		}
+	}
+
+	_, err := EphemeralPortsForOS("plan9")
+	if err == nil {
+		t.Fatalf("Expected error for unknown operating system")
+	}
+}
+
+func TestCreateNetworkACLRulePair(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RulePairMock(&calls, false)
+
+	out, err := CreateNetworkACLRulePair(conn, testNetworkACLRulePair(), nil)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if out.Forward.Created != true || out.Return.Created != true {
+		t.Fatalf("Expected both rules to be created, got %#v", out)
+	}
+
+	expected := fmt.Sprintf("%v", []string{"create false 1", "create true 1"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestCreateNetworkACLRulePairRollback(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RulePairMock(&calls, true)
+
+	out, err := CreateNetworkACLRulePair(conn, testNetworkACLRulePair(), nil)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	if out.Forward.Created != false || out.Return.Created != false {
+		t.Fatalf("Expected neither rule to be left created, got %#v", out)
+	}
+
+	expected := fmt.Sprintf("%v", []string{"create false 1", "create true 1", "delete false 1"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestDeleteNetworkACLRulePair(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RulePairMock(&calls, false)
+
+	pair := testNetworkACLRulePair()
+	pair.Forward.Created, pair.Forward.RuleNumber = true, 1
+	pair.Return.Created, pair.Return.RuleNumber = true, 2
+
+	out, err := DeleteNetworkACLRulePair(conn, pair)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if out.Created() == true {
+		t.Fatalf("Expected both rules to be deleted, got %#v", out)
+	}
+
+	expected := fmt.Sprintf("%v", []string{"delete false 1", "delete true 2"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestDeleteNetworkACLRulePairRestore(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RulePairMock(&calls, true)
+
+	pair := testNetworkACLRulePair()
+	pair.Forward.Created, pair.Forward.RuleNumber = true, 1
+	pair.Return.Created, pair.Return.RuleNumber = true, 2
+
+	out, err := DeleteNetworkACLRulePair(conn, pair)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if out.Forward.Created != true || out.Return.Created != true {
+		t.Fatalf("Expected both rules to be left in place, got %#v", out)
+	}
+
+	expected := fmt.Sprintf("%v", []string{"delete false 1", "delete true 2", "create false 1"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
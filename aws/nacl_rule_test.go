@@ -74,6 +74,46 @@ func testDescribeNetworkAclsOutput() *ec2.DescribeNetworkAclsOutput {
 						RuleAction:   aws.String("allow"),
 						RuleNumber:   aws.Int64(100),
 					},
+					&ec2.NetworkAclEntry{
+						CidrBlock:  aws.String("10.0.0.0/24"),
+						Egress:     aws.Bool(false),
+						PortRange:  &ec2.PortRange{From: aws.Int64(60000), To: aws.Int64(61000)},
+						Protocol:   aws.String("17"),
+						RuleAction: aws.String("allow"),
+						RuleNumber: aws.Int64(110),
+					},
+					&ec2.NetworkAclEntry{
+						CidrBlock:    aws.String("10.0.0.0/24"),
+						Egress:       aws.Bool(false),
+						IcmpTypeCode: &ec2.IcmpTypeCode{Type: aws.Int64(3), Code: aws.Int64(4)},
+						Protocol:     aws.String("1"),
+						RuleAction:   aws.String("allow"),
+						RuleNumber:   aws.Int64(120),
+					},
+					&ec2.NetworkAclEntry{
+						Egress:        aws.Bool(false),
+						Ipv6CidrBlock: aws.String("2001:db8::/64"),
+						PortRange:     &ec2.PortRange{From: aws.Int64(22), To: aws.Int64(22)},
+						Protocol:      aws.String("6"),
+						RuleAction:    aws.String("allow"),
+						RuleNumber:    aws.Int64(130),
+					},
+					&ec2.NetworkAclEntry{
+						CidrBlock:  aws.String("10.0.5.0/24"),
+						Egress:     aws.Bool(false),
+						PortRange:  &ec2.PortRange{From: aws.Int64(0), To: aws.Int64(65535)},
+						Protocol:   aws.String("6"),
+						RuleAction: aws.String("deny"),
+						RuleNumber: aws.Int64(50),
+					},
+					&ec2.NetworkAclEntry{
+						CidrBlock:  aws.String("10.0.5.0/24"),
+						Egress:     aws.Bool(false),
+						PortRange:  &ec2.PortRange{From: aws.Int64(22), To: aws.Int64(22)},
+						Protocol:   aws.String("6"),
+						RuleAction: aws.String("allow"),
+						RuleNumber: aws.Int64(140),
+					},
 				},
 				IsDefault:    aws.Bool(false),
 				NetworkAclId: aws.String("nacl-123456"),
@@ -85,7 +125,28 @@ func testDescribeNetworkAclsOutput() *ec2.DescribeNetworkAclsOutput {
 
 // testDescribeNetworkAcls is a stub function for testing the
 // ec2.DescribeNetworkAcls function.
+//
+// When searching by filter, subnet-123456 is explicitly associated with
+// nacl-123456, and any other subnet falls back to the VPC default,
+// nacl-default.
 func testDescribeNetworkAcls(input *ec2.DescribeNetworkAclsInput) (*ec2.DescribeNetworkAclsOutput, error) {
+	for _, f := range input.Filters {
+		switch *f.Name {
+		case "association.subnet-id":
+			if *f.Values[0] == "bad" {
+				return nil, fmt.Errorf("error")
+			}
+			if *f.Values[0] == "subnet-123456" {
+				return testDescribeNetworkAclsOutput(), nil
+			}
+			return &ec2.DescribeNetworkAclsOutput{}, nil
+		case "default":
+			out := testDescribeNetworkAclsOutput()
+			out.NetworkAcls[0].NetworkAclId = aws.String("nacl-default")
+			out.NetworkAcls[0].IsDefault = aws.Bool(true)
+			return out, nil
+		}
+	}
 	if *input.NetworkAclIds[0] == "bad" {
 		return nil, fmt.Errorf("error")
 	}
@@ -124,6 +185,12 @@ func createTestEC2NACLMock() *ec2.EC2 {
 				*r.Data.(*ec2.DescribeNetworkAclsOutput) = *out
 			}
 			r.Error = err
+		case *ec2.DescribeSubnetsInput:
+			out, err := testDescribeSubnets(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeSubnetsOutput) = *out
+			}
+			r.Error = err
 		case *ec2.CreateNetworkAclEntryInput:
 			out, err := testCreateNetworkAclEntry(p)
 			if out != nil {
@@ -143,12 +210,12 @@ func createTestEC2NACLMock() *ec2.EC2 {
 	return conn
 }
 
-func TestFindVacantNetworkACLRule(t *testing.T) {
+func TestFindNetworkACLForSubnet(t *testing.T) {
 	conn := createTestEC2NACLMock()
-	acl := "nacl-123456"
+	subnet := "subnet-123456"
 
-	expected := 1
-	actual, err := FindVacantNetworkACLRule(conn, acl)
+	expected := "nacl-123456"
+	actual, err := FindNetworkACLForSubnet(conn, subnet)
 	if err != nil {
 		t.Fatalf("Bad: %s", err.Error())
 	}
@@ -157,16 +224,26 @@ func TestFindVacantNetworkACLRule(t *testing.T) {
 	}
 }
 
-func TestFindPreExistingNetworkACLRule(t *testing.T) {
+func TestFindNetworkACLForSubnetDefault(t *testing.T) {
+	conn := createTestEC2NACLMock()
+	subnet := "subnet-unassociated"
+
+	expected := "nacl-default"
+	actual, err := FindNetworkACLForSubnet(conn, subnet)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestFindVacantNetworkACLRule(t *testing.T) {
 	conn := createTestEC2NACLMock()
 	acl := "nacl-123456"
-	cidr := "10.0.0.0/24"
-	start := 22
-	end := 22
-	egress := false
 
-	expected := 100
-	actual, err := FindPreExistingNetworkACLRule(conn, acl, cidr, start, end, egress)
+	expected := 1
+	actual, err := FindVacantNetworkACLRule(conn, acl, false)
 	if err != nil {
 		t.Fatalf("Bad: %s", err.Error())
 	}
@@ -175,18 +252,134 @@ func TestFindPreExistingNetworkACLRule(t *testing.T) {
 	}
 }
 
+func TestFindPreExistingNetworkACLRule(t *testing.T) {
+	conn := createTestEC2NACLMock()
+
+	cases := []struct {
+		name     string
+		rule     NetworkACLRule
+		expected int
+	}{
+		{
+			name: "tcp",
+			rule: NetworkACLRule{
+				NetworkAclID: "nacl-123456",
+				CidrBlock:    "10.0.0.0/24",
+				StartPort:    22,
+				EndPort:      22,
+			},
+			expected: 100,
+		},
+		{
+			name: "udp",
+			rule: NetworkACLRule{
+				NetworkAclID: "nacl-123456",
+				CidrBlock:    "10.0.0.0/24",
+				Protocol:     ProtocolUDP,
+				StartPort:    60000,
+				EndPort:      61000,
+			},
+			expected: 110,
+		},
+		{
+			name: "udp on tcp ports",
+			rule: NetworkACLRule{
+				NetworkAclID: "nacl-123456",
+				CidrBlock:    "10.0.0.0/24",
+				Protocol:     ProtocolUDP,
+				StartPort:    22,
+				EndPort:      22,
+			},
+			expected: -1,
+		},
+		{
+			name: "icmp",
+			rule: NetworkACLRule{
+				NetworkAclID: "nacl-123456",
+				CidrBlock:    "10.0.0.0/24",
+				Protocol:     ProtocolICMP,
+				ICMPType:     3,
+				ICMPCode:     4,
+			},
+			expected: 120,
+		},
+		{
+			name: "icmp with other code",
+			rule: NetworkACLRule{
+				NetworkAclID: "nacl-123456",
+				CidrBlock:    "10.0.0.0/24",
+				Protocol:     ProtocolICMP,
+				ICMPType:     3,
+				ICMPCode:     -1,
+			},
+			expected: -1,
+		},
+		{
+			name: "covered by broader allow",
+			rule: NetworkACLRule{
+				NetworkAclID: "nacl-123456",
+				CidrBlock:    "10.0.0.128/25",
+				StartPort:    22,
+				EndPort:      22,
+			},
+			expected: 100,
+		},
+		{
+			name: "shadowed by deny",
+			rule: NetworkACLRule{
+				NetworkAclID: "nacl-123456",
+				CidrBlock:    "10.0.5.0/24",
+				StartPort:    22,
+				EndPort:      22,
+			},
+			expected: -1,
+		},
+		{
+			name: "ipv6",
+			rule: NetworkACLRule{
+				NetworkAclID:  "nacl-123456",
+				Ipv6CidrBlock: "2001:db8::/64",
+				StartPort:     22,
+				EndPort:       22,
+			},
+			expected: 130,
+		},
+		{
+			name: "ipv6 other range",
+			rule: NetworkACLRule{
+				NetworkAclID:  "nacl-123456",
+				Ipv6CidrBlock: "2001:db8:1::/64",
+				StartPort:     22,
+				EndPort:       22,
+			},
+			expected: -1,
+		},
+	}
+
+	for _, tc := range cases {
+		actual, err := FindPreExistingNetworkACLRule(conn, tc.rule)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if tc.expected != actual {
+			t.Fatalf("%s: Expected %v, got %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
 func TestCreateNetworkACLRule(t *testing.T) {
 	conn := createTestEC2NACLMock()
-	acl := "nacl-123456"
-	cidr := "10.0.1.0/24"
-	start := 22
-	end := 22
-	egress := false
+	rule := NetworkACLRule{
+		NetworkAclID: "nacl-123456",
+		CidrBlock:    "10.0.1.0/24",
+		StartPort:    22,
+		EndPort:      22,
+	}
 
 	expectedRule := 1
 	expectedCreated := true
 
-	out, err := CreateNetworkACLRule(conn, acl, cidr, start, end, egress)
+	out, err := CreateNetworkACLRule(conn, rule)
 	if err != nil {
 		t.Fatalf("Bad: %s", err.Error())
 	}
@@ -201,6 +394,62 @@ func TestCreateNetworkACLRule(t *testing.T) {
 	}
 }
 
+func TestNetworkACLEntryInput(t *testing.T) {
+	cases := []struct {
+		rule     NetworkACLRule
+		protocol string
+		ports    bool
+		icmp     bool
+	}{
+		{rule: NetworkACLRule{CidrBlock: "10.0.0.0/24", StartPort: 22, EndPort: 22}, protocol: "6", ports: true},
+		{rule: NetworkACLRule{CidrBlock: "10.0.0.0/24", Protocol: "UDP", StartPort: 60000, EndPort: 61000}, protocol: "17", ports: true},
+		{rule: NetworkACLRule{CidrBlock: "10.0.0.0/24", Protocol: ProtocolICMP, ICMPType: 3, ICMPCode: 4}, protocol: "1", icmp: true},
+		{rule: NetworkACLRule{Ipv6CidrBlock: "2001:db8::/64", Protocol: ProtocolICMPv6, ICMPType: -1, ICMPCode: -1}, protocol: "58", icmp: true},
+		{rule: NetworkACLRule{CidrBlock: "10.0.0.0/24", Protocol: ProtocolAll}, protocol: "-1"},
+	}
+
+	for _, tc := range cases {
+		req, err := networkACLEntryInput(tc.rule, 1)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if *req.Protocol != tc.protocol {
+			t.Fatalf("Expected protocol %v, got %v", tc.protocol, *req.Protocol)
+		}
+		if (req.PortRange != nil) != tc.ports {
+			t.Fatalf("Expected port range for %s to be %v, got %v", tc.protocol, tc.ports, req.PortRange)
+		}
+		if (req.IcmpTypeCode != nil) != tc.icmp {
+			t.Fatalf("Expected ICMP type and code for %s to be %v, got %v", tc.protocol, tc.icmp, req.IcmpTypeCode)
+		}
+	}
+
+	_, err := networkACLEntryInput(NetworkACLRule{CidrBlock: "10.0.0.0/24", Protocol: "gre"}, 1)
+	if err == nil {
+		t.Fatalf("Expected error for unsupported protocol")
+	}
+}
+
+func TestNetworkACLEntryInputCIDRBlocks(t *testing.T) {
+	req, err := networkACLEntryInput(NetworkACLRule{Ipv6CidrBlock: "2001:db8::/64", StartPort: 22, EndPort: 22}, 1)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if req.CidrBlock != nil || aws.StringValue(req.Ipv6CidrBlock) != "2001:db8::/64" {
+		t.Fatalf("Expected only an IPv6 CIDR block, got %v and %v", req.CidrBlock, req.Ipv6CidrBlock)
+	}
+
+	_, err = networkACLEntryInput(NetworkACLRule{CidrBlock: "10.0.0.0/24", Ipv6CidrBlock: "2001:db8::/64"}, 1)
+	if err == nil {
+		t.Fatalf("Expected error for rule with both CIDR blocks")
+	}
+
+	_, err = networkACLEntryInput(NetworkACLRule{}, 1)
+	if err == nil {
+		t.Fatalf("Expected error for rule with no CIDR block")
+	}
+}
+
 func TestDeleteNetworkACLRule(t *testing.T) {
 	conn := createTestEC2NACLMock()
 	acl := testNetworkACLRule()
@@ -0,0 +1,214 @@
+package aws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// defaultNameTemplate is the template that is used to name auto-generated
+// resources when no other template has been supplied.
+const defaultNameTemplate = "bastion-{{.SessionID}}"
+
+// sessionIDBytes is the number of random bytes that go into a session ID.
+const sessionIDBytes = 8
+
+// nameSuffixBytes is the number of random bytes that go into the suffix that
+// is added to a name after a collision.
+const nameSuffixBytes = 4
+
+// maxNameAttempts is the number of times a name will be generated for a
+// resource before giving up on collisions.
+const maxNameAttempts = 5
+
+// unsafeNameChars matches the characters that are not allowed to be
+// interpolated into a resource name.
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// Namer generates names for the resources bastion creates.
+//
+// Names are derived from a text/template, which is supplied the Namer itself
+// as data, so that the fields User, Environment, and SessionID can be
+// referenced in it (for example "bastion-{{.User}}-{{.SessionID}}").
+type Namer struct {
+	_ struct{}
+
+	// The name template. If this is empty, defaultNameTemplate is used.
+	Template string `json:"template"`
+
+	// The name of the user launching the bastion host.
+	User string `json:"user"`
+
+	// The environment the bastion host is being launched in (for example,
+	// "staging").
+	Environment string `json:"environment"`
+
+	// The session ID that names are derived from.
+	SessionID string `json:"session_id"`
+}
+
+// NewSessionID returns a new, cryptographically random session ID.
+func NewSessionID() (string, error) {
+	return randomHex(sessionIDBytes)
+}
+
+// NewNamer returns a Namer for the supplied session ID, using the default
+// template. The user is taken from the current OS user, falling back to the
+// USER environment variable.
+func NewNamer(sessionID string) Namer {
+	n := Namer{
+		SessionID: sessionID,
+		User:      os.Getenv("USER"),
+	}
+	if u, err := user.Current(); err == nil {
+		n.User = u.Username
+	}
+	return n
+}
+
+// randomHex returns n cryptographically random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sanitizeNamePart strips characters that are not safe to use in AWS
+// resource names out of a value that is being interpolated into a name.
+func sanitizeNamePart(s string) string {
+	return unsafeNameChars.ReplaceAllString(s, "")
+}
+
+// BaseName renders the name template. The same Namer will always render the
+// same base name.
+func (n Namer) BaseName() (string, error) {
+	if n.SessionID == "" {
+		return "", fmt.Errorf("A session ID is required to generate resource names.")
+	}
+
+	text := n.Template
+	if text == "" {
+		text = defaultNameTemplate
+	}
+
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Invalid name template %q: %s", text, err)
+	}
+
+	data := Namer{
+		User:        sanitizeNamePart(n.User),
+		Environment: sanitizeNamePart(n.Environment),
+		SessionID:   sanitizeNamePart(n.SessionID),
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("Invalid name template %q: %s", text, err)
+	}
+
+	return buf.String(), nil
+}
+
+// Name returns the name to use for the given attempt. Attempt 0 is the base
+// name; later attempts add a random suffix to get around collisions.
+func (n Namer) Name(attempt int) (string, error) {
+	name, err := n.BaseName()
+	if err != nil {
+		return "", err
+	}
+
+	if attempt == 0 {
+		return name, nil
+	}
+
+	suffix, err := randomHex(nameSuffixBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return name + "-" + suffix, nil
+}
+
+// isAWSErrorCode returns true if err is an AWS error with one of the
+// supplied codes.
+func isAWSErrorCode(err error, codes ...string) bool {
+	aerr, ok := err.(awserr.Error)
+	if ok == false {
+		return false
+	}
+
+	for _, code := range codes {
+		if aerr.Code() == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createWithUniqueName runs create with names generated by namer, retrying
+// with a new name if create returns an error with the supplied duplicate
+// error code. The name that was successfully used is returned.
+func createWithUniqueName(namer Namer, duplicateCode string, create func(name string) error) (string, error) {
+	var name string
+	var err error
+	for i := 0; i < maxNameAttempts; i++ {
+		name, err = namer.Name(i)
+		if err != nil {
+			return "", err
+		}
+
+		err = create(name)
+		if err == nil {
+			return name, nil
+		}
+
+		if isAWSErrorCode(err, duplicateCode) == false {
+			return name, err
+		}
+	}
+
+	return name, fmt.Errorf("Could not find a unique name after %d attempts: %s", maxNameAttempts, err)
+}
+
+// findUnusedName returns the first name generated by namer that inUse
+// reports as free, trying the same names as createWithUniqueName would.
+func findUnusedName(namer Namer, inUse func(name string) (bool, error)) (string, error) {
+	for i := 0; i < maxNameAttempts; i++ {
+		name, err := namer.Name(i)
+		if err != nil {
+			return "", err
+		}
+
+		used, err := inUse(name)
+		if err != nil {
+			return name, err
+		}
+		if used == false {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("Could not find a unique name after %d attempts.", maxNameAttempts)
+}
+
+// createWithPlannedName runs create with a name chosen when a plan was made.
+// The plan was reviewed under that name, so it is never changed: if the name
+// has been taken since, an error asks for the plan to be made again.
+func createWithPlannedName(name, resource, duplicateCode string, create func(name string) error) error {
+	err := create(name)
+	if isAWSErrorCode(err, duplicateCode) == true {
+		return fmt.Errorf("The planned %s name %q has been taken since the plan was made. Plan again and review the changes.", resource, name)
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestNewSessionID(t *testing.T) {
+	a, err := NewSessionID()
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	b, err := NewSessionID()
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	matched, _ := regexp.MatchString("^[0-9a-f]{16}$", a)
+	if matched != true {
+		t.Fatalf("Expected a 16 character hex session ID, got %v", a)
+	}
+	if a == b {
+		t.Fatalf("Expected unique session IDs, got %v twice", a)
+	}
+}
+
+func TestNamerBaseName(t *testing.T) {
+	n := Namer{
+		Template:    "bastion-{{.User}}-{{.Environment}}-{{.SessionID}}",
+		User:        "jane doe",
+		Environment: "staging",
+		SessionID:   "abcdef0123456789",
+	}
+
+	expected := "bastion-janedoe-staging-abcdef0123456789"
+	actual, err := n.BaseName()
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestNamerBaseNameDefault(t *testing.T) {
+	n := Namer{SessionID: "abcdef0123456789"}
+
+	expected := "bastion-abcdef0123456789"
+	actual, err := n.BaseName()
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestNamerBaseNameNoSession(t *testing.T) {
+	n := Namer{}
+
+	_, err := n.BaseName()
+	if err == nil {
+		t.Fatalf("Expected error, got none")
+	}
+}
+
+func TestNamerBaseNameBadTemplate(t *testing.T) {
+	n := Namer{Template: "bastion-{{.Nope}}", SessionID: "abcdef0123456789"}
+
+	_, err := n.BaseName()
+	if err == nil {
+		t.Fatalf("Expected error, got none")
+	}
+}
+
+func TestCreateWithUniqueName(t *testing.T) {
+	n := Namer{SessionID: "abcdef0123456789"}
+	names := []string{}
+
+	name, err := createWithUniqueName(n, "InvalidGroup.Duplicate", func(name string) error {
+		names = append(names, name)
+		if len(names) < 3 {
+			return awserr.New("InvalidGroup.Duplicate", "duplicate", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if len(names) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(names))
+	}
+	if names[0] != "bastion-abcdef0123456789" {
+		t.Fatalf("Expected first attempt to be the base name, got %v", names[0])
+	}
+	if name != names[2] {
+		t.Fatalf("Expected %v, got %v", names[2], name)
+	}
+}
+
+func TestCreateWithUniqueNameOtherError(t *testing.T) {
+	n := Namer{SessionID: "abcdef0123456789"}
+	attempts := 0
+
+	_, err := createWithUniqueName(n, "InvalidGroup.Duplicate", func(name string) error {
+		attempts++
+		return fmt.Errorf("error")
+	})
+	if err == nil {
+		t.Fatalf("Expected error, got none")
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestCreateWithUniqueNameExhausted(t *testing.T) {
+	n := Namer{SessionID: "abcdef0123456789"}
+
+	_, err := createWithUniqueName(n, "InvalidGroup.Duplicate", func(name string) error {
+		return awserr.New("InvalidGroup.Duplicate", "duplicate", nil)
+	})
+	if err == nil {
+		t.Fatalf("Expected error, got none")
+	}
+}
+
+func TestCreateWithPlannedName(t *testing.T) {
+	attempts := 0
+
+	err := createWithPlannedName("bastion-abcdef0123456789", "security group", "InvalidGroup.Duplicate", func(name string) error {
+		attempts++
+		return awserr.New("InvalidGroup.Duplicate", "duplicate", nil)
+	})
+	if err == nil || strings.Contains(err.Error(), "Plan again") == false {
+		t.Fatalf("Expected a plan again error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+}
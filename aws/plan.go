@@ -0,0 +1,847 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// PlanAction is what applying a plan will do for a single resource.
+type PlanAction string
+
+const (
+	// PlanCreate means the resource will be created.
+	PlanCreate PlanAction = "create"
+
+	// PlanPreExisting means the access the resource is for is already
+	// allowed, so nothing will be created, and nothing will be removed on
+	// teardown.
+	PlanPreExisting PlanAction = "pre_existing"
+
+	// PlanReuse means an existing resource will be used, such as a tagged
+	// Elastic IP address.
+	PlanReuse PlanAction = "reuse"
+)
+
+// PlannedChange describes what applying a plan will do for a single
+// resource.
+type PlannedChange struct {
+	_ struct{}
+
+	// The kind of resource (for example, network_acl_rule).
+	Resource string `json:"resource"`
+
+	// What will be done for the resource.
+	Action PlanAction `json:"action"`
+
+	// A human-readable description of the resource.
+	Detail string `json:"detail"`
+}
+
+// String returns the change as a single line, prefixed with + for resources
+// that will be created, and = for ones that will be left alone.
+func (c PlannedChange) String() string {
+	switch c.Action {
+	case PlanCreate:
+		return fmt.Sprintf("+ %-20s %s", c.Resource, c.Detail)
+	case PlanReuse:
+		return fmt.Sprintf("= %-20s %s (reused)", c.Resource, c.Detail)
+	}
+	return fmt.Sprintf("= %-20s %s (pre-existing)", c.Resource, c.Detail)
+}
+
+// Plan is the full set of changes that launching a bastion session will
+// make, computed by PlanSession without changing anything. ApplyPlan
+// launches the session exactly as planned.
+type Plan struct {
+	_ struct{}
+
+	// The session ID, which resource names are derived from.
+	SessionID string `json:"session_id"`
+
+	// The public subnet the bastion host will be launched in.
+	SubnetID string `json:"subnet_id"`
+
+	// How the subnet was chosen, if it was selected automatically.
+	SubnetSelection *SubnetSelection `json:"subnet_selection,omitempty"`
+
+	// The network range that SSH access will be opened to, in CIDR notation.
+	ClientCIDR string `json:"client_cidr"`
+
+	// The AMI the bastion host will be launched from.
+	ImageID string `json:"image_id"`
+
+	// Anything the user should be told about before applying the plan, such
+	// as problems discovering the client address.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// The policy violations that will be allowed through, as the policy is
+	// overridden.
+	PolicyOverrides []PolicyViolation `json:"policy_overrides,omitempty"`
+
+	// The name of the key pair. It was free when the plan was made.
+	KeyPairName string `json:"key_pair_name"`
+
+	// The name of the security group. It was free in the VPC when the plan
+	// was made.
+	SecurityGroupName string `json:"security_group_name"`
+
+	// The network ACL rules that will allow SSH access from ClientCIDR. Rules
+	// that will be created have the rule number they will be created with.
+	// Pre-existing rules have the number of the entry that already allows
+	// the traffic.
+	ClientNetworkACLRules NetworkACLRulePair `json:"client_network_acl_rules"`
+
+	// The network ACL rules that will allow SSH access from each allowlist
+	// entry, in the order of the allowlist.
+	AllowlistNetworkACLRules []NetworkACLRulePair `json:"allowlist_network_acl_rules,omitempty"`
+
+	// The network ACL rules that will allow the bastion host into the target
+	// subnet, if target access is requested and the target is in another
+	// subnet. As the bastion host's private address is not known until it is
+	// launched, the rules are planned for the whole of the bastion subnet.
+	TargetNetworkACLRules NetworkACLRulePair `json:"target_network_acl_rules"`
+
+	// The allocation ID of the tagged Elastic IP address that will be
+	// reused, if any.
+	ElasticIPAllocationID string `json:"elastic_ip_allocation_id"`
+
+	// The changes, in the order they will be made.
+	Changes []PlannedChange `json:"changes"`
+
+	// The state of the security groups and network ACLs that the plan was
+	// computed from. ApplyPlan refuses to apply the plan if it has changed.
+	Snapshot StateSnapshot `json:"snapshot"`
+
+	// The options the plan was computed from that ApplyPlan needs, beyond
+	// what is recorded above.
+	Options PlanOptions `json:"options"`
+}
+
+// PlanOptions are the launch options that a plan is applied with, beyond
+// the subnet, client CIDR, AMI, and rule numbers the plan records itself.
+// They are serialized with the plan, so that a plan saved as JSON can be
+// applied later by another process. See LoadPlan.
+type PlanOptions struct {
+	_ struct{}
+
+	// The named network ranges that SSH access is also allowed from.
+	Allowlist Allowlist `json:"allowlist"`
+
+	// The network ACL that SSH access is added to.
+	NetworkACLID string `json:"network_acl_id"`
+
+	// The operating system of the client. See LaunchOptions.
+	ClientOS string `json:"client_os"`
+
+	// The naming options for the session's resources.
+	Namer Namer `json:"namer"`
+
+	// The Elastic IP address options. See LaunchOptions.
+	ElasticIP         bool   `json:"elastic_ip"`
+	ElasticIPTagKey   string `json:"elastic_ip_tag_key"`
+	ElasticIPTagValue string `json:"elastic_ip_tag_value"`
+
+	// The DNS record options. See LaunchOptions.
+	HostedZoneID   string `json:"hosted_zone_id"`
+	DNSName        string `json:"dns_name"`
+	DNSUsePublicIP bool   `json:"dns_use_public_ip"`
+
+	// The private host to give the bastion host access to, and the port.
+	TargetInstanceID         string `json:"target_instance_id"`
+	TargetNetworkInterfaceID string `json:"target_network_interface_id"`
+	TargetPort               int    `json:"target_port"`
+
+	// The instance options for the bastion host. See InstanceOptions.
+	AssignIPv6  bool `json:"assign_ipv6"`
+	ConnectIPv6 bool `json:"connect_ipv6"`
+
+	// The policy the rules are checked against, if not DefaultPolicy.
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+// newPlanOptions returns the options of a plan, from the launch options it
+// is computed from.
+func newPlanOptions(opts LaunchOptions) PlanOptions {
+	return PlanOptions{
+		Allowlist:                opts.Allowlist,
+		NetworkACLID:             opts.NetworkACLID,
+		ClientOS:                 opts.ClientOS,
+		Namer:                    opts.Namer,
+		ElasticIP:                opts.ElasticIP,
+		ElasticIPTagKey:          opts.ElasticIPTagKey,
+		ElasticIPTagValue:        opts.ElasticIPTagValue,
+		HostedZoneID:             opts.HostedZoneID,
+		DNSName:                  opts.DNSName,
+		DNSUsePublicIP:           opts.DNSUsePublicIP,
+		TargetInstanceID:         opts.TargetAccess.InstanceID,
+		TargetNetworkInterfaceID: opts.TargetAccess.NetworkInterfaceID,
+		TargetPort:               opts.TargetAccess.Port,
+		AssignIPv6:               opts.Instance.AssignIPv6,
+		ConnectIPv6:              opts.Instance.ConnectIPv6,
+		Policy:                   opts.Policy,
+	}
+}
+
+// launchOptions returns the launch options a plan is applied with.
+func (o PlanOptions) launchOptions() LaunchOptions {
+	return LaunchOptions{
+		Allowlist:         o.Allowlist,
+		NetworkACLID:      o.NetworkACLID,
+		ClientOS:          o.ClientOS,
+		Namer:             o.Namer,
+		ElasticIP:         o.ElasticIP,
+		ElasticIPTagKey:   o.ElasticIPTagKey,
+		ElasticIPTagValue: o.ElasticIPTagValue,
+		HostedZoneID:      o.HostedZoneID,
+		DNSName:           o.DNSName,
+		DNSUsePublicIP:    o.DNSUsePublicIP,
+		TargetAccess: TargetAccessOptions{
+			InstanceID:         o.TargetInstanceID,
+			NetworkInterfaceID: o.TargetNetworkInterfaceID,
+			Port:               o.TargetPort,
+		},
+		Instance: InstanceOptions{
+			AssignIPv6:  o.AssignIPv6,
+			ConnectIPv6: o.ConnectIPv6,
+		},
+		Policy: o.Policy,
+	}
+}
+
+// add records a planned change.
+func (p *Plan) add(resource string, action PlanAction, format string, a ...interface{}) {
+	p.Changes = append(p.Changes, PlannedChange{
+		Resource: resource,
+		Action:   action,
+		Detail:   fmt.Sprintf(format, a...),
+	})
+}
+
+// String renders the plan as a human-readable diff, followed by a summary
+// line.
+func (p Plan) String() string {
+	counts := make(map[PlanAction]int)
+	lines := []string{fmt.Sprintf("Plan for session %s in subnet %s:", p.SessionID, p.SubnetID)}
+	if p.SubnetSelection != nil {
+		lines = append(lines, p.SubnetSelection.Explain())
+	}
+	for _, v := range p.Changes {
+		lines = append(lines, "  "+v.String())
+		counts[v.Action]++
+	}
+	lines = append(lines, fmt.Sprintf("%d to create, %d pre-existing, %d to reuse.", counts[PlanCreate], counts[PlanPreExisting], counts[PlanReuse]))
+	for _, v := range p.PolicyOverrides {
+		lines = append(lines, "Policy override: "+v.String())
+	}
+	for _, v := range p.Warnings {
+		lines = append(lines, "Warning: "+v)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// JSON renders the plan as indented JSON. The plan can be read back with
+// LoadPlan, and applied.
+func (p Plan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// LoadPlan reads a plan rendered by Plan.JSON, so that it can be reviewed
+// and applied by a different process to the one that made it.
+func LoadPlan(data []byte) (Plan, error) {
+	var p Plan
+	err := json.Unmarshal(data, &p)
+	if err != nil {
+		return p, fmt.Errorf("Unable to parse plan: %s", err)
+	}
+	if p.SessionID == "" || p.SubnetID == "" || p.ImageID == "" {
+		return p, fmt.Errorf("The plan is incomplete: it needs a session ID, subnet ID, and image ID.")
+	}
+	return p, nil
+}
+
+// planPorts returns a human-readable port range.
+func planPorts(start, end int) string {
+	if start == end {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d-%d", start, end)
+}
+
+// planNetworkACLRuleDetail describes a planned network ACL rule, naming the
+// peer it allows.
+func planNetworkACLRuleDetail(rule NetworkACLRule, peer string) string {
+	preposition := "from"
+	if rule.Egress == true {
+		preposition = "to"
+	}
+	protocol, _ := NormalizeProtocol(rule.Protocol)
+	return fmt.Sprintf("%s %s #%d %s %s %s %s", rule.NetworkAclID, ruleDirection(rule.Egress), rule.RuleNumber,
+		protocol, planPorts(rule.StartPort, rule.EndPort), preposition, peer)
+}
+
+// planner holds the state of a plan while it is computed.
+type planner struct {
+	conn   *ec2.EC2
+	plan   Plan
+	policy Policy
+
+	// The network ACLs described so far, with the entries the plan will
+	// create added, so that later rules are placed around them.
+	acls map[string]*ec2.NetworkAcl
+
+	// The permissions the plan will add to the bastion security group.
+	permissions []*ec2.IpPermission
+}
+
+// networkACL returns a network ACL as the plan will leave it, describing and
+// snapshotting it the first time it is needed.
+func (p *planner) networkACL(id string) (*ec2.NetworkAcl, error) {
+	if acl, ok := p.acls[id]; ok {
+		return acl, nil
+	}
+
+	acl, err := describeNetworkACL(p.conn, id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.plan.Snapshot.NetworkACLs = append(p.plan.Snapshot.NetworkACLs, NetworkACLSnapshot{
+		NetworkAclID: id,
+		Entries:      acl.Entries,
+	})
+	p.acls[id] = acl
+	return acl, nil
+}
+
+// enforce checks a rule's violations against the plan's policy, recording
+// any that it overrides.
+func (p *planner) enforce(violations []PolicyViolation) error {
+	overrides, err := p.policy.enforce(violations)
+	p.plan.PolicyOverrides = append(p.plan.PolicyOverrides, overrides...)
+	return err
+}
+
+// planNetworkACLRule works out what CreateNetworkACLRuleWithPlacement will
+// do for a rule: the rule is either pre-existing, or is given the rule
+// number it will be created with. The entries of transient rules do not
+// count as allowing the traffic, as with RuleSet.TransientNetworkACLRules.
+func (p *planner) planNetworkACLRule(rule NetworkACLRule, placement RulePlacement, peer string, transient []NetworkACLRule) (NetworkACLRule, error) {
+	acl, err := p.networkACL(rule.NetworkAclID)
+	if err != nil {
+		return rule, err
+	}
+
+	err = p.enforce(p.policy.CheckNetworkACLRule(acl, rule))
+	if err != nil {
+		return rule, err
+	}
+
+	eval, err := EvaluateNetworkACL(withoutTransientEntries(acl, rule.NetworkAclID, transient), rule)
+	if err != nil {
+		return rule, err
+	}
+	if eval.Allowed() == true {
+		rule.PreExisting = true
+		rule.RuleNumber = eval.RuleNumber
+		p.plan.add("network_acl_rule", PlanPreExisting, "%s", planNetworkACLRuleDetail(rule, peer))
+		return rule, nil
+	}
+
+	err = checkNetworkACLQuota(acl, rule.Egress)
+	if err != nil {
+		return rule, err
+	}
+
+	n, err := placement.PlaceRule(acl, rule)
+	if err != nil {
+		return rule, err
+	}
+	rule.RuleNumber = n
+
+	// Add the entry to the plan's copy of the ACL, so that the number is not
+	// used twice.
+	req, err := networkACLEntryInput(rule, n)
+	if err != nil {
+		return rule, err
+	}
+	planned := *acl
+	planned.Entries = append(append([]*ec2.NetworkAclEntry(nil), acl.Entries...), &ec2.NetworkAclEntry{
+		CidrBlock:     req.CidrBlock,
+		Egress:        req.Egress,
+		IcmpTypeCode:  req.IcmpTypeCode,
+		Ipv6CidrBlock: req.Ipv6CidrBlock,
+		PortRange:     req.PortRange,
+		Protocol:      req.Protocol,
+		RuleAction:    req.RuleAction,
+		RuleNumber:    req.RuleNumber,
+	})
+	p.acls[rule.NetworkAclID] = &planned
+
+	p.plan.add("network_acl_rule", PlanCreate, "%s", planNetworkACLRuleDetail(rule, peer))
+	return rule, nil
+}
+
+// planNetworkACLRulePair plans both rules of a pair.
+func (p *planner) planNetworkACLRulePair(pair NetworkACLRulePair, placement RulePlacement, peer string, transient []NetworkACLRule) (NetworkACLRulePair, error) {
+	if placement == nil {
+		placement = DefaultRulePlacement
+	}
+
+	var err error
+	pair.Forward, err = p.planNetworkACLRule(pair.Forward, placement, peer, transient)
+	if err != nil {
+		return pair, err
+	}
+
+	pair.Return, err = p.planNetworkACLRule(pair.Return, placement, peer, transient)
+	return pair, err
+}
+
+// planSecurityGroupRule checks a rule for the bastion security group against
+// the plan's policy, and records it. The group does not exist yet, so the rule
+// is created, unless one of the covering permissions (some or all of those
+// planned before it) already allows the traffic.
+func (p *planner) planSecurityGroupRule(rule SecurityGroupRule, peer string, covering []*ec2.IpPermission) error {
+	rule.GroupID = p.plan.SecurityGroupName
+	err := p.enforce(p.policy.CheckSecurityGroupRule(nil, rule))
+	if err != nil {
+		return err
+	}
+
+	if permissionsCoverRule(covering, rule) == true {
+		p.plan.add("security_group_rule", PlanPreExisting, "%s ingress tcp %s from %s", p.plan.SecurityGroupName,
+			planPorts(rule.StartPort, rule.EndPort), peer)
+		return nil
+	}
+
+	perm, err := securityGroupRulePermission(rule)
+	if err != nil {
+		return err
+	}
+	p.permissions = append(p.permissions, perm)
+
+	p.plan.add("security_group_rule", PlanCreate, "%s ingress tcp %s from %s", p.plan.SecurityGroupName,
+		planPorts(rule.StartPort, rule.EndPort), peer)
+	return nil
+}
+
+// planTargetAccess plans the changes GrantTargetAccess will make.
+func (p *planner) planTargetAccess(subnet *ec2.Subnet, opts LaunchOptions) error {
+	port := opts.TargetAccess.Port
+	if port == 0 {
+		port = sshPort
+	}
+
+	target, err := findAccessTarget(p.conn, opts.TargetAccess)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range target.groupIDs {
+		p.plan.Snapshot, err = SnapshotSecurityGroup(p.conn, p.plan.Snapshot, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	group, err := describeSecurityGroup(p.conn, target.groupIDs[0])
+	if err != nil {
+		return err
+	}
+
+	// The bastion security group does not exist yet, so the rule can never be
+	// pre-existing.
+	sgr := SecurityGroupRule{
+		GroupID:   target.groupIDs[0],
+		Peer:      SecurityGroupPeer(p.plan.SecurityGroupName, ""),
+		StartPort: port,
+		EndPort:   port,
+	}
+	err = p.enforce(p.policy.CheckSecurityGroupRule(group, sgr))
+	if err != nil {
+		return err
+	}
+	p.plan.add("security_group_rule", PlanCreate, "%s ingress tcp %d from %s", sgr.GroupID, port, p.plan.SecurityGroupName)
+
+	if target.subnetID == p.plan.SubnetID {
+		return nil
+	}
+
+	acl, err := FindNetworkACLForSubnet(p.conn, target.subnetID)
+	if err != nil {
+		return err
+	}
+
+	forward := NetworkACLRule{
+		NetworkAclID: acl,
+		CidrBlock:    aws.StringValue(subnet.CidrBlock),
+		StartPort:    port,
+		EndPort:      port,
+	}
+
+	placement := opts.TargetAccess.Placement
+	if placement == nil {
+		placement = opts.NetworkACLPlacement
+	}
+
+	peer := fmt.Sprintf("bastion private address (%s)", forward.CidrBlock)
+	p.plan.TargetNetworkACLRules, err = p.planNetworkACLRulePair(NewNetworkACLRulePair(forward, EphemeralPortsAny), placement, peer, nil)
+	return err
+}
+
+// PlanSession works out everything LaunchSession would do for a set of
+// options, without changing anything: the subnet, AMI, and resource names to
+// use, the security group and network ACL rules that will be created or are
+// already in place, and the rule numbers new network ACL entries will get.
+// Rules are checked against opts.Policy (DefaultPolicy if nil), as they would
+// be on launch, and violations that it overrides are listed in the plan.
+//
+// The key pair and security group name is the first one the Namer generates
+// that is not in use yet. The plan records the state of every shared
+// security group and network ACL it looked at. See ApplyPlan.
+func PlanSession(conn *ec2.EC2, opts LaunchOptions) (Plan, error) {
+	return PlanSessionWithContext(context.Background(), conn, opts)
+}
+
+// PlanSessionWithContext is PlanSession, with a context that bounds the
+// discovery of the client's public address when ClientCIDR is not supplied.
+func PlanSessionWithContext(ctx context.Context, conn *ec2.EC2, opts LaunchOptions) (Plan, error) {
+	p := &planner{
+		conn:   conn,
+		policy: policyOrDefault(opts.Policy),
+		acls:   make(map[string]*ec2.NetworkAcl),
+	}
+
+	if opts.SubnetID == "" {
+		selection, err := SelectPublicSubnet(conn, opts.SubnetTarget)
+		if err != nil {
+			return p.plan, err
+		}
+		opts.SubnetID = selection.SubnetID
+		p.plan.SubnetSelection = &selection
+	}
+	p.plan.SubnetID = opts.SubnetID
+
+	err := ValidatePublicSubnetForInstance(conn, opts.SubnetID, opts.Instance)
+	if err != nil {
+		return p.plan, err
+	}
+
+	subnet, err := describeSubnet(conn, opts.SubnetID)
+	if err != nil {
+		return p.plan, err
+	}
+
+	p.plan.ClientCIDR, p.plan.Warnings, err = resolveClientCIDR(ctx, opts)
+	if err != nil {
+		return p.plan, err
+	}
+
+	namer := opts.Namer
+	if namer.SessionID == "" {
+		namer.SessionID, err = NewSessionID()
+		if err != nil {
+			return p.plan, err
+		}
+	}
+	p.plan.SessionID = namer.SessionID
+
+	// The names are checked now, as ApplyPlan will not rename anything.
+	vpc := aws.StringValue(subnet.VpcId)
+	name, err := findUnusedName(namer, func(name string) (bool, error) {
+		inUse, err := keyPairNameInUse(conn, name)
+		if err != nil || inUse == true {
+			return inUse, err
+		}
+		return securityGroupNameInUse(conn, vpc, name)
+	})
+	if err != nil {
+		return p.plan, err
+	}
+	p.plan.KeyPairName = name
+	p.plan.SecurityGroupName = name
+	p.plan.add("key_pair", PlanCreate, "%s", name)
+	p.plan.add("security_group", PlanCreate, "%s in %s", name, vpc)
+
+	if opts.NetworkACLID == "" {
+		opts.NetworkACLID, err = FindNetworkACLForSubnet(conn, opts.SubnetID)
+		if err != nil {
+			return p.plan, err
+		}
+	}
+
+	ephemeral, err := EphemeralPortsForOS(opts.ClientOS)
+	if err != nil {
+		return p.plan, err
+	}
+
+	// As on launch, the allowlist goes before the client's own access.
+	for _, entry := range opts.Allowlist.Entries {
+		peer := fmt.Sprintf("%s (%s)", entry.CIDR, entry.Name)
+		err = p.planSecurityGroupRule(allowlistRule(p.plan.SecurityGroupName, opts.Allowlist.Source, entry), peer, p.permissions)
+		if err != nil {
+			return p.plan, err
+		}
+
+		pair := allowlistNetworkACLRulePair(opts.NetworkACLID, opts.Allowlist.Source, entry, ephemeral)
+		pair, err = p.planNetworkACLRulePair(pair, opts.NetworkACLPlacement, peer, nil)
+		if err != nil {
+			return p.plan, err
+		}
+		p.plan.AllowlistNetworkACLRules = append(p.plan.AllowlistNetworkACLRules, pair)
+	}
+
+	if p.plan.ClientCIDR != "" {
+		// As on launch, the allowlist rules do not count as allowing the
+		// client, except for a security group rule for exactly the client
+		// range (see allowlistTransientRules).
+		peer := clientPeer(p.plan.ClientCIDR)
+		var covering []*ec2.IpPermission
+		for _, entry := range opts.Allowlist.Entries {
+			if clientPeer(entry.CIDR) == peer {
+				perm, err := securityGroupRulePermission(allowlistRule(p.plan.SecurityGroupName, opts.Allowlist.Source, entry))
+				if err != nil {
+					return p.plan, err
+				}
+				covering = append(covering, perm)
+			}
+		}
+		var transient []NetworkACLRule
+		for _, v := range p.plan.AllowlistNetworkACLRules {
+			for _, rule := range []NetworkACLRule{v.Forward, v.Return} {
+				if rule.PreExisting == false {
+					rule.Created = true
+					transient = append(transient, rule)
+				}
+			}
+		}
+
+		err = p.planSecurityGroupRule(SecurityGroupRule{
+			Peer:      peer,
+			StartPort: sshPort,
+			EndPort:   sshPort,
+		}, p.plan.ClientCIDR, covering)
+		if err != nil {
+			return p.plan, err
+		}
+
+		forward := NetworkACLRule{
+			NetworkAclID: opts.NetworkACLID,
+			StartPort:    sshPort,
+			EndPort:      sshPort,
+		}
+		if peer.Type == RulePeerIPv6CIDR {
+			forward.Ipv6CidrBlock = p.plan.ClientCIDR
+		} else {
+			forward.CidrBlock = p.plan.ClientCIDR
+		}
+
+		p.plan.ClientNetworkACLRules, err = p.planNetworkACLRulePair(NewNetworkACLRulePair(forward, ephemeral), opts.NetworkACLPlacement, p.plan.ClientCIDR, transient)
+		if err != nil {
+			return p.plan, err
+		}
+	}
+
+	if opts.ElasticIP == true {
+		var addr *ec2.Address
+		if opts.ElasticIPTagKey != "" {
+			addr, err = findTaggedElasticIP(conn, opts.ElasticIPTagKey, opts.ElasticIPTagValue)
+			if err != nil {
+				return p.plan, err
+			}
+		}
+		if addr != nil {
+			p.plan.ElasticIPAllocationID = aws.StringValue(addr.AllocationId)
+			p.plan.add("elastic_ip", PlanReuse, "%s (%s)", p.plan.ElasticIPAllocationID, aws.StringValue(addr.PublicIp))
+		} else {
+			p.plan.add("elastic_ip", PlanCreate, "new allocation")
+		}
+	}
+
+	p.plan.ImageID = opts.Instance.ImageID
+	if p.plan.ImageID == "" {
+		p.plan.ImageID, err = LocateImage(conn)
+		if err != nil {
+			return p.plan, err
+		}
+	}
+	p.plan.add("instance", PlanCreate, "%s %s in %s", p.plan.ImageID, instanceType, opts.SubnetID)
+
+	if opts.TargetAccess.InstanceID != "" || opts.TargetAccess.NetworkInterfaceID != "" {
+		err = p.planTargetAccess(subnet, opts)
+		if err != nil {
+			return p.plan, err
+		}
+	}
+
+	if opts.HostedZoneID != "" {
+		addr := "private address"
+		if opts.DNSUsePublicIP == true {
+			addr = "public address"
+		}
+		p.plan.add("dns_record", PlanCreate, "%s in %s -> %s", opts.DNSName, opts.HostedZoneID, addr)
+	}
+
+	p.plan.Options = newPlanOptions(opts)
+	return p.plan, nil
+}
+
+// plannedPlacement places new network ACL entries at the rule numbers a plan
+// chose for them, keyed by plannedPlacementKey.
+type plannedPlacement map[string]int
+
+// plannedPlacementKey identifies a rule within a plan by its network ACL,
+// direction, and CIDR block.
+func plannedPlacementKey(rule NetworkACLRule) string {
+	return fmt.Sprintf("%s %s %s%s", rule.NetworkAclID, ruleDirection(rule.Egress), rule.CidrBlock, rule.Ipv6CidrBlock)
+}
+
+// newPlannedPlacement returns the placement for the planned rules of some
+// pairs that are not pre-existing.
+func newPlannedPlacement(pairs ...NetworkACLRulePair) plannedPlacement {
+	p := make(plannedPlacement)
+	for _, pair := range pairs {
+		for _, v := range []NetworkACLRule{pair.Forward, pair.Return} {
+			if v.PreExisting == false && v.RuleNumber > 0 {
+				p[plannedPlacementKey(v)] = v.RuleNumber
+			}
+		}
+	}
+	return p
+}
+
+// PlaceRule implements RulePlacement for plannedPlacement.
+func (p plannedPlacement) PlaceRule(acl *ec2.NetworkAcl, rule NetworkACLRule) (int, error) {
+	n := p[plannedPlacementKey(rule)]
+	if n == 0 {
+		return 0, fmt.Errorf("The plan has no %s rule number for network ACL %s, as the traffic was already allowed. Plan again.", ruleDirection(rule.Egress), rule.NetworkAclID)
+	}
+	if usedNetworkACLRuleNumbers(acl, rule.Egress)[n] == true {
+		return 0, fmt.Errorf("Planned %s rule number %d in network ACL %s is already in use. Plan again.", ruleDirection(rule.Egress), n, rule.NetworkAclID)
+	}
+	return n, nil
+}
+
+// plannedPairPlacement checks that a network ACL rule pair has the outcome a
+// plan had for planned, which may have been for a different CIDR block in
+// the same network ACL, and returns the placement that gives the pair's new
+// entries the planned rule numbers.
+func plannedPairPlacement(conn *ec2.EC2, pair, planned NetworkACLRulePair) (RulePlacement, error) {
+	if planned.Forward.NetworkAclID != pair.Forward.NetworkAclID {
+		return nil, fmt.Errorf("The plan has no network ACL rules for %s in network ACL %s. Plan again and review the changes.", pair.Forward.CidrBlock, pair.Forward.NetworkAclID)
+	}
+
+	acl, err := describeNetworkACL(conn, pair.Forward.NetworkAclID)
+	if err != nil {
+		return nil, err
+	}
+
+	outcome := func(preExisting bool) string {
+		if preExisting == true {
+			return "pre-existing"
+		}
+		return "created"
+	}
+
+	rules := [][2]NetworkACLRule{{pair.Forward, planned.Forward}, {pair.Return, planned.Return}}
+	for i, v := range rules {
+		eval, err := EvaluateNetworkACL(acl, v[0])
+		if err != nil {
+			return nil, err
+		}
+		if eval.Allowed() != v[1].PreExisting {
+			return nil, fmt.Errorf("The plan has the %s rule for %s in network ACL %s %s, but for %s it would be %s. Plan again and review the changes.",
+				ruleDirection(v[0].Egress), networkACLRulePairCIDR(planned), v[0].NetworkAclID, outcome(v[1].PreExisting), v[0].CidrBlock, outcome(eval.Allowed()))
+		}
+		rules[i][1].CidrBlock = v[0].CidrBlock
+		rules[i][1].Ipv6CidrBlock = v[0].Ipv6CidrBlock
+	}
+
+	return newPlannedPlacement(NetworkACLRulePair{Forward: rules[0][1], Return: rules[1][1]}), nil
+}
+
+// ApplyPlan launches a session exactly as planned by PlanSession: with the
+// planned session ID, subnet, AMI, and network ACL rule numbers. The plan
+// can come from PlanSession in the same process, or from LoadPlan.
+//
+// Before anything is changed, the security groups and network ACLs the plan
+// was computed from are compared with their live state. If any of them has
+// changed, the planned key pair or security group name has been taken, or
+// the Elastic IP address that was going to be reused is no longer
+// available, nothing is applied and an error describing the drift is
+// returned, so that the plan can be made and reviewed again.
+//
+// As with LaunchSession, the Session will contain the resources that were
+// created before any error, and should be passed to TeardownSession to
+// clean them up.
+//
+// Target access was planned for the whole bastion subnet, as the bastion
+// host's address is not known until it is launched. If the network ACL rules
+// for its address would have a different outcome (for example, an entry
+// already allows the address, but not the whole subnet), no target access
+// is granted, and an error is returned along with the session.
+func ApplyPlan(clients Clients, plan Plan) (Session, error) {
+	conn := clients.EC2
+	var s Session
+
+	report, err := DiffSnapshot(conn, plan.Snapshot)
+	if err != nil {
+		return s, err
+	}
+	if report.Clean() == false {
+		return s, fmt.Errorf("Live state has changed since the plan was made. Plan again and review the changes.\n%s", report)
+	}
+
+	vpc, err := findVpcIDFromSubnet(conn, plan.SubnetID)
+	if err != nil {
+		return s, err
+	}
+	inUse, err := keyPairNameInUse(conn, plan.KeyPairName)
+	if err == nil && inUse == false {
+		inUse, err = securityGroupNameInUse(conn, vpc, plan.SecurityGroupName)
+	}
+	if err != nil {
+		return s, err
+	}
+	if inUse == true {
+		return s, fmt.Errorf("The planned key pair or security group name %q has been taken since the plan was made. Plan again and review the changes.", plan.KeyPairName)
+	}
+
+	opts := plan.Options.launchOptions()
+	if opts.ElasticIP == true && opts.ElasticIPTagKey != "" {
+		addr, err := findTaggedElasticIP(conn, opts.ElasticIPTagKey, opts.ElasticIPTagValue)
+		if err != nil {
+			return s, err
+		}
+		var id string
+		if addr != nil {
+			id = aws.StringValue(addr.AllocationId)
+		}
+		if id != plan.ElasticIPAllocationID {
+			return s, fmt.Errorf("The Elastic IP address to reuse has changed since the plan was made (planned %q, found %q). Plan again and review the changes.", plan.ElasticIPAllocationID, id)
+		}
+	}
+
+	opts.SubnetID = plan.SubnetID
+	opts.ClientCIDR = plan.ClientCIDR
+	opts.Namer.SessionID = plan.SessionID
+	opts.plannedKeyPairName = plan.KeyPairName
+	opts.plannedSecurityGroupName = plan.SecurityGroupName
+	opts.Instance.ImageID = plan.ImageID
+	opts.NetworkACLPlacement = newPlannedPlacement(append([]NetworkACLRulePair{plan.ClientNetworkACLRules}, plan.AllowlistNetworkACLRules...)...)
+
+	// The target rules were planned for the whole bastion subnet, so they
+	// are checked again for the bastion host's address before any are made.
+	target := plan.TargetNetworkACLRules
+	opts.TargetAccess.Planned = &target
+
+	s, err = LaunchSession(clients, opts)
+	s.SubnetSelection = plan.SubnetSelection
+	s.Warnings = append(append([]string(nil), plan.Warnings...), s.Warnings...)
+	return s, err
+}
@@ -0,0 +1,493 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testPlanMock holds the live state served by the plan mock, and the
+// operations called on it that are not describes.
+type testPlanMock struct {
+	acl      *ec2.NetworkAcl
+	group    *ec2.SecurityGroup
+	keyPairs []string
+	changes  []string
+}
+
+// newTestPlanMock provides a plan mock with a network ACL that is shared by
+// the bastion and target subnets. It already allows return traffic out on
+// ephemeral ports, but not SSH in.
+func newTestPlanMock() *testPlanMock {
+	entry := func(n int64, egress bool, action, cidr string, from, to int64) *ec2.NetworkAclEntry {
+		return &ec2.NetworkAclEntry{
+			CidrBlock:  aws.String(cidr),
+			Egress:     aws.Bool(egress),
+			PortRange:  &ec2.PortRange{From: aws.Int64(from), To: aws.Int64(to)},
+			Protocol:   aws.String("6"),
+			RuleAction: aws.String(action),
+			RuleNumber: aws.Int64(n),
+		}
+	}
+
+	return &testPlanMock{
+		acl: &ec2.NetworkAcl{
+			NetworkAclId: aws.String("acl-plan"),
+			VpcId:        aws.String("vpc-123456"),
+			Entries: []*ec2.NetworkAclEntry{
+				entry(100, false, "allow", "10.1.0.0/16", 22, 22),
+				entry(32767, false, "deny", "0.0.0.0/0", 0, 65535),
+				entry(100, true, "allow", "0.0.0.0/0", 1024, 65535),
+				entry(32767, true, "deny", "0.0.0.0/0", 0, 65535),
+			},
+		},
+		group: &ec2.SecurityGroup{
+			GroupId:       aws.String("sg-target"),
+			VpcId:         aws.String("vpc-123456"),
+			IpPermissions: []*ec2.IpPermission{testSnapshotPermission("10.1.0.0/16")},
+		},
+	}
+}
+
+// createTestEC2PlanMock returns a mock EC2 service to use with the plan test
+// functions. The target instance is in subnet-private.
+func createTestEC2PlanMock(m *testPlanMock) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeSubnetsInput:
+			*r.Data.(*ec2.DescribeSubnetsOutput) = *testDescribeSubnetsOutput()
+		case *ec2.DescribeRouteTablesInput:
+			*r.Data.(*ec2.DescribeRouteTablesOutput) = *testDescribeRouteTablesOutput()
+		case *ec2.DescribeNetworkAclsInput:
+			*r.Data.(*ec2.DescribeNetworkAclsOutput) = ec2.DescribeNetworkAclsOutput{
+				NetworkAcls: []*ec2.NetworkAcl{m.acl},
+			}
+		case *ec2.DescribeSecurityGroupsInput:
+			out := ec2.DescribeSecurityGroupsOutput{}
+			if len(p.Filters) < 1 || aws.StringValue(p.Filters[0].Values[0]) == aws.StringValue(m.group.GroupName) {
+				out.SecurityGroups = []*ec2.SecurityGroup{m.group}
+			}
+			*r.Data.(*ec2.DescribeSecurityGroupsOutput) = out
+		case *ec2.DescribeKeyPairsInput:
+			r.Error = awserr.New("InvalidKeyPair.NotFound", "not found", nil)
+			for _, v := range m.keyPairs {
+				if v == *p.KeyNames[0] {
+					r.Error = nil
+				}
+			}
+		case *ec2.DescribeImagesInput:
+			*r.Data.(*ec2.DescribeImagesOutput) = *testDescribeImagesOutput()
+		case *ec2.DescribeInstancesInput:
+			out := testDescribeInstancesOutput()
+			i := out.Reservations[0].Instances[0]
+			i.InstanceId = p.InstanceIds[0]
+			i.SubnetId = aws.String("subnet-private")
+			i.SecurityGroups = []*ec2.GroupIdentifier{
+				&ec2.GroupIdentifier{GroupId: aws.String("sg-target")},
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = *out
+		default:
+			m.changes = append(m.changes, fmt.Sprintf("%T", p))
+		}
+	})
+	return conn
+}
+
+// testPlanOptions provides launch options for the plan tests.
+func testPlanOptions() LaunchOptions {
+	return LaunchOptions{
+		SubnetID:   "subnet-123456",
+		ClientCIDR: "203.0.113.7/32",
+		TargetAccess: TargetAccessOptions{
+			InstanceID: "i-target",
+		},
+		HostedZoneID: "Z123456",
+		DNSName:      "bastion.example.com",
+	}
+}
+
+func TestPlanSession(t *testing.T) {
+	m := newTestPlanMock()
+	conn := createTestEC2PlanMock(m)
+
+	plan, err := PlanSession(conn, testPlanOptions())
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	if len(m.changes) > 0 {
+		t.Fatalf("Expected no changes while planning, got %v", m.changes)
+	}
+
+	if plan.SessionID == "" || plan.KeyPairName != "bastion-"+plan.SessionID {
+		t.Fatalf("Expected key pair bastion-%s, got %q", plan.SessionID, plan.KeyPairName)
+	}
+
+	if plan.ClientCIDR != "203.0.113.7/32" {
+		t.Fatalf("Expected client CIDR 203.0.113.7/32, got %s", plan.ClientCIDR)
+	}
+
+	image, _ := LocateImage(conn)
+	if plan.ImageID != image {
+		t.Fatalf("Expected image %s, got %s", image, plan.ImageID)
+	}
+
+	client := plan.ClientNetworkACLRules
+	if client.Forward.PreExisting == true || client.Forward.RuleNumber != 1 {
+		t.Fatalf("Expected client forward rule to be created as rule 1, got %#v", client.Forward)
+	}
+	if client.Return.PreExisting == false || client.Return.RuleNumber != 100 {
+		t.Fatalf("Expected client return rule to be pre-existing as rule 100, got %#v", client.Return)
+	}
+
+	// The target subnet shares the ACL, so its entry goes after the client's.
+	target := plan.TargetNetworkACLRules
+	if target.Forward.CidrBlock != "10.0.0.0/24" || target.Forward.RuleNumber != 2 {
+		t.Fatalf("Expected target forward rule for 10.0.0.0/24 as rule 2, got %#v", target.Forward)
+	}
+	if target.Return.PreExisting == false {
+		t.Fatalf("Expected target return rule to be pre-existing, got %#v", target.Return)
+	}
+
+	var actions []string
+	for _, v := range plan.Changes {
+		actions = append(actions, v.Resource+" "+string(v.Action))
+	}
+	expected := []string{
+		"key_pair create",
+		"security_group create",
+		"security_group_rule create",
+		"network_acl_rule create",
+		"network_acl_rule pre_existing",
+		"instance create",
+		"security_group_rule create",
+		"network_acl_rule create",
+		"network_acl_rule pre_existing",
+		"dns_record create",
+	}
+	if reflect.DeepEqual(actions, expected) == false {
+		t.Fatalf("Expected changes %v, got %v", expected, actions)
+	}
+
+	if len(plan.Snapshot.NetworkACLs) != 1 || len(plan.Snapshot.SecurityGroups) != 1 {
+		t.Fatalf("Expected the ACL and target group to be snapshotted, got %#v", plan.Snapshot)
+	}
+}
+
+func TestPlanSessionString(t *testing.T) {
+	conn := createTestEC2PlanMock(newTestPlanMock())
+
+	plan, err := PlanSession(conn, testPlanOptions())
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	out := plan.String()
+	for _, v := range []string{
+		"+ network_acl_rule     acl-plan ingress #1 tcp 22 from 203.0.113.7/32",
+		"= network_acl_rule     acl-plan egress #100 tcp 1024-65535 to 203.0.113.7/32 (pre-existing)",
+		"+ network_acl_rule     acl-plan ingress #2 tcp 22 from bastion private address (10.0.0.0/24)",
+		"8 to create, 2 pre-existing, 0 to reuse.",
+	} {
+		if strings.Contains(out, v) == false {
+			t.Fatalf("Expected plan to contain %q, got:\n%s", v, out)
+		}
+	}
+
+	data, err := plan.JSON()
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if strings.Contains(string(data), `"image_id": "`+plan.ImageID+`"`) == false {
+		t.Fatalf("Expected JSON to contain the image ID, got:\n%s", data)
+	}
+}
+
+func TestPlanSessionAllowlist(t *testing.T) {
+	conn := createTestEC2PlanMock(newTestPlanMock())
+
+	opts := testPlanOptions()
+	opts.Allowlist = Allowlist{
+		Source:  "teams.yml",
+		Entries: []AllowlistEntry{AllowlistEntry{Name: "office", CIDR: "203.0.113.0/24"}},
+	}
+	plan, err := PlanSession(conn, opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	// The allowlist is planned first. The client gets rules of its own, so
+	// that removing the allowlist entry does not cut its access.
+	if len(plan.AllowlistNetworkACLRules) != 1 || plan.AllowlistNetworkACLRules[0].Forward.RuleNumber != 1 ||
+		plan.AllowlistNetworkACLRules[0].Forward.PreExisting == true {
+		t.Fatalf("Expected the allowlist forward rule to be created as rule 1, got %#v", plan.AllowlistNetworkACLRules)
+	}
+	client := plan.ClientNetworkACLRules
+	if client.Forward.PreExisting == true || client.Forward.RuleNumber != 2 {
+		t.Fatalf("Expected client forward rule to be created as rule 2, got %#v", client.Forward)
+	}
+
+	out := plan.String()
+	for _, v := range []string{
+		"+ security_group_rule",
+		"ingress tcp 22 from 203.0.113.0/24 (office)",
+		"ingress tcp 22 from 203.0.113.7/32",
+		"+ network_acl_rule     acl-plan ingress #1 tcp 22 from 203.0.113.0/24 (office)",
+	} {
+		if strings.Contains(out, v) == false {
+			t.Fatalf("Expected plan to contain %q, got:\n%s", v, out)
+		}
+	}
+	if strings.Contains(out, "ingress tcp 22 from 203.0.113.7/32 (pre-existing)") == true {
+		t.Fatalf("Expected the client rule to be created, got:\n%s", out)
+	}
+
+	p := newPlannedPlacement(append([]NetworkACLRulePair{plan.ClientNetworkACLRules}, plan.AllowlistNetworkACLRules...)...)
+	acl := &ec2.NetworkAcl{NetworkAclId: aws.String("acl-plan")}
+	n, err := p.PlaceRule(acl, plan.AllowlistNetworkACLRules[0].Forward)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1, got %d", n)
+	}
+}
+
+func TestPlanSessionPolicy(t *testing.T) {
+	m := newTestPlanMock()
+	conn := createTestEC2PlanMock(m)
+
+	opts := testPlanOptions()
+	opts.ClientCIDR = "0.0.0.0/0"
+	_, err := PlanSession(conn, opts)
+	if _, ok := err.(*PolicyError); ok == false {
+		t.Fatalf("Expected a PolicyError, got %v", err)
+	}
+
+	// An overridden policy lets the plan through, and lists the violations.
+	opts.Policy = &Policy{MinIPv4PrefixLength: 8, Override: true}
+	plan, err := PlanSession(conn, opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if len(plan.PolicyOverrides) != 3 {
+		t.Fatalf("Expected the security group rule and both network ACL rules to be overridden, got %#v", plan.PolicyOverrides)
+	}
+	if strings.Contains(plan.String(), "Policy override: ") == false {
+		t.Fatalf("Expected the overrides to be shown, got:\n%s", plan.String())
+	}
+}
+
+func TestApplyPlanDrift(t *testing.T) {
+	m := newTestPlanMock()
+	conn := createTestEC2PlanMock(m)
+
+	plan, err := PlanSession(conn, testPlanOptions())
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	// Someone else takes the planned rule number.
+	m.acl = &ec2.NetworkAcl{
+		NetworkAclId: m.acl.NetworkAclId,
+		VpcId:        m.acl.VpcId,
+		Entries:      append([]*ec2.NetworkAclEntry{testSnapshotEntry(1, "198.51.100.0/24")}, m.acl.Entries...),
+	}
+
+	_, err = ApplyPlan(Clients{EC2: conn}, plan)
+	if err == nil || strings.Contains(err.Error(), "Live state has changed") == false {
+		t.Fatalf("Expected a drift error, got %v", err)
+	}
+	if len(m.changes) > 0 {
+		t.Fatalf("Expected nothing to be applied, got %v", m.changes)
+	}
+}
+
+func TestPlannedPlacement(t *testing.T) {
+	pair := testNetworkACLRulePair()
+	pair.Forward.RuleNumber = 5
+	pair.Return.PreExisting = true
+	pair.Return.RuleNumber = 100
+	p := newPlannedPlacement(pair)
+
+	acl := &ec2.NetworkAcl{NetworkAclId: aws.String(pair.Forward.NetworkAclID)}
+	n, err := p.PlaceRule(acl, pair.Forward)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if n != 5 {
+		t.Fatalf("Expected 5, got %d", n)
+	}
+
+	_, err = p.PlaceRule(acl, pair.Return)
+	if err == nil {
+		t.Fatalf("Expected an error for a direction with no planned number")
+	}
+
+	acl.Entries = []*ec2.NetworkAclEntry{testSnapshotEntry(5, "198.51.100.0/24")}
+	_, err = p.PlaceRule(acl, pair.Forward)
+	if err == nil {
+		t.Fatalf("Expected an error for a planned number that is in use")
+	}
+}
+
+// testPlannedBastion provides the bastion host of a plan made with
+// testPlanOptions, once it has been launched.
+func testPlannedBastion() Instance {
+	return Instance{
+		SubnetID:         "subnet-123456",
+		SecurityGroupID:  "sg-bastion",
+		PrivateIPAddress: "10.0.0.5",
+	}
+}
+
+func TestGrantTargetAccessPlanned(t *testing.T) {
+	m := newTestPlanMock()
+	conn := createTestEC2PlanMock(m)
+
+	plan, err := PlanSession(conn, testPlanOptions())
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	planned := plan.TargetNetworkACLRules
+	_, pairs, _, err := GrantTargetAccess(conn, testPlannedBastion(), TargetAccessOptions{
+		InstanceID: "i-target",
+		Planned:    &planned,
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	if len(pairs) != 1 {
+		t.Fatalf("Expected 1 network ACL rule pair, got %d", len(pairs))
+	}
+	if pairs[0].Forward.CidrBlock != "10.0.0.5/32" || pairs[0].Forward.RuleNumber != planned.Forward.RuleNumber {
+		t.Fatalf("Expected forward rule for 10.0.0.5/32 as rule %d, got %#v", planned.Forward.RuleNumber, pairs[0].Forward)
+	}
+	if pairs[0].Return.PreExisting == false {
+		t.Fatalf("Expected return rule to be pre-existing, got %#v", pairs[0].Return)
+	}
+}
+
+func TestGrantTargetAccessPlannedMismatch(t *testing.T) {
+	m := newTestPlanMock()
+	conn := createTestEC2PlanMock(m)
+
+	plan, err := PlanSession(conn, testPlanOptions())
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	// An entry allows the bastion host's address in, but not its subnet.
+	m.acl.Entries = append([]*ec2.NetworkAclEntry{testSnapshotEntry(50, "10.0.0.5/32")}, m.acl.Entries...)
+
+	planned := plan.TargetNetworkACLRules
+	_, _, _, err = GrantTargetAccess(conn, testPlannedBastion(), TargetAccessOptions{
+		InstanceID: "i-target",
+		Planned:    &planned,
+	})
+	if err == nil || strings.Contains(err.Error(), "Plan again") == false {
+		t.Fatalf("Expected a plan mismatch error, got %v", err)
+	}
+	if len(m.changes) > 0 {
+		t.Fatalf("Expected nothing to be applied, got %v", m.changes)
+	}
+}
+
+func TestPlanSessionNameInUse(t *testing.T) {
+	m := newTestPlanMock()
+	conn := createTestEC2PlanMock(m)
+
+	// The base name is taken by a security group, so a suffix is added.
+	opts := testPlanOptions()
+	opts.Namer = Namer{SessionID: "abcdef0123456789"}
+	m.group.GroupName = aws.String("bastion-abcdef0123456789")
+	plan, err := PlanSession(conn, opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if strings.HasPrefix(plan.KeyPairName, "bastion-abcdef0123456789-") == false || plan.SecurityGroupName != plan.KeyPairName {
+		t.Fatalf("Expected a suffixed name, got %q and %q", plan.KeyPairName, plan.SecurityGroupName)
+	}
+
+	// If the planned name is taken before the plan is applied, it is not
+	// renamed.
+	m.keyPairs = []string{plan.KeyPairName}
+	_, err = ApplyPlan(Clients{EC2: conn}, plan)
+	if err == nil || strings.Contains(err.Error(), "Plan again") == false {
+		t.Fatalf("Expected a plan again error, got %v", err)
+	}
+	if len(m.changes) > 0 {
+		t.Fatalf("Expected nothing to be applied, got %v", m.changes)
+	}
+}
+
+func TestLoadPlan(t *testing.T) {
+	m := newTestPlanMock()
+	conn := createTestEC2PlanMock(m)
+
+	opts := testPlanOptions()
+	opts.Policy = &Policy{MinIPv4PrefixLength: 16}
+	plan, err := PlanSession(conn, opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	data, err := plan.JSON()
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	loaded, err := LoadPlan(data)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if reflect.DeepEqual(loaded.Options, plan.Options) == false {
+		t.Fatalf("Expected options %#v, got %#v", plan.Options, loaded.Options)
+	}
+	if loaded.Options.launchOptions().TargetAccess.InstanceID != "i-target" {
+		t.Fatalf("Expected target i-target, got %#v", loaded.Options)
+	}
+
+	// A loaded plan is still checked against the live state.
+	m.acl.Entries = append([]*ec2.NetworkAclEntry{testSnapshotEntry(1, "198.51.100.0/24")}, m.acl.Entries...)
+	_, err = ApplyPlan(Clients{EC2: conn}, loaded)
+	if err == nil || strings.Contains(err.Error(), "Live state has changed") == false {
+		t.Fatalf("Expected a drift error, got %v", err)
+	}
+
+	_, err = LoadPlan([]byte(`{"session_id": ""}`))
+	if err == nil {
+		t.Fatalf("Expected an error for an incomplete plan")
+	}
+}
+
+func TestPlanSessionSubnetSelection(t *testing.T) {
+	conn := createTestEC2PlanMock(newTestPlanMock())
+
+	opts := testPlanOptions()
+	opts.SubnetID = ""
+	opts.SubnetTarget = SubnetTarget{VpcID: "vpc-123456"}
+	plan, err := PlanSession(conn, opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	if plan.SubnetSelection == nil || plan.SubnetSelection.SubnetID != plan.SubnetID {
+		t.Fatalf("Expected the subnet selection to be recorded, got %#v", plan.SubnetSelection)
+	}
+	if strings.Contains(plan.String(), "Selected subnet "+plan.SubnetID+" in VPC vpc-123456.") == false {
+		t.Fatalf("Expected the selection to be explained, got:\n%s", plan.String())
+	}
+}
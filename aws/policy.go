@@ -0,0 +1,334 @@
+package aws
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// The constraints that a policy violation can be for.
+const (
+	// PolicyCIDRSize is the maximum CIDR block size constraint.
+	PolicyCIDRSize = "cidr_size"
+
+	// PolicyProtocol is the allowed protocols constraint.
+	PolicyProtocol = "protocol"
+
+	// PolicyPort is the allowed ports constraint.
+	PolicyPort = "port"
+
+	// PolicyVPC is the forbidden VPCs constraint.
+	PolicyVPC = "vpc"
+
+	// PolicySubnet is the forbidden subnets constraint.
+	PolicySubnet = "subnet"
+
+	// PolicyTag is the required tags constraint.
+	PolicyTag = "tag"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	_ struct{}
+
+	// The first port in the range.
+	Start int `json:"start"`
+
+	// The last port in the range.
+	End int `json:"end"`
+}
+
+// Policy describes the constraints that security group and network ACL
+// rules must meet before they are created. The zero value allows
+// everything.
+type Policy struct {
+	_ struct{}
+
+	// The shortest prefix length allowed for IPv4 CIDR blocks (for example,
+	// 16 allows a /16 but not a /8). Zero means no limit.
+	MinIPv4PrefixLength int `json:"min_ipv4_prefix_length"`
+
+	// The shortest prefix length allowed for IPv6 CIDR blocks. Zero means no
+	// limit.
+	MinIPv6PrefixLength int `json:"min_ipv6_prefix_length"`
+
+	// The protocols that rules may apply to. If this is empty, all protocols
+	// are allowed.
+	AllowedProtocols []string `json:"allowed_protocols"`
+
+	// The port ranges that tcp and udp rules must fall within. If this is
+	// empty, all ports are allowed.
+	AllowedPorts []PortRange `json:"allowed_ports"`
+
+	// The VPCs that rules may not be added in.
+	ForbiddenVPCs []string `json:"forbidden_vpcs"`
+
+	// The subnets that network ACL rules may not be added for. Security
+	// groups are not tied to a subnet, so this only applies to network ACLs.
+	ForbiddenSubnets []string `json:"forbidden_subnets"`
+
+	// The tags that the security group or network ACL must have for rules to
+	// be added to it. An empty value means any value is accepted.
+	RequiredTags map[string]string `json:"required_tags"`
+
+	// true if violations should be reported back instead of rejecting the
+	// rule. The overridden violations are returned to the caller (for
+	// example, in RuleSetResult), and recorded in the session or plan.
+	Override bool `json:"override"`
+}
+
+// DefaultPolicy is the policy enforced when no other is supplied: by
+// CreateSecurityGroupRule and CreateNetworkACLRule, and by the functions
+// whose options have a Policy field, such as ApplyRuleSet and LaunchSession.
+// By default it rejects CIDR blocks larger than a /8 (or an IPv6 /32), and
+// rules for all protocols.
+//
+// It does not limit ports: target access can be for any port, and network
+// ACL return rules span the client's ephemeral port range, which starts as
+// low as 1024. Set AllowedPorts in a Policy to restrict them.
+//
+// DefaultPolicy is read without any locking, so it should not be changed
+// while sessions are being managed. Supply a Policy in the options instead.
+var DefaultPolicy = Policy{
+	MinIPv4PrefixLength: 8,
+	MinIPv6PrefixLength: 32,
+	AllowedProtocols:    []string{ProtocolTCP, ProtocolUDP, ProtocolICMP, ProtocolICMPv6},
+}
+
+// PolicyViolation describes a single way in which a rule breaks a policy.
+type PolicyViolation struct {
+	_ struct{}
+
+	// The constraint that was violated (for example, PolicyCIDRSize).
+	Constraint string `json:"constraint"`
+
+	// The security group or network ACL the rule was for.
+	Resource string `json:"resource"`
+
+	// A human-readable description of the violation.
+	Message string `json:"message"`
+}
+
+// String returns the violation as a single line.
+func (v PolicyViolation) String() string {
+	return fmt.Sprintf("%s: %s (%s)", v.Resource, v.Message, v.Constraint)
+}
+
+// PolicyError is returned when a rule is rejected by a policy.
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+// Error implements error for PolicyError.
+func (e *PolicyError) Error() string {
+	var lines []string
+	for _, v := range e.Violations {
+		lines = append(lines, v.String())
+	}
+	return fmt.Sprintf("Rule rejected by policy:\n%s", strings.Join(lines, "\n"))
+}
+
+// policyRule is the part of a security group or network ACL rule that a
+// policy applies to.
+type policyRule struct {
+	resource  string
+	cidr      string
+	protocol  string
+	startPort int
+	endPort   int
+}
+
+// checkRule returns the violations of the CIDR size, protocol, and port
+// constraints.
+func (p Policy) checkRule(rule policyRule) []PolicyViolation {
+	var out []PolicyViolation
+	add := func(constraint, format string, a ...interface{}) {
+		out = append(out, PolicyViolation{
+			Constraint: constraint,
+			Resource:   rule.resource,
+			Message:    fmt.Sprintf(format, a...),
+		})
+	}
+
+	if rule.cidr != "" {
+		_, n, err := net.ParseCIDR(rule.cidr)
+		if err == nil {
+			ones, _ := n.Mask.Size()
+			min := p.MinIPv4PrefixLength
+			if n.IP.To4() == nil {
+				min = p.MinIPv6PrefixLength
+			}
+			if ones < min {
+				add(PolicyCIDRSize, "CIDR block %s is larger than the maximum of a /%d", rule.cidr, min)
+			}
+		}
+	}
+
+	protocol, err := NormalizeProtocol(rule.protocol)
+	if err != nil {
+		return out
+	}
+
+	if len(p.AllowedProtocols) > 0 {
+		allowed := false
+		for _, v := range p.AllowedProtocols {
+			if np, err := NormalizeProtocol(v); err == nil && np == protocol {
+				allowed = true
+			}
+		}
+		if allowed == false {
+			add(PolicyProtocol, "protocol %s is not allowed", protocol)
+		}
+	}
+
+	if len(p.AllowedPorts) > 0 && protocolUsesPorts(protocol) == true {
+		allowed := false
+		for _, v := range p.AllowedPorts {
+			if portRangeCovers(v.Start, v.End, rule.startPort, rule.endPort) == true {
+				allowed = true
+			}
+		}
+		if allowed == false {
+			add(PolicyPort, "ports %d-%d are not allowed", rule.startPort, rule.endPort)
+		}
+	}
+
+	return out
+}
+
+// needsResource returns true if the policy has constraints that depend on
+// the security group or network ACL a rule is added to.
+func (p Policy) needsResource() bool {
+	return len(p.ForbiddenVPCs) > 0 || len(p.ForbiddenSubnets) > 0 || len(p.RequiredTags) > 0
+}
+
+// checkResource returns the violations of the VPC, subnet, and tag
+// constraints, for a security group or network ACL.
+func (p Policy) checkResource(resource, vpc string, subnets []string, tags []*ec2.Tag) []PolicyViolation {
+	var out []PolicyViolation
+	add := func(constraint, format string, a ...interface{}) {
+		out = append(out, PolicyViolation{
+			Constraint: constraint,
+			Resource:   resource,
+			Message:    fmt.Sprintf(format, a...),
+		})
+	}
+
+	for _, v := range p.ForbiddenVPCs {
+		if v == vpc {
+			add(PolicyVPC, "VPC %s is forbidden", vpc)
+		}
+	}
+
+	for _, v := range p.ForbiddenSubnets {
+		for _, subnet := range subnets {
+			if v == subnet {
+				add(PolicySubnet, "subnet %s is forbidden", subnet)
+			}
+		}
+	}
+
+	for k, want := range p.RequiredTags {
+		found := false
+		for _, tag := range tags {
+			if aws.StringValue(tag.Key) == k && (want == "" || aws.StringValue(tag.Value) == want) {
+				found = true
+			}
+		}
+		if found == true {
+			continue
+		}
+		if want == "" {
+			add(PolicyTag, "required tag %s is missing", k)
+		} else {
+			add(PolicyTag, "required tag %s=%s is missing", k, want)
+		}
+	}
+
+	return out
+}
+
+// policyOrDefault returns the policy to enforce for an options struct: p,
+// or DefaultPolicy if p is nil.
+func policyOrDefault(p *Policy) Policy {
+	if p == nil {
+		return DefaultPolicy
+	}
+	return *p
+}
+
+// enforce returns a PolicyError for a set of violations, unless the policy
+// is overridden, in which case the violations are returned as overridden,
+// along with a nil error.
+func (p Policy) enforce(violations []PolicyViolation) ([]PolicyViolation, error) {
+	if len(violations) < 1 {
+		return nil, nil
+	}
+
+	if p.Override == true {
+		return violations, nil
+	}
+
+	return nil, &PolicyError{Violations: violations}
+}
+
+// logPolicyOverrides logs overridden violations, so that every override
+// leaves a trace, whether or not the caller reports it.
+func logPolicyOverrides(violations []PolicyViolation) {
+	for _, v := range violations {
+		log.Printf("Policy override: %s", v)
+	}
+}
+
+// CheckSecurityGroupRule returns the ways in which a security group rule
+// breaks the policy. group is the security group the rule is added to, and
+// is only used for the VPC and tag constraints; it can be nil if the policy
+// has none.
+func (p Policy) CheckSecurityGroupRule(group *ec2.SecurityGroup, rule SecurityGroupRule) []PolicyViolation {
+	r := policyRule{
+		resource:  rule.GroupID,
+		protocol:  rule.Protocol,
+		startPort: rule.StartPort,
+		endPort:   rule.EndPort,
+	}
+	if rule.Peer.Type == RulePeerIPv4CIDR || rule.Peer.Type == RulePeerIPv6CIDR {
+		r.cidr = rule.Peer.Value
+	}
+
+	out := p.checkRule(r)
+	if group != nil {
+		out = append(out, p.checkResource(rule.GroupID, aws.StringValue(group.VpcId), nil, group.Tags)...)
+	}
+	return out
+}
+
+// CheckNetworkACLRule returns the ways in which a network ACL rule breaks
+// the policy. acl is the network ACL the rule is added to, and is only used
+// for the VPC, subnet, and tag constraints; it can be nil if the policy has
+// none.
+func (p Policy) CheckNetworkACLRule(acl *ec2.NetworkAcl, rule NetworkACLRule) []PolicyViolation {
+	r := policyRule{
+		resource:  rule.NetworkAclID,
+		cidr:      rule.CidrBlock,
+		protocol:  rule.Protocol,
+		startPort: rule.StartPort,
+		endPort:   rule.EndPort,
+	}
+	if r.cidr == "" {
+		r.cidr = rule.Ipv6CidrBlock
+	}
+
+	out := p.checkRule(r)
+	if acl != nil {
+		var subnets []string
+		for _, v := range acl.Associations {
+			subnets = append(subnets, aws.StringValue(v.SubnetId))
+		}
+		out = append(out, p.checkResource(rule.NetworkAclID, aws.StringValue(acl.VpcId), subnets, acl.Tags)...)
+	}
+	return out
+}
@@ -0,0 +1,189 @@
+package aws
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// withTestPolicy replaces DefaultPolicy for the duration of a test.
+func withTestPolicy(t *testing.T, p Policy) {
+	old := DefaultPolicy
+	DefaultPolicy = p
+	t.Cleanup(func() { DefaultPolicy = old })
+}
+
+// violationConstraints returns the constraints of a set of violations.
+func violationConstraints(violations []PolicyViolation) []string {
+	var out []string
+	for _, v := range violations {
+		out = append(out, v.Constraint)
+	}
+	return out
+}
+
+func TestPolicyCheckSecurityGroupRule(t *testing.T) {
+	p := Policy{
+		MinIPv4PrefixLength: 16,
+		MinIPv6PrefixLength: 48,
+		AllowedProtocols:    []string{"tcp", "icmp"},
+		AllowedPorts:        []PortRange{PortRange{Start: 22, End: 22}, PortRange{Start: 443, End: 443}},
+	}
+
+	cases := []struct {
+		rule     SecurityGroupRule
+		expected []string
+	}{
+		{SecurityGroupRule{Peer: IPv4CIDRPeer("10.0.0.0/16"), StartPort: 22, EndPort: 22}, nil},
+		{SecurityGroupRule{Peer: IPv4CIDRPeer("10.0.0.0/8"), StartPort: 22, EndPort: 22}, []string{PolicyCIDRSize}},
+		{SecurityGroupRule{Peer: IPv6CIDRPeer("2001:db8::/32"), StartPort: 443, EndPort: 443}, []string{PolicyCIDRSize}},
+		{SecurityGroupRule{Peer: IPv4CIDRPeer("10.0.1.0/24"), StartPort: 22, EndPort: 443}, []string{PolicyPort}},
+		{SecurityGroupRule{Peer: IPv4CIDRPeer("10.0.1.0/24"), Protocol: "udp", StartPort: 22, EndPort: 22}, []string{PolicyProtocol}},
+		{SecurityGroupRule{Peer: IPv4CIDRPeer("0.0.0.0/0"), Protocol: "all"}, []string{PolicyCIDRSize, PolicyProtocol}},
+		{SecurityGroupRule{Peer: IPv4CIDRPeer("10.0.1.0/24"), Protocol: "icmp", ICMPType: -1, ICMPCode: -1}, nil},
+		{SecurityGroupRule{Peer: SecurityGroupPeer("sg-654321", ""), StartPort: 22, EndPort: 22}, nil},
+	}
+
+	for _, tc := range cases {
+		actual := violationConstraints(p.CheckSecurityGroupRule(nil, tc.rule))
+		if reflect.DeepEqual(tc.expected, actual) == false {
+			t.Fatalf("Expected %v, got %v for %#v", tc.expected, actual, tc.rule)
+		}
+	}
+}
+
+func TestPolicyCheckNetworkACLRule(t *testing.T) {
+	acl := testDescribeNetworkAclsOutput().NetworkAcls[0]
+	acl.Tags = []*ec2.Tag{&ec2.Tag{Key: aws.String("env"), Value: aws.String("staging")}}
+
+	cases := []struct {
+		policy   Policy
+		expected []string
+	}{
+		{Policy{}, nil},
+		{Policy{ForbiddenVPCs: []string{"vpc-123456"}}, []string{PolicyVPC}},
+		{Policy{ForbiddenSubnets: []string{"subnet-123456"}}, []string{PolicySubnet}},
+		{Policy{ForbiddenSubnets: []string{"subnet-654321"}}, nil},
+		{Policy{RequiredTags: map[string]string{"env": ""}}, nil},
+		{Policy{RequiredTags: map[string]string{"env": "staging"}}, nil},
+		{Policy{RequiredTags: map[string]string{"env": "production"}}, []string{PolicyTag}},
+		{Policy{RequiredTags: map[string]string{"owner": ""}}, []string{PolicyTag}},
+	}
+
+	for _, tc := range cases {
+		actual := violationConstraints(tc.policy.CheckNetworkACLRule(acl, testNetworkACLRule()))
+		if reflect.DeepEqual(tc.expected, actual) == false {
+			t.Fatalf("Expected %v, got %v for %#v", tc.expected, actual, tc.policy)
+		}
+	}
+}
+
+func TestCreateSecurityGroupRulePolicy(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	rule := testSecurityGroupRule()
+	rule.Created = false
+	rule.Peer = IPv4CIDRPeer("0.0.0.0/0")
+
+	_, err := CreateSecurityGroupRule(conn, rule)
+	perr, ok := err.(*PolicyError)
+	if ok == false {
+		t.Fatalf("Expected PolicyError, got %v", err)
+	}
+	if len(perr.Violations) != 1 || perr.Violations[0].Constraint != PolicyCIDRSize || perr.Violations[0].Resource != "sg-123456" {
+		t.Fatalf("Unexpected violations %#v", perr.Violations)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls, got %v", calls)
+	}
+}
+
+func TestCreateNetworkACLRulePolicy(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	withTestPolicy(t, Policy{ForbiddenSubnets: []string{"subnet-123456"}})
+
+	rule := testNetworkACLRule()
+	rule.Created = false
+	rule.RuleNumber = 0
+	rule.CidrBlock = "10.0.9.0/24"
+
+	_, err := CreateNetworkACLRule(conn, rule)
+	if _, ok := err.(*PolicyError); ok == false {
+		t.Fatalf("Expected PolicyError, got %v", err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls, got %v", calls)
+	}
+
+	// Overriding the policy logs the violation and creates the rule.
+	DefaultPolicy.Override = true
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	out, err := CreateNetworkACLRule(conn, rule)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if out.Created == false || len(calls) != 1 {
+		t.Fatalf("Expected rule to be created, got %#v (calls %v)", out, calls)
+	}
+	if strings.Contains(buf.String(), "Policy override: nacl-123456: subnet subnet-123456 is forbidden") == false {
+		t.Fatalf("Expected override to be logged, got %q", buf.String())
+	}
+}
+
+func TestApplyRuleSetPolicy(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	set := testRuleSet()
+	set.SecurityGroupRules[1].Peer = IPv4CIDRPeer("0.0.0.0/0")
+
+	_, result, err := ApplyRuleSet(conn, set)
+	if _, ok := err.(*PolicyError); ok == false {
+		t.Fatalf("Expected PolicyError, got %v", err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls, got %v", calls)
+	}
+	if result.Outcomes[1].Status != RuleFailed {
+		t.Fatalf("Expected %v, got %v", RuleFailed, result.Outcomes[1].Status)
+	}
+}
+
+func TestApplyRuleSetPolicyOverride(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	// The set's policy is used instead of DefaultPolicy.
+	set := testRuleSet()
+	set.Policy = &Policy{ForbiddenSubnets: []string{"subnet-123456"}}
+
+	_, _, err := ApplyRuleSet(conn, set)
+	if _, ok := err.(*PolicyError); ok == false {
+		t.Fatalf("Expected PolicyError, got %v", err)
+	}
+
+	calls = nil
+	set.Policy.Override = true
+	_, result, err := ApplyRuleSet(conn, set)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if len(calls) != 2 {
+		t.Fatalf("Expected the rules to be created, got %v", calls)
+	}
+	if len(result.PolicyOverrides) != 1 || result.PolicyOverrides[0].Constraint != PolicySubnet {
+		t.Fatalf("Expected the subnet violation to be returned, got %#v", result.PolicyOverrides)
+	}
+}
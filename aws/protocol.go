@@ -0,0 +1,79 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The protocols that security group and network ACL rules can apply to.
+const (
+	// ProtocolTCP is TCP. This is the default when no protocol is supplied.
+	ProtocolTCP = "tcp"
+
+	// ProtocolUDP is UDP.
+	ProtocolUDP = "udp"
+
+	// ProtocolICMP is ICMP. Rules for ICMP match on type and code rather than
+	// port.
+	ProtocolICMP = "icmp"
+
+	// ProtocolICMPv6 is ICMPv6. Rules for ICMPv6 match on type and code
+	// rather than port.
+	ProtocolICMPv6 = "icmpv6"
+
+	// ProtocolAll is all protocols, on all ports.
+	ProtocolAll = "all"
+)
+
+// protocolNumbers maps protocol names to their IANA protocol numbers, as
+// used by network ACL entries. All protocols is represented as "-1".
+var protocolNumbers = map[string]string{
+	ProtocolTCP:    "6",
+	ProtocolUDP:    "17",
+	ProtocolICMP:   "1",
+	ProtocolICMPv6: "58",
+	ProtocolAll:    "-1",
+}
+
+// NormalizeProtocol returns the canonical name for a protocol, accepting
+// names in any case, and IANA protocol numbers as returned by the EC2 API.
+// An empty protocol is treated as TCP.
+func NormalizeProtocol(protocol string) (string, error) {
+	p := strings.ToLower(protocol)
+	if p == "" {
+		return ProtocolTCP, nil
+	}
+
+	if _, ok := protocolNumbers[p]; ok {
+		return p, nil
+	}
+
+	for name, number := range protocolNumbers {
+		if p == number {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("Unsupported protocol %q. Supported protocols are tcp, udp, icmp, icmpv6, and all.", protocol)
+}
+
+// protocolUsesPorts returns true if rules for a (normalized) protocol match on
+// port ranges.
+func protocolUsesPorts(protocol string) bool {
+	return protocol == ProtocolTCP || protocol == ProtocolUDP
+}
+
+// protocolUsesICMP returns true if rules for a (normalized) protocol match on
+// ICMP type and code.
+func protocolUsesICMP(protocol string) bool {
+	return protocol == ProtocolICMP || protocol == ProtocolICMPv6
+}
+
+// securityGroupProtocol returns the IpProtocol value for a security group
+// permission for a (normalized) protocol.
+func securityGroupProtocol(protocol string) string {
+	if protocol == ProtocolAll {
+		return "-1"
+	}
+	return protocol
+}
@@ -0,0 +1,39 @@
+package aws
+
+import (
+	"testing"
+)
+
+func TestNormalizeProtocol(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected string
+	}{
+		{in: "", expected: ProtocolTCP},
+		{in: "TCP", expected: ProtocolTCP},
+		{in: "6", expected: ProtocolTCP},
+		{in: "udp", expected: ProtocolUDP},
+		{in: "17", expected: ProtocolUDP},
+		{in: "icmp", expected: ProtocolICMP},
+		{in: "1", expected: ProtocolICMP},
+		{in: "ICMPv6", expected: ProtocolICMPv6},
+		{in: "58", expected: ProtocolICMPv6},
+		{in: "all", expected: ProtocolAll},
+		{in: "-1", expected: ProtocolAll},
+	}
+
+	for _, c := range cases {
+		actual, err := NormalizeProtocol(c.in)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if c.expected != actual {
+			t.Fatalf("Expected %v for %q, got %v", c.expected, c.in, actual)
+		}
+	}
+
+	_, err := NormalizeProtocol("gre")
+	if err == nil {
+		t.Fatalf("Expected error for unsupported protocol")
+	}
+}
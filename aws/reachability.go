@@ -0,0 +1,534 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// defaultNetworkACLRuleNumber is the rule number of the catch-all deny entry
+// that ends every network ACL.
+const defaultNetworkACLRuleNumber = 32767
+
+// HostSnapshot is the network configuration of one end of a path, as
+// fetched from EC2.
+type HostSnapshot struct {
+	_ struct{}
+
+	// The ID of the instance.
+	InstanceID string `json:"instance_id"`
+
+	// The private IP address of the instance.
+	Address string `json:"address"`
+
+	// The public IPv4 address of the instance, which is its Elastic IP
+	// address if it has one.
+	PublicAddress string `json:"public_address,omitempty"`
+
+	// The IPv6 addresses of the instance.
+	IPv6Addresses []string `json:"ipv6_addresses,omitempty"`
+
+	// The subnet the instance is in.
+	SubnetID string `json:"subnet_id"`
+
+	// The security groups of the instance.
+	SecurityGroups []*ec2.SecurityGroup `json:"security_groups"`
+
+	// The network ACL in effect for the subnet.
+	NetworkACL *ec2.NetworkAcl `json:"network_acl"`
+
+	// The route table in effect for the subnet.
+	RouteTable *ec2.RouteTable `json:"route_table"`
+}
+
+// PathSnapshot is everything needed to evaluate the path from a client,
+// through the bastion host, to a private target.
+type PathSnapshot struct {
+	_ struct{}
+
+	// The network range of the client, in CIDR notation.
+	ClientCIDR string `json:"client_cidr"`
+
+	// The ephemeral port range of the client, that return traffic goes to.
+	ClientEphemeral EphemeralPortRange `json:"client_ephemeral"`
+
+	// The ephemeral port range of the bastion host, that return traffic from
+	// the target goes to. Defaults to EphemeralPortsLinux, as bastion hosts
+	// are launched from Amazon Linux.
+	BastionEphemeral EphemeralPortRange `json:"bastion_ephemeral"`
+
+	// The port on the target that is being connected to.
+	Port int `json:"port"`
+
+	// The bastion host.
+	Bastion HostSnapshot `json:"bastion"`
+
+	// The target.
+	Target HostSnapshot `json:"target"`
+}
+
+// HopResult is the verdict for a single hop along a path.
+type HopResult struct {
+	_ struct{}
+
+	// The name of the hop (for example, "client -> bastion: security group
+	// ingress").
+	Hop string `json:"hop"`
+
+	// true if the hop lets the traffic through.
+	Allowed bool `json:"allowed"`
+
+	// The rule that decided the verdict, if there is one.
+	Rule string `json:"rule,omitempty"`
+
+	// Why the hop was decided the way it was.
+	Detail string `json:"detail"`
+}
+
+// ReachabilityReport is the result of evaluating a path.
+type ReachabilityReport struct {
+	_ struct{}
+
+	// The hops along the path, in the order the traffic crosses them.
+	Hops []HopResult `json:"hops"`
+
+	// true if every hop lets the traffic through.
+	Reachable bool `json:"reachable"`
+}
+
+// String renders the report as a human-readable table, followed by the
+// verdict.
+func (r ReachabilityReport) String() string {
+	var lines []string
+	for _, v := range r.Hops {
+		status := "allow"
+		if v.Allowed == false {
+			status = "BLOCK"
+		}
+		line := fmt.Sprintf("%-5s %-50s %s", status, v.Hop, v.Detail)
+		if v.Rule != "" {
+			line += " [" + v.Rule + "]"
+		}
+		lines = append(lines, line)
+	}
+
+	if r.Reachable == true {
+		lines = append(lines, "Verdict: reachable.")
+	} else {
+		lines = append(lines, "Verdict: NOT reachable.")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hostCIDR returns the single address network range for an IP address.
+func hostCIDR(ip string) string {
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+// cidrNetworkACLRule returns a network ACL rule for TCP traffic to or from a
+// CIDR block, using the field that matches its address family.
+func cidrNetworkACLRule(acl, cidr string, egress bool, start, end int) NetworkACLRule {
+	rule := NetworkACLRule{
+		NetworkAclID: acl,
+		Egress:       egress,
+		StartPort:    start,
+		EndPort:      end,
+	}
+	return withClientCIDR(rule, cidr)
+}
+
+// evaluateNetworkACLHop returns the verdict of a network ACL for a single
+// hop.
+func evaluateNetworkACLHop(hop string, acl *ec2.NetworkAcl, cidr string, egress bool, start, end int) HopResult {
+	result := HopResult{Hop: hop}
+	if acl == nil {
+		result.Detail = "no network ACL found"
+		return result
+	}
+
+	id := aws.StringValue(acl.NetworkAclId)
+	eval, err := EvaluateNetworkACL(acl, cidrNetworkACLRule(id, cidr, egress, start, end))
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+
+	if eval.Matched == false {
+		result.Detail = fmt.Sprintf("no entry applies to %s on ports %d-%d", cidr, start, end)
+		return result
+	}
+
+	number := fmt.Sprintf("%d", eval.RuleNumber)
+	if eval.RuleNumber == defaultNetworkACLRuleNumber {
+		number = "*"
+	}
+	result.Rule = fmt.Sprintf("%s #%s %s", id, number, eval.Action)
+	result.Allowed = eval.Allowed()
+
+	switch {
+	case result.Allowed == true:
+		result.Detail = fmt.Sprintf("%s on ports %d-%d is allowed", cidr, start, end)
+	case eval.Covered == false:
+		result.Detail = fmt.Sprintf("the first matching entry only applies to part of %s on ports %d-%d", cidr, start, end)
+	default:
+		result.Detail = fmt.Sprintf("%s on ports %d-%d is denied", cidr, start, end)
+	}
+	return result
+}
+
+// describePermission returns a short description of a security group
+// permission.
+func describePermission(group string, perm *ec2.IpPermission) string {
+	protocol, err := NormalizeProtocol(aws.StringValue(perm.IpProtocol))
+	if err != nil {
+		protocol = aws.StringValue(perm.IpProtocol)
+	}
+
+	var peers []string
+	for _, v := range perm.IpRanges {
+		peers = append(peers, aws.StringValue(v.CidrIp))
+	}
+	for _, v := range perm.Ipv6Ranges {
+		peers = append(peers, aws.StringValue(v.CidrIpv6))
+	}
+	for _, v := range perm.UserIdGroupPairs {
+		peers = append(peers, aws.StringValue(v.GroupId))
+	}
+	for _, v := range perm.PrefixListIds {
+		peers = append(peers, aws.StringValue(v.PrefixListId))
+	}
+
+	ports := ""
+	if protocolUsesPorts(protocol) == true {
+		ports = fmt.Sprintf(" %d-%d", aws.Int64Value(perm.FromPort), aws.Int64Value(perm.ToPort))
+	}
+	return fmt.Sprintf("%s %s%s %s", group, protocol, ports, strings.Join(peers, ","))
+}
+
+// evaluateSecurityGroupHop returns the verdict of a set of security groups
+// for a single hop. The traffic is allowed if any permission of any group
+// covers it for any of the peers, as security group rules are permissive
+// and the traffic matches each of the peers (for example, an address and
+// the groups of the instance it belongs to).
+func evaluateSecurityGroupHop(hop string, groups []*ec2.SecurityGroup, egress bool, peers []RulePeer, port int) HopResult {
+	result := HopResult{Hop: hop}
+	if len(groups) < 1 {
+		result.Detail = "no security groups found"
+		return result
+	}
+
+	var names []string
+	for _, g := range groups {
+		id := aws.StringValue(g.GroupId)
+		names = append(names, id)
+		for _, perm := range securityGroupPermissions(g, egress) {
+			for _, peer := range peers {
+				rule := SecurityGroupRule{Peer: peer, StartPort: port, EndPort: port}
+				if permissionCoversPeer(perm, peer) && permissionCoversTraffic(perm, rule) {
+					result.Allowed = true
+					result.Rule = describePermission(id, perm)
+					result.Detail = fmt.Sprintf("%s on port %d is allowed", peer, port)
+					return result
+				}
+			}
+		}
+	}
+
+	result.Detail = fmt.Sprintf("no rule in %s allows %s on port %d", strings.Join(names, ", "), peers[0], port)
+	return result
+}
+
+// routeFor returns the most specific route in a table that covers a CIDR
+// block, or nil if there is none.
+func routeFor(table *ec2.RouteTable, cidr string) *ec2.Route {
+	var best *ec2.Route
+	bestLen := -1
+	for _, r := range table.Routes {
+		dest := aws.StringValue(r.DestinationCidrBlock)
+		if dest == "" {
+			dest = aws.StringValue(r.DestinationIpv6CidrBlock)
+		}
+		if cidrCovers(dest, cidr) == false {
+			continue
+		}
+		_, n, _ := net.ParseCIDR(dest)
+		if ones, _ := n.Mask.Size(); ones > bestLen {
+			best, bestLen = r, ones
+		}
+	}
+	return best
+}
+
+// routeTarget returns the ID of the target of a route.
+func routeTarget(r *ec2.Route) string {
+	for _, v := range []*string{
+		r.GatewayId, r.NatGatewayId, r.TransitGatewayId, r.VpcPeeringConnectionId,
+		r.NetworkInterfaceId, r.InstanceId, r.EgressOnlyInternetGatewayId, r.LocalGatewayId,
+	} {
+		if aws.StringValue(v) != "" {
+			return aws.StringValue(v)
+		}
+	}
+	return "unknown"
+}
+
+// evaluateRouteHop returns the verdict of a route table for a single hop.
+// If internet is true, the route must go to an internet gateway.
+func evaluateRouteHop(hop string, table *ec2.RouteTable, cidr string, internet bool) HopResult {
+	result := HopResult{Hop: hop}
+	if table == nil {
+		result.Detail = "no route table found"
+		return result
+	}
+
+	r := routeFor(table, cidr)
+	if r == nil {
+		result.Detail = fmt.Sprintf("no route to %s", cidr)
+		return result
+	}
+
+	target := routeTarget(r)
+	dest := aws.StringValue(r.DestinationCidrBlock) + aws.StringValue(r.DestinationIpv6CidrBlock)
+	result.Rule = fmt.Sprintf("%s %s -> %s", aws.StringValue(table.RouteTableId), dest, target)
+
+	switch {
+	case aws.StringValue(r.State) == ec2.RouteStateBlackhole:
+		result.Detail = fmt.Sprintf("the route to %s is a blackhole", cidr)
+	case internet == true && strings.HasPrefix(target, internetGatewayPrefix) == false:
+		result.Detail = fmt.Sprintf("%s is not routed through an internet gateway", cidr)
+	default:
+		result.Allowed = true
+		result.Detail = fmt.Sprintf("%s is routed to %s", cidr, target)
+	}
+	return result
+}
+
+// evaluatePublicAddressHop returns whether a host has a public address that a
+// client in a CIDR block can connect to: an IPv6 address for an IPv6 client,
+// or a public IPv4 address otherwise.
+func evaluatePublicAddressHop(hop string, host HostSnapshot, cidr string) HopResult {
+	result := HopResult{Hop: hop}
+	if clientPeer(cidr).Type == RulePeerIPv6CIDR {
+		if len(host.IPv6Addresses) < 1 {
+			result.Detail = fmt.Sprintf("%s has no IPv6 address", host.InstanceID)
+			return result
+		}
+		result.Allowed = true
+		result.Detail = fmt.Sprintf("%s has IPv6 address %s", host.InstanceID, host.IPv6Addresses[0])
+		return result
+	}
+
+	if host.PublicAddress == "" {
+		result.Detail = fmt.Sprintf("%s has no public IPv4 or Elastic IP address", host.InstanceID)
+		return result
+	}
+	result.Allowed = true
+	result.Detail = fmt.Sprintf("%s has public address %s", host.InstanceID, host.PublicAddress)
+	return result
+}
+
+// groupPeers returns security group peers for a set of security groups.
+func groupPeers(groups []*ec2.SecurityGroup) []RulePeer {
+	var out []RulePeer
+	for _, g := range groups {
+		out = append(out, SecurityGroupPeer(aws.StringValue(g.GroupId), ""))
+	}
+	return out
+}
+
+// EvaluatePath evaluates a path snapshot hop by hop: from the client to the
+// bastion host, from the bastion host to the target, and the return traffic
+// for both. The bastion host must also have a public address for the client
+// to connect to. Every hop is evaluated, even after one blocks the traffic, so
+// that all problems are reported at once.
+//
+// Network ACLs are not evaluated for traffic between the bastion host and
+// the target if they are in the same subnet, as network ACLs only apply to
+// traffic crossing the subnet boundary.
+func EvaluatePath(p PathSnapshot) ReachabilityReport {
+	var r ReachabilityReport
+
+	client := p.ClientCIDR
+	bastion := hostCIDR(p.Bastion.Address)
+	target := hostCIDR(p.Target.Address)
+	ephemeral := p.ClientEphemeral
+	if ephemeral.Start == 0 && ephemeral.End == 0 {
+		ephemeral = EphemeralPortsAny
+	}
+	bastionEphemeral := p.BastionEphemeral
+	if bastionEphemeral.Start == 0 && bastionEphemeral.End == 0 {
+		bastionEphemeral = EphemeralPortsLinux
+	}
+	sameSubnet := p.Bastion.SubnetID == p.Target.SubnetID
+
+	add := func(result HopResult) {
+		r.Hops = append(r.Hops, result)
+	}
+	skip := func(hop string) {
+		add(HopResult{Hop: hop, Allowed: true, Detail: "same subnet, network ACLs do not apply"})
+	}
+
+	// Client to bastion host, and back.
+	add(evaluatePublicAddressHop("client -> bastion: public address", p.Bastion, client))
+	add(evaluateRouteHop("client -> bastion: route", p.Bastion.RouteTable, client, true))
+	add(evaluateNetworkACLHop("client -> bastion: network ACL ingress", p.Bastion.NetworkACL, client, false, sshPort, sshPort))
+	add(evaluateSecurityGroupHop("client -> bastion: security group ingress", p.Bastion.SecurityGroups, false, []RulePeer{clientPeer(client)}, sshPort))
+	add(evaluateNetworkACLHop("bastion -> client: network ACL egress", p.Bastion.NetworkACL, client, true, ephemeral.Start, ephemeral.End))
+
+	// Bastion host to target, and back.
+	targetPeers := append([]RulePeer{clientPeer(target)}, groupPeers(p.Target.SecurityGroups)...)
+	bastionPeers := append([]RulePeer{clientPeer(bastion)}, groupPeers(p.Bastion.SecurityGroups)...)
+
+	add(evaluateSecurityGroupHop("bastion -> target: security group egress", p.Bastion.SecurityGroups, true, targetPeers, p.Port))
+	add(evaluateRouteHop("bastion -> target: route", p.Bastion.RouteTable, target, false))
+	if sameSubnet == true {
+		skip("bastion -> target: network ACL egress")
+		skip("bastion -> target: network ACL ingress")
+	} else {
+		add(evaluateNetworkACLHop("bastion -> target: network ACL egress", p.Bastion.NetworkACL, target, true, p.Port, p.Port))
+		add(evaluateNetworkACLHop("bastion -> target: network ACL ingress", p.Target.NetworkACL, bastion, false, p.Port, p.Port))
+	}
+	add(evaluateSecurityGroupHop("bastion -> target: security group ingress", p.Target.SecurityGroups, false, bastionPeers, p.Port))
+	add(evaluateRouteHop("target -> bastion: route", p.Target.RouteTable, bastion, false))
+	if sameSubnet == true {
+		skip("target -> bastion: network ACL egress")
+		skip("target -> bastion: network ACL ingress")
+	} else {
+		add(evaluateNetworkACLHop("target -> bastion: network ACL egress", p.Target.NetworkACL, bastion, true, bastionEphemeral.Start, bastionEphemeral.End))
+		add(evaluateNetworkACLHop("target -> bastion: network ACL ingress", p.Bastion.NetworkACL, target, false, bastionEphemeral.Start, bastionEphemeral.End))
+	}
+
+	r.Reachable = true
+	for _, v := range r.Hops {
+		if v.Allowed == false {
+			r.Reachable = false
+		}
+	}
+	return r
+}
+
+// ExplainQuery describes the path to explain.
+type ExplainQuery struct {
+	_ struct{}
+
+	// The network range of the client, in CIDR notation.
+	ClientCIDR string
+
+	// The operating system of the client, used to choose the ephemeral port
+	// range that return traffic goes to: linux, windows, or macos. If this
+	// is empty, all ephemeral ports are assumed.
+	ClientOS string
+
+	// The ID of the bastion host instance.
+	BastionInstanceID string
+
+	// The ID of the target instance.
+	TargetInstanceID string
+
+	// The port on the target to connect to. Defaults to 22.
+	Port int
+}
+
+// fetchHostSnapshot fetches the network configuration of an instance.
+func fetchHostSnapshot(conn *ec2.EC2, instanceID string) (HostSnapshot, error) {
+	host := HostSnapshot{InstanceID: instanceID}
+
+	resp, err := conn.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	})
+	if err != nil {
+		return host, err
+	}
+	if len(resp.Reservations) < 1 || len(resp.Reservations[0].Instances) < 1 {
+		return host, fmt.Errorf("Instance %s not found.", instanceID)
+	}
+	i := resp.Reservations[0].Instances[0]
+	if i.SubnetId == nil || i.VpcId == nil {
+		return host, fmt.Errorf("Instance %s is not in a VPC.", instanceID)
+	}
+	host.SubnetID = *i.SubnetId
+	host.Address = aws.StringValue(i.PrivateIpAddress)
+	host.PublicAddress = aws.StringValue(i.PublicIpAddress)
+	for _, n := range i.NetworkInterfaces {
+		for _, v := range n.Ipv6Addresses {
+			host.IPv6Addresses = append(host.IPv6Addresses, aws.StringValue(v.Ipv6Address))
+		}
+	}
+
+	for _, g := range i.SecurityGroups {
+		sg, err := describeSecurityGroup(conn, aws.StringValue(g.GroupId))
+		if err != nil {
+			return host, err
+		}
+		host.SecurityGroups = append(host.SecurityGroups, sg)
+	}
+
+	acl, err := FindNetworkACLForSubnet(conn, host.SubnetID)
+	if err != nil {
+		return host, err
+	}
+	host.NetworkACL, err = describeNetworkACL(conn, acl)
+	if err != nil {
+		return host, err
+	}
+
+	tables, err := describeRouteTables(conn, *i.VpcId)
+	if err != nil {
+		return host, err
+	}
+	host.RouteTable = effectiveRouteTable(tables, host.SubnetID)
+
+	return host, nil
+}
+
+// FetchPathSnapshot fetches the security groups, network ACLs, and route
+// tables along the path described by a query. Nothing is created or
+// changed.
+func FetchPathSnapshot(conn *ec2.EC2, q ExplainQuery) (PathSnapshot, error) {
+	p := PathSnapshot{Port: q.Port}
+	if p.Port == 0 {
+		p.Port = sshPort
+	}
+
+	var err error
+	p.ClientCIDR, err = normalizeCIDR(q.ClientCIDR)
+	if err != nil {
+		return p, err
+	}
+
+	p.ClientEphemeral, err = EphemeralPortsForOS(q.ClientOS)
+	if err != nil {
+		return p, err
+	}
+
+	p.BastionEphemeral = EphemeralPortsLinux
+
+	p.Bastion, err = fetchHostSnapshot(conn, q.BastionInstanceID)
+	if err != nil {
+		return p, err
+	}
+
+	p.Target, err = fetchHostSnapshot(conn, q.TargetInstanceID)
+	if err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// Explain fetches the path described by a query and evaluates it, without
+// launching or changing anything. See EvaluatePath.
+func Explain(conn *ec2.EC2, q ExplainQuery) (ReachabilityReport, error) {
+	p, err := FetchPathSnapshot(conn, q)
+	if err != nil {
+		return ReachabilityReport{}, err
+	}
+
+	return EvaluatePath(p), nil
+}
@@ -0,0 +1,273 @@
+package aws
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testReachabilityACL provides a network ACL with the supplied entries,
+// followed by the catch-all deny entries.
+func testReachabilityACL(id string, entries ...*ec2.NetworkAclEntry) *ec2.NetworkAcl {
+	for _, egress := range []bool{false, true} {
+		entries = append(entries, &ec2.NetworkAclEntry{
+			CidrBlock:  aws.String("0.0.0.0/0"),
+			Egress:     aws.Bool(egress),
+			Protocol:   aws.String("-1"),
+			RuleAction: aws.String("deny"),
+			RuleNumber: aws.Int64(32767),
+		})
+	}
+	return &ec2.NetworkAcl{NetworkAclId: aws.String(id), Entries: entries}
+}
+
+// testReachabilityEntry provides a TCP network ACL entry.
+func testReachabilityEntry(n int64, egress bool, cidr string, from, to int64) *ec2.NetworkAclEntry {
+	return &ec2.NetworkAclEntry{
+		CidrBlock:  aws.String(cidr),
+		Egress:     aws.Bool(egress),
+		PortRange:  &ec2.PortRange{From: aws.Int64(from), To: aws.Int64(to)},
+		Protocol:   aws.String("6"),
+		RuleAction: aws.String("allow"),
+		RuleNumber: aws.Int64(n),
+	}
+}
+
+// testPathSnapshot provides a path where the client at 203.0.113.0/24 can
+// reach the target at 10.0.2.10 on port 22 through the bastion host at
+// 10.0.1.10.
+func testPathSnapshot() PathSnapshot {
+	allEgress := &ec2.IpPermission{
+		IpProtocol: aws.String("-1"),
+		IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("0.0.0.0/0")}},
+	}
+
+	return PathSnapshot{
+		ClientCIDR: "203.0.113.0/24",
+		Port:       22,
+		Bastion: HostSnapshot{
+			InstanceID:    "i-bastion",
+			Address:       "10.0.1.10",
+			PublicAddress: "198.51.100.10",
+			SubnetID:      "subnet-public",
+			SecurityGroups: []*ec2.SecurityGroup{
+				&ec2.SecurityGroup{
+					GroupId: aws.String("sg-bastion"),
+					IpPermissions: []*ec2.IpPermission{
+						&ec2.IpPermission{
+							FromPort:   aws.Int64(22),
+							IpProtocol: aws.String("tcp"),
+							IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("203.0.113.0/24")}},
+							ToPort:     aws.Int64(22),
+						},
+					},
+					IpPermissionsEgress: []*ec2.IpPermission{allEgress},
+				},
+			},
+			NetworkACL: testReachabilityACL("nacl-public",
+				&ec2.NetworkAclEntry{
+					CidrBlock:  aws.String("0.0.0.0/0"),
+					Egress:     aws.Bool(false),
+					Protocol:   aws.String("-1"),
+					RuleAction: aws.String("allow"),
+					RuleNumber: aws.Int64(100),
+				},
+				&ec2.NetworkAclEntry{
+					CidrBlock:  aws.String("0.0.0.0/0"),
+					Egress:     aws.Bool(true),
+					Protocol:   aws.String("-1"),
+					RuleAction: aws.String("allow"),
+					RuleNumber: aws.Int64(100),
+				},
+			),
+			RouteTable: &ec2.RouteTable{
+				RouteTableId: aws.String("rtb-public"),
+				Routes: []*ec2.Route{
+					&ec2.Route{DestinationCidrBlock: aws.String("10.0.0.0/16"), GatewayId: aws.String("local"), State: aws.String("active")},
+					&ec2.Route{DestinationCidrBlock: aws.String("0.0.0.0/0"), GatewayId: aws.String("igw-123456"), State: aws.String("active")},
+				},
+			},
+		},
+		Target: HostSnapshot{
+			InstanceID: "i-target",
+			Address:    "10.0.2.10",
+			SubnetID:   "subnet-private",
+			SecurityGroups: []*ec2.SecurityGroup{
+				&ec2.SecurityGroup{
+					GroupId: aws.String("sg-target"),
+					IpPermissions: []*ec2.IpPermission{
+						&ec2.IpPermission{
+							FromPort:         aws.Int64(22),
+							IpProtocol:       aws.String("tcp"),
+							ToPort:           aws.Int64(22),
+							UserIdGroupPairs: []*ec2.UserIdGroupPair{&ec2.UserIdGroupPair{GroupId: aws.String("sg-bastion")}},
+						},
+					},
+					IpPermissionsEgress: []*ec2.IpPermission{allEgress},
+				},
+			},
+			NetworkACL: testReachabilityACL("nacl-private",
+				testReachabilityEntry(100, false, "10.0.0.0/16", 22, 22),
+				testReachabilityEntry(100, true, "10.0.0.0/16", 1024, 65535),
+			),
+			RouteTable: &ec2.RouteTable{
+				RouteTableId: aws.String("rtb-private"),
+				Routes: []*ec2.Route{
+					&ec2.Route{DestinationCidrBlock: aws.String("10.0.0.0/16"), GatewayId: aws.String("local"), State: aws.String("active")},
+				},
+			},
+		},
+	}
+}
+
+// blockedHops returns the names of the hops in a report that block the
+// traffic.
+func blockedHops(r ReachabilityReport) []string {
+	var out []string
+	for _, v := range r.Hops {
+		if v.Allowed == false {
+			out = append(out, v.Hop)
+		}
+	}
+	return out
+}
+
+func TestEvaluatePath(t *testing.T) {
+	r := EvaluatePath(testPathSnapshot())
+	if r.Reachable == false {
+		t.Fatalf("Expected path to be reachable, got:\n%s", r)
+	}
+	if len(r.Hops) != 13 {
+		t.Fatalf("Expected %v, got %v", 13, len(r.Hops))
+	}
+
+	expected := "sg-target tcp 22-22 sg-bastion"
+	actual := r.Hops[9].Rule
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	if strings.HasSuffix(r.String(), "Verdict: reachable.") == false {
+		t.Fatalf("Unexpected report:\n%s", r)
+	}
+}
+
+func TestEvaluatePathBlocked(t *testing.T) {
+	cases := map[string]func(p *PathSnapshot){
+		"client -> bastion: security group ingress": func(p *PathSnapshot) {
+			p.ClientCIDR = "198.51.100.0/24"
+		},
+		"client -> bastion: public address": func(p *PathSnapshot) {
+			p.Bastion.PublicAddress = ""
+		},
+		"client -> bastion: route": func(p *PathSnapshot) {
+			p.Bastion.RouteTable.Routes = p.Bastion.RouteTable.Routes[:1]
+		},
+		"bastion -> target: security group ingress": func(p *PathSnapshot) {
+			p.Target.SecurityGroups[0].IpPermissions = nil
+		},
+		"target -> bastion: network ACL egress": func(p *PathSnapshot) {
+			p.Target.NetworkACL.Entries[1].PortRange.From = aws.Int64(40000)
+		},
+		"bastion -> target: route": func(p *PathSnapshot) {
+			p.Bastion.RouteTable.Routes[0].State = aws.String("blackhole")
+		},
+	}
+
+	for hop, f := range cases {
+		p := testPathSnapshot()
+		f(&p)
+		r := EvaluatePath(p)
+		if r.Reachable == true {
+			t.Fatalf("Expected %s to block the path", hop)
+		}
+		if blocked := blockedHops(r); len(blocked) != 1 || blocked[0] != hop {
+			t.Fatalf("Expected only %v to block, got %v", hop, blocked)
+		}
+	}
+}
+
+func TestEvaluatePathBastionEphemeral(t *testing.T) {
+	// Only the Linux ephemeral range is allowed back to the bastion host.
+	p := testPathSnapshot()
+	p.Target.NetworkACL.Entries[1].PortRange = &ec2.PortRange{From: aws.Int64(32768), To: aws.Int64(60999)}
+
+	r := EvaluatePath(p)
+	if r.Reachable == false {
+		t.Fatalf("Expected path to be reachable, got:\n%s", r)
+	}
+
+	// A bastion host with a wider range is blocked.
+	p.BastionEphemeral = EphemeralPortsAny
+	r = EvaluatePath(p)
+	if blocked := blockedHops(r); len(blocked) != 1 || blocked[0] != "target -> bastion: network ACL egress" {
+		t.Fatalf("Expected only the target egress hop to block, got %v", blocked)
+	}
+}
+
+func TestEvaluatePathNetworkACLRule(t *testing.T) {
+	p := testPathSnapshot()
+	p.Target.NetworkACL.Entries[0].CidrBlock = aws.String("10.0.9.0/24")
+
+	r := EvaluatePath(p)
+	var hop HopResult
+	for _, v := range r.Hops {
+		if v.Hop == "bastion -> target: network ACL ingress" {
+			hop = v
+		}
+	}
+
+	expected := "nacl-private #* deny"
+	if hop.Allowed == true || hop.Rule != expected {
+		t.Fatalf("Expected %v, got %#v", expected, hop)
+	}
+}
+
+func TestEvaluatePathSameSubnet(t *testing.T) {
+	p := testPathSnapshot()
+	p.Target.SubnetID = p.Bastion.SubnetID
+	p.Target.NetworkACL = nil
+
+	r := EvaluatePath(p)
+	if r.Reachable == false {
+		t.Fatalf("Expected path to be reachable, got:\n%s", r)
+	}
+}
+
+func TestEvaluatePublicAddressHop(t *testing.T) {
+	host := HostSnapshot{InstanceID: "i-bastion", PublicAddress: "198.51.100.10"}
+
+	// An IPv6 client needs an IPv6 address, even if there is a public IPv4
+	// address.
+	hop := evaluatePublicAddressHop("client -> bastion: public address", host, "2001:db8::/64")
+	if hop.Allowed == true {
+		t.Fatalf("Expected the hop to block, got %#v", hop)
+	}
+
+	host.IPv6Addresses = []string{"2001:db8:1::10"}
+	hop = evaluatePublicAddressHop("client -> bastion: public address", host, "2001:db8::/64")
+	if hop.Allowed == false {
+		t.Fatalf("Expected the hop to be allowed, got %#v", hop)
+	}
+}
+
+func TestRouteFor(t *testing.T) {
+	table := testPathSnapshot().Bastion.RouteTable
+
+	cases := map[string]string{
+		"10.0.2.10/32":   "local",
+		"203.0.113.0/24": "igw-123456",
+	}
+	for cidr, expected := range cases {
+		actual := routeTarget(routeFor(table, cidr))
+		if expected != actual {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+	}
+
+	if routeFor(table, "2001:db8::/64") != nil {
+		t.Fatalf("Expected no route")
+	}
+}
@@ -0,0 +1,546 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ReconcileStatus is the kind of difference found between a session and
+// AWS.
+type ReconcileStatus string
+
+const (
+	// ReconcileMissing means a resource in the session no longer exists.
+	ReconcileMissing ReconcileStatus = "missing"
+
+	// ReconcileModified means a resource in the session exists, but no
+	// longer matches what the session recorded.
+	ReconcileModified ReconcileStatus = "modified"
+
+	// ReconcileUnexpected means a rule exists in the session's security
+	// group that the session does not know about.
+	ReconcileUnexpected ReconcileStatus = "unexpected"
+)
+
+// The actions that reconciliation can take for a finding.
+const (
+	// ReconcileRecreated means a missing rule was created again.
+	ReconcileRecreated = "recreated"
+
+	// ReconcileForgotten means a missing resource was marked as no longer
+	// created, so that teardown skips it.
+	ReconcileForgotten = "forgotten"
+)
+
+// ReconcileOptions describes what ReconcileSession should do about the
+// differences it finds. By default, differences are only reported.
+type ReconcileOptions struct {
+	_ struct{}
+
+	// true if missing security group and network ACL rules should be
+	// created again.
+	Recreate bool
+
+	// true if missing resources that are not recreated should be marked as
+	// no longer created, so that teardown does not try to delete them.
+	Forget bool
+
+	// The placement strategy for recreated network ACL entries. Defaults to
+	// DefaultRulePlacement.
+	Placement RulePlacement
+
+	// The policy recreated rules are checked against. Defaults to
+	// DefaultPolicy.
+	Policy *Policy
+}
+
+// ReconcileFinding describes a single difference between a session and
+// AWS.
+type ReconcileFinding struct {
+	_ struct{}
+
+	// The kind of resource (for example, "security_group_rule").
+	Resource string `json:"resource"`
+
+	// The identifier of the resource.
+	ID string `json:"id"`
+
+	// The kind of difference.
+	Status ReconcileStatus `json:"status"`
+
+	// A human-readable description of the difference.
+	Detail string `json:"detail"`
+
+	// What was done about the difference, if anything.
+	Action string `json:"action,omitempty"`
+
+	// The error message, if the action failed.
+	Error string `json:"error,omitempty"`
+}
+
+// ReconcileReport is the report produced by ReconcileSession.
+type ReconcileReport struct {
+	_ struct{}
+
+	// The differences that were found. Resources that match are not
+	// included.
+	Findings []ReconcileFinding `json:"findings"`
+
+	// The policy violations that were allowed through while recreating
+	// rules, as the policy is overridden. They are also added to the
+	// session's PolicyOverrides.
+	PolicyOverrides []PolicyViolation `json:"policy_overrides,omitempty"`
+}
+
+// Clean returns true if no differences were found.
+func (r ReconcileReport) Clean() bool {
+	return len(r.Findings) < 1
+}
+
+// String renders the report as a human-readable table.
+func (r ReconcileReport) String() string {
+	if r.Clean() == true {
+		return "Session matches AWS."
+	}
+
+	var lines []string
+	for _, v := range r.Findings {
+		line := fmt.Sprintf("%-20s %-30s %-10s %s", v.Resource, v.ID, v.Status, v.Detail)
+		if v.Action != "" {
+			line += " (" + v.Action + ")"
+		}
+		if v.Error != "" {
+			line += ": " + v.Error
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reconcileState holds the resources looked up while reconciling a
+// session, so that each is only described once.
+type reconcileState struct {
+	conn   *ec2.EC2
+	opts   ReconcileOptions
+	report ReconcileReport
+	errs   []string
+
+	groups map[string]*ec2.SecurityGroup
+	acls   map[string]*ec2.NetworkAcl
+}
+
+// add records a finding, along with the error of its action, if any.
+func (st *reconcileState) add(f ReconcileFinding, err error) {
+	if err != nil {
+		f.Error = err.Error()
+		st.errs = append(st.errs, fmt.Sprintf("%s %s: %s", f.Resource, f.ID, err))
+	}
+	st.report.Findings = append(st.report.Findings, f)
+}
+
+// securityGroup returns a security group, or nil if it does not exist.
+// Unlike describeSecurityGroup, not found errors are not retried.
+func (st *reconcileState) securityGroup(group string) (*ec2.SecurityGroup, error) {
+	if sg, ok := st.groups[group]; ok {
+		return sg, nil
+	}
+
+	resp, err := st.conn.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice([]string{group}),
+	})
+	if err != nil && isAWSErrorCode(err, "InvalidGroup.NotFound", "InvalidGroupId.NotFound") == false {
+		return nil, err
+	}
+
+	var sg *ec2.SecurityGroup
+	if err == nil && len(resp.SecurityGroups) > 0 {
+		sg = resp.SecurityGroups[0]
+	}
+	st.groups[group] = sg
+	return sg, nil
+}
+
+// networkACL returns a network ACL, or nil if it does not exist.
+func (st *reconcileState) networkACL(acl string) (*ec2.NetworkAcl, error) {
+	if out, ok := st.acls[acl]; ok {
+		return out, nil
+	}
+
+	resp, err := st.conn.DescribeNetworkAcls(&ec2.DescribeNetworkAclsInput{
+		NetworkAclIds: aws.StringSlice([]string{acl}),
+	})
+	if err != nil && isAWSErrorCode(err, "InvalidNetworkAclID.NotFound") == false {
+		return nil, err
+	}
+
+	var out *ec2.NetworkAcl
+	if err == nil && len(resp.NetworkAcls) > 0 {
+		out = resp.NetworkAcls[0]
+	}
+	st.acls[acl] = out
+	return out, nil
+}
+
+// securityGroupRuleKey returns the key of a security group rule, as used to
+// compare it with the flattened permissions of a security group.
+func securityGroupRuleKey(rule SecurityGroupRule) (string, error) {
+	perm, err := securityGroupRulePermission(rule)
+	if err != nil {
+		return "", err
+	}
+	return flattenPermissions([]*ec2.IpPermission{perm}, rule.Egress)[0].key(), nil
+}
+
+// networkACLRuleKey returns the key of the entry a network ACL rule was
+// created as, as used to compare it with the live entries of a network ACL.
+func networkACLRuleKey(rule NetworkACLRule) (string, error) {
+	req, err := networkACLEntryInput(rule, rule.RuleNumber)
+	if err != nil {
+		return "", err
+	}
+	return networkACLItemKey(&ec2.NetworkAclEntry{
+		CidrBlock:     req.CidrBlock,
+		Egress:        req.Egress,
+		IcmpTypeCode:  req.IcmpTypeCode,
+		Ipv6CidrBlock: req.Ipv6CidrBlock,
+		PortRange:     req.PortRange,
+		Protocol:      req.Protocol,
+		RuleAction:    req.RuleAction,
+		RuleNumber:    req.RuleNumber,
+	}), nil
+}
+
+// reconcileKeyPair checks that the session's key pair still exists.
+func (st *reconcileState) reconcileKeyPair(kp KeyPair) (KeyPair, error) {
+	if kp.Created == false {
+		return kp, nil
+	}
+
+	_, err := st.conn.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{
+		KeyNames: aws.StringSlice([]string{kp.KeyName}),
+	})
+	if err == nil {
+		return kp, nil
+	}
+	if isAWSErrorCode(err, "InvalidKeyPair.NotFound") == false {
+		return kp, err
+	}
+
+	f := ReconcileFinding{Resource: "key_pair", ID: kp.KeyName, Status: ReconcileMissing, Detail: "key pair no longer exists"}
+	if st.opts.Forget == true {
+		kp.Created = false
+		f.Action = ReconcileForgotten
+	}
+	st.add(f, nil)
+	return kp, nil
+}
+
+// reconcileInstance checks that the bastion host is still running, and
+// still in the session's security group.
+func (st *reconcileState) reconcileInstance(instance Instance) (Instance, error) {
+	if instance.Created == false {
+		return instance, nil
+	}
+
+	resp, err := st.conn.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instance.InstanceID}),
+	})
+	if err != nil && isAWSErrorCode(err, "InvalidInstanceID.NotFound") == false {
+		return instance, err
+	}
+
+	var live *ec2.Instance
+	if err == nil && len(resp.Reservations) > 0 && len(resp.Reservations[0].Instances) > 0 {
+		live = resp.Reservations[0].Instances[0]
+	}
+
+	f := ReconcileFinding{Resource: "instance", ID: instance.InstanceID}
+	switch {
+	case live == nil:
+		f.Status, f.Detail = ReconcileMissing, "instance no longer exists"
+	case live.State != nil && (aws.StringValue(live.State.Name) == ec2.InstanceStateNameTerminated || aws.StringValue(live.State.Name) == ec2.InstanceStateNameShuttingDown):
+		f.Status, f.Detail = ReconcileMissing, fmt.Sprintf("instance is %s", aws.StringValue(live.State.Name))
+	default:
+		for _, g := range live.SecurityGroups {
+			if aws.StringValue(g.GroupId) == instance.SecurityGroupID {
+				return instance, nil
+			}
+		}
+		st.add(ReconcileFinding{
+			Resource: f.Resource,
+			ID:       f.ID,
+			Status:   ReconcileModified,
+			Detail:   fmt.Sprintf("security group %s is no longer attached", instance.SecurityGroupID),
+		}, nil)
+		return instance, nil
+	}
+
+	if st.opts.Forget == true {
+		instance.Created = false
+		f.Action = ReconcileForgotten
+	}
+	st.add(f, nil)
+	return instance, nil
+}
+
+// reconcileSecurityGroupRule checks that a rule the session created still
+// exists, and recreates or forgets it if it does not.
+func (st *reconcileState) reconcileSecurityGroupRule(rule SecurityGroupRule) (SecurityGroupRule, error) {
+	if rule.Created == false || rule.PreExisting == true {
+		return rule, nil
+	}
+
+	group, err := st.securityGroup(rule.GroupID)
+	if err != nil {
+		return rule, err
+	}
+
+	f := ReconcileFinding{Resource: "security_group_rule", ID: securityGroupRuleID(rule), Status: ReconcileMissing}
+	if group == nil {
+		f.Detail = fmt.Sprintf("security group %s no longer exists", rule.GroupID)
+		if st.opts.Forget == true {
+			rule.Created = false
+			f.Action = ReconcileForgotten
+		}
+		st.add(f, nil)
+		return rule, nil
+	}
+
+	key, err := securityGroupRuleKey(rule)
+	if err != nil {
+		return rule, err
+	}
+	live := securityGroupPermissions(group, rule.Egress)
+	for _, v := range flattenPermissions(live, rule.Egress) {
+		if v.key() == key {
+			return rule, nil
+		}
+	}
+
+	f.Detail = "rule no longer exists"
+	switch {
+	case st.opts.Recreate == true:
+		rule.Created = false
+		out, overrides, err := createSecurityGroupRule(st.conn, rule, policyOrDefault(st.opts.Policy))
+		if err == nil {
+			rule = out
+			f.Action = ReconcileRecreated
+			st.report.PolicyOverrides = append(st.report.PolicyOverrides, overrides...)
+			logPolicyOverrides(overrides)
+		}
+		st.add(f, err)
+		// The group has changed, so look it up again next time.
+		delete(st.groups, rule.GroupID)
+	case st.opts.Forget == true:
+		rule.Created = false
+		f.Action = ReconcileForgotten
+		st.add(f, nil)
+	default:
+		st.add(f, nil)
+	}
+	return rule, nil
+}
+
+// reconcileNetworkACLRule checks that the entry for a rule the session
+// created still exists under its rule number and has not been changed, and
+// recreates or forgets it if it does not. A changed entry is no longer the
+// session's, and is treated the same as a missing one, so that teardown
+// does not delete it.
+func (st *reconcileState) reconcileNetworkACLRule(resource string, rule NetworkACLRule) (NetworkACLRule, error) {
+	if rule.Created == false || rule.PreExisting == true {
+		return rule, nil
+	}
+
+	acl, err := st.networkACL(rule.NetworkAclID)
+	if err != nil {
+		return rule, err
+	}
+
+	f := ReconcileFinding{Resource: resource, ID: networkACLRuleID(rule), Status: ReconcileMissing}
+	if acl == nil {
+		f.Detail = fmt.Sprintf("network ACL %s no longer exists", rule.NetworkAclID)
+		if st.opts.Forget == true {
+			rule.Created = false
+			f.Action = ReconcileForgotten
+		}
+		st.add(f, nil)
+		return rule, nil
+	}
+
+	key, err := networkACLRuleKey(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	f.Detail = "entry no longer exists"
+	for _, e := range acl.Entries {
+		if aws.BoolValue(e.Egress) != rule.Egress || int(aws.Int64Value(e.RuleNumber)) != rule.RuleNumber {
+			continue
+		}
+		if networkACLItemKey(e) == key {
+			return rule, nil
+		}
+		f.Status = ReconcileModified
+		f.Detail = fmt.Sprintf("entry was changed to %s", networkACLItemKey(e))
+	}
+
+	switch {
+	case st.opts.Recreate == true:
+		rule.Created = false
+		rule.RuleNumber = 0
+		out, overrides, err := createNetworkACLRule(st.conn, rule, st.opts.Placement, nil, policyOrDefault(st.opts.Policy))
+		if err == nil {
+			rule = out
+			f.Action = ReconcileRecreated
+			st.report.PolicyOverrides = append(st.report.PolicyOverrides, overrides...)
+			logPolicyOverrides(overrides)
+		}
+		st.add(f, err)
+		delete(st.acls, rule.NetworkAclID)
+	case st.opts.Forget == true:
+		rule.Created = false
+		f.Action = ReconcileForgotten
+		st.add(f, nil)
+	default:
+		st.add(f, nil)
+	}
+	return rule, nil
+}
+
+// reconcileSecurityGroup checks that the session's security group still
+// exists.
+func (st *reconcileState) reconcileSecurityGroup(sg SecurityGroup) (SecurityGroup, error) {
+	if sg.Created == false {
+		return sg, nil
+	}
+
+	group, err := st.securityGroup(sg.GroupID)
+	if err != nil || group != nil {
+		return sg, err
+	}
+
+	f := ReconcileFinding{Resource: "security_group", ID: sg.GroupID, Status: ReconcileMissing, Detail: "security group no longer exists"}
+	if st.opts.Forget == true {
+		sg.Created = false
+		f.Action = ReconcileForgotten
+	}
+	st.add(f, nil)
+	return sg, nil
+}
+
+// reportUnexpectedRules reports ingress rules in the session's security
+// group that the session did not create.
+func (st *reconcileState) reportUnexpectedRules(s Session) error {
+	if s.SecurityGroup.Created == false {
+		return nil
+	}
+
+	group, err := st.securityGroup(s.SecurityGroup.GroupID)
+	if err != nil || group == nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, v := range s.SecurityGroupRules {
+		if v.GroupID != s.SecurityGroup.GroupID || v.Egress == true || v.Created == false {
+			continue
+		}
+		if key, err := securityGroupRuleKey(v); err == nil {
+			known[key] = true
+		}
+	}
+
+	for _, v := range flattenPermissions(group.IpPermissions, false) {
+		if known[v.key()] == false {
+			st.add(ReconcileFinding{
+				Resource: "security_group_rule",
+				ID:       s.SecurityGroup.GroupID,
+				Status:   ReconcileUnexpected,
+				Detail:   fmt.Sprintf("rule %s was not created by the session", v.key()),
+			}, nil)
+		}
+	}
+	return nil
+}
+
+// ReconcileSession compares the session's key pair, instance, security
+// group, security group rules, and network ACL rules against AWS, and reports
+// resources that are missing or have been modified, along with ingress rules
+// in the session's security group that the session does not know about.
+// Pre-existing rules are not checked.
+//
+// Depending on opts, missing rules are created again, and missing resources
+// are marked as no longer created so that teardown skips them. Unexpected
+// rules are only reported.
+//
+// An error is returned if AWS cannot be queried, or if any action fails. The
+// returned session reflects the actions that succeeded.
+func ReconcileSession(conn *ec2.EC2, s Session, opts ReconcileOptions) (Session, ReconcileReport, error) {
+	st := &reconcileState{
+		conn:   conn,
+		opts:   opts,
+		groups: make(map[string]*ec2.SecurityGroup),
+		acls:   make(map[string]*ec2.NetworkAcl),
+	}
+
+	// Copy the rule slices so that the caller's session is left untouched.
+	s.SecurityGroupRules = append([]SecurityGroupRule(nil), s.SecurityGroupRules...)
+	s.NetworkACLRules = append([]NetworkACLRule(nil), s.NetworkACLRules...)
+	s.NetworkACLRulePairs = append([]NetworkACLRulePair(nil), s.NetworkACLRulePairs...)
+
+	var err error
+	s.KeyPair, err = st.reconcileKeyPair(s.KeyPair)
+	if err != nil {
+		return s, st.report, err
+	}
+
+	s.Instance, err = st.reconcileInstance(s.Instance)
+	if err != nil {
+		return s, st.report, err
+	}
+
+	s.SecurityGroup, err = st.reconcileSecurityGroup(s.SecurityGroup)
+	if err != nil {
+		return s, st.report, err
+	}
+
+	err = st.reportUnexpectedRules(s)
+	if err != nil {
+		return s, st.report, err
+	}
+
+	for i, rule := range s.SecurityGroupRules {
+		s.SecurityGroupRules[i], err = st.reconcileSecurityGroupRule(rule)
+		if err != nil {
+			return s, st.report, err
+		}
+	}
+
+	for i, rule := range s.NetworkACLRules {
+		s.NetworkACLRules[i], err = st.reconcileNetworkACLRule("network_acl_rule", rule)
+		if err != nil {
+			return s, st.report, err
+		}
+	}
+
+	for i, pair := range s.NetworkACLRulePairs {
+		s.NetworkACLRulePairs[i].Forward, err = st.reconcileNetworkACLRule("network_acl_rule_pair", pair.Forward)
+		if err != nil {
+			return s, st.report, err
+		}
+		s.NetworkACLRulePairs[i].Return, err = st.reconcileNetworkACLRule("network_acl_rule_pair", pair.Return)
+		if err != nil {
+			return s, st.report, err
+		}
+	}
+
+	s.PolicyOverrides = append(append([]PolicyViolation(nil), s.PolicyOverrides...), st.report.PolicyOverrides...)
+
+	if len(st.errs) > 0 {
+		return s, st.report, fmt.Errorf("Reconciliation failed for %d resource(s):\n%s", len(st.errs), strings.Join(st.errs, "\n"))
+	}
+	return s, st.report, nil
+}
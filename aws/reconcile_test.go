@@ -0,0 +1,223 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testReconcileMock holds the live state served by the reconcile mock, and
+// the mutating calls made to it.
+type testReconcileMock struct {
+	group    *ec2.SecurityGroup
+	acl      *ec2.NetworkAcl
+	keyPair  bool
+	instance *ec2.Instance
+	calls    []string
+}
+
+// newTestReconcileMock provides a reconcile mock whose live state matches
+// testReconcileSession.
+func newTestReconcileMock() *testReconcileMock {
+	return &testReconcileMock{
+		group: &ec2.SecurityGroup{
+			GroupId:       aws.String("sg-123456"),
+			IpPermissions: []*ec2.IpPermission{testSnapshotPermission("10.0.1.0/24")},
+		},
+		acl: &ec2.NetworkAcl{
+			NetworkAclId: aws.String("nacl-123456"),
+			Entries:      []*ec2.NetworkAclEntry{testSnapshotEntry(1, "10.0.1.0/24")},
+		},
+		keyPair: true,
+		instance: &ec2.Instance{
+			InstanceId:     aws.String("i-1234567890abcdef0"),
+			SecurityGroups: []*ec2.GroupIdentifier{&ec2.GroupIdentifier{GroupId: aws.String("sg-123456")}},
+			State:          &ec2.InstanceState{Name: aws.String("running")},
+		},
+	}
+}
+
+// testReconcileSession provides a session to reconcile.
+func testReconcileSession() Session {
+	instance := testInstance()
+	instance.SecurityGroupID = "sg-123456"
+
+	return Session{
+		KeyPair:            KeyPair{Created: true, KeyName: "bastion-test"},
+		SecurityGroup:      testSecurityGroup(),
+		SecurityGroupRules: []SecurityGroupRule{testSecurityGroupRule()},
+		NetworkACLRules:    []NetworkACLRule{testNetworkACLRule()},
+		Instance:           instance,
+	}
+}
+
+// createTestEC2ReconcileMock returns a mock EC2 service to use with the
+// reconcile test functions.
+func createTestEC2ReconcileMock(m *testReconcileMock) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeSecurityGroupsInput:
+			if m.group == nil {
+				r.Error = awserr.New("InvalidGroup.NotFound", "not found", nil)
+				return
+			}
+			*r.Data.(*ec2.DescribeSecurityGroupsOutput) = ec2.DescribeSecurityGroupsOutput{
+				SecurityGroups: []*ec2.SecurityGroup{m.group},
+			}
+		case *ec2.DescribeNetworkAclsInput:
+			*r.Data.(*ec2.DescribeNetworkAclsOutput) = ec2.DescribeNetworkAclsOutput{
+				NetworkAcls: []*ec2.NetworkAcl{m.acl},
+			}
+		case *ec2.DescribeKeyPairsInput:
+			if m.keyPair == false {
+				r.Error = awserr.New("InvalidKeyPair.NotFound", "not found", nil)
+			}
+		case *ec2.DescribeInstancesInput:
+			if m.instance == nil {
+				r.Error = awserr.New("InvalidInstanceID.NotFound", "not found", nil)
+				return
+			}
+			*r.Data.(*ec2.DescribeInstancesOutput) = ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{&ec2.Reservation{Instances: []*ec2.Instance{m.instance}}},
+			}
+		case *ec2.AuthorizeSecurityGroupIngressInput:
+			m.calls = append(m.calls, "authorize "+*p.IpPermissions[0].IpRanges[0].CidrIp)
+		case *ec2.CreateNetworkAclEntryInput:
+			m.calls = append(m.calls, fmt.Sprintf("create entry %d", *p.RuleNumber))
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+// findingStatuses returns the resource and status of each finding in a
+// report.
+func findingStatuses(r ReconcileReport) []string {
+	var out []string
+	for _, v := range r.Findings {
+		out = append(out, fmt.Sprintf("%s %s %s", v.Resource, v.Status, v.Action))
+	}
+	return out
+}
+
+// driftTestReconcileMock changes the live state of a reconcile mock: the
+// key pair is deleted, the instance is terminated, the session's rule is
+// replaced with another one, and its network ACL entry is changed.
+func driftTestReconcileMock(m *testReconcileMock) {
+	m.keyPair = false
+	m.instance.State.Name = aws.String("terminated")
+	m.group.IpPermissions = []*ec2.IpPermission{testSnapshotPermission("10.0.9.0/24")}
+	m.acl.Entries = []*ec2.NetworkAclEntry{testSnapshotEntry(1, "10.0.9.0/24")}
+}
+
+func TestReconcileSessionClean(t *testing.T) {
+	m := newTestReconcileMock()
+	conn := createTestEC2ReconcileMock(m)
+
+	_, report, err := ReconcileSession(conn, testReconcileSession(), ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if report.Clean() == false {
+		t.Fatalf("Expected no findings, got:\n%s", report)
+	}
+}
+
+func TestReconcileSessionReport(t *testing.T) {
+	m := newTestReconcileMock()
+	driftTestReconcileMock(m)
+	conn := createTestEC2ReconcileMock(m)
+
+	in := testReconcileSession()
+	out, report, err := ReconcileSession(conn, in, ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := []string{
+		"key_pair missing ",
+		"instance missing ",
+		"security_group_rule unexpected ",
+		"security_group_rule missing ",
+		"network_acl_rule modified ",
+	}
+	actual := findingStatuses(report)
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	if reflect.DeepEqual(in, out) == false {
+		t.Fatalf("Expected session to be unchanged")
+	}
+	if len(m.calls) != 0 {
+		t.Fatalf("Expected no calls, got %v", m.calls)
+	}
+}
+
+func TestReconcileSessionRepair(t *testing.T) {
+	m := newTestReconcileMock()
+	driftTestReconcileMock(m)
+	conn := createTestEC2ReconcileMock(m)
+
+	out, report, err := ReconcileSession(conn, testReconcileSession(), ReconcileOptions{Recreate: true, Forget: true})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := []string{
+		"key_pair missing forgotten",
+		"instance missing forgotten",
+		"security_group_rule unexpected ",
+		"security_group_rule missing recreated",
+		"network_acl_rule modified recreated",
+	}
+	actual := findingStatuses(report)
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	expectedCalls := []string{"authorize 10.0.1.0/24", "create entry 2"}
+	if reflect.DeepEqual(expectedCalls, m.calls) == false {
+		t.Fatalf("Expected %v, got %v", expectedCalls, m.calls)
+	}
+
+	if out.KeyPair.Created == true || out.Instance.Created == true {
+		t.Fatalf("Expected missing resources to be forgotten")
+	}
+	if out.NetworkACLRules[0].RuleNumber != 2 || out.NetworkACLRules[0].Created == false {
+		t.Fatalf("Unexpected recreated rule %#v", out.NetworkACLRules[0])
+	}
+}
+
+func TestReconcileSessionGroupMissing(t *testing.T) {
+	m := newTestReconcileMock()
+	m.group = nil
+	conn := createTestEC2ReconcileMock(m)
+
+	out, report, err := ReconcileSession(conn, testReconcileSession(), ReconcileOptions{Recreate: true, Forget: true})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := []string{
+		"security_group missing forgotten",
+		"security_group_rule missing forgotten",
+	}
+	actual := findingStatuses(report)
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	if out.SecurityGroup.Created == true || out.SecurityGroupRules[0].Created == true {
+		t.Fatalf("Expected missing resources to be forgotten")
+	}
+}
@@ -0,0 +1,284 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/paybyphone/bastion-go/clientip"
+)
+
+// defaultRoamingInterval is the default interval at which the client address
+// is re-detected.
+const defaultRoamingInterval = time.Minute
+
+// ClientAddressFunc returns the current network range of the client, in CIDR
+// notation.
+type ClientAddressFunc func(ctx context.Context) (string, error)
+
+// ClientIPAddress returns a ClientAddressFunc that discovers the client's
+// public address with the clientip package.
+func ClientIPAddress(opts clientip.Options) ClientAddressFunc {
+	return func(ctx context.Context) (string, error) {
+		result, err := clientip.Discover(ctx, opts)
+		if err != nil {
+			return "", err
+		}
+		return result.CIDR, nil
+	}
+}
+
+// RoamingOptions describes how WatchClientAddress follows the client address.
+type RoamingOptions struct {
+	_ struct{}
+
+	// The source of the client address. Required.
+	Address ClientAddressFunc
+
+	// The interval at which the client address is re-detected. Defaults to
+	// one minute.
+	Interval time.Duration
+
+	// The placement strategy for new network ACL entries. Defaults to
+	// DefaultRulePlacement.
+	Placement RulePlacement
+
+	// The policy new rules are checked against. Defaults to DefaultPolicy.
+	Policy *Policy
+
+	// Called with the updated session after every change, so that the
+	// persisted state always reflects the rules that exist. If it returns an
+	// error, watching stops.
+	Save func(Session) error
+
+	// Called with errors from a single check, after which watching carries
+	// on. If nil, errors are ignored.
+	OnError func(error)
+}
+
+// withClientCIDR returns a network ACL rule with its CIDR block replaced,
+// using the field that matches the address family of cidr.
+func withClientCIDR(rule NetworkACLRule, cidr string) NetworkACLRule {
+	rule.CidrBlock = ""
+	rule.Ipv6CidrBlock = ""
+	if isIPv6CIDR(cidr) == true {
+		rule.Ipv6CidrBlock = cidr
+	} else {
+		rule.CidrBlock = cidr
+	}
+	return rule
+}
+
+// clientPeer returns the security group rule peer for a client CIDR.
+func clientPeer(cidr string) RulePeer {
+	if isIPv6CIDR(cidr) == true {
+		return IPv6CIDRPeer(cidr)
+	}
+	return IPv4CIDRPeer(cidr)
+}
+
+// isClientSecurityGroupRule returns true if a rule is one of the session's
+// rules that allows the client in.
+func isClientSecurityGroupRule(s Session, rule SecurityGroupRule) bool {
+	if rule.Created == false || rule.Egress == true || isAllowlistRule(rule) == true {
+		return false
+	}
+	return rule.GroupID == s.SecurityGroup.GroupID && rule.Peer == clientPeer(s.ClientCIDR)
+}
+
+// isClientNetworkACLRulePair returns true if a pair is one of the session's
+// pairs that allows the client in.
+func isClientNetworkACLRulePair(s Session, pair NetworkACLRulePair) bool {
+	if pair.Created() == false || pair.Forward.Egress == true || isAllowlistNetworkACLRulePair(pair) == true {
+		return false
+	}
+	return pair.Forward.CidrBlock == s.ClientCIDR || pair.Forward.Ipv6CidrBlock == s.ClientCIDR
+}
+
+// openClientAccess creates copies of the client security group rules and
+// network ACL rule pairs for a new CIDR block, as a single RuleSet. The rules
+// being replaced do not count as allowing the new CIDR block, so a new range
+// inside the old one still gets rules of its own. If any rule cannot be
+// created, the others are rolled back; the rules that are returned marked as
+// created are the ones that could not be. Any policy violations that were
+// overridden are returned. The session's allowlist rules do not count as
+// allowing the new CIDR block either (see allowlistTransientRules).
+func openClientAccess(conn *ec2.EC2, s Session, sgrs []SecurityGroupRule, pairs []NetworkACLRulePair, cidr string, placement RulePlacement, policy *Policy) ([]SecurityGroupRule, []NetworkACLRulePair, []PolicyViolation, error) {
+	transientSGRs, transientRules := allowlistTransientRules(s, cidr)
+	set := RuleSet{
+		Placement:                   placement,
+		Policy:                      policy,
+		TransientSecurityGroupRules: append(append([]SecurityGroupRule(nil), sgrs...), transientSGRs...),
+		TransientNetworkACLRules:    transientRules,
+	}
+
+	for _, v := range sgrs {
+		rule := v
+		rule.Peer = clientPeer(cidr)
+		rule.Created = false
+		rule.PreExisting = false
+		set.SecurityGroupRules = append(set.SecurityGroupRules, rule)
+	}
+
+	for _, v := range pairs {
+		set.TransientNetworkACLRules = append(set.TransientNetworkACLRules, v.Forward, v.Return)
+
+		forward := withClientCIDR(v.Forward, cidr)
+		forward.Created = false
+		forward.PreExisting = false
+		forward.RuleNumber = 0
+		ephemeral := EphemeralPortRange{Start: v.Return.StartPort, End: v.Return.EndPort}
+		pair := NewNetworkACLRulePair(forward, ephemeral)
+		set.NetworkACLRules = append(set.NetworkACLRules, pair.Forward, pair.Return)
+	}
+
+	set, result, err := ApplyRuleSet(conn, set)
+
+	var newPairs []NetworkACLRulePair
+	for i := 0; i+1 < len(set.NetworkACLRules); i += 2 {
+		newPairs = append(newPairs, NetworkACLRulePair{Forward: set.NetworkACLRules[i], Return: set.NetworkACLRules[i+1]})
+	}
+	return set.SecurityGroupRules, newPairs, result.PolicyOverrides, err
+}
+
+// UpdateClientCIDR moves the session's client access to a new network
+// range. The security group rules and network ACL rule pairs for the new
+// range are created first, then the ones for the old range are removed, so
+// that access is not interrupted. New rules are checked against policy
+// (DefaultPolicy if nil), and any violations it overrides are added to the
+// session's PolicyOverrides.
+//
+// If the new rules cannot all be created, the ones that were are removed
+// again, and the session keeps its old client access. Any new rule that
+// cannot be removed again is added to the returned session, and if the old
+// rules cannot be removed, they are kept alongside the new ones, so that
+// teardown still removes them either way.
+func UpdateClientCIDR(conn *ec2.EC2, s Session, cidr string, placement RulePlacement, policy *Policy) (Session, error) {
+	cidr, err := normalizeCIDR(cidr)
+	if err != nil {
+		return s, err
+	}
+	if cidr == s.ClientCIDR {
+		return s, nil
+	}
+	if s.ClientCIDR == "" {
+		return s, fmt.Errorf("The session has no client access to move.")
+	}
+
+	var oldSGRs, keepSGRs []SecurityGroupRule
+	for _, v := range s.SecurityGroupRules {
+		if isClientSecurityGroupRule(s, v) == true {
+			oldSGRs = append(oldSGRs, v)
+		} else {
+			keepSGRs = append(keepSGRs, v)
+		}
+	}
+
+	var oldPairs, keepPairs []NetworkACLRulePair
+	for _, v := range s.NetworkACLRulePairs {
+		if isClientNetworkACLRulePair(s, v) == true {
+			oldPairs = append(oldPairs, v)
+		} else {
+			keepPairs = append(keepPairs, v)
+		}
+	}
+
+	// Make the new rules first.
+	newSGRs, newPairs, overrides, err := openClientAccess(conn, s, oldSGRs, oldPairs, cidr, placement, policy)
+	if err != nil {
+		// Keep anything that could not be rolled back, so that teardown
+		// removes it.
+		s.SecurityGroupRules = append([]SecurityGroupRule(nil), s.SecurityGroupRules...)
+		for _, v := range newSGRs {
+			if v.Created == true && v.PreExisting == false {
+				s.SecurityGroupRules = append(s.SecurityGroupRules, v)
+			}
+		}
+		s.NetworkACLRulePairs = append([]NetworkACLRulePair(nil), s.NetworkACLRulePairs...)
+		for _, v := range newPairs {
+			if v.Created() == true && v.PreExisting() == false {
+				s.NetworkACLRulePairs = append(s.NetworkACLRulePairs, v)
+			}
+		}
+		return s, fmt.Errorf("Unable to open access to %s: %s", cidr, err)
+	}
+
+	// Then remove the old ones.
+	var errs []error
+	for _, v := range oldSGRs {
+		_, err := DeleteSecurityGroupRule(conn, v)
+		if err != nil {
+			keepSGRs = append(keepSGRs, v)
+			errs = append(errs, err)
+		}
+	}
+	for _, v := range oldPairs {
+		out, err := DeleteNetworkACLRulePair(conn, v)
+		if err != nil {
+			keepPairs = append(keepPairs, out)
+			errs = append(errs, err)
+		}
+	}
+
+	s.ClientCIDR = cidr
+	s.PolicyOverrides = append(append([]PolicyViolation(nil), s.PolicyOverrides...), overrides...)
+	s.SecurityGroupRules = append(keepSGRs, newSGRs...)
+	s.NetworkACLRulePairs = append(keepPairs, newPairs...)
+
+	if len(errs) > 0 {
+		return s, fmt.Errorf("Opened access to %s, but removing access for the previous address failed: %s", cidr, errs[0])
+	}
+	return s, nil
+}
+
+// WatchClientAddress re-detects the client address at an interval, and when
+// it changes, moves the session's client access to the new address with
+// UpdateClientCIDR. It runs until ctx is done, and returns the latest
+// session.
+func WatchClientAddress(ctx context.Context, conn *ec2.EC2, s Session, opts RoamingOptions) (Session, error) {
+	if opts.Address == nil {
+		return s, fmt.Errorf("A client address source is required.")
+	}
+
+	interval := opts.Interval
+	if interval == 0 {
+		interval = defaultRoamingInterval
+	}
+
+	report := func(err error) {
+		if opts.OnError != nil {
+			opts.OnError(err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return s, nil
+		case <-time.After(interval):
+		}
+
+		cidr, err := opts.Address(ctx)
+		if err != nil {
+			report(err)
+			continue
+		}
+
+		previous := s.ClientCIDR
+		s, err = UpdateClientCIDR(conn, s, cidr, opts.Placement, opts.Policy)
+		if err != nil {
+			report(err)
+		}
+		if s.ClientCIDR == previous {
+			continue
+		}
+
+		if opts.Save != nil {
+			err = opts.Save(s)
+			if err != nil {
+				return s, err
+			}
+		}
+	}
+}
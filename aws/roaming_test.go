@@ -0,0 +1,277 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// createTestEC2RoamingMock returns a mock EC2 service to use with the roaming
+// test functions. Mutating calls are recorded in calls.
+func createTestEC2RoamingMock(calls *[]string) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeSecurityGroupsInput:
+			out, err := testDescribeSecurityGroups(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeSecurityGroupsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.AuthorizeSecurityGroupIngressInput:
+			*calls = append(*calls, "authorize "+*p.IpPermissions[0].IpRanges[0].CidrIp)
+			_, r.Error = testAuthorizeSecurityGroupIngress(p)
+		case *ec2.RevokeSecurityGroupIngressInput:
+			*calls = append(*calls, "revoke "+*p.IpPermissions[0].IpRanges[0].CidrIp)
+			_, r.Error = testRevokeSecurityGroupIngress(p)
+		case *ec2.DescribeNetworkAclsInput:
+			out, err := testDescribeNetworkAcls(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeNetworkAclsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.CreateNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("create entry %s %v", *p.CidrBlock, *p.Egress))
+			_, r.Error = testCreateNetworkAclEntry(p)
+		case *ec2.DeleteNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("delete entry %d %v", *p.RuleNumber, *p.Egress))
+			_, r.Error = testDeleteNetworkAclEntry(p)
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+// testRoamingSession provides a session with client access open to
+// 10.0.1.0/24, and a target access rule that should be left alone.
+func testRoamingSession() Session {
+	target := SecurityGroupRule{
+		Created:   true,
+		GroupID:   "sg-654321",
+		Peer:      SecurityGroupPeer("sg-123456", ""),
+		StartPort: 22,
+		EndPort:   22,
+	}
+
+	pair := NewNetworkACLRulePair(testNetworkACLRule(), EphemeralPortsLinux)
+	pair.Return.RuleNumber = 2
+	pair.Return.Created = true
+
+	return Session{
+		ID:                  "abcdef0123456789",
+		ClientCIDR:          "10.0.1.0/24",
+		SecurityGroup:       testSecurityGroup(),
+		SecurityGroupRules:  []SecurityGroupRule{testSecurityGroupRule(), target},
+		NetworkACLRulePairs: []NetworkACLRulePair{pair},
+	}
+}
+
+// testRoamingLiveState is a handler that adds the client access rules of
+// testRoamingSession to the security groups and network ACLs described by
+// the other mocks, so that they are in place as they would be live.
+func testRoamingLiveState(r *request.Request) {
+	switch r.Params.(type) {
+	case *ec2.DescribeSecurityGroupsInput:
+		group := r.Data.(*ec2.DescribeSecurityGroupsOutput).SecurityGroups[0]
+		group.IpPermissions = append(group.IpPermissions, &ec2.IpPermission{
+			FromPort:   aws.Int64(22),
+			IpProtocol: aws.String("tcp"),
+			IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.1.0/24")}},
+			ToPort:     aws.Int64(22),
+		})
+	case *ec2.DescribeNetworkAclsInput:
+		acl := r.Data.(*ec2.DescribeNetworkAclsOutput).NetworkAcls[0]
+		acl.Entries = append(acl.Entries,
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("10.0.1.0/24"),
+				Egress:     aws.Bool(false),
+				PortRange:  &ec2.PortRange{From: aws.Int64(22), To: aws.Int64(22)},
+				Protocol:   aws.String("6"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(1),
+			},
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("10.0.1.0/24"),
+				Egress:     aws.Bool(true),
+				PortRange:  &ec2.PortRange{From: aws.Int64(32768), To: aws.Int64(60999)},
+				Protocol:   aws.String("6"),
+				RuleAction: aws.String("allow"),
+				RuleNumber: aws.Int64(2),
+			},
+		)
+	}
+}
+
+func TestUpdateClientCIDR(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RoamingMock(&calls)
+
+	out, err := UpdateClientCIDR(conn, testRoamingSession(), "203.0.113.10/32", nil, nil)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := fmt.Sprintf("%v", []string{
+		"authorize 203.0.113.10/32",
+		"create entry 203.0.113.10/32 false",
+		"create entry 203.0.113.10/32 true",
+		"revoke 10.0.1.0/24",
+		"delete entry 1 false",
+		"delete entry 2 true",
+	})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	if out.ClientCIDR != "203.0.113.10/32" {
+		t.Fatalf("Expected client CIDR to be updated, got %v", out.ClientCIDR)
+	}
+	if len(out.SecurityGroupRules) != 2 || out.SecurityGroupRules[0].GroupID != "sg-654321" || out.SecurityGroupRules[1].Peer != IPv4CIDRPeer("203.0.113.10/32") {
+		t.Fatalf("Unexpected security group rules %#v", out.SecurityGroupRules)
+	}
+	if len(out.NetworkACLRulePairs) != 1 || out.NetworkACLRulePairs[0].Return.CidrBlock != "203.0.113.10/32" || out.NetworkACLRulePairs[0].Return.StartPort != 32768 {
+		t.Fatalf("Unexpected network ACL rule pairs %#v", out.NetworkACLRulePairs)
+	}
+}
+
+func TestUpdateClientCIDRUnchanged(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RoamingMock(&calls)
+
+	_, err := UpdateClientCIDR(conn, testRoamingSession(), "10.0.1.5/24", nil, nil)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls, got %v", calls)
+	}
+}
+
+func TestUpdateClientCIDRRollback(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RoamingMock(&calls)
+
+	s := testRoamingSession()
+	s.NetworkACLRulePairs[0].Forward.NetworkAclID = "bad"
+
+	out, err := UpdateClientCIDR(conn, s, "203.0.113.10/32", nil, nil)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	expected := fmt.Sprintf("%v", []string{"authorize 203.0.113.10/32", "revoke 203.0.113.10/32"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	if out.ClientCIDR != "10.0.1.0/24" || out.SecurityGroupRules[0].Peer != IPv4CIDRPeer("10.0.1.0/24") {
+		t.Fatalf("Expected session to be unchanged, got %#v", out)
+	}
+}
+
+func TestUpdateClientCIDRRollbackFailure(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RoamingMock(&calls)
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		if _, ok := r.Params.(*ec2.RevokeSecurityGroupIngressInput); ok == true {
+			r.Error = fmt.Errorf("revoke failed")
+		}
+	})
+
+	s := testRoamingSession()
+	s.NetworkACLRulePairs[0].Forward.NetworkAclID = "bad"
+
+	out, err := UpdateClientCIDR(conn, s, "203.0.113.10/32", nil, nil)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if strings.Contains(err.Error(), "revoke failed") == false {
+		t.Fatalf("Expected the rollback error to be reported, got %s", err.Error())
+	}
+
+	if out.ClientCIDR != "10.0.1.0/24" {
+		t.Fatalf("Expected client CIDR to be unchanged, got %v", out.ClientCIDR)
+	}
+	if len(out.SecurityGroupRules) != 3 || out.SecurityGroupRules[2].Peer != IPv4CIDRPeer("203.0.113.10/32") || out.SecurityGroupRules[2].Created == false {
+		t.Fatalf("Expected the rule that was not rolled back to be kept, got %#v", out.SecurityGroupRules)
+	}
+}
+
+func TestUpdateClientCIDRWithinOld(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RoamingMock(&calls)
+
+	// The live state still has the rules for the old range, which covers the
+	// new address.
+	conn.Handlers.Send.PushBack(testRoamingLiveState)
+
+	out, err := UpdateClientCIDR(conn, testRoamingSession(), "10.0.1.5/32", nil, nil)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := fmt.Sprintf("%v", []string{
+		"authorize 10.0.1.5/32",
+		"create entry 10.0.1.5/32 false",
+		"create entry 10.0.1.5/32 true",
+		"revoke 10.0.1.0/24",
+		"delete entry 1 false",
+		"delete entry 2 true",
+	})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	if out.SecurityGroupRules[1].PreExisting == true || out.NetworkACLRulePairs[0].PreExisting() == true {
+		t.Fatalf("Expected the new rules to be created, got %#v", out)
+	}
+}
+
+func TestWatchClientAddress(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RoamingMock(&calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addrs := []string{"10.0.1.0/24", "203.0.113.10/32"}
+	var saved []Session
+
+	out, err := WatchClientAddress(ctx, conn, testRoamingSession(), RoamingOptions{
+		Interval: time.Millisecond,
+		Address: func(ctx context.Context) (string, error) {
+			addr := addrs[0]
+			if len(addrs) > 1 {
+				addrs = addrs[1:]
+			}
+			return addr, nil
+		},
+		Save: func(s Session) error {
+			saved = append(saved, s)
+			cancel()
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if len(saved) != 1 || saved[0].ClientCIDR != "203.0.113.10/32" {
+		t.Fatalf("Expected a single save with the new address, got %#v", saved)
+	}
+	if out.ClientCIDR != "203.0.113.10/32" {
+		t.Fatalf("Expected %v, got %v", "203.0.113.10/32", out.ClientCIDR)
+	}
+}
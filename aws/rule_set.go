@@ -0,0 +1,440 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// RuleStatus is the outcome of applying a single rule in a RuleSet.
+type RuleStatus string
+
+const (
+	// RuleCreated means the rule was created.
+	RuleCreated RuleStatus = "created"
+
+	// RulePreExisting means the traffic was already allowed, and the rule was
+	// not created.
+	RulePreExisting RuleStatus = "pre_existing"
+
+	// RuleRolledBack means the rule was created, then removed again as
+	// another rule in the set failed.
+	RuleRolledBack RuleStatus = "rolled_back"
+
+	// RuleFailed means the rule could not be created, or could not be rolled
+	// back.
+	RuleFailed RuleStatus = "failed"
+
+	// RuleNotAttempted means the rule was not applied, as another rule in the
+	// set failed first.
+	RuleNotAttempted RuleStatus = "not_attempted"
+)
+
+// RuleOutcome describes the outcome of applying a single rule in a RuleSet.
+type RuleOutcome struct {
+	_ struct{}
+
+	// The kind of rule: security_group_rule or network_acl_rule.
+	Resource string `json:"resource"`
+
+	// The identifier of the rule.
+	ID string `json:"id"`
+
+	// The outcome.
+	Status RuleStatus `json:"status"`
+
+	// The error message, if Status is RuleFailed.
+	Error string `json:"error,omitempty"`
+}
+
+// RuleSet is a set of security group and network ACL rules that are applied
+// as one unit: either all of them take effect, or none of the ones that were
+// created are left behind.
+type RuleSet struct {
+	_ struct{}
+
+	// The security group rules in the set.
+	SecurityGroupRules []SecurityGroupRule `json:"security_group_rules"`
+
+	// The network ACL rules in the set.
+	NetworkACLRules []NetworkACLRule `json:"network_acl_rules"`
+
+	// The placement strategy for new network ACL entries. Defaults to
+	// DefaultRulePlacement.
+	Placement RulePlacement `json:"-"`
+
+	// The policy every rule is checked against. Defaults to DefaultPolicy.
+	Policy *Policy `json:"-"`
+
+	// Security group rules that may be removed independently of the set,
+	// such as the ones it replaces. They do not count as allowing the
+	// traffic of rules in the set, so that no rule is left relying on them.
+	TransientSecurityGroupRules []SecurityGroupRule `json:"-"`
+
+	// Network ACL rules that may be removed independently of the set, as
+	// with TransientSecurityGroupRules.
+	TransientNetworkACLRules []NetworkACLRule `json:"-"`
+}
+
+// RuleSetResult is the per-rule report produced by ApplyRuleSet. Security
+// group rules are reported first, followed by network ACL rules, each in the
+// order they appear in the set.
+type RuleSetResult struct {
+	_ struct{}
+
+	// The outcome of each rule.
+	Outcomes []RuleOutcome `json:"outcomes"`
+
+	// The policy violations that were allowed through, as the policy is
+	// overridden.
+	PolicyOverrides []PolicyViolation `json:"policy_overrides,omitempty"`
+}
+
+// ruleSetState tracks the status of each rule while a RuleSet is applied.
+type ruleSetState struct {
+	sgStatus   []RuleStatus
+	sgErrs     []error
+	naclStatus []RuleStatus
+	naclErrs   []error
+	policy     Policy
+	overrides  []PolicyViolation
+}
+
+// newRuleSetState returns a ruleSetState with every rule not attempted.
+func newRuleSetState(set RuleSet) *ruleSetState {
+	st := &ruleSetState{
+		sgStatus:   make([]RuleStatus, len(set.SecurityGroupRules)),
+		sgErrs:     make([]error, len(set.SecurityGroupRules)),
+		naclStatus: make([]RuleStatus, len(set.NetworkACLRules)),
+		naclErrs:   make([]error, len(set.NetworkACLRules)),
+		policy:     policyOrDefault(set.Policy),
+	}
+	for i := range st.sgStatus {
+		st.sgStatus[i] = RuleNotAttempted
+	}
+	for i := range st.naclStatus {
+		st.naclStatus[i] = RuleNotAttempted
+	}
+	return st
+}
+
+// override records violations that the policy overrode. They are logged as
+// well, as not every caller reports the result.
+func (st *ruleSetState) override(violations []PolicyViolation) {
+	st.overrides = append(st.overrides, violations...)
+	logPolicyOverrides(violations)
+}
+
+// result renders the state as a RuleSetResult.
+func (st *ruleSetState) result(set RuleSet) RuleSetResult {
+	var r RuleSetResult
+	for i, v := range set.SecurityGroupRules {
+		o := RuleOutcome{Resource: "security_group_rule", ID: securityGroupRuleID(v), Status: st.sgStatus[i]}
+		if st.sgErrs[i] != nil {
+			o.Error = st.sgErrs[i].Error()
+		}
+		r.Outcomes = append(r.Outcomes, o)
+	}
+	for i, v := range set.NetworkACLRules {
+		o := RuleOutcome{Resource: "network_acl_rule", ID: networkACLRuleID(v), Status: st.naclStatus[i]}
+		if st.naclErrs[i] != nil {
+			o.Error = st.naclErrs[i].Error()
+		}
+		r.Outcomes = append(r.Outcomes, o)
+	}
+	r.PolicyOverrides = st.overrides
+	return r
+}
+
+// securityGroupBatch is a set of security group rules that can be authorized
+// or revoked in a single call: the same group and direction.
+type securityGroupBatch struct {
+	group  string
+	egress bool
+}
+
+// batchSecurityGroupRules groups the indexes of security group rules by
+// group and direction, keeping the order in which each batch first appears.
+func batchSecurityGroupRules(rules []SecurityGroupRule) ([]securityGroupBatch, map[securityGroupBatch][]int) {
+	var order []securityGroupBatch
+	batches := make(map[securityGroupBatch][]int)
+	for i, v := range rules {
+		k := securityGroupBatch{group: v.GroupID, egress: v.Egress}
+		if _, ok := batches[k]; ok == false {
+			order = append(order, k)
+		}
+		batches[k] = append(batches[k], i)
+	}
+	return order, batches
+}
+
+// withoutTransientPermissions returns the permissions of a security group,
+// split into one permission per peer, less the ones for transient rules that
+// were created by bastion.
+func withoutTransientPermissions(perms []*ec2.IpPermission, k securityGroupBatch, transient []SecurityGroupRule) []*ec2.IpPermission {
+	if len(transient) < 1 {
+		return perms
+	}
+
+	skip := make(map[string]bool)
+	for _, v := range transient {
+		if v.Created == false || v.PreExisting == true || v.GroupID != k.group || v.Egress != k.egress {
+			continue
+		}
+		perm, err := securityGroupRulePermission(v)
+		if err != nil {
+			continue
+		}
+		for _, item := range flattenPermissions([]*ec2.IpPermission{perm}, k.egress) {
+			skip[item.key()] = true
+		}
+	}
+
+	var out []*ec2.IpPermission
+	for _, item := range flattenPermissions(perms, k.egress) {
+		if skip[item.key()] == false {
+			out = append(out, item.perm)
+		}
+	}
+	return out
+}
+
+// withoutTransientEntries returns a copy of a network ACL without the entries
+// for transient rules that were created by bastion.
+func withoutTransientEntries(acl *ec2.NetworkAcl, id string, transient []NetworkACLRule) *ec2.NetworkAcl {
+	out := *acl
+	out.Entries = nil
+	for _, e := range acl.Entries {
+		keep := true
+		for _, v := range transient {
+			if v.Created == true && v.PreExisting == false && v.NetworkAclID == id &&
+				v.Egress == aws.BoolValue(e.Egress) && int64(v.RuleNumber) == aws.Int64Value(e.RuleNumber) {
+				keep = false
+			}
+		}
+		if keep == true {
+			out.Entries = append(out.Entries, e)
+		}
+	}
+	return &out
+}
+
+// applySecurityGroupBatch applies one batch of security group rules. Rules
+// whose traffic is already allowed, either by the group or by an earlier rule
+// in the batch, are marked pre-existing, and the rest are authorized in a
+// single call.
+func applySecurityGroupBatch(conn *ec2.EC2, set *RuleSet, st *ruleSetState, k securityGroupBatch, idxs []int) error {
+	group, err := describeSecurityGroup(conn, k.group)
+	if err != nil {
+		for _, i := range idxs {
+			st.sgStatus[i], st.sgErrs[i] = RuleFailed, err
+		}
+		return err
+	}
+
+	// Check the whole batch against the policy before authorizing any of it.
+	var overrides []PolicyViolation
+	for _, i := range idxs {
+		out, err := st.policy.enforce(st.policy.CheckSecurityGroupRule(group, set.SecurityGroupRules[i]))
+		if err != nil {
+			st.sgStatus[i], st.sgErrs[i] = RuleFailed, err
+			return err
+		}
+		overrides = append(overrides, out...)
+	}
+	st.override(overrides)
+
+	existing := withoutTransientPermissions(securityGroupPermissions(group, k.egress), k, set.TransientSecurityGroupRules)
+
+	var pending []int
+	var perms []*ec2.IpPermission
+	for _, i := range idxs {
+		rule := set.SecurityGroupRules[i]
+		if permissionsCoverRule(existing, rule) == true {
+			set.SecurityGroupRules[i].PreExisting = true
+			set.SecurityGroupRules[i].Created = true
+			st.sgStatus[i] = RulePreExisting
+			continue
+		}
+
+		// Already validated by ApplyRuleSet.
+		perm, _ := securityGroupRulePermission(rule)
+		perms = append(perms, perm)
+		pending = append(pending, i)
+
+		// Authorizing the same permission twice in one call fails the whole
+		// call, so later rules it covers are treated as pre-existing.
+		existing = append(existing, perm)
+	}
+
+	if len(perms) < 1 {
+		return nil
+	}
+
+	err = authorizeSecurityGroupPermissions(conn, k.group, k.egress, perms)
+	if err != nil {
+		for _, i := range pending {
+			st.sgStatus[i], st.sgErrs[i] = RuleFailed, err
+		}
+		return err
+	}
+
+	for _, i := range pending {
+		set.SecurityGroupRules[i].Created = true
+		st.sgStatus[i] = RuleCreated
+	}
+	return nil
+}
+
+// rollbackRuleSet removes every rule in the set that was created, network
+// ACL rules first, in reverse order, then security group rules, in batches.
+// Rules that cannot be removed are marked as failed, and left marked as
+// created.
+func rollbackRuleSet(conn *ec2.EC2, set *RuleSet, st *ruleSetState) []string {
+	var errs []string
+
+	for i := len(set.NetworkACLRules) - 1; i >= 0; i-- {
+		if st.naclStatus[i] != RuleCreated {
+			continue
+		}
+		out, err := DeleteNetworkACLRule(conn, set.NetworkACLRules[i])
+		if err != nil {
+			st.naclStatus[i], st.naclErrs[i] = RuleFailed, err
+			errs = append(errs, fmt.Sprintf("rolling back network ACL rule %s: %s", networkACLRuleID(set.NetworkACLRules[i]), err))
+			continue
+		}
+		set.NetworkACLRules[i] = out
+		st.naclStatus[i] = RuleRolledBack
+	}
+
+	order, batches := batchSecurityGroupRules(set.SecurityGroupRules)
+	for _, k := range order {
+		var created []int
+		var perms []*ec2.IpPermission
+		for _, i := range batches[k] {
+			if st.sgStatus[i] != RuleCreated {
+				continue
+			}
+			perm, _ := securityGroupRulePermission(set.SecurityGroupRules[i])
+			perms = append(perms, perm)
+			created = append(created, i)
+		}
+		if len(perms) < 1 {
+			continue
+		}
+
+		err := revokeSecurityGroupPermissions(conn, k.group, k.egress, perms)
+		for _, i := range created {
+			if err != nil {
+				st.sgStatus[i], st.sgErrs[i] = RuleFailed, err
+				continue
+			}
+			set.SecurityGroupRules[i].Created = false
+			st.sgStatus[i] = RuleRolledBack
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("rolling back security group %s rules: %s", k.group, err))
+		}
+	}
+
+	return errs
+}
+
+// ApplyRuleSet creates all of the rules in a set, and returns the updated set
+// along with a per-rule report.
+//
+// Security group rules for the same group and direction are authorized in a
+// single call. Rules whose traffic is already allowed are marked
+// PreExisting, as with CreateSecurityGroupRule and CreateNetworkACLRule. For
+// network ACL rules, that is decided by the state of the ACL before the set
+// was applied, so no rule depends on another rule in the same set. Every
+// rule is checked against the set's Policy, and any violations it overrides
+// are logged and returned in the result.
+//
+// If any rule fails, every rule that was created by this call is removed
+// again, and the error is returned. Pre-existing rules are never removed. If
+// the rollback itself fails, the rules that could not be removed are left
+// marked as created in the returned set, so that they can be cleaned up.
+func ApplyRuleSet(conn *ec2.EC2, set RuleSet) (RuleSet, RuleSetResult, error) {
+	set.SecurityGroupRules = append([]SecurityGroupRule(nil), set.SecurityGroupRules...)
+	set.NetworkACLRules = append([]NetworkACLRule(nil), set.NetworkACLRules...)
+	st := newRuleSetState(set)
+
+	// Validate every rule up front, so that bad input fails before anything
+	// is created.
+	for i := range set.SecurityGroupRules {
+		peer, err := normalizeRulePeer(set.SecurityGroupRules[i].Peer)
+		if err == nil {
+			set.SecurityGroupRules[i].Peer = peer
+			_, err = securityGroupRulePermission(set.SecurityGroupRules[i])
+		}
+		if err != nil {
+			st.sgStatus[i], st.sgErrs[i] = RuleFailed, err
+			return set, st.result(set), err
+		}
+	}
+	for i, rule := range set.NetworkACLRules {
+		_, err := networkACLEntryInput(rule, 1)
+		if err != nil {
+			st.naclStatus[i], st.naclErrs[i] = RuleFailed, err
+			return set, st.result(set), err
+		}
+	}
+
+	var failed error
+
+	order, batches := batchSecurityGroupRules(set.SecurityGroupRules)
+	for _, k := range order {
+		failed = applySecurityGroupBatch(conn, &set, st, k, batches[k])
+		if failed != nil {
+			break
+		}
+	}
+
+	if failed == nil {
+		// Each ACL is described before the set adds anything to it, and rules
+		// are only pre-existing if that state allowed them. Otherwise a rule
+		// covered by an entry created earlier in the set would lose its
+		// access when that entry is removed.
+		baselines := make(map[string]*ec2.NetworkAcl)
+		for i, rule := range set.NetworkACLRules {
+			baseline, ok := baselines[rule.NetworkAclID]
+			if ok == false {
+				baseline, failed = describeNetworkACL(conn, rule.NetworkAclID)
+				if failed != nil {
+					st.naclStatus[i], st.naclErrs[i] = RuleFailed, failed
+					break
+				}
+				baseline = withoutTransientEntries(baseline, rule.NetworkAclID, set.TransientNetworkACLRules)
+				baselines[rule.NetworkAclID] = baseline
+			}
+
+			out, overrides, err := createNetworkACLRule(conn, rule, set.Placement, baseline, st.policy)
+			set.NetworkACLRules[i] = out
+			st.override(overrides)
+			if err != nil {
+				st.naclStatus[i], st.naclErrs[i] = RuleFailed, err
+				failed = err
+				break
+			}
+			if out.PreExisting == true {
+				st.naclStatus[i] = RulePreExisting
+			} else {
+				st.naclStatus[i] = RuleCreated
+			}
+		}
+	}
+
+	if failed == nil {
+		return set, st.result(set), nil
+	}
+
+	errs := rollbackRuleSet(conn, &set, st)
+	if len(errs) > 0 {
+		failed = fmt.Errorf("%s (additionally, %s)", failed, strings.Join(errs, "; "))
+	}
+
+	return set, st.result(set), failed
+}
@@ -0,0 +1,259 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// createTestEC2RuleSetMock returns a mock EC2 service to use with the rule
+// set test functions. Mutating calls are recorded in calls, along with the
+// number of permissions for security group calls.
+func createTestEC2RuleSetMock(calls *[]string) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeSecurityGroupsInput:
+			out, err := testDescribeSecurityGroups(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeSecurityGroupsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.AuthorizeSecurityGroupIngressInput:
+			*calls = append(*calls, fmt.Sprintf("authorize %d", len(p.IpPermissions)))
+			_, r.Error = testAuthorizeSecurityGroupIngress(p)
+		case *ec2.AuthorizeSecurityGroupEgressInput:
+			*calls = append(*calls, fmt.Sprintf("authorize egress %d", len(p.IpPermissions)))
+			_, r.Error = testAuthorizeSecurityGroupEgress(p)
+		case *ec2.RevokeSecurityGroupIngressInput:
+			*calls = append(*calls, fmt.Sprintf("revoke %d", len(p.IpPermissions)))
+			_, r.Error = testRevokeSecurityGroupIngress(p)
+		case *ec2.DescribeNetworkAclsInput:
+			out, err := testDescribeNetworkAcls(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeNetworkAclsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.CreateNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("create entry %d", *p.RuleNumber))
+			_, r.Error = testCreateNetworkAclEntry(p)
+		case *ec2.DeleteNetworkAclEntryInput:
+			*calls = append(*calls, fmt.Sprintf("delete entry %d", *p.RuleNumber))
+			_, r.Error = testDeleteNetworkAclEntry(p)
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+// testRuleSet provides a test rule set: two new ingress rules and a
+// pre-existing one on the same security group, and a new network ACL rule.
+func testRuleSet() RuleSet {
+	return RuleSet{
+		SecurityGroupRules: []SecurityGroupRule{
+			SecurityGroupRule{GroupID: "sg-123456", Peer: IPv4CIDRPeer("10.0.1.0/24"), StartPort: 22, EndPort: 22},
+			SecurityGroupRule{GroupID: "sg-123456", Peer: IPv4CIDRPeer("10.0.0.0/24"), StartPort: 22, EndPort: 22},
+			SecurityGroupRule{GroupID: "sg-123456", Peer: IPv4CIDRPeer("10.0.1.0/24"), Protocol: ProtocolUDP, StartPort: 60000, EndPort: 61000},
+		},
+		NetworkACLRules: []NetworkACLRule{
+			NetworkACLRule{NetworkAclID: "nacl-123456", CidrBlock: "10.0.1.0/24", StartPort: 22, EndPort: 22},
+		},
+	}
+}
+
+func TestApplyRuleSet(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	out, result, err := ApplyRuleSet(conn, testRuleSet())
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expectedStatuses := []RuleStatus{RuleCreated, RulePreExisting, RuleCreated, RuleCreated}
+	for i, v := range expectedStatuses {
+		if result.Outcomes[i].Status != v {
+			t.Fatalf("Expected outcome %d to be %v, got %v", i, v, result.Outcomes[i].Status)
+		}
+	}
+
+	// The two new ingress rules should be authorized in a single call.
+	expected := fmt.Sprintf("%v", []string{"authorize 2", "create entry 1"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	for _, v := range out.SecurityGroupRules {
+		if v.Created != true {
+			t.Fatalf("Expected security group rule to be created, got %#v", v)
+		}
+	}
+	if out.SecurityGroupRules[1].PreExisting != true {
+		t.Fatalf("Expected security group rule 1 to be pre-existing")
+	}
+}
+
+func TestApplyRuleSetDuplicate(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	rule := SecurityGroupRule{GroupID: "sg-123456", Peer: IPv4CIDRPeer("10.0.1.0/24"), StartPort: 22, EndPort: 22}
+	set := RuleSet{SecurityGroupRules: []SecurityGroupRule{rule, rule}}
+
+	out, result, err := ApplyRuleSet(conn, set)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if result.Outcomes[0].Status != RuleCreated || result.Outcomes[1].Status != RulePreExisting {
+		t.Fatalf("Expected the first rule to be created and the second pre-existing, got %#v", result.Outcomes)
+	}
+	if out.SecurityGroupRules[1].PreExisting != true {
+		t.Fatalf("Expected the duplicate rule to be pre-existing, got %#v", out.SecurityGroupRules[1])
+	}
+
+	expected := fmt.Sprintf("%v", []string{"authorize 1"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestApplyRuleSetRollback(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	set := testRuleSet()
+	set.NetworkACLRules = append(set.NetworkACLRules, NetworkACLRule{NetworkAclID: "bad", CidrBlock: "10.0.1.0/24", StartPort: 22, EndPort: 22})
+
+	out, result, err := ApplyRuleSet(conn, set)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	expectedStatuses := []RuleStatus{RuleRolledBack, RulePreExisting, RuleRolledBack, RuleRolledBack, RuleFailed}
+	for i, v := range expectedStatuses {
+		if result.Outcomes[i].Status != v {
+			t.Fatalf("Expected outcome %d to be %v, got %v", i, v, result.Outcomes[i].Status)
+		}
+	}
+
+	expected := fmt.Sprintf("%v", []string{"authorize 2", "create entry 1", "delete entry 1", "revoke 2"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+
+	if out.SecurityGroupRules[0].Created != false || out.NetworkACLRules[0].Created != false {
+		t.Fatalf("Expected created rules to be rolled back, got %#v", out)
+	}
+}
+
+func TestApplyRuleSetInvalid(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	set := testRuleSet()
+	set.SecurityGroupRules[2].Protocol = "gre"
+
+	_, result, err := ApplyRuleSet(conn, set)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls for an invalid rule set, got %v", calls)
+	}
+	if result.Outcomes[2].Status != RuleFailed || result.Outcomes[0].Status != RuleNotAttempted {
+		t.Fatalf("Unexpected outcomes %#v", result.Outcomes)
+	}
+}
+
+func TestApplyRuleSetInvalidNetworkACLRule(t *testing.T) {
+	var calls []string
+	conn := createTestEC2RuleSetMock(&calls)
+
+	set := testRuleSet()
+	set.NetworkACLRules[0].CidrBlock = ""
+
+	_, result, err := ApplyRuleSet(conn, set)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if len(calls) != 0 {
+		t.Fatalf("Expected no calls for an invalid rule set, got %v", calls)
+	}
+	if result.Outcomes[3].Status != RuleFailed || result.Outcomes[0].Status != RuleNotAttempted {
+		t.Fatalf("Unexpected outcomes %#v", result.Outcomes)
+	}
+}
+
+func TestApplyRuleSetNetworkACLBaseline(t *testing.T) {
+	var calls []string
+	acl := &ec2.NetworkAcl{
+		NetworkAclId: aws.String("nacl-123456"),
+		Entries: []*ec2.NetworkAclEntry{
+			&ec2.NetworkAclEntry{
+				CidrBlock:  aws.String("0.0.0.0/0"),
+				Egress:     aws.Bool(false),
+				Protocol:   aws.String("-1"),
+				RuleAction: aws.String("deny"),
+				RuleNumber: aws.Int64(32767),
+			},
+		},
+	}
+
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeNetworkAclsInput:
+			*r.Data.(*ec2.DescribeNetworkAclsOutput) = ec2.DescribeNetworkAclsOutput{
+				NetworkAcls: []*ec2.NetworkAcl{acl},
+			}
+		case *ec2.CreateNetworkAclEntryInput:
+			calls = append(calls, fmt.Sprintf("create entry %d", *p.RuleNumber))
+			acl = &ec2.NetworkAcl{
+				NetworkAclId: acl.NetworkAclId,
+				Entries: append(append([]*ec2.NetworkAclEntry(nil), acl.Entries...), &ec2.NetworkAclEntry{
+					CidrBlock:  p.CidrBlock,
+					Egress:     p.Egress,
+					PortRange:  p.PortRange,
+					Protocol:   p.Protocol,
+					RuleAction: p.RuleAction,
+					RuleNumber: p.RuleNumber,
+				}),
+			}
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+
+	// The second rule is covered by the first, but not by the ACL as it was
+	// before the set, so it has to be created too.
+	out, _, err := ApplyRuleSet(conn, RuleSet{
+		NetworkACLRules: []NetworkACLRule{
+			NetworkACLRule{NetworkAclID: "nacl-123456", CidrBlock: "10.0.0.0/16", StartPort: 22, EndPort: 22},
+			NetworkACLRule{NetworkAclID: "nacl-123456", CidrBlock: "10.0.5.0/24", StartPort: 22, EndPort: 22},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	expected := fmt.Sprintf("%v", []string{"create entry 1", "create entry 2"})
+	actual := fmt.Sprintf("%v", calls)
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+	if out.NetworkACLRules[1].PreExisting != false {
+		t.Fatalf("Expected the second rule not to be pre-existing, got %#v", out.NetworkACLRules[1])
+	}
+}
@@ -1,21 +1,31 @@
 package aws
 
 import (
+	"context"
 	"fmt"
-	"math/rand"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
-// securityGroupNamePrefix is the prefix that is applied to auto-generated
-// security group names.
-const securityGroupNamePrefix = "bastion-"
+// securityGroupDuplicateCode is the error code returned by AWS when a
+// security group name is already taken in a VPC.
+const securityGroupDuplicateCode = "InvalidGroup.Duplicate"
 
 // securityGroupDescription is the description that goes into auto-generated
 // security groups.
 const securityGroupDescription = "Managed by bastion"
 
+// securityGroupDeleteBackoff is the initial delay between attempts to delete
+// a security group that still has dependencies. The delay doubles on each
+// attempt, up to securityGroupDeleteMaxBackoff.
+var securityGroupDeleteBackoff = 2 * time.Second
+
+// securityGroupDeleteMaxBackoff is the maximum delay between attempts to
+// delete a security group that still has dependencies.
+var securityGroupDeleteMaxBackoff = 30 * time.Second
+
 // SecurityGroup describes an AWS VPC security group.
 type SecurityGroup struct {
 	_ struct{}
@@ -37,53 +47,67 @@ type SecurityGroup struct {
 
 // findVpcIDFromSubnet finds the VPC ID from a supplied subnet ID.
 func findVpcIDFromSubnet(conn *ec2.EC2, subnet string) (string, error) {
-	params := &ec2.DescribeSubnetsInput{
-		SubnetIds: aws.StringSlice([]string{subnet}),
-	}
-
-	resp, err := conn.DescribeSubnets(params)
+	s, err := describeSubnet(conn, subnet)
 	if err != nil {
 		return "", err
 	}
 
-	if len(resp.Subnets) < 1 {
-		return "", fmt.Errorf("Subnet ID %s not found.", subnet)
-	}
-
-	if len(resp.Subnets) > 1 {
-		panic(fmt.Errorf("More than subnet found for subnet ID  %s", subnet))
-	}
-
-	return *resp.Subnets[0].VpcId, nil
-}
-
-// generateSecurityGroupName creates an randomly-generated security group name.
-func generateSecurityGroupName() string {
-	id := fmt.Sprintf("%x", rand.Int())
-	return securityGroupNamePrefix + id
+	return *s.VpcId, nil
 }
 
-// CreateSecurityGroup creates the security group, and returns a SecurityGroup struct.
+// CreateSecurityGroup creates the security group, named by namer, and
+// returns a SecurityGroup struct. If the name is already taken, a new name is
+// tried.
 //
 // Note that in the event of errors, SecurityGroup will be in an inconsistent
 // state and should not be used.
-func CreateSecurityGroup(conn *ec2.EC2, subnet string) (SecurityGroup, error) {
+func CreateSecurityGroup(conn *ec2.EC2, subnet string, namer Namer) (SecurityGroup, error) {
 	var group SecurityGroup
-	name := generateSecurityGroupName()
 	vpc, err := findVpcIDFromSubnet(conn, subnet)
 	if err != nil {
 		return group, err
 	}
 
+	group.VpcID = vpc
+
+	name, err := createWithUniqueName(namer, securityGroupDuplicateCode, func(name string) error {
+		var err error
+		group, err = createSecurityGroup(conn, vpc, name)
+		return err
+	})
 	group.GroupName = name
+	return group, err
+}
+
+// createPlannedSecurityGroup creates the security group with the name from a
+// plan (see createWithPlannedName).
+func createPlannedSecurityGroup(conn *ec2.EC2, subnet, name string) (SecurityGroup, error) {
+	var group SecurityGroup
+	vpc, err := findVpcIDFromSubnet(conn, subnet)
+	if err != nil {
+		return group, err
+	}
+
 	group.VpcID = vpc
 
+	err = createWithPlannedName(name, "security group", securityGroupDuplicateCode, func(name string) error {
+		var err error
+		group, err = createSecurityGroup(conn, vpc, name)
+		return err
+	})
+	group.GroupName = name
+	return group, err
+}
+
+// createSecurityGroup creates a security group with exactly the supplied
+// name in a VPC.
+func createSecurityGroup(conn *ec2.EC2, vpc, name string) (SecurityGroup, error) {
+	group := SecurityGroup{GroupName: name, VpcID: vpc}
 	params := &ec2.CreateSecurityGroupInput{
 		Description: aws.String(securityGroupDescription),
 		GroupName:   aws.String(name),
 		VpcId:       aws.String(vpc),
 	}
-
 	resp, err := conn.CreateSecurityGroup(params)
 	if err != nil {
 		return group, err
@@ -94,6 +118,27 @@ func CreateSecurityGroup(conn *ec2.EC2, subnet string) (SecurityGroup, error) {
 	return group, nil
 }
 
+// securityGroupNameInUse returns true if a security group with the supplied
+// name exists in a VPC.
+func securityGroupNameInUse(conn *ec2.EC2, vpc, name string) (bool, error) {
+	resp, err := conn.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("group-name"),
+				Values: aws.StringSlice([]string{name}),
+			},
+			&ec2.Filter{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{vpc}),
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.SecurityGroups) > 0, nil
+}
+
 // DeleteSecurityGroup deletes the security group.
 func DeleteSecurityGroup(conn *ec2.EC2, group SecurityGroup) (SecurityGroup, error) {
 	params := &ec2.DeleteSecurityGroupInput{
@@ -108,3 +153,39 @@ func DeleteSecurityGroup(conn *ec2.EC2, group SecurityGroup) (SecurityGroup, err
 	group.Created = false
 	return group, nil
 }
+
+// DeleteSecurityGroupWithContext deletes the security group, retrying with
+// backoff while AWS reports that the group still has dependencies (for
+// example, the network interface of an instance that is still terminating).
+// Retries stop when ctx is done.
+func DeleteSecurityGroupWithContext(ctx context.Context, conn *ec2.EC2, group SecurityGroup) (SecurityGroup, error) {
+	params := &ec2.DeleteSecurityGroupInput{
+		GroupId: aws.String(group.GroupID),
+	}
+
+	delay := securityGroupDeleteBackoff
+	for {
+		_, err := conn.DeleteSecurityGroupWithContext(ctx, params)
+		if err == nil {
+			break
+		}
+
+		if isAWSErrorCode(err, "DependencyViolation") == false {
+			return group, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return group, fmt.Errorf("Security group %s still has dependencies: %s", group.GroupID, err)
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > securityGroupDeleteMaxBackoff {
+			delay = securityGroupDeleteMaxBackoff
+		}
+	}
+
+	group.Created = false
+	return group, nil
+}
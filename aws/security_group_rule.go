@@ -1,18 +1,90 @@
 package aws
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
+// RulePeerType is the kind of source (for ingress rules) or destination (for
+// egress rules) that a security group rule references.
+type RulePeerType string
+
+const (
+	// RulePeerIPv4CIDR is an IPv4 network range, in CIDR notation.
+	RulePeerIPv4CIDR RulePeerType = "ipv4_cidr"
+
+	// RulePeerIPv6CIDR is an IPv6 network range, in CIDR notation.
+	RulePeerIPv6CIDR RulePeerType = "ipv6_cidr"
+
+	// RulePeerSecurityGroup is another security group, optionally owned by
+	// another account.
+	RulePeerSecurityGroup RulePeerType = "security_group"
+
+	// RulePeerPrefixList is a managed prefix list.
+	RulePeerPrefixList RulePeerType = "prefix_list"
+)
+
+// RulePeer is the source or destination of a security group rule. Exactly
+// one kind of peer is referenced, as indicated by Type. Use the IPv4CIDRPeer,
+// IPv6CIDRPeer, SecurityGroupPeer, and PrefixListPeer functions to create
+// one.
+type RulePeer struct {
+	_ struct{}
+
+	// The kind of peer.
+	Type RulePeerType `json:"type"`
+
+	// The CIDR block, security group ID, or prefix list ID, depending on Type.
+	Value string `json:"value"`
+
+	// The ID of the AWS account that owns the security group, for references
+	// to security groups in other accounts. Only used with
+	// RulePeerSecurityGroup.
+	UserID string `json:"user_id,omitempty"`
+}
+
+// IPv4CIDRPeer returns a RulePeer for an IPv4 network range (for example
+// 172.16.0.0/24).
+func IPv4CIDRPeer(cidr string) RulePeer {
+	return RulePeer{Type: RulePeerIPv4CIDR, Value: cidr}
+}
+
+// IPv6CIDRPeer returns a RulePeer for an IPv6 network range (for example
+// 2001:db8::/64).
+func IPv6CIDRPeer(cidr string) RulePeer {
+	return RulePeer{Type: RulePeerIPv6CIDR, Value: cidr}
+}
+
+// SecurityGroupPeer returns a RulePeer for a security group. account can be
+// left empty for security groups in the same account.
+func SecurityGroupPeer(group, account string) RulePeer {
+	return RulePeer{Type: RulePeerSecurityGroup, Value: group, UserID: account}
+}
+
+// PrefixListPeer returns a RulePeer for a managed prefix list.
+func PrefixListPeer(list string) RulePeer {
+	return RulePeer{Type: RulePeerPrefixList, Value: list}
+}
+
+// String returns the peer value, prefixed with the account ID for
+// cross-account security group references.
+func (p RulePeer) String() string {
+	if p.Type == RulePeerSecurityGroup && p.UserID != "" {
+		return p.UserID + "/" + p.Value
+	}
+	return p.Value
+}
+
 // SecurityGroupRule describes an AWS VPC security group rule.
 type SecurityGroupRule struct {
 	_ struct{}
 
-	// The network range to allow or deny, in CIDR notation (for example 172.16.0.0/24).
-	CidrBlock string `json:"cidr_block"`
+	// The source (for ingress rules) or destination (for egress rules) of the
+	// traffic the rule allows.
+	Peer RulePeer `json:"peer"`
 
 	// true if the security group rule has been created, or is accounted for (ie: the
 	// PreExisting flag is set).
@@ -31,106 +103,370 @@ type SecurityGroupRule struct {
 	// The starting port in the range that this rule applies to.
 	EndPort int `json:"end_port"`
 
+	// The protocol the rule applies to: one of tcp, udp, icmp, icmpv6, or
+	// all. An empty protocol is treated as tcp. StartPort and EndPort are only
+	// used for tcp and udp.
+	Protocol string `json:"protocol"`
+
+	// The ICMP type the rule applies to, or -1 for all types. Only used for
+	// icmp and icmpv6.
+	ICMPType int `json:"icmp_type"`
+
+	// The ICMP code the rule applies to, or -1 for all codes. Only used for
+	// icmp and icmpv6.
+	ICMPCode int `json:"icmp_code"`
+
+	// A description of the rule, shown in the AWS console alongside the
+	// peer. Optional.
+	Description string `json:"description,omitempty"`
+
 	// "true" if the rule was pre-existing in the exact form that it was going
 	// to be created in (ie: direction and port). This is necessary to prevent
 	// API errors for duplicate rule entries. Pre-existing rules are not deleted.
 	PreExisting bool `json:"pre_existing"`
 }
 
-// FindPreExistingSecurityGroupRule will check to see if a rule already exists in
-// the security group for a specific direction and port range.
-func FindPreExistingSecurityGroupRule(conn *ec2.EC2, group, cidr string, start, end int, egress bool) (bool, error) {
+// UnmarshalJSON implements json.Unmarshaler for SecurityGroupRule. Rules
+// saved before peers were supported have either a cidr_block field, which is
+// read as an IPv4 CIDR peer, or a source_group_id field, which is read as a
+// security group peer.
+func (r *SecurityGroupRule) UnmarshalJSON(data []byte) error {
+	type rule SecurityGroupRule
+	var v struct {
+		rule
+
+		// The network range of a rule saved in the legacy format.
+		CidrBlock string `json:"cidr_block"`
+
+		// The source security group of a rule saved in the legacy format.
+		SourceGroupID string `json:"source_group_id"`
+	}
+
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	*r = SecurityGroupRule(v.rule)
+	if r.Peer.Type != "" {
+		return nil
+	}
+	switch {
+	case v.SourceGroupID != "":
+		r.Peer = SecurityGroupPeer(v.SourceGroupID, "")
+	case v.CidrBlock != "":
+		r.Peer = IPv4CIDRPeer(v.CidrBlock)
+	}
+	return nil
+}
+
+// securityGroupRulePermission returns the IP permission for a rule.
+func securityGroupRulePermission(rule SecurityGroupRule) (*ec2.IpPermission, error) {
+	protocol, err := NormalizeProtocol(rule.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	perm := &ec2.IpPermission{
+		IpProtocol: aws.String(securityGroupProtocol(protocol)),
+	}
+
+	switch {
+	case protocolUsesPorts(protocol):
+		perm.FromPort = aws.Int64(int64(rule.StartPort))
+		perm.ToPort = aws.Int64(int64(rule.EndPort))
+	case protocolUsesICMP(protocol):
+		// Security groups carry the ICMP type and code in the port fields.
+		perm.FromPort = aws.Int64(int64(rule.ICMPType))
+		perm.ToPort = aws.Int64(int64(rule.ICMPCode))
+	}
+
+	var description *string
+	if rule.Description != "" {
+		description = aws.String(rule.Description)
+	}
+
+	switch rule.Peer.Type {
+	case RulePeerIPv4CIDR:
+		perm.IpRanges = []*ec2.IpRange{
+			&ec2.IpRange{CidrIp: aws.String(rule.Peer.Value), Description: description},
+		}
+	case RulePeerIPv6CIDR:
+		perm.Ipv6Ranges = []*ec2.Ipv6Range{
+			&ec2.Ipv6Range{CidrIpv6: aws.String(rule.Peer.Value), Description: description},
+		}
+	case RulePeerSecurityGroup:
+		pair := &ec2.UserIdGroupPair{GroupId: aws.String(rule.Peer.Value), Description: description}
+		if rule.Peer.UserID != "" {
+			pair.UserId = aws.String(rule.Peer.UserID)
+		}
+		perm.UserIdGroupPairs = []*ec2.UserIdGroupPair{pair}
+	case RulePeerPrefixList:
+		perm.PrefixListIds = []*ec2.PrefixListId{
+			&ec2.PrefixListId{PrefixListId: aws.String(rule.Peer.Value), Description: description},
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported security group rule peer type %q.", rule.Peer.Type)
+	}
+
+	return perm, nil
+}
+
+// permissionCoversPeer returns true if an IP permission applies to all of
+// the traffic from (or to) the supplied peer. CIDR peers are covered by any
+// range of the same address family that contains them; security group and
+// prefix list peers must be referenced directly.
+func permissionCoversPeer(perm *ec2.IpPermission, peer RulePeer) bool {
+	switch peer.Type {
+	case RulePeerIPv4CIDR:
+		for _, x := range perm.IpRanges {
+			if cidrCovers(aws.StringValue(x.CidrIp), peer.Value) {
+				return true
+			}
+		}
+	case RulePeerIPv6CIDR:
+		for _, x := range perm.Ipv6Ranges {
+			if cidrCovers(aws.StringValue(x.CidrIpv6), peer.Value) {
+				return true
+			}
+		}
+	case RulePeerSecurityGroup:
+		for _, x := range perm.UserIdGroupPairs {
+			if aws.StringValue(x.GroupId) != peer.Value {
+				continue
+			}
+			if peer.UserID == "" || aws.StringValue(x.UserId) == peer.UserID {
+				return true
+			}
+		}
+	case RulePeerPrefixList:
+		for _, x := range perm.PrefixListIds {
+			if aws.StringValue(x.PrefixListId) == peer.Value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// permissionCoversTraffic returns true if an IP permission applies to all of
+// the traffic described by a rule's protocol and port range (or ICMP type and
+// code). A permission for all protocols covers everything; otherwise the
+// protocols must match and the permission's port range (or ICMP type and
+// code) must include the rule's.
+func permissionCoversTraffic(perm *ec2.IpPermission, rule SecurityGroupRule) bool {
+	protocol, err := NormalizeProtocol(rule.Protocol)
+	if err != nil {
+		return false
+	}
+
+	permProtocol, err := NormalizeProtocol(aws.StringValue(perm.IpProtocol))
+	if err != nil || protocolCovers(permProtocol, protocol) == false {
+		return false
+	}
+
+	// All protocol permissions have no port range.
+	if permProtocol == ProtocolAll {
+		return true
+	}
+
+	from := int(aws.Int64Value(perm.FromPort))
+	to := int(aws.Int64Value(perm.ToPort))
+	switch {
+	case protocolUsesPorts(protocol):
+		return portRangeCovers(from, to, rule.StartPort, rule.EndPort)
+	case protocolUsesICMP(protocol):
+		return icmpValueCovers(from, rule.ICMPType) && icmpValueCovers(to, rule.ICMPCode)
+	}
+
+	return true
+}
+
+// describeSecurityGroup returns a security group.
+//
+// As the security group may have just been created, not found errors are
+// retried for a short period.
+func describeSecurityGroup(conn *ec2.EC2, group string) (*ec2.SecurityGroup, error) {
 	params := &ec2.DescribeSecurityGroupsInput{
 		GroupIds: aws.StringSlice([]string{group}),
 	}
 
-	resp, err := conn.DescribeSecurityGroups(params)
+	var resp *ec2.DescribeSecurityGroupsOutput
+	err := retryEventualConsistency(func() error {
+		var err error
+		resp, err = conn.DescribeSecurityGroups(params)
+		return err
+	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	if len(resp.SecurityGroups) < 1 {
-		return false, fmt.Errorf("Security group %s not found.", group)
+		return nil, fmt.Errorf("Security group %s not found.", group)
 	}
 
 	if len(resp.SecurityGroups) > 1 {
 		panic(fmt.Errorf("More than one security group found for security group search %s", group))
 	}
 
-	var rules []*ec2.IpPermission
+	return resp.SecurityGroups[0], nil
+}
+
+// securityGroupPermissions returns the ingress or egress permissions of a
+// security group.
+func securityGroupPermissions(group *ec2.SecurityGroup, egress bool) []*ec2.IpPermission {
 	if egress == true {
-		rules = resp.SecurityGroups[0].IpPermissionsEgress
-	} else {
-		rules = resp.SecurityGroups[0].IpPermissions
+		return group.IpPermissionsEgress
 	}
+	return group.IpPermissions
+}
 
-	for _, v := range rules {
-		for _, x := range v.IpRanges {
-			if *x.CidrIp == cidr && int(*v.FromPort) == start && int(*v.ToPort) == end {
-				return true, nil
-			}
+// describeSecurityGroupPermissions returns the ingress or egress permissions
+// of a security group.
+func describeSecurityGroupPermissions(conn *ec2.EC2, group string, egress bool) ([]*ec2.IpPermission, error) {
+	sg, err := describeSecurityGroup(conn, group)
+	if err != nil {
+		return nil, err
+	}
+
+	return securityGroupPermissions(sg, egress), nil
+}
+
+// FindPreExistingSecurityGroupRule will check to see if the traffic a rule
+// describes is already allowed by the security group, for a specific
+// direction. An existing rule counts if it covers the requested one: its
+// protocol is the same (or all protocols), its port range (or ICMP type and
+// code) includes the requested one, and its CIDR block contains the
+// requested one.
+func FindPreExistingSecurityGroupRule(conn *ec2.EC2, rule SecurityGroupRule) (bool, error) {
+	rules, err := describeSecurityGroupPermissions(conn, rule.GroupID, rule.Egress)
+	if err != nil {
+		return false, err
+	}
+
+	return permissionsCoverRule(rules, rule), nil
+}
+
+// permissionsCoverRule returns true if any of a set of IP permissions covers
+// the traffic a rule describes.
+func permissionsCoverRule(perms []*ec2.IpPermission, rule SecurityGroupRule) bool {
+	for _, v := range perms {
+		if permissionCoversPeer(v, rule.Peer) && permissionCoversTraffic(v, rule) {
+			return true
 		}
 	}
 
-	return false, nil
+	return false
 }
 
-// CreateSecurityGroupRule creates a network ACL rule, and returns a
-// NetworkACLRule struct.
+// authorizeSecurityGroupPermissions adds a batch of ingress or egress
+// permissions to a security group in a single call.
 //
-// If the rule already exists, the struct wiil still be populated, however the
-// PreExisting flag will be set to true.
+// As the security group may have just been created, not found errors are
+// retried for a short period.
+func authorizeSecurityGroupPermissions(conn *ec2.EC2, group string, egress bool, perms []*ec2.IpPermission) error {
+	if egress == true {
+		req := &ec2.AuthorizeSecurityGroupEgressInput{
+			GroupId:       aws.String(group),
+			IpPermissions: perms,
+		}
+		return retryEventualConsistency(func() error {
+			_, err := conn.AuthorizeSecurityGroupEgress(req)
+			return err
+		})
+	}
+
+	req := &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(group),
+		IpPermissions: perms,
+	}
+	return retryEventualConsistency(func() error {
+		_, err := conn.AuthorizeSecurityGroupIngress(req)
+		return err
+	})
+}
+
+// revokeSecurityGroupPermissions removes a batch of ingress or egress
+// permissions from a security group in a single call.
+func revokeSecurityGroupPermissions(conn *ec2.EC2, group string, egress bool, perms []*ec2.IpPermission) error {
+	if egress == true {
+		req := &ec2.RevokeSecurityGroupEgressInput{
+			GroupId:       aws.String(group),
+			IpPermissions: perms,
+		}
+		_, err := conn.RevokeSecurityGroupEgress(req)
+		return err
+	}
+
+	req := &ec2.RevokeSecurityGroupIngressInput{
+		GroupId:       aws.String(group),
+		IpPermissions: perms,
+	}
+	_, err := conn.RevokeSecurityGroupIngress(req)
+	return err
+}
+
+// CreateSecurityGroupRule creates a security group rule from the supplied
+// rule's GroupID, Peer, Egress, Protocol, and port range (or ICMP type and
+// code), and returns the updated SecurityGroupRule struct.
+//
+// CIDR peers are normalized (for example, 10.0.1.5/24 becomes 10.0.1.0/24).
+// Rules that break DefaultPolicy are rejected with a PolicyError, unless the
+// policy is overridden, in which case the violations are logged. Use
+// ApplyRuleSet to enforce another policy.
+//
+// If the traffic is already allowed by an existing rule (see
+// FindPreExistingSecurityGroupRule), the struct wiil still be populated,
+// however the PreExisting flag will be set to true.
 //
 // Note that in the event of errors, SecurityGroupRule will be in an inconsistent
 // state and should not be used.
-func CreateSecurityGroupRule(conn *ec2.EC2, group, cidr string, start, end int, egress bool) (SecurityGroupRule, error) {
-	rule := SecurityGroupRule{
-		CidrBlock: cidr,
-		Egress:    egress,
-		GroupID:   group,
-		StartPort: start,
-		EndPort:   end,
+func CreateSecurityGroupRule(conn *ec2.EC2, rule SecurityGroupRule) (SecurityGroupRule, error) {
+	rule, overrides, err := createSecurityGroupRule(conn, rule, DefaultPolicy)
+	logPolicyOverrides(overrides)
+	return rule, err
+}
+
+// createSecurityGroupRule runs the logic for CreateSecurityGroupRule,
+// enforcing the supplied policy, and returns any violations the policy
+// overrode.
+func createSecurityGroupRule(conn *ec2.EC2, rule SecurityGroupRule, policy Policy) (SecurityGroupRule, []PolicyViolation, error) {
+	var err error
+	rule.Peer, err = normalizeRulePeer(rule.Peer)
+	if err != nil {
+		return rule, nil, err
 	}
 
-	// Check for pre-existing rules first
-	exists, err := FindPreExistingSecurityGroupRule(conn, group, cidr, start, end, egress)
+	perm, err := securityGroupRulePermission(rule)
 	if err != nil {
-		return rule, err
+		return rule, nil, err
 	}
-	if exists == true {
+
+	group, err := describeSecurityGroup(conn, rule.GroupID)
+	if err != nil {
+		return rule, nil, err
+	}
+
+	overrides, err := policy.enforce(policy.CheckSecurityGroupRule(group, rule))
+	if err != nil {
+		return rule, nil, err
+	}
+
+	// Check for pre-existing rules first
+	if permissionsCoverRule(securityGroupPermissions(group, rule.Egress), rule) == true {
 		rule.PreExisting = true
 		rule.Created = true
-		return rule, nil
+		return rule, overrides, nil
 	}
 
-	if egress == true {
-		req := &ec2.AuthorizeSecurityGroupEgressInput{
-			CidrIp:     aws.String(cidr),
-			FromPort:   aws.Int64(int64(start)),
-			IpProtocol: aws.String("tcp"),
-			ToPort:     aws.Int64(int64(end)),
-			GroupId:    aws.String(group),
-		}
-		_, err = conn.AuthorizeSecurityGroupEgress(req)
-		if err != nil {
-			return rule, err
-		}
-	} else {
-		req := &ec2.AuthorizeSecurityGroupIngressInput{
-			CidrIp:     aws.String(cidr),
-			FromPort:   aws.Int64(int64(start)),
-			IpProtocol: aws.String("tcp"),
-			ToPort:     aws.Int64(int64(end)),
-			GroupId:    aws.String(group),
-		}
-		_, err = conn.AuthorizeSecurityGroupIngress(req)
-		if err != nil {
-			return rule, err
-		}
+	err = authorizeSecurityGroupPermissions(conn, rule.GroupID, rule.Egress, []*ec2.IpPermission{perm})
+	if err != nil {
+		return rule, nil, err
 	}
 
 	rule.Created = true
-	return rule, nil
+	return rule, overrides, nil
 }
 
 // runSecurityGroupRuleDelete runs most of the logic for
@@ -141,30 +477,14 @@ func runSecurityGroupRuleDelete(conn *ec2.EC2, rule SecurityGroupRule) error {
 		return nil
 	}
 
-	if rule.Egress == true {
-		req := &ec2.RevokeSecurityGroupEgressInput{
-			CidrIp:     aws.String(rule.CidrBlock),
-			FromPort:   aws.Int64(int64(rule.StartPort)),
-			IpProtocol: aws.String("tcp"),
-			ToPort:     aws.Int64(int64(rule.EndPort)),
-			GroupId:    aws.String(rule.GroupID),
-		}
-		_, err := conn.RevokeSecurityGroupEgress(req)
-		if err != nil {
-			return err
-		}
-	} else {
-		req := &ec2.RevokeSecurityGroupIngressInput{
-			CidrIp:     aws.String(rule.CidrBlock),
-			FromPort:   aws.Int64(int64(rule.StartPort)),
-			IpProtocol: aws.String("tcp"),
-			ToPort:     aws.Int64(int64(rule.EndPort)),
-			GroupId:    aws.String(rule.GroupID),
-		}
-		_, err := conn.RevokeSecurityGroupIngress(req)
-		if err != nil {
-			return err
-		}
+	perm, err := securityGroupRulePermission(rule)
+	if err != nil {
+		return err
+	}
+
+	err = revokeSecurityGroupPermissions(conn, rule.GroupID, rule.Egress, []*ec2.IpPermission{perm})
+	if err != nil {
+		return err
 	}
 
 	rule.Created = false
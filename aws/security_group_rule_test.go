@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"testing"
@@ -14,7 +15,7 @@ import (
 // testSecurityGroupRule provides a test network ACL rule.
 func testSecurityGroupRule() SecurityGroupRule {
 	return SecurityGroupRule{
-		CidrBlock:   "10.0.1.0/24",
+		Peer:        IPv4CIDRPeer("10.0.1.0/24"),
 		Created:     true,
 		Egress:      false,
 		GroupID:     "sg-123456",
@@ -45,6 +46,40 @@ func testDescribeSecurityGroupsOutput() *ec2.DescribeSecurityGroupsOutput {
 						IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.0.0/24")}},
 						ToPort:     aws.Int64(22),
 					},
+					&ec2.IpPermission{
+						FromPort:         aws.Int64(22),
+						IpProtocol:       aws.String("tcp"),
+						ToPort:           aws.Int64(22),
+						UserIdGroupPairs: []*ec2.UserIdGroupPair{&ec2.UserIdGroupPair{GroupId: aws.String("sg-654321"), UserId: aws.String("123456789012")}},
+					},
+					&ec2.IpPermission{
+						FromPort:   aws.Int64(22),
+						IpProtocol: aws.String("tcp"),
+						Ipv6Ranges: []*ec2.Ipv6Range{&ec2.Ipv6Range{CidrIpv6: aws.String("2001:db8::/64")}},
+						ToPort:     aws.Int64(22),
+					},
+					&ec2.IpPermission{
+						FromPort:      aws.Int64(22),
+						IpProtocol:    aws.String("tcp"),
+						PrefixListIds: []*ec2.PrefixListId{&ec2.PrefixListId{PrefixListId: aws.String("pl-123456")}},
+						ToPort:        aws.Int64(22),
+					},
+					&ec2.IpPermission{
+						FromPort:   aws.Int64(60000),
+						IpProtocol: aws.String("udp"),
+						IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.2.0/24")}},
+						ToPort:     aws.Int64(61000),
+					},
+					&ec2.IpPermission{
+						FromPort:   aws.Int64(3),
+						IpProtocol: aws.String("icmp"),
+						IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.2.0/24")}},
+						ToPort:     aws.Int64(4),
+					},
+					&ec2.IpPermission{
+						IpProtocol: aws.String("-1"),
+						IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.3.0/24")}},
+					},
 				},
 				IpPermissionsEgress: []*ec2.IpPermission{
 					&ec2.IpPermission{
@@ -153,32 +188,92 @@ func createTestEC2SGRMock() *ec2.EC2 {
 
 func TestFindPreExistingSecurityGroupRule(t *testing.T) {
 	conn := createTestEC2SGRMock()
-	group := "sg-123456"
-	cidr := "10.0.0.0/24"
-	start := 22
-	end := 22
-	egress := false
-
-	expected := true
-	actual, err := FindPreExistingSecurityGroupRule(conn, group, cidr, start, end, egress)
-	if err != nil {
-		t.Fatalf("Bad: %s", err.Error())
+
+	cases := []struct {
+		peer     RulePeer
+		egress   bool
+		expected bool
+	}{
+		{peer: IPv4CIDRPeer("10.0.0.0/24"), expected: true},
+		{peer: IPv4CIDRPeer("10.0.1.0/24"), expected: false},
+		{peer: IPv4CIDRPeer("10.0.1.0/24"), egress: true, expected: true},
+		{peer: IPv6CIDRPeer("2001:db8::/64"), expected: true},
+		{peer: SecurityGroupPeer("sg-654321", ""), expected: true},
+		{peer: SecurityGroupPeer("sg-654321", "123456789012"), expected: true},
+		{peer: SecurityGroupPeer("sg-654321", "210987654321"), expected: false},
+		{peer: SecurityGroupPeer("sg-111111", ""), expected: false},
+		{peer: PrefixListPeer("pl-123456"), expected: true},
+		{peer: IPv4CIDRPeer("10.0.0.5/24"), expected: true},
+		{peer: IPv4CIDRPeer("10.0.0.128/25"), expected: true},
+		{peer: IPv4CIDRPeer("10.0.0.0/23"), expected: false},
+		{peer: IPv6CIDRPeer("2001:db8::/80"), expected: true},
+		{peer: IPv6CIDRPeer("2001:db8::/48"), expected: false},
 	}
-	if expected != actual {
-		t.Fatalf("Expected %v, got %v", expected, actual)
+
+	for _, c := range cases {
+		rule := SecurityGroupRule{
+			GroupID:   "sg-123456",
+			Peer:      c.peer,
+			Egress:    c.egress,
+			StartPort: 22,
+			EndPort:   22,
+		}
+		actual, err := FindPreExistingSecurityGroupRule(conn, rule)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if c.expected != actual {
+			t.Fatalf("Expected %v for %#v, got %v", c.expected, c.peer, actual)
+		}
+	}
+}
+
+func TestFindPreExistingSecurityGroupRuleProtocols(t *testing.T) {
+	conn := createTestEC2SGRMock()
+
+	cases := []struct {
+		rule     SecurityGroupRule
+		expected bool
+	}{
+		{rule: SecurityGroupRule{Protocol: ProtocolUDP, StartPort: 60000, EndPort: 61000}, expected: true},
+		{rule: SecurityGroupRule{Protocol: ProtocolTCP, StartPort: 60000, EndPort: 61000}, expected: false},
+		{rule: SecurityGroupRule{Protocol: ProtocolICMP, ICMPType: 3, ICMPCode: 4}, expected: true},
+		{rule: SecurityGroupRule{Protocol: ProtocolICMP, ICMPType: 3, ICMPCode: -1}, expected: false},
+		{rule: SecurityGroupRule{Protocol: ProtocolAll, Peer: IPv4CIDRPeer("10.0.3.0/24")}, expected: true},
+		{rule: SecurityGroupRule{Protocol: ProtocolUDP, StartPort: 60100, EndPort: 60200}, expected: true},
+		{rule: SecurityGroupRule{Protocol: ProtocolUDP, StartPort: 59000, EndPort: 60200}, expected: false},
+		{rule: SecurityGroupRule{Protocol: ProtocolTCP, StartPort: 22, EndPort: 22, Peer: IPv4CIDRPeer("10.0.3.0/24")}, expected: true},
+		{rule: SecurityGroupRule{Protocol: ProtocolICMP, ICMPType: 3, ICMPCode: 4, Peer: IPv4CIDRPeer("10.0.3.128/25")}, expected: true},
+	}
+
+	for _, c := range cases {
+		rule := c.rule
+		rule.GroupID = "sg-123456"
+		if rule.Peer.Type == "" {
+			rule.Peer = IPv4CIDRPeer("10.0.2.0/24")
+		}
+		actual, err := FindPreExistingSecurityGroupRule(conn, rule)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if c.expected != actual {
+			t.Fatalf("Expected %v for %#v, got %v", c.expected, c.rule, actual)
+		}
 	}
 }
 
 func TestCreateSecurityGroupRule(t *testing.T) {
 	conn := createTestEC2SGRMock()
 	expected := testSecurityGroupRule()
-	group := expected.GroupID
-	cidr := expected.CidrBlock
-	start := expected.StartPort
-	end := expected.EndPort
-	egress := expected.Egress
+	spec := SecurityGroupRule{
+		GroupID:   expected.GroupID,
+		Peer:      expected.Peer,
+		StartPort: expected.StartPort,
+		EndPort:   expected.EndPort,
+		Egress:    expected.Egress,
+	}
 
-	actual, err := CreateSecurityGroupRule(conn, group, cidr, start, end, egress)
+	actual, err := CreateSecurityGroupRule(conn, spec)
 	if err != nil {
 		t.Fatalf("Bad: %s", err.Error())
 	}
@@ -188,6 +283,78 @@ func TestCreateSecurityGroupRule(t *testing.T) {
 	}
 }
 
+func TestCreateSecurityGroupRulePeers(t *testing.T) {
+	conn := createTestEC2SGRMock()
+
+	peers := []RulePeer{
+		IPv6CIDRPeer("2001:db8:1::/64"),
+		SecurityGroupPeer("sg-111111", "123456789012"),
+		PrefixListPeer("pl-654321"),
+	}
+	for _, peer := range peers {
+		rule := SecurityGroupRule{
+			GroupID:   "sg-123456",
+			Peer:      peer,
+			StartPort: 22,
+			EndPort:   22,
+		}
+		out, err := CreateSecurityGroupRule(conn, rule)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if out.Created != true || out.PreExisting != false {
+			t.Fatalf("Expected rule for %#v to be created, got %#v", peer, out)
+		}
+	}
+}
+
+func TestSecurityGroupRulePermissionProtocols(t *testing.T) {
+	cases := []struct {
+		rule     SecurityGroupRule
+		protocol string
+		from     *int64
+		to       *int64
+	}{
+		{rule: SecurityGroupRule{StartPort: 22, EndPort: 22}, protocol: "tcp", from: aws.Int64(22), to: aws.Int64(22)},
+		{rule: SecurityGroupRule{Protocol: "UDP", StartPort: 60000, EndPort: 61000}, protocol: "udp", from: aws.Int64(60000), to: aws.Int64(61000)},
+		{rule: SecurityGroupRule{Protocol: ProtocolICMP, ICMPType: 3, ICMPCode: 4}, protocol: "icmp", from: aws.Int64(3), to: aws.Int64(4)},
+		{rule: SecurityGroupRule{Protocol: ProtocolAll, StartPort: 22, EndPort: 22}, protocol: "-1"},
+	}
+
+	for _, c := range cases {
+		c.rule.Peer = IPv4CIDRPeer("10.0.2.0/24")
+		perm, err := securityGroupRulePermission(c.rule)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if *perm.IpProtocol != c.protocol {
+			t.Fatalf("Expected protocol %v, got %v", c.protocol, *perm.IpProtocol)
+		}
+		if aws.Int64Value(perm.FromPort) != aws.Int64Value(c.from) || aws.Int64Value(perm.ToPort) != aws.Int64Value(c.to) {
+			t.Fatalf("Expected ports %v-%v for %s, got %v-%v", aws.Int64Value(c.from), aws.Int64Value(c.to), c.protocol, aws.Int64Value(perm.FromPort), aws.Int64Value(perm.ToPort))
+		}
+		if (perm.FromPort == nil) != (c.from == nil) {
+			t.Fatalf("Expected ports to be set for %s: %v", c.protocol, c.from != nil)
+		}
+	}
+
+	_, err := securityGroupRulePermission(SecurityGroupRule{Protocol: "gre", Peer: IPv4CIDRPeer("10.0.2.0/24")})
+	if err == nil {
+		t.Fatalf("Expected error for unsupported protocol")
+	}
+}
+
+func TestCreateSecurityGroupRuleBadPeer(t *testing.T) {
+	conn := createTestEC2SGRMock()
+	rule := testSecurityGroupRule()
+	rule.Peer = RulePeer{Type: "bad", Value: "bad"}
+
+	_, err := CreateSecurityGroupRule(conn, rule)
+	if err == nil {
+		t.Fatalf("Expected error, got none")
+	}
+}
+
 func TestDeleteSecurityGroupRule(t *testing.T) {
 	conn := createTestEC2SGRMock()
 	expected := testSecurityGroupRule()
@@ -203,3 +370,73 @@ func TestDeleteSecurityGroupRule(t *testing.T) {
 		t.Fatalf("Expected %#v, got %#v", expected, actual)
 	}
 }
+
+func TestSecurityGroupRuleUnmarshalLegacy(t *testing.T) {
+	// A rule as saved before peers were supported.
+	data := []byte(`{
+		"cidr_block": "10.0.1.0/24",
+		"created": true,
+		"egress": false,
+		"security_group_id": "sg-123456",
+		"start_port": 22,
+		"end_port": 22,
+		"pre_existing": false
+	}`)
+
+	var actual SecurityGroupRule
+	err := json.Unmarshal(data, &actual)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	expected := testSecurityGroupRule()
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+
+	// Rules in the current format round-trip unchanged.
+	expected.Peer = SecurityGroupPeer("sg-654321", "123456789012")
+	data, err = json.Marshal(expected)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	actual = SecurityGroupRule{}
+	err = json.Unmarshal(data, &actual)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+}
+
+func TestSecurityGroupRuleUnmarshalLegacySourceGroup(t *testing.T) {
+	// A target access rule as saved before peers were supported.
+	data := []byte(`{
+		"created": true,
+		"egress": false,
+		"security_group_id": "sg-123456",
+		"source_group_id": "sg-654321",
+		"start_port": 22,
+		"end_port": 22,
+		"pre_existing": false
+	}`)
+
+	var actual SecurityGroupRule
+	err := json.Unmarshal(data, &actual)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+
+	expected := testSecurityGroupRule()
+	expected.Peer = SecurityGroupPeer("sg-654321", "")
+	if reflect.DeepEqual(expected, actual) == false {
+		t.Fatalf("Expected %#v, got %#v", expected, actual)
+	}
+
+	// The rule can be turned back into a permission for teardown.
+	_, err = securityGroupRulePermission(actual)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+}
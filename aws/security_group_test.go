@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -55,6 +56,9 @@ func testCreateSecurityGroup(input *ec2.CreateSecurityGroupInput) (*ec2.CreateSe
 	if *input.GroupName == "bad" {
 		return nil, fmt.Errorf("error")
 	}
+	if *input.GroupName == "bastion-duplicate" {
+		return nil, awserr.New("InvalidGroup.Duplicate", "duplicate", nil)
+	}
 	out := &ec2.CreateSecurityGroupOutput{
 		GroupId: aws.String("sg-123456"),
 	}
@@ -125,7 +129,7 @@ func TestCreateSecurityGroup(t *testing.T) {
 	expectedCreated := true
 	expectedSgNameStart := "bastion-"
 
-	out, err := CreateSecurityGroup(conn, subnet)
+	out, err := CreateSecurityGroup(conn, subnet, Namer{SessionID: "abcdefgh0123456789"})
 	if err != nil {
 		t.Fatalf("Bad: %s", err.Error())
 	}
@@ -146,6 +150,24 @@ func TestCreateSecurityGroup(t *testing.T) {
 	}
 }
 
+func TestCreateSecurityGroupDuplicate(t *testing.T) {
+	conn := createTestEC2SGMock()
+	subnet := "subnet-123456"
+
+	expectedSgNameStart := "bastion-duplicate-"
+
+	out, err := CreateSecurityGroup(conn, subnet, Namer{SessionID: "duplicate"})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	actualSgName := out.GroupName
+	matched, _ := regexp.MatchString("^"+expectedSgNameStart+"[0-9a-f]+$", actualSgName)
+	if matched != true {
+		t.Fatalf("Expected name to start with %v, but name is %v", expectedSgNameStart, actualSgName)
+	}
+}
+
 func TestDeleteSecurityGroup(t *testing.T) {
 	conn := createTestEC2SGMock()
 	group := testSecurityGroup()
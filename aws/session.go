@@ -0,0 +1,658 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/paybyphone/bastion-go/clientip"
+)
+
+// Clients holds the AWS service clients that bastion sessions are managed
+// with.
+type Clients struct {
+	_ struct{}
+
+	// The EC2 client.
+	EC2 *ec2.EC2
+
+	// The Route 53 client. This is only required if a DNS record is
+	// requested.
+	Route53 Route53API
+}
+
+// Session describes all of the AWS resources that make up a single bastion
+// session. It is the state that is persisted between launch and teardown.
+type Session struct {
+	_ struct{}
+
+	// The session ID. Resource names are derived from this.
+	ID string `json:"id"`
+
+	// The network range that SSH access is currently open to, in CIDR
+	// notation.
+	ClientCIDR string `json:"client_cidr"`
+
+	// The key pair used to log into the bastion host.
+	KeyPair KeyPair `json:"key_pair"`
+
+	// The security group the bastion host is launched in.
+	SecurityGroup SecurityGroup `json:"security_group"`
+
+	// The security group rules that have been added for the session.
+	SecurityGroupRules []SecurityGroupRule `json:"security_group_rules"`
+
+	// The individual network ACL rules that have been added for the session.
+	NetworkACLRules []NetworkACLRule `json:"network_acl_rules"`
+
+	// The network ACL rules that have been added for the session along with
+	// their return traffic rules.
+	NetworkACLRulePairs []NetworkACLRulePair `json:"network_acl_rule_pairs"`
+
+	// The bastion host.
+	Instance Instance `json:"instance"`
+
+	// The Elastic IP address associated with the bastion host, if one was
+	// requested.
+	ElasticIP ElasticIP `json:"elastic_ip"`
+
+	// The DNS record pointing to the bastion host, if one was requested.
+	DNSRecord DNSRecord `json:"dns_record"`
+
+	// How the bastion subnet was chosen, if it was selected automatically.
+	SubnetSelection *SubnetSelection `json:"subnet_selection,omitempty"`
+
+	// The policy violations that were allowed through while adding the
+	// session's rules, as the policy was overridden.
+	PolicyOverrides []PolicyViolation `json:"policy_overrides,omitempty"`
+
+	// Anything about the launch that the user should be told about, such as
+	// a client address resolver failing, or the discovered address being
+	// shared carrier-grade NAT space.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// The state of the shared security groups and network ACLs that the
+	// session changes, captured before they were changed. See
+	// CheckTeardownDrift.
+	Snapshot StateSnapshot `json:"snapshot"`
+}
+
+// sshPort is the port that SSH access is opened on.
+const sshPort = 22
+
+// LaunchOptions describes the options for launching a bastion session.
+type LaunchOptions struct {
+	_ struct{}
+
+	// The public subnet to launch the bastion host in. If this is empty, one
+	// is selected using SubnetTarget.
+	SubnetID string
+
+	// The VPC or target host used to select a public subnet, when SubnetID is
+	// not supplied.
+	SubnetTarget SubnetTarget
+
+	// The network range that SSH access to the bastion host is allowed from,
+	// in CIDR notation. This may be an IPv4 or IPv6 range. If this is empty
+	// and Allowlist has no entries, the client's public address is discovered
+	// using ClientAddress.
+	ClientCIDR string
+
+	// The options for discovering the client's public address when
+	// ClientCIDR is not supplied. The resolvers default to
+	// clientip.DefaultResolvers, and can be replaced (for example, in tests).
+	// Discovery is bounded by ClientAddress.Timeout; use
+	// LaunchSessionWithContext to cancel it.
+	ClientAddress clientip.Options
+
+	// The named network ranges that SSH access to the bastion host is also
+	// allowed from. Each entry gets its own security group rule and network
+	// ACL rule pair. See LoadAllowlist and SyncAllowlist.
+	Allowlist Allowlist
+
+	// The network ACL to add SSH access to. If this is empty, the network ACL
+	// in effect for SubnetID is used.
+	NetworkACLID string
+
+	// The operating system of the client, used to choose the ephemeral port
+	// range that return traffic is allowed to: linux, windows, or macos. If
+	// this is empty, all ephemeral ports are allowed. This also applies to
+	// allowlist entries.
+	ClientOS string
+
+	// The placement strategy for new network ACL entries. This is also used
+	// for target access entries, unless TargetAccess sets its own. Defaults
+	// to DefaultRulePlacement.
+	NetworkACLPlacement RulePlacement
+
+	// The policy every rule the session adds is checked against, including
+	// target access rules, unless TargetAccess sets its own. Defaults to
+	// DefaultPolicy. Violations that the policy overrides are recorded in the
+	// session's PolicyOverrides.
+	Policy *Policy
+
+	// The naming options for the session's resources. The session ID is
+	// filled in by LaunchSession, unless it is already set (as it is by
+	// ApplyPlan).
+	Namer Namer
+
+	// true if the bastion host should have an Elastic IP address, so that
+	// its public address stays the same between sessions.
+	ElasticIP bool
+
+	// The tag used to find an existing Elastic IP address to reuse. If this
+	// is empty, a new address is always allocated.
+	ElasticIPTagKey string
+
+	// The value of ElasticIPTagKey that the address must have.
+	ElasticIPTagValue string
+
+	// The Route 53 hosted zone to add a DNS record for the bastion host to.
+	// If this is empty, no record is added.
+	HostedZoneID string
+
+	// The fully qualified name of the DNS record (for example,
+	// bastion.staging.internal).
+	DNSName string
+
+	// true if the DNS record should point to the public address of the
+	// bastion host. By default, it points to the private address, so that the
+	// name can be used from inside the VPC.
+	DNSUsePublicIP bool
+
+	// The private host to give the bastion host access to. If neither an
+	// instance ID or network interface ID is set, no access is granted.
+	TargetAccess TargetAccessOptions
+
+	// The instance options for the bastion host, such as IPv6 assignment.
+	Instance InstanceOptions
+
+	// The key pair and security group names from a plan, set by ApplyPlan.
+	// They are used as is, rather than generated by Namer, and are never
+	// changed to get around a collision.
+	plannedKeyPairName       string
+	plannedSecurityGroupName string
+}
+
+// isIPv6CIDR returns true if cidr is an IPv6 network range.
+func isIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// resolveClientCIDR returns the normalized client CIDR for a launch. If none
+// was supplied and there is no allowlist, the client's public address is
+// discovered, and any warnings from discovery are returned along with it. An
+// empty CIDR is returned for allowlist-only launches. Discovery stops when ctx
+// is done, or after opts.ClientAddress.Timeout.
+func resolveClientCIDR(ctx context.Context, opts LaunchOptions) (string, []string, error) {
+	if opts.ClientCIDR != "" {
+		cidr, err := normalizeCIDR(opts.ClientCIDR)
+		return cidr, nil, err
+	}
+
+	if len(opts.Allowlist.Entries) > 0 {
+		return "", nil, nil
+	}
+
+	result, err := clientip.Discover(ctx, opts.ClientAddress)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cidr, err := normalizeCIDR(result.CIDR)
+	return cidr, result.Warnings, err
+}
+
+// openLaunchClientAccess creates the security group rule and network ACL
+// rule pair that allow SSH access from the session's client CIDR, as a
+// single RuleSet in the network ACL opts.NetworkACLID, and returns the
+// session with them added. If any of the rules cannot be created, the others
+// are rolled back. Rules that could not be rolled back are left in the
+// session, so that teardown removes them. The session's allowlist rules do
+// not count as allowing the client (see allowlistTransientRules).
+func openLaunchClientAccess(conn *ec2.EC2, s Session, opts LaunchOptions) (Session, error) {
+	acl := opts.NetworkACLID
+	ephemeral, err := EphemeralPortsForOS(opts.ClientOS)
+	if err != nil {
+		return s, err
+	}
+
+	s.Snapshot, err = SnapshotNetworkACL(conn, s.Snapshot, acl)
+	if err != nil {
+		return s, err
+	}
+
+	peer := clientPeer(s.ClientCIDR)
+	naclSpec := NetworkACLRule{
+		NetworkAclID: acl,
+		StartPort:    sshPort,
+		EndPort:      sshPort,
+	}
+	if peer.Type == RulePeerIPv6CIDR {
+		naclSpec.Ipv6CidrBlock = s.ClientCIDR
+	} else {
+		naclSpec.CidrBlock = s.ClientCIDR
+	}
+	pair := NewNetworkACLRulePair(naclSpec, ephemeral)
+
+	transientSGRs, transientRules := allowlistTransientRules(s, s.ClientCIDR)
+	set, result, err := ApplyRuleSet(conn, RuleSet{
+		SecurityGroupRules: []SecurityGroupRule{
+			SecurityGroupRule{
+				GroupID:   s.SecurityGroup.GroupID,
+				Peer:      peer,
+				StartPort: sshPort,
+				EndPort:   sshPort,
+			},
+		},
+		NetworkACLRules:             []NetworkACLRule{pair.Forward, pair.Return},
+		Placement:                   opts.NetworkACLPlacement,
+		Policy:                      opts.Policy,
+		TransientSecurityGroupRules: transientSGRs,
+		TransientNetworkACLRules:    transientRules,
+	})
+	s.PolicyOverrides = append(s.PolicyOverrides, result.PolicyOverrides...)
+	s.SecurityGroupRules = append(s.SecurityGroupRules, set.SecurityGroupRules...)
+	s.NetworkACLRulePairs = append(s.NetworkACLRulePairs, NetworkACLRulePair{
+		Forward: set.NetworkACLRules[0],
+		Return:  set.NetworkACLRules[1],
+	})
+	return s, err
+}
+
+// LaunchSession creates all of the resources for a bastion session, and
+// launches the bastion host.
+//
+// Note that in the event of errors, the Session will contain the resources
+// that were created before the error, and should be passed to
+// TeardownSession to clean them up.
+func LaunchSession(clients Clients, opts LaunchOptions) (Session, error) {
+	return LaunchSessionWithContext(context.Background(), clients, opts)
+}
+
+// LaunchSessionWithContext is LaunchSession, with a context that bounds the
+// discovery of the client's public address when ClientCIDR is not supplied.
+// Discovery is abandoned, and an error returned, when ctx is done.
+func LaunchSessionWithContext(ctx context.Context, clients Clients, opts LaunchOptions) (Session, error) {
+	conn := clients.EC2
+	var s Session
+
+	if opts.SubnetID == "" {
+		selection, err := SelectPublicSubnet(conn, opts.SubnetTarget)
+		if err != nil {
+			return s, err
+		}
+		opts.SubnetID = selection.SubnetID
+		s.SubnetSelection = &selection
+	}
+
+	// Fail fast if the bastion host could never be reached.
+	err := ValidatePublicSubnetForInstance(conn, opts.SubnetID, opts.Instance)
+	if err != nil {
+		return s, err
+	}
+
+	s.ClientCIDR, s.Warnings, err = resolveClientCIDR(ctx, opts)
+	if err != nil {
+		return s, err
+	}
+
+	namer := opts.Namer
+	if namer.SessionID == "" {
+		namer.SessionID, err = NewSessionID()
+		if err != nil {
+			return s, err
+		}
+	}
+	s.ID = namer.SessionID
+
+	if opts.plannedKeyPairName != "" {
+		s.KeyPair, err = createPlannedKeyPair(conn, opts.plannedKeyPairName)
+	} else {
+		s.KeyPair, err = CreateKeyPair(conn, namer)
+	}
+	if err != nil {
+		return s, err
+	}
+
+	if opts.plannedSecurityGroupName != "" {
+		s.SecurityGroup, err = createPlannedSecurityGroup(conn, opts.SubnetID, opts.plannedSecurityGroupName)
+	} else {
+		s.SecurityGroup, err = CreateSecurityGroup(conn, opts.SubnetID, namer)
+	}
+	if err != nil {
+		return s, err
+	}
+
+	if opts.NetworkACLID == "" {
+		opts.NetworkACLID, err = FindNetworkACLForSubnet(conn, opts.SubnetID)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	// The allowlist goes first, so that its rules never rely on the client's
+	// rules, which move with the client.
+	if len(opts.Allowlist.Entries) > 0 {
+		s, _, err = SyncAllowlist(conn, s, opts.Allowlist, AllowlistOptions{
+			NetworkACLID: opts.NetworkACLID,
+			ClientOS:     opts.ClientOS,
+			Placement:    opts.NetworkACLPlacement,
+			Policy:       opts.Policy,
+		})
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if s.ClientCIDR != "" {
+		s, err = openLaunchClientAccess(conn, s, opts)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if opts.ElasticIP == true {
+		s.ElasticIP, err = AllocateElasticIP(conn, opts.ElasticIPTagKey, opts.ElasticIPTagValue)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	s.Instance, err = CreateInstance(conn, opts.SubnetID, s.SecurityGroup.GroupID, s.KeyPair, opts.Instance)
+	if err != nil {
+		return s, err
+	}
+
+	if s.ElasticIP.Created == true {
+		s.ElasticIP, s.Instance, err = AssociateElasticIP(conn, s.ElasticIP, s.Instance)
+		if err != nil {
+			return s, err
+		}
+
+		// Associating the Elastic IP replaces the address SSH was checked
+		// on, so check again on the address clients will actually use.
+		if opts.Instance.ConnectIPv6 == false {
+			err = waitForSSH(s.Instance.PublicIPAddress, s.Instance.SSHUser, s.KeyPair, startTimeout)
+			if err != nil {
+				return s, err
+			}
+		}
+	}
+
+	if opts.TargetAccess.InstanceID != "" || opts.TargetAccess.NetworkInterfaceID != "" {
+		if opts.TargetAccess.Placement == nil {
+			opts.TargetAccess.Placement = opts.NetworkACLPlacement
+		}
+		if opts.TargetAccess.Policy == nil {
+			opts.TargetAccess.Policy = opts.Policy
+		}
+		s.Snapshot, err = snapshotTargetAccess(conn, s.Snapshot, s.Instance, opts.TargetAccess)
+		if err != nil {
+			return s, err
+		}
+		sgrs, pairs, result, err := GrantTargetAccess(conn, s.Instance, opts.TargetAccess)
+		s.PolicyOverrides = append(s.PolicyOverrides, result.PolicyOverrides...)
+		s.SecurityGroupRules = append(s.SecurityGroupRules, sgrs...)
+		s.NetworkACLRulePairs = append(s.NetworkACLRulePairs, pairs...)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	if opts.HostedZoneID != "" {
+		addr := s.Instance.PrivateIPAddress
+		if opts.DNSUsePublicIP == true {
+			addr = s.Instance.PublicIPAddress
+		}
+		s.DNSRecord, err = CreateDNSRecord(clients.Route53, opts.HostedZoneID, opts.DNSName, addr)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	return s, nil
+}
+
+// TeardownStatus is the outcome of tearing down a single resource.
+type TeardownStatus string
+
+const (
+	// TeardownDeleted means the resource was deleted.
+	TeardownDeleted TeardownStatus = "deleted"
+
+	// TeardownSkippedPreExisting means the resource existed before the session
+	// and was left alone.
+	TeardownSkippedPreExisting TeardownStatus = "skipped_pre_existing"
+
+	// TeardownSkippedNotCreated means the resource was never created, or has
+	// already been deleted.
+	TeardownSkippedNotCreated TeardownStatus = "skipped_not_created"
+
+	// TeardownFailed means the resource could not be deleted.
+	TeardownFailed TeardownStatus = "failed"
+)
+
+// TeardownResult describes the outcome of tearing down a single resource.
+type TeardownResult struct {
+	_ struct{}
+
+	// The kind of resource (for example, "instance").
+	Resource string `json:"resource"`
+
+	// The identifier of the resource.
+	ID string `json:"id"`
+
+	// The outcome.
+	Status TeardownStatus `json:"status"`
+
+	// The error message, if Status is TeardownFailed.
+	Error string `json:"error,omitempty"`
+}
+
+// TeardownReport is the per-resource report produced by TeardownSession.
+type TeardownReport struct {
+	_ struct{}
+
+	// The results, in the order the resources were torn down.
+	Results []TeardownResult `json:"results"`
+}
+
+// add records the outcome of a single resource in the report.
+func (r *TeardownReport) add(resource, id string, status TeardownStatus, err error) {
+	result := TeardownResult{
+		Resource: resource,
+		ID:       id,
+		Status:   status,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.Results = append(r.Results, result)
+}
+
+// Err returns an error summarizing any failures in the report, or nil if
+// there were none.
+func (r TeardownReport) Err() error {
+	var failed []string
+	for _, v := range r.Results {
+		if v.Status == TeardownFailed {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", v.Resource, v.ID, v.Error))
+		}
+	}
+
+	if len(failed) < 1 {
+		return nil
+	}
+
+	return fmt.Errorf("Teardown failed for %d resource(s):\n%s", len(failed), strings.Join(failed, "\n"))
+}
+
+// String renders the report as a human-readable table.
+func (r TeardownReport) String() string {
+	var lines []string
+	for _, v := range r.Results {
+		line := fmt.Sprintf("%-20s %-30s %s", v.Resource, v.ID, v.Status)
+		if v.Error != "" {
+			line += ": " + v.Error
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// securityGroupRuleID returns a description of a security group rule to use
+// in reports.
+func securityGroupRuleID(rule SecurityGroupRule) string {
+	return fmt.Sprintf("%s/%s/%d-%d", rule.GroupID, rule.Peer, rule.StartPort, rule.EndPort)
+}
+
+// networkACLRuleID returns a description of a network ACL rule to use in
+// reports.
+func networkACLRuleID(rule NetworkACLRule) string {
+	return fmt.Sprintf("%s/%d", rule.NetworkAclID, rule.RuleNumber)
+}
+
+// networkACLRulePairID returns a description of a network ACL rule pair to
+// use in reports.
+func networkACLRulePairID(pair NetworkACLRulePair) string {
+	return fmt.Sprintf("%s/%d+%d", pair.Forward.NetworkAclID, pair.Forward.RuleNumber, pair.Return.RuleNumber)
+}
+
+// TeardownSession deletes all of the resources in a session, in dependency
+// order: the DNS record and rules first, then the instance (waiting for it to
+// terminate), then the Elastic IP address, the security group, and finally
+// the key pair.
+//
+// Teardown continues past failures. The returned Session reflects what is
+// still left over, and the report records what happened to each resource.
+// Waiting for termination and retrying security group deletion both stop
+// when ctx is done. Use CheckTeardownDrift afterwards to confirm that shared
+// security groups and network ACLs were left as they were found.
+func TeardownSession(ctx context.Context, clients Clients, s Session) (Session, TeardownReport) {
+	conn := clients.EC2
+	var report TeardownReport
+
+	switch {
+	case s.DNSRecord.Created == false:
+		report.add("dns_record", s.DNSRecord.Name, TeardownSkippedNotCreated, nil)
+	case s.DNSRecord.PreExisting == true:
+		s.DNSRecord.Created = false
+		report.add("dns_record", s.DNSRecord.Name, TeardownSkippedPreExisting, nil)
+	default:
+		out, err := DeleteDNSRecord(clients.Route53, s.DNSRecord)
+		s.DNSRecord = out
+		report.add("dns_record", s.DNSRecord.Name, teardownStatus(err), err)
+	}
+
+	// Copy the rule slices so that the caller's session is left untouched.
+	s.SecurityGroupRules = append([]SecurityGroupRule(nil), s.SecurityGroupRules...)
+	s.NetworkACLRules = append([]NetworkACLRule(nil), s.NetworkACLRules...)
+	s.NetworkACLRulePairs = append([]NetworkACLRulePair(nil), s.NetworkACLRulePairs...)
+
+	for i, rule := range s.SecurityGroupRules {
+		id := securityGroupRuleID(rule)
+		switch {
+		case rule.Created == false:
+			report.add("security_group_rule", id, TeardownSkippedNotCreated, nil)
+		case rule.PreExisting == true:
+			s.SecurityGroupRules[i].Created = false
+			report.add("security_group_rule", id, TeardownSkippedPreExisting, nil)
+		default:
+			out, err := DeleteSecurityGroupRule(conn, rule)
+			s.SecurityGroupRules[i] = out
+			report.add("security_group_rule", id, teardownStatus(err), err)
+		}
+	}
+
+	for i, rule := range s.NetworkACLRules {
+		id := networkACLRuleID(rule)
+		switch {
+		case rule.Created == false:
+			report.add("network_acl_rule", id, TeardownSkippedNotCreated, nil)
+		case rule.PreExisting == true:
+			s.NetworkACLRules[i].Created = false
+			report.add("network_acl_rule", id, TeardownSkippedPreExisting, nil)
+		default:
+			out, err := DeleteNetworkACLRule(conn, rule)
+			s.NetworkACLRules[i] = out
+			report.add("network_acl_rule", id, teardownStatus(err), err)
+		}
+	}
+
+	for i, pair := range s.NetworkACLRulePairs {
+		id := networkACLRulePairID(pair)
+		switch {
+		case pair.Created() == false:
+			report.add("network_acl_rule_pair", id, TeardownSkippedNotCreated, nil)
+		case pair.PreExisting() == true:
+			s.NetworkACLRulePairs[i].Forward.Created = false
+			s.NetworkACLRulePairs[i].Return.Created = false
+			report.add("network_acl_rule_pair", id, TeardownSkippedPreExisting, nil)
+		default:
+			out, err := DeleteNetworkACLRulePair(conn, pair)
+			s.NetworkACLRulePairs[i] = out
+			report.add("network_acl_rule_pair", id, teardownStatus(err), err)
+		}
+	}
+
+	if s.Instance.Created == true {
+		out, err := DeleteInstance(conn, s.Instance)
+		if err == nil {
+			err = WaitForInstanceTermination(ctx, conn, s.Instance.InstanceID)
+		}
+		if err == nil {
+			s.Instance = out
+		}
+		report.add("instance", s.Instance.InstanceID, teardownStatus(err), err)
+	} else {
+		report.add("instance", s.Instance.InstanceID, TeardownSkippedNotCreated, nil)
+	}
+
+	switch {
+	case s.ElasticIP.Created == false:
+		report.add("elastic_ip", s.ElasticIP.AllocationID, TeardownSkippedNotCreated, nil)
+	case s.ElasticIP.PreExisting == true:
+		out, err := ReleaseElasticIP(conn, s.ElasticIP)
+		s.ElasticIP = out
+		status := TeardownSkippedPreExisting
+		if err != nil {
+			status = TeardownFailed
+		}
+		report.add("elastic_ip", s.ElasticIP.AllocationID, status, err)
+	default:
+		out, err := ReleaseElasticIP(conn, s.ElasticIP)
+		s.ElasticIP = out
+		report.add("elastic_ip", s.ElasticIP.AllocationID, teardownStatus(err), err)
+	}
+
+	if s.SecurityGroup.Created == true {
+		out, err := DeleteSecurityGroupWithContext(ctx, conn, s.SecurityGroup)
+		s.SecurityGroup = out
+		report.add("security_group", s.SecurityGroup.GroupID, teardownStatus(err), err)
+	} else {
+		report.add("security_group", s.SecurityGroup.GroupID, TeardownSkippedNotCreated, nil)
+	}
+
+	if s.KeyPair.Created == true {
+		out, err := DeleteKeyPair(conn, s.KeyPair)
+		s.KeyPair = out
+		report.add("key_pair", s.KeyPair.KeyName, teardownStatus(err), err)
+	} else {
+		report.add("key_pair", s.KeyPair.KeyName, TeardownSkippedNotCreated, nil)
+	}
+
+	return s, report
+}
+
+// teardownStatus returns the TeardownStatus for the error returned by a
+// delete call.
+func teardownStatus(err error) TeardownStatus {
+	if err != nil {
+		return TeardownFailed
+	}
+	return TeardownDeleted
+}
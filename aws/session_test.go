@@ -0,0 +1,336 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/paybyphone/bastion-go/clientip"
+)
+
+// testSession provides a test session, with a pre-existing security group
+// rule, a created network ACL rule, and a created network ACL rule pair.
+func testSession() Session {
+	sgr := testSecurityGroupRule()
+	sgr.PreExisting = true
+
+	pair := NewNetworkACLRulePair(testNetworkACLRule(), EphemeralPortsAny)
+	pair.Return.RuleNumber = 2
+	pair.Return.Created = true
+
+	return Session{
+		ID:                  "abcdef0123456789",
+		KeyPair:             testKeyPair(),
+		SecurityGroup:       testSecurityGroup(),
+		SecurityGroupRules:  []SecurityGroupRule{sgr},
+		NetworkACLRules:     []NetworkACLRule{testNetworkACLRule()},
+		NetworkACLRulePairs: []NetworkACLRulePair{pair},
+		Instance:            testInstance(),
+		ElasticIP:           testElasticIP(),
+		DNSRecord:           testDNSRecord(),
+	}
+}
+
+// testTeardownMock holds the state for the teardown mock.
+type testTeardownMock struct {
+	// The number of DescribeInstances calls that report the instance as
+	// shutting down before it is reported as terminated.
+	shuttingDown int
+
+	// The number of DeleteSecurityGroup calls that fail with a
+	// DependencyViolation before succeeding.
+	dependencyViolations int
+
+	// The calls that have been made, in order.
+	calls []string
+}
+
+// describeInstances is a stub function for testing the
+// ec2.DescribeInstances function during teardown.
+func (m *testTeardownMock) describeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	state := ec2.InstanceStateNameTerminated
+	if m.shuttingDown > 0 {
+		m.shuttingDown--
+		state = ec2.InstanceStateNameShuttingDown
+	}
+
+	out := testDescribeInstancesOutput()
+	out.Reservations[0].Instances[0].State.Name = aws.String(state)
+	return out, nil
+}
+
+// deleteSecurityGroup is a stub function for testing the
+// ec2.DeleteSecurityGroup function during teardown.
+func (m *testTeardownMock) deleteSecurityGroup(input *ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+	if m.dependencyViolations > 0 {
+		m.dependencyViolations--
+		return nil, awserr.New("DependencyViolation", "resource has a dependent object", nil)
+	}
+	return testDeleteSecurityGroup(input)
+}
+
+// createTestEC2TeardownMock returns a mock EC2 service to use with the
+// session teardown functions.
+func createTestEC2TeardownMock(m *testTeardownMock) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		m.calls = append(m.calls, r.Operation.Name)
+		switch p := r.Params.(type) {
+		case *ec2.RevokeSecurityGroupIngressInput:
+			out, err := testRevokeSecurityGroupIngress(p)
+			if out != nil {
+				*r.Data.(*ec2.RevokeSecurityGroupIngressOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DeleteNetworkAclEntryInput:
+			out, err := testDeleteNetworkAclEntry(p)
+			if out != nil {
+				*r.Data.(*ec2.DeleteNetworkAclEntryOutput) = *out
+			}
+			r.Error = err
+		case *ec2.TerminateInstancesInput:
+			out, err := testTerminateInstances(p)
+			if out != nil {
+				*r.Data.(*ec2.TerminateInstancesOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DescribeInstancesInput:
+			out, err := m.describeInstances(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeInstancesOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DisassociateAddressInput:
+			out, err := testDisassociateAddress(p)
+			if out != nil {
+				*r.Data.(*ec2.DisassociateAddressOutput) = *out
+			}
+			r.Error = err
+		case *ec2.ReleaseAddressInput:
+			out, err := testReleaseAddress(p)
+			if out != nil {
+				*r.Data.(*ec2.ReleaseAddressOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DeleteSecurityGroupInput:
+			out, err := m.deleteSecurityGroup(p)
+			if out != nil {
+				*r.Data.(*ec2.DeleteSecurityGroupOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DeleteKeyPairInput:
+			out, err := testDeleteKeyPair(p)
+			if out != nil {
+				*r.Data.(*ec2.DeleteKeyPairOutput) = *out
+			}
+			r.Error = err
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+// shortenTeardownDelays shortens the polling and backoff delays used during
+// teardown, and returns a function that restores them.
+func shortenTeardownDelays() func() {
+	poll := instancePollInterval
+	backoff := securityGroupDeleteBackoff
+	instancePollInterval = time.Millisecond
+	securityGroupDeleteBackoff = time.Millisecond
+	return func() {
+		instancePollInterval = poll
+		securityGroupDeleteBackoff = backoff
+	}
+}
+
+func TestTeardownSession(t *testing.T) {
+	defer shortenTeardownDelays()()
+	m := &testTeardownMock{shuttingDown: 2, dependencyViolations: 2}
+	conn := createTestEC2TeardownMock(m)
+	dns := newTestRoute53()
+	s := testSession()
+	dns.records["bastion.staging.internal."] = s.DNSRecord.Value
+
+	out, report := TeardownSession(context.Background(), Clients{EC2: conn, Route53: dns}, s)
+	if err := report.Err(); err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expectedStatuses := []TeardownStatus{
+		TeardownDeleted,
+		TeardownSkippedPreExisting,
+		TeardownDeleted,
+		TeardownDeleted,
+		TeardownDeleted,
+		TeardownDeleted,
+		TeardownDeleted,
+		TeardownDeleted,
+	}
+	if len(report.Results) != len(expectedStatuses) {
+		t.Fatalf("Expected %d results, got %d", len(expectedStatuses), len(report.Results))
+	}
+	for i, v := range expectedStatuses {
+		if report.Results[i].Status != v {
+			t.Fatalf("Expected result %d (%s) to be %v, got %v", i, report.Results[i].Resource, v, report.Results[i].Status)
+		}
+	}
+
+	if out.DNSRecord.Created || out.Instance.Created || out.ElasticIP.Created || out.SecurityGroup.Created || out.KeyPair.Created {
+		t.Fatalf("Expected all resources to be marked deleted, got %#v", out)
+	}
+	if s.NetworkACLRules[0].Created != true {
+		t.Fatalf("Expected the original session to be left untouched")
+	}
+
+	// The security group should only be deleted after the instance is
+	// reported as terminated.
+	lastDescribe, firstDelete := -1, -1
+	for i, v := range m.calls {
+		if v == "DescribeInstances" {
+			lastDescribe = i
+		}
+		if v == "DeleteSecurityGroup" && firstDelete < 0 {
+			firstDelete = i
+		}
+	}
+	if lastDescribe > firstDelete {
+		t.Fatalf("Expected security group to be deleted after instance termination, got calls %v", m.calls)
+	}
+}
+
+func TestTeardownSessionTimeout(t *testing.T) {
+	defer shortenTeardownDelays()()
+	m := &testTeardownMock{shuttingDown: 1000000, dependencyViolations: 1000000}
+	conn := createTestEC2TeardownMock(m)
+	s := testSession()
+	s.DNSRecord = DNSRecord{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	out, report := TeardownSession(ctx, Clients{EC2: conn}, s)
+	if report.Err() == nil {
+		t.Fatalf("Expected error, got none")
+	}
+
+	for _, v := range report.Results {
+		if v.Resource == "instance" && v.Status != TeardownFailed {
+			t.Fatalf("Expected instance teardown to fail, got %v", v.Status)
+		}
+		if v.Resource == "key_pair" && v.Status != TeardownDeleted {
+			t.Fatalf("Expected key pair to be deleted, got %v", v.Status)
+		}
+	}
+
+	if out.Instance.Created != true || out.SecurityGroup.Created != true {
+		t.Fatalf("Expected instance and security group to still be marked created, got %#v", out)
+	}
+}
+
+// testClientResolver is a clientip.Resolver that returns a fixed address or
+// error.
+type testClientResolver struct {
+	source string
+	ip     string
+	err    error
+}
+
+// Source implements clientip.Resolver for testClientResolver.
+func (r testClientResolver) Source() string {
+	return r.source
+}
+
+// Resolve implements clientip.Resolver for testClientResolver.
+func (r testClientResolver) Resolve(ctx context.Context) (net.IP, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return net.ParseIP(r.ip), nil
+}
+
+func TestResolveClientCIDR(t *testing.T) {
+	opts := LaunchOptions{
+		ClientAddress: clientip.Options{
+			Resolvers: []clientip.Resolver{
+				testClientResolver{source: "echo", ip: "100.64.1.2"},
+				testClientResolver{source: "dns", err: fmt.Errorf("timeout")},
+			},
+		},
+	}
+
+	cidr, warnings, err := resolveClientCIDR(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+	if cidr != "100.64.1.2/32" {
+		t.Fatalf("Expected 100.64.1.2/32, got %s", cidr)
+	}
+
+	// Both the failed resolver and the CGNAT address should be reported.
+	if len(warnings) != 2 || strings.Contains(warnings[0], "dns: timeout") == false || strings.Contains(warnings[1], "carrier-grade NAT") == false {
+		t.Fatalf("Unexpected warnings %v", warnings)
+	}
+
+	// An explicit CIDR is used without discovery.
+	opts.ClientCIDR = "203.0.113.7"
+	opts.ClientAddress.Resolvers = []clientip.Resolver{testClientResolver{source: "echo", err: fmt.Errorf("should not be called")}}
+	_, _, err = resolveClientCIDR(context.Background(), opts)
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid CIDR")
+	}
+	opts.ClientCIDR = "203.0.113.7/32"
+	cidr, warnings, err = resolveClientCIDR(context.Background(), opts)
+	if err != nil || cidr != "203.0.113.7/32" || len(warnings) != 0 {
+		t.Fatalf("Expected 203.0.113.7/32 with no warnings, got %s, %v, %v", cidr, warnings, err)
+	}
+
+	// Allowlist-only launches have no client CIDR.
+	opts.ClientCIDR = ""
+	opts.Allowlist.Entries = testAllowlistEntries()
+	cidr, _, err = resolveClientCIDR(context.Background(), opts)
+	if err != nil || cidr != "" {
+		t.Fatalf("Expected no client CIDR for an allowlist-only launch, got %q, %v", cidr, err)
+	}
+}
+
+func TestResolveClientCIDRCanceled(t *testing.T) {
+	opts := LaunchOptions{
+		ClientAddress: clientip.Options{
+			Resolvers: []clientip.Resolver{testBlockingResolver{}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := resolveClientCIDR(ctx, opts)
+	if err == nil {
+		t.Fatalf("Expected an error when discovery is canceled")
+	}
+}
+
+// testBlockingResolver is a clientip.Resolver that only returns when its
+// context is done.
+type testBlockingResolver struct{}
+
+// Source implements clientip.Resolver for testBlockingResolver.
+func (r testBlockingResolver) Source() string {
+	return "blocking"
+}
+
+// Resolve implements clientip.Resolver for testBlockingResolver.
+func (r testBlockingResolver) Resolve(ctx context.Context) (net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
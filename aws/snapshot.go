@@ -0,0 +1,642 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// SecurityGroupSnapshot is the full rule set of a security group at a point
+// in time.
+type SecurityGroupSnapshot struct {
+	_ struct{}
+
+	// The ID of the security group.
+	GroupID string `json:"security_group_id"`
+
+	// The ingress permissions.
+	Ingress []*ec2.IpPermission `json:"ingress"`
+
+	// The egress permissions.
+	Egress []*ec2.IpPermission `json:"egress"`
+}
+
+// NetworkACLSnapshot is the full entry list of a network ACL at a point in
+// time.
+type NetworkACLSnapshot struct {
+	_ struct{}
+
+	// The ID of the network ACL.
+	NetworkAclID string `json:"network_acl_id"`
+
+	// The entries, both ingress and egress.
+	Entries []*ec2.NetworkAclEntry `json:"entries"`
+}
+
+// StateSnapshot is the state of the shared security groups and network ACLs
+// that a session changes, captured before the first change to each.
+type StateSnapshot struct {
+	_ struct{}
+
+	// The security groups.
+	SecurityGroups []SecurityGroupSnapshot `json:"security_groups"`
+
+	// The network ACLs.
+	NetworkACLs []NetworkACLSnapshot `json:"network_acls"`
+}
+
+// hasSecurityGroup returns true if a security group has been captured.
+func (s StateSnapshot) hasSecurityGroup(group string) bool {
+	for _, v := range s.SecurityGroups {
+		if v.GroupID == group {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNetworkACL returns true if a network ACL has been captured.
+func (s StateSnapshot) hasNetworkACL(acl string) bool {
+	for _, v := range s.NetworkACLs {
+		if v.NetworkAclID == acl {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapshotSecurityGroup adds the current rules of a security group to a
+// snapshot, and returns the updated snapshot. Security groups that are
+// already in the snapshot are left as they were first captured.
+func SnapshotSecurityGroup(conn *ec2.EC2, snap StateSnapshot, group string) (StateSnapshot, error) {
+	if snap.hasSecurityGroup(group) == true {
+		return snap, nil
+	}
+
+	sg, err := describeSecurityGroup(conn, group)
+	if err != nil {
+		return snap, err
+	}
+
+	snap.SecurityGroups = append(snap.SecurityGroups, SecurityGroupSnapshot{
+		GroupID: group,
+		Ingress: sg.IpPermissions,
+		Egress:  sg.IpPermissionsEgress,
+	})
+	return snap, nil
+}
+
+// SnapshotNetworkACL adds the current entries of a network ACL to a
+// snapshot, and returns the updated snapshot. Network ACLs that are already
+// in the snapshot are left as they were first captured.
+func SnapshotNetworkACL(conn *ec2.EC2, snap StateSnapshot, acl string) (StateSnapshot, error) {
+	if snap.hasNetworkACL(acl) == true {
+		return snap, nil
+	}
+
+	out, err := describeNetworkACL(conn, acl)
+	if err != nil {
+		return snap, err
+	}
+
+	snap.NetworkACLs = append(snap.NetworkACLs, NetworkACLSnapshot{
+		NetworkAclID: acl,
+		Entries:      out.Entries,
+	})
+	return snap, nil
+}
+
+// snapshotTargetAccess captures the security groups and network ACL that
+// GrantTargetAccess will change for a target.
+func snapshotTargetAccess(conn *ec2.EC2, snap StateSnapshot, bastion Instance, opts TargetAccessOptions) (StateSnapshot, error) {
+	target, err := findAccessTarget(conn, opts)
+	if err != nil {
+		return snap, err
+	}
+
+	for _, v := range target.groupIDs {
+		snap, err = SnapshotSecurityGroup(conn, snap, v)
+		if err != nil {
+			return snap, err
+		}
+	}
+
+	if target.subnetID == bastion.SubnetID {
+		return snap, nil
+	}
+
+	acl, err := FindNetworkACLForSubnet(conn, target.subnetID)
+	if err != nil {
+		return snap, err
+	}
+	return SnapshotNetworkACL(conn, snap, acl)
+}
+
+// securityGroupItem is a single security group rule: one peer of one
+// permission, in one direction.
+type securityGroupItem struct {
+	egress bool
+	perm   *ec2.IpPermission
+}
+
+// key returns a string identifying the rule, ignoring its description.
+func (i securityGroupItem) key() string {
+	direction := "ingress"
+	if i.egress == true {
+		direction = "egress"
+	}
+
+	var peer string
+	switch {
+	case len(i.perm.IpRanges) > 0:
+		peer = aws.StringValue(i.perm.IpRanges[0].CidrIp)
+	case len(i.perm.Ipv6Ranges) > 0:
+		peer = aws.StringValue(i.perm.Ipv6Ranges[0].CidrIpv6)
+	case len(i.perm.UserIdGroupPairs) > 0:
+		peer = aws.StringValue(i.perm.UserIdGroupPairs[0].GroupId)
+	case len(i.perm.PrefixListIds) > 0:
+		peer = aws.StringValue(i.perm.PrefixListIds[0].PrefixListId)
+	}
+
+	return fmt.Sprintf("%s %s %d-%d %s", direction, aws.StringValue(i.perm.IpProtocol),
+		aws.Int64Value(i.perm.FromPort), aws.Int64Value(i.perm.ToPort), peer)
+}
+
+// flattenPermissions splits permissions into one item per peer, so that
+// they can be compared rule by rule.
+func flattenPermissions(perms []*ec2.IpPermission, egress bool) []securityGroupItem {
+	var out []securityGroupItem
+	for _, p := range perms {
+		base := ec2.IpPermission{
+			FromPort:   p.FromPort,
+			IpProtocol: p.IpProtocol,
+			ToPort:     p.ToPort,
+		}
+		for _, v := range p.IpRanges {
+			perm := base
+			perm.IpRanges = []*ec2.IpRange{v}
+			out = append(out, securityGroupItem{egress: egress, perm: &perm})
+		}
+		for _, v := range p.Ipv6Ranges {
+			perm := base
+			perm.Ipv6Ranges = []*ec2.Ipv6Range{v}
+			out = append(out, securityGroupItem{egress: egress, perm: &perm})
+		}
+		for _, v := range p.UserIdGroupPairs {
+			perm := base
+			perm.UserIdGroupPairs = []*ec2.UserIdGroupPair{v}
+			out = append(out, securityGroupItem{egress: egress, perm: &perm})
+		}
+		for _, v := range p.PrefixListIds {
+			perm := base
+			perm.PrefixListIds = []*ec2.PrefixListId{v}
+			out = append(out, securityGroupItem{egress: egress, perm: &perm})
+		}
+	}
+	return out
+}
+
+// networkACLItemKey returns a string identifying a network ACL entry.
+func networkACLItemKey(e *ec2.NetworkAclEntry) string {
+	direction := "ingress"
+	if aws.BoolValue(e.Egress) == true {
+		direction = "egress"
+	}
+
+	detail := ""
+	if e.PortRange != nil {
+		detail = fmt.Sprintf(" %d-%d", aws.Int64Value(e.PortRange.From), aws.Int64Value(e.PortRange.To))
+	}
+	if e.IcmpTypeCode != nil {
+		detail = fmt.Sprintf(" type %d code %d", aws.Int64Value(e.IcmpTypeCode.Type), aws.Int64Value(e.IcmpTypeCode.Code))
+	}
+
+	return fmt.Sprintf("%s #%d %s %s%s %s%s", direction, aws.Int64Value(e.RuleNumber), aws.StringValue(e.RuleAction),
+		aws.StringValue(e.Protocol), detail, aws.StringValue(e.CidrBlock), aws.StringValue(e.Ipv6CidrBlock))
+}
+
+// ResourceDrift describes how a single security group or network ACL
+// differs from its snapshot.
+type ResourceDrift struct {
+	_ struct{}
+
+	// The kind of resource: "security_group" or "network_acl".
+	Resource string `json:"resource"`
+
+	// The ID of the resource.
+	ID string `json:"id"`
+
+	// The rules that exist now, but not in the snapshot.
+	Added []string `json:"added"`
+
+	// The rules that were in the snapshot, but no longer exist.
+	Removed []string `json:"removed"`
+
+	// The added and removed rules that the session did not create or
+	// delete, such as changes made by someone else while it was running.
+	// They are left alone when drift is reverted. Only CheckTeardownDrift
+	// and RestoreSnapshot know which rules are the session's.
+	Foreign []string `json:"foreign,omitempty"`
+}
+
+// DriftReport is the result of comparing the live state of the resources in
+// a snapshot against it.
+type DriftReport struct {
+	_ struct{}
+
+	// The resources that differ from the snapshot. Resources that match are
+	// not included.
+	Drift []ResourceDrift `json:"drift"`
+}
+
+// Clean returns true if every resource matches its snapshot.
+func (r DriftReport) Clean() bool {
+	return len(r.Drift) < 1
+}
+
+// String renders the report as human-readable text.
+func (r DriftReport) String() string {
+	if r.Clean() == true {
+		return "No drift."
+	}
+
+	var lines []string
+	for _, v := range r.Drift {
+		lines = append(lines, fmt.Sprintf("%s %s:", v.Resource, v.ID))
+		foreign := make(map[string]bool)
+		for _, x := range v.Foreign {
+			foreign[x] = true
+		}
+		for _, x := range v.Added {
+			lines = append(lines, "  + "+x+foreignSuffix(foreign[x]))
+		}
+		for _, x := range v.Removed {
+			lines = append(lines, "  - "+x+foreignSuffix(foreign[x]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// foreignSuffix returns the note added to a foreign rule in a report.
+func foreignSuffix(foreign bool) string {
+	if foreign == true {
+		return " (foreign)"
+	}
+	return ""
+}
+
+// securityGroupDrift is the drift of a single security group, along with
+// the rules needed to revert it.
+type securityGroupDrift struct {
+	group   string
+	added   []securityGroupItem
+	removed []securityGroupItem
+}
+
+// networkACLDrift is the drift of a single network ACL, along with the
+// entries needed to revert it.
+type networkACLDrift struct {
+	acl     string
+	added   []*ec2.NetworkAclEntry
+	removed []*ec2.NetworkAclEntry
+}
+
+// diffKeys compares two lists of keys, and returns the indexes of the keys
+// only in live (added) and the indexes of the keys only in snapshot
+// (removed).
+func diffKeys(snapshot, live []string) ([]int, []int) {
+	before := make(map[string]bool)
+	for _, v := range snapshot {
+		before[v] = true
+	}
+	after := make(map[string]bool)
+	for _, v := range live {
+		after[v] = true
+	}
+
+	var added, removed []int
+	for i, v := range live {
+		if before[v] == false {
+			added = append(added, i)
+		}
+	}
+	for i, v := range snapshot {
+		if after[v] == false {
+			removed = append(removed, i)
+		}
+	}
+	return added, removed
+}
+
+// securityGroupItemKeys returns the keys of a set of security group rules.
+func securityGroupItemKeys(items []securityGroupItem) []string {
+	var out []string
+	for _, v := range items {
+		out = append(out, v.key())
+	}
+	return out
+}
+
+// networkACLItemKeys returns the keys of a set of network ACL entries.
+func networkACLItemKeys(entries []*ec2.NetworkAclEntry) []string {
+	var out []string
+	for _, v := range entries {
+		out = append(out, networkACLItemKey(v))
+	}
+	return out
+}
+
+// sortedStrings returns a sorted copy of a list of strings.
+func sortedStrings(in []string) []string {
+	out := append([]string(nil), in...)
+	sort.Strings(out)
+	return out
+}
+
+// diffSnapshot compares the live state of every resource in a snapshot
+// against it.
+func diffSnapshot(conn *ec2.EC2, snap StateSnapshot) ([]securityGroupDrift, []networkACLDrift, DriftReport, error) {
+	var sgDrift []securityGroupDrift
+	var naclDrift []networkACLDrift
+	var report DriftReport
+
+	for _, v := range snap.SecurityGroups {
+		live, err := describeSecurityGroup(conn, v.GroupID)
+		if err != nil {
+			return sgDrift, naclDrift, report, err
+		}
+
+		before := append(flattenPermissions(v.Ingress, false), flattenPermissions(v.Egress, true)...)
+		after := append(flattenPermissions(live.IpPermissions, false), flattenPermissions(live.IpPermissionsEgress, true)...)
+		addedIdx, removedIdx := diffKeys(securityGroupItemKeys(before), securityGroupItemKeys(after))
+		if len(addedIdx) < 1 && len(removedIdx) < 1 {
+			continue
+		}
+
+		d := securityGroupDrift{group: v.GroupID}
+		for _, i := range addedIdx {
+			d.added = append(d.added, after[i])
+		}
+		for _, i := range removedIdx {
+			d.removed = append(d.removed, before[i])
+		}
+		sgDrift = append(sgDrift, d)
+		report.Drift = append(report.Drift, ResourceDrift{
+			Resource: "security_group",
+			ID:       v.GroupID,
+			Added:    sortedStrings(securityGroupItemKeys(d.added)),
+			Removed:  sortedStrings(securityGroupItemKeys(d.removed)),
+		})
+	}
+
+	for _, v := range snap.NetworkACLs {
+		live, err := describeNetworkACL(conn, v.NetworkAclID)
+		if err != nil {
+			return sgDrift, naclDrift, report, err
+		}
+
+		addedIdx, removedIdx := diffKeys(networkACLItemKeys(v.Entries), networkACLItemKeys(live.Entries))
+		if len(addedIdx) < 1 && len(removedIdx) < 1 {
+			continue
+		}
+
+		d := networkACLDrift{acl: v.NetworkAclID}
+		for _, i := range addedIdx {
+			d.added = append(d.added, live.Entries[i])
+		}
+		for _, i := range removedIdx {
+			d.removed = append(d.removed, v.Entries[i])
+		}
+		naclDrift = append(naclDrift, d)
+		report.Drift = append(report.Drift, ResourceDrift{
+			Resource: "network_acl",
+			ID:       v.NetworkAclID,
+			Added:    sortedStrings(networkACLItemKeys(d.added)),
+			Removed:  sortedStrings(networkACLItemKeys(d.removed)),
+		})
+	}
+
+	return sgDrift, naclDrift, report, nil
+}
+
+// DiffSnapshot compares the live state of every security group and network
+// ACL in a snapshot against it, and reports the rules that have been added
+// or removed since. Rule descriptions are not compared.
+func DiffSnapshot(conn *ec2.EC2, snap StateSnapshot) (DriftReport, error) {
+	_, _, report, err := diffSnapshot(conn, snap)
+	return report, err
+}
+
+// sessionRuleKeys returns the keys of the security group rules and network
+// ACL entries that a session created, even if they have since been deleted.
+// Security group rules are keyed by group and rule, and network ACL entries
+// by ACL, direction, and rule number, as that is all the session owns.
+func sessionRuleKeys(s Session) (map[string]bool, map[string]bool) {
+	sgKeys := make(map[string]bool)
+	for _, v := range s.SecurityGroupRules {
+		if v.PreExisting == true || v.GroupID == "" {
+			continue
+		}
+		perm, err := securityGroupRulePermission(v)
+		if err != nil {
+			continue
+		}
+		for _, item := range flattenPermissions([]*ec2.IpPermission{perm}, v.Egress) {
+			sgKeys[v.GroupID+" "+item.key()] = true
+		}
+	}
+
+	naclKeys := make(map[string]bool)
+	rules := append([]NetworkACLRule(nil), s.NetworkACLRules...)
+	for _, v := range s.NetworkACLRulePairs {
+		rules = append(rules, v.Forward, v.Return)
+	}
+	for _, v := range rules {
+		if v.PreExisting == false && v.RuleNumber > 0 {
+			naclKeys[networkACLOwnerKey(v.NetworkAclID, v.Egress, int64(v.RuleNumber))] = true
+		}
+	}
+	return sgKeys, naclKeys
+}
+
+// networkACLOwnerKey returns the key that a network ACL entry is owned by.
+func networkACLOwnerKey(acl string, egress bool, number int64) string {
+	return fmt.Sprintf("%s %v %d", acl, egress, number)
+}
+
+// diffSessionSnapshot compares the live state of every resource in a
+// session's snapshot against it, like diffSnapshot, but only returns the
+// session's own rules to revert. The rest are reported as foreign.
+func diffSessionSnapshot(conn *ec2.EC2, s Session) ([]securityGroupDrift, []networkACLDrift, DriftReport, error) {
+	sgDrift, naclDrift, report, err := diffSnapshot(conn, s.Snapshot)
+	if err != nil {
+		return nil, nil, report, err
+	}
+
+	sgKeys, naclKeys := sessionRuleKeys(s)
+	foreign := make(map[string][]string)
+
+	var sgOwned []securityGroupDrift
+	for _, d := range sgDrift {
+		owned := securityGroupDrift{group: d.group}
+		split := func(items []securityGroupItem) []securityGroupItem {
+			var out []securityGroupItem
+			for _, v := range items {
+				if sgKeys[d.group+" "+v.key()] == true {
+					out = append(out, v)
+				} else {
+					foreign["security_group "+d.group] = append(foreign["security_group "+d.group], v.key())
+				}
+			}
+			return out
+		}
+		owned.added = split(d.added)
+		owned.removed = split(d.removed)
+		if len(owned.added) > 0 || len(owned.removed) > 0 {
+			sgOwned = append(sgOwned, owned)
+		}
+	}
+
+	var naclOwned []networkACLDrift
+	for _, d := range naclDrift {
+		owned := networkACLDrift{acl: d.acl}
+		split := func(entries []*ec2.NetworkAclEntry) []*ec2.NetworkAclEntry {
+			var out []*ec2.NetworkAclEntry
+			for _, e := range entries {
+				if naclKeys[networkACLOwnerKey(d.acl, aws.BoolValue(e.Egress), aws.Int64Value(e.RuleNumber))] == true {
+					out = append(out, e)
+				} else {
+					foreign["network_acl "+d.acl] = append(foreign["network_acl "+d.acl], networkACLItemKey(e))
+				}
+			}
+			return out
+		}
+		owned.added = split(d.added)
+		owned.removed = split(d.removed)
+		if len(owned.added) > 0 || len(owned.removed) > 0 {
+			naclOwned = append(naclOwned, owned)
+		}
+	}
+
+	for i, v := range report.Drift {
+		report.Drift[i].Foreign = sortedStrings(foreign[v.Resource+" "+v.ID])
+	}
+	return sgOwned, naclOwned, report, nil
+}
+
+// securityGroupItemPermissions returns the permissions for the items in one
+// direction.
+func securityGroupItemPermissions(items []securityGroupItem, egress bool) []*ec2.IpPermission {
+	var out []*ec2.IpPermission
+	for _, v := range items {
+		if v.egress == egress {
+			out = append(out, v.perm)
+		}
+	}
+	return out
+}
+
+// revertSecurityGroupDrift removes the rules added to a security group and
+// restores the rules removed from it.
+func revertSecurityGroupDrift(conn *ec2.EC2, d securityGroupDrift) error {
+	for _, egress := range []bool{false, true} {
+		if perms := securityGroupItemPermissions(d.added, egress); len(perms) > 0 {
+			err := revokeSecurityGroupPermissions(conn, d.group, egress, perms)
+			if err != nil {
+				return err
+			}
+		}
+		if perms := securityGroupItemPermissions(d.removed, egress); len(perms) > 0 {
+			err := authorizeSecurityGroupPermissions(conn, d.group, egress, perms)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// revertNetworkACLDrift deletes the entries added to a network ACL and
+// recreates the entries removed from it. Entries are deleted first, as a
+// changed entry shows up as both added and removed under the same rule
+// number.
+func revertNetworkACLDrift(conn *ec2.EC2, d networkACLDrift) error {
+	for _, e := range d.added {
+		_, err := conn.DeleteNetworkAclEntry(&ec2.DeleteNetworkAclEntryInput{
+			Egress:       e.Egress,
+			NetworkAclId: aws.String(d.acl),
+			RuleNumber:   e.RuleNumber,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range d.removed {
+		_, err := conn.CreateNetworkAclEntry(&ec2.CreateNetworkAclEntryInput{
+			CidrBlock:     e.CidrBlock,
+			Egress:        e.Egress,
+			IcmpTypeCode:  e.IcmpTypeCode,
+			Ipv6CidrBlock: e.Ipv6CidrBlock,
+			NetworkAclId:  aws.String(d.acl),
+			PortRange:     e.PortRange,
+			Protocol:      e.Protocol,
+			RuleAction:    e.RuleAction,
+			RuleNumber:    e.RuleNumber,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot reverts the session's own drift from its snapshot: rules
+// the session created that still exist are removed, and rules it deleted are
+// put back. Security group rules are matched by their permission, and
+// network ACL entries by their rule number. Any other drift is foreign, for
+// example a rule someone else added while the session was running, and is
+// reported but left alone. The returned report describes all of the drift
+// that was found before reverting.
+//
+// Reverting stops at the first error. Run CheckTeardownDrift again to see
+// what is left over.
+func RestoreSnapshot(conn *ec2.EC2, s Session) (DriftReport, error) {
+	sgDrift, naclDrift, report, err := diffSessionSnapshot(conn, s)
+	if err != nil {
+		return report, err
+	}
+
+	for _, v := range naclDrift {
+		err = revertNetworkACLDrift(conn, v)
+		if err != nil {
+			return report, fmt.Errorf("Unable to restore network ACL %s: %s", v.acl, err)
+		}
+	}
+
+	for _, v := range sgDrift {
+		err = revertSecurityGroupDrift(conn, v)
+		if err != nil {
+			return report, fmt.Errorf("Unable to restore security group %s: %s", v.group, err)
+		}
+	}
+
+	return report, nil
+}
+
+// CheckTeardownDrift compares the shared security groups and network ACLs
+// that a torn down session changed against the snapshot taken before the
+// changes, to confirm that teardown left them exactly as they were found.
+// Drift that the session did not cause is reported as foreign. If revert is
+// true, the session's own drift is reverted (see RestoreSnapshot). The
+// returned report describes the drift that was found.
+func CheckTeardownDrift(conn *ec2.EC2, s Session, revert bool) (DriftReport, error) {
+	if revert == true {
+		return RestoreSnapshot(conn, s)
+	}
+	_, _, report, err := diffSessionSnapshot(conn, s)
+	return report, err
+}
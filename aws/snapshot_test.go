@@ -0,0 +1,261 @@
+package aws
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testSnapshotMock holds the live state served by the snapshot mock, and the
+// calls made to it.
+type testSnapshotMock struct {
+	group *ec2.SecurityGroup
+	acl   *ec2.NetworkAcl
+	calls []string
+}
+
+// createTestEC2SnapshotMock returns a mock EC2 service to use with the
+// snapshot test functions.
+func createTestEC2SnapshotMock(m *testSnapshotMock) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeSecurityGroupsInput:
+			m.calls = append(m.calls, "describe "+*p.GroupIds[0])
+			*r.Data.(*ec2.DescribeSecurityGroupsOutput) = ec2.DescribeSecurityGroupsOutput{
+				SecurityGroups: []*ec2.SecurityGroup{m.group},
+			}
+		case *ec2.DescribeNetworkAclsInput:
+			m.calls = append(m.calls, "describe "+*p.NetworkAclIds[0])
+			*r.Data.(*ec2.DescribeNetworkAclsOutput) = ec2.DescribeNetworkAclsOutput{
+				NetworkAcls: []*ec2.NetworkAcl{m.acl},
+			}
+		case *ec2.AuthorizeSecurityGroupIngressInput:
+			m.calls = append(m.calls, fmt.Sprintf("authorize %d", len(p.IpPermissions)))
+		case *ec2.RevokeSecurityGroupIngressInput:
+			m.calls = append(m.calls, fmt.Sprintf("revoke %d", len(p.IpPermissions)))
+		case *ec2.CreateNetworkAclEntryInput:
+			m.calls = append(m.calls, fmt.Sprintf("create entry %d", *p.RuleNumber))
+		case *ec2.DeleteNetworkAclEntryInput:
+			m.calls = append(m.calls, fmt.Sprintf("delete entry %d", *p.RuleNumber))
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+// testSnapshotEntry provides a TCP network ACL entry.
+func testSnapshotEntry(n int64, cidr string) *ec2.NetworkAclEntry {
+	return &ec2.NetworkAclEntry{
+		CidrBlock:  aws.String(cidr),
+		Egress:     aws.Bool(false),
+		PortRange:  &ec2.PortRange{From: aws.Int64(22), To: aws.Int64(22)},
+		Protocol:   aws.String("6"),
+		RuleAction: aws.String("allow"),
+		RuleNumber: aws.Int64(n),
+	}
+}
+
+// testSnapshotPermission provides an SSH ingress permission.
+func testSnapshotPermission(cidrs ...string) *ec2.IpPermission {
+	perm := &ec2.IpPermission{
+		FromPort:   aws.Int64(22),
+		IpProtocol: aws.String("tcp"),
+		ToPort:     aws.Int64(22),
+	}
+	for _, v := range cidrs {
+		perm.IpRanges = append(perm.IpRanges, &ec2.IpRange{CidrIp: aws.String(v)})
+	}
+	return perm
+}
+
+// newTestSnapshotMock provides a snapshot mock with a security group and
+// network ACL in their original state.
+func newTestSnapshotMock() *testSnapshotMock {
+	return &testSnapshotMock{
+		group: &ec2.SecurityGroup{
+			GroupId:       aws.String("sg-123456"),
+			IpPermissions: []*ec2.IpPermission{testSnapshotPermission("10.0.0.0/24", "10.0.1.0/24")},
+		},
+		acl: &ec2.NetworkAcl{
+			NetworkAclId: aws.String("nacl-123456"),
+			Entries:      []*ec2.NetworkAclEntry{testSnapshotEntry(100, "10.0.0.0/24")},
+		},
+	}
+}
+
+// takeTestSnapshot captures the mock's security group and network ACL.
+func takeTestSnapshot(t *testing.T, conn *ec2.EC2) StateSnapshot {
+	snap, err := SnapshotSecurityGroup(conn, StateSnapshot{}, "sg-123456")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	snap, err = SnapshotNetworkACL(conn, snap, "nacl-123456")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	return snap
+}
+
+func TestSnapshotCapturedOnce(t *testing.T) {
+	m := newTestSnapshotMock()
+	conn := createTestEC2SnapshotMock(m)
+
+	snap := takeTestSnapshot(t, conn)
+	snap, err := SnapshotSecurityGroup(conn, snap, "sg-123456")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := []string{"describe sg-123456", "describe nacl-123456"}
+	if reflect.DeepEqual(expected, m.calls) == false {
+		t.Fatalf("Expected %v, got %v", expected, m.calls)
+	}
+	if len(snap.SecurityGroups) != 1 || len(snap.NetworkACLs) != 1 {
+		t.Fatalf("Unexpected snapshot %#v", snap)
+	}
+}
+
+func TestDiffSnapshotClean(t *testing.T) {
+	m := newTestSnapshotMock()
+	conn := createTestEC2SnapshotMock(m)
+	snap := takeTestSnapshot(t, conn)
+
+	// The same rules, grouped differently, are not drift.
+	m.group = &ec2.SecurityGroup{
+		GroupId: aws.String("sg-123456"),
+		IpPermissions: []*ec2.IpPermission{
+			testSnapshotPermission("10.0.1.0/24"),
+			testSnapshotPermission("10.0.0.0/24"),
+		},
+	}
+
+	report, err := DiffSnapshot(conn, snap)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if report.Clean() == false {
+		t.Fatalf("Expected no drift, got:\n%s", report)
+	}
+}
+
+func TestDiffSnapshotDrift(t *testing.T) {
+	m := newTestSnapshotMock()
+	conn := createTestEC2SnapshotMock(m)
+	snap := takeTestSnapshot(t, conn)
+
+	m.group = &ec2.SecurityGroup{
+		GroupId:       aws.String("sg-123456"),
+		IpPermissions: []*ec2.IpPermission{testSnapshotPermission("10.0.0.0/24", "10.0.9.0/24")},
+	}
+	m.acl = &ec2.NetworkAcl{
+		NetworkAclId: aws.String("nacl-123456"),
+		Entries:      []*ec2.NetworkAclEntry{testSnapshotEntry(5, "10.0.9.0/24"), testSnapshotEntry(100, "10.0.8.0/24")},
+	}
+
+	report, err := DiffSnapshot(conn, snap)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := []ResourceDrift{
+		ResourceDrift{
+			Resource: "security_group",
+			ID:       "sg-123456",
+			Added:    []string{"ingress tcp 22-22 10.0.9.0/24"},
+			Removed:  []string{"ingress tcp 22-22 10.0.1.0/24"},
+		},
+		ResourceDrift{
+			Resource: "network_acl",
+			ID:       "nacl-123456",
+			Added:    []string{"ingress #100 allow 6 22-22 10.0.8.0/24", "ingress #5 allow 6 22-22 10.0.9.0/24"},
+			Removed:  []string{"ingress #100 allow 6 22-22 10.0.0.0/24"},
+		},
+	}
+	if reflect.DeepEqual(expected, report.Drift) == false {
+		t.Fatalf("Expected %#v, got %#v", expected, report.Drift)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	m := newTestSnapshotMock()
+	conn := createTestEC2SnapshotMock(m)
+	snap := takeTestSnapshot(t, conn)
+
+	// The session's rules for 10.0.9.0/24 were left behind, while someone
+	// else changed entry #100 and removed the rule for 10.0.1.0/24.
+	m.group = &ec2.SecurityGroup{
+		GroupId:       aws.String("sg-123456"),
+		IpPermissions: []*ec2.IpPermission{testSnapshotPermission("10.0.0.0/24", "10.0.9.0/24")},
+	}
+	m.acl = &ec2.NetworkAcl{
+		NetworkAclId: aws.String("nacl-123456"),
+		Entries:      []*ec2.NetworkAclEntry{testSnapshotEntry(5, "10.0.9.0/24"), testSnapshotEntry(100, "10.0.8.0/24")},
+	}
+	m.calls = nil
+
+	s := Session{
+		Snapshot: snap,
+		SecurityGroupRules: []SecurityGroupRule{
+			SecurityGroupRule{
+				Created:   true,
+				GroupID:   "sg-123456",
+				Peer:      IPv4CIDRPeer("10.0.9.0/24"),
+				StartPort: 22,
+				EndPort:   22,
+			},
+		},
+		NetworkACLRules: []NetworkACLRule{
+			NetworkACLRule{
+				CidrBlock:    "10.0.9.0/24",
+				Created:      true,
+				NetworkAclID: "nacl-123456",
+				StartPort:    22,
+				EndPort:      22,
+				RuleNumber:   5,
+			},
+		},
+	}
+	report, err := CheckTeardownDrift(conn, s, true)
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := []string{
+		"describe sg-123456",
+		"describe nacl-123456",
+		"delete entry 5",
+		"revoke 1",
+	}
+	if reflect.DeepEqual(expected, m.calls) == false {
+		t.Fatalf("Expected %v, got %v", expected, m.calls)
+	}
+
+	expectedDrift := []ResourceDrift{
+		ResourceDrift{
+			Resource: "security_group",
+			ID:       "sg-123456",
+			Added:    []string{"ingress tcp 22-22 10.0.9.0/24"},
+			Removed:  []string{"ingress tcp 22-22 10.0.1.0/24"},
+			Foreign:  []string{"ingress tcp 22-22 10.0.1.0/24"},
+		},
+		ResourceDrift{
+			Resource: "network_acl",
+			ID:       "nacl-123456",
+			Added:    []string{"ingress #100 allow 6 22-22 10.0.8.0/24", "ingress #5 allow 6 22-22 10.0.9.0/24"},
+			Removed:  []string{"ingress #100 allow 6 22-22 10.0.0.0/24"},
+			Foreign:  []string{"ingress #100 allow 6 22-22 10.0.0.0/24", "ingress #100 allow 6 22-22 10.0.8.0/24"},
+		},
+	}
+	if reflect.DeepEqual(expectedDrift, report.Drift) == false {
+		t.Fatalf("Expected %#v, got %#v", expectedDrift, report.Drift)
+	}
+}
@@ -0,0 +1,458 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// defaultRouteCidr is the destination of the default IPv4 route.
+const defaultRouteCidr = "0.0.0.0/0"
+
+// defaultIPv6RouteCidr is the destination of the default IPv6 route.
+const defaultIPv6RouteCidr = "::/0"
+
+// internetGatewayPrefix is the ID prefix of internet gateways.
+const internetGatewayPrefix = "igw-"
+
+// Scores used when ranking candidate subnets for the bastion host.
+const (
+	// subnetScoreTargetAZ is added to subnets in the same availability zone
+	// as the target, to avoid cross-AZ traffic.
+	subnetScoreTargetAZ = 100
+
+	// subnetScorePublicTag is added to subnets with "public" in their name,
+	// and subtracted from subnets with "private" in their name.
+	subnetScorePublicTag = 10
+
+	// subnetScoreMapPublicIP is added to subnets that assign public IP
+	// addresses on launch.
+	subnetScoreMapPublicIP = 5
+)
+
+// SubnetTarget describes what the bastion host is being launched to reach,
+// for the purposes of selecting a public subnet for it. One of the fields
+// must be set; if more than one is, the target instance or IP address takes
+// precedence over VpcID.
+type SubnetTarget struct {
+	_ struct{}
+
+	// The VPC to launch the bastion host in.
+	VpcID string
+
+	// The ID of the private instance the bastion host is being used to reach.
+	TargetInstanceID string
+
+	// The private IP address of the host the bastion host is being used to
+	// reach.
+	TargetIP string
+}
+
+// SubnetCandidate describes how a single subnet was ranked during subnet
+// selection.
+type SubnetCandidate struct {
+	_ struct{}
+
+	// The ID of the subnet.
+	SubnetID string `json:"subnet_id"`
+
+	// The availability zone of the subnet.
+	AvailabilityZone string `json:"availability_zone"`
+
+	// true if the bastion host can be launched in the subnet.
+	Eligible bool `json:"eligible"`
+
+	// The score of the subnet. Higher scores are preferred.
+	Score int `json:"score"`
+
+	// The reasons that contributed to the score, or made the subnet
+	// ineligible.
+	Reasons []string `json:"reasons"`
+}
+
+// SubnetSelection is the result of SelectPublicSubnet.
+type SubnetSelection struct {
+	_ struct{}
+
+	// The ID of the selected subnet.
+	SubnetID string `json:"subnet_id"`
+
+	// The VPC the subnet was selected from.
+	VpcID string `json:"vpc_id"`
+
+	// The availability zone of the target, if a target was supplied.
+	TargetAvailabilityZone string `json:"target_availability_zone"`
+
+	// All of the subnets that were considered, best first.
+	Candidates []SubnetCandidate `json:"candidates"`
+}
+
+// Explain returns a human-readable explanation of the selection.
+func (s SubnetSelection) Explain() string {
+	var lines []string
+	if s.SubnetID != "" {
+		lines = append(lines, fmt.Sprintf("Selected subnet %s in VPC %s.", s.SubnetID, s.VpcID))
+	}
+	if s.TargetAvailabilityZone != "" {
+		lines = append(lines, fmt.Sprintf("Target is in availability zone %s.", s.TargetAvailabilityZone))
+	}
+	for _, c := range s.Candidates {
+		status := fmt.Sprintf("score %d", c.Score)
+		if c.Eligible == false {
+			status = "ineligible"
+		}
+		lines = append(lines, fmt.Sprintf("  %s (%s, %s): %s", c.SubnetID, c.AvailabilityZone, status, strings.Join(c.Reasons, "; ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// subnetName returns the value of the Name tag of a subnet, or an empty
+// string if it has none.
+func subnetName(subnet *ec2.Subnet) string {
+	for _, t := range subnet.Tags {
+		if *t.Key == "Name" {
+			return *t.Value
+		}
+	}
+	return ""
+}
+
+// rankSubnets scores the supplied subnets as candidates for the bastion host,
+// given the route tables for their VPC and the availability zone of the
+// target (which can be empty). The result is sorted best first: eligible
+// subnets by descending score, then by subnet ID so that the order is
+// deterministic, followed by ineligible subnets by subnet ID.
+func rankSubnets(subnets []*ec2.Subnet, tables []*ec2.RouteTable, targetAZ string) []SubnetCandidate {
+	var candidates []SubnetCandidate
+	for _, s := range subnets {
+		c := SubnetCandidate{
+			SubnetID:         *s.SubnetId,
+			AvailabilityZone: aws.StringValue(s.AvailabilityZone),
+		}
+
+		if err := checkPublicSubnet(s, tables); err != nil {
+			c.Reasons = append(c.Reasons, err.Error())
+			candidates = append(candidates, c)
+			continue
+		}
+
+		c.Eligible = true
+		c.Reasons = append(c.Reasons, "routes to an internet gateway")
+
+		if targetAZ != "" && c.AvailabilityZone == targetAZ {
+			c.Score += subnetScoreTargetAZ
+			c.Reasons = append(c.Reasons, "in the target's availability zone")
+		}
+
+		name := strings.ToLower(subnetName(s))
+		switch {
+		case strings.Contains(name, "public"):
+			c.Score += subnetScorePublicTag
+			c.Reasons = append(c.Reasons, fmt.Sprintf("named %q", subnetName(s)))
+		case strings.Contains(name, "private"):
+			c.Score -= subnetScorePublicTag
+			c.Reasons = append(c.Reasons, fmt.Sprintf("named %q", subnetName(s)))
+		}
+
+		if aws.BoolValue(s.MapPublicIpOnLaunch) == true {
+			c.Score += subnetScoreMapPublicIP
+			c.Reasons = append(c.Reasons, "assigns public IP addresses on launch")
+		}
+
+		candidates = append(candidates, c)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Eligible != b.Eligible {
+			return a.Eligible
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.SubnetID < b.SubnetID
+	})
+
+	return candidates
+}
+
+// findTargetLocation finds the VPC and availability zone of the target.
+func findTargetLocation(conn *ec2.EC2, target SubnetTarget) (string, string, error) {
+	switch {
+	case target.TargetInstanceID != "":
+		params := &ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice([]string{target.TargetInstanceID}),
+		}
+		resp, err := conn.DescribeInstances(params)
+		if err != nil {
+			return "", "", err
+		}
+		if len(resp.Reservations) < 1 || len(resp.Reservations[0].Instances) < 1 {
+			return "", "", fmt.Errorf("Target instance %s not found.", target.TargetInstanceID)
+		}
+		i := resp.Reservations[0].Instances[0]
+		if i.VpcId == nil {
+			return "", "", fmt.Errorf("Target instance %s is not in a VPC.", target.TargetInstanceID)
+		}
+		var az string
+		if i.Placement != nil {
+			az = aws.StringValue(i.Placement.AvailabilityZone)
+		}
+		return *i.VpcId, az, nil
+	case target.TargetIP != "":
+		params := &ec2.DescribeNetworkInterfacesInput{
+			Filters: []*ec2.Filter{
+				&ec2.Filter{
+					Name:   aws.String("addresses.private-ip-address"),
+					Values: aws.StringSlice([]string{target.TargetIP}),
+				},
+			},
+		}
+		resp, err := conn.DescribeNetworkInterfaces(params)
+		if err != nil {
+			return "", "", err
+		}
+		if len(resp.NetworkInterfaces) < 1 {
+			return "", "", fmt.Errorf("No network interface found with private IP address %s.", target.TargetIP)
+		}
+		if len(resp.NetworkInterfaces) > 1 {
+			return "", "", fmt.Errorf("More than one network interface found with private IP address %s. Supply a VPC ID or instance ID instead.", target.TargetIP)
+		}
+		eni := resp.NetworkInterfaces[0]
+		return *eni.VpcId, aws.StringValue(eni.AvailabilityZone), nil
+	case target.VpcID != "":
+		return target.VpcID, "", nil
+	}
+
+	return "", "", fmt.Errorf("A VPC ID, target instance ID, or target IP address is required to select a subnet.")
+}
+
+// SelectPublicSubnet selects a public subnet to launch the bastion host in,
+// from either a VPC ID, or the instance ID or private IP address of the host
+// the bastion host is being used to reach.
+//
+// Only subnets that pass the same checks as ValidatePublicSubnet are
+// eligible. Eligible subnets are preferred if they are in the same
+// availability zone as the target, are named "public" (and not "private"),
+// or assign public IP addresses on launch. Ties are broken by subnet ID. The
+// returned SubnetSelection records how every subnet was ranked.
+func SelectPublicSubnet(conn *ec2.EC2, target SubnetTarget) (SubnetSelection, error) {
+	var selection SubnetSelection
+
+	vpc, az, err := findTargetLocation(conn, target)
+	if err != nil {
+		return selection, err
+	}
+	selection.VpcID = vpc
+	selection.TargetAvailabilityZone = az
+
+	params := &ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{vpc}),
+			},
+		},
+	}
+
+	resp, err := conn.DescribeSubnets(params)
+	if err != nil {
+		return selection, err
+	}
+
+	tables, err := describeRouteTables(conn, vpc)
+	if err != nil {
+		return selection, err
+	}
+
+	selection.Candidates = rankSubnets(resp.Subnets, tables, az)
+	if len(selection.Candidates) < 1 || selection.Candidates[0].Eligible == false {
+		return selection, fmt.Errorf("No suitable public subnet found in VPC %s.\n%s", vpc, selection.Explain())
+	}
+
+	selection.SubnetID = selection.Candidates[0].SubnetID
+	return selection, nil
+}
+
+// describeSubnet returns the details for a single subnet.
+func describeSubnet(conn *ec2.EC2, subnet string) (*ec2.Subnet, error) {
+	params := &ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice([]string{subnet}),
+	}
+
+	resp, err := conn.DescribeSubnets(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Subnets) < 1 {
+		return nil, fmt.Errorf("Subnet ID %s not found.", subnet)
+	}
+
+	if len(resp.Subnets) > 1 {
+		panic(fmt.Errorf("More than subnet found for subnet ID  %s", subnet))
+	}
+
+	return resp.Subnets[0], nil
+}
+
+// describeRouteTables returns all of the route tables in a VPC.
+func describeRouteTables(conn *ec2.EC2, vpc string) ([]*ec2.RouteTable, error) {
+	params := &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{vpc}),
+			},
+		},
+	}
+
+	resp, err := conn.DescribeRouteTables(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.RouteTables, nil
+}
+
+// effectiveRouteTable returns the route table in effect for a subnet out of
+// the route tables for its VPC: the explicitly associated table if there is
+// one, otherwise the main route table. nil is returned if neither is found.
+func effectiveRouteTable(tables []*ec2.RouteTable, subnet string) *ec2.RouteTable {
+	var main *ec2.RouteTable
+	for _, t := range tables {
+		for _, a := range t.Associations {
+			if a.SubnetId != nil && *a.SubnetId == subnet {
+				return t
+			}
+			if a.Main != nil && *a.Main == true {
+				main = t
+			}
+		}
+	}
+	return main
+}
+
+// internetGatewayRoute returns the active route for dest (defaultRouteCidr
+// or defaultIPv6RouteCidr) to an internet gateway in a route table, or nil if
+// there is none. Egress-only internet gateways do not allow inbound
+// connections, so they are not counted.
+func internetGatewayRoute(table *ec2.RouteTable, dest string) *ec2.Route {
+	if table == nil {
+		return nil
+	}
+
+	for _, r := range table.Routes {
+		if aws.StringValue(r.DestinationCidrBlock) != dest && aws.StringValue(r.DestinationIpv6CidrBlock) != dest {
+			continue
+		}
+		if r.GatewayId == nil || strings.HasPrefix(*r.GatewayId, internetGatewayPrefix) == false {
+			continue
+		}
+		if r.State != nil && *r.State != ec2.RouteStateActive {
+			continue
+		}
+		return r
+	}
+
+	return nil
+}
+
+// checkPublicSubnet checks that a subnet is available, has free addresses,
+// and routes to an internet gateway, given the route tables for its VPC.
+func checkPublicSubnet(subnet *ec2.Subnet, tables []*ec2.RouteTable) error {
+	id := *subnet.SubnetId
+
+	if subnet.State != nil && *subnet.State != ec2.SubnetStateAvailable {
+		return fmt.Errorf("Subnet %s is in state %q, and cannot be launched into yet.", id, *subnet.State)
+	}
+
+	if subnet.AvailableIpAddressCount != nil && *subnet.AvailableIpAddressCount < 1 {
+		return fmt.Errorf("Subnet %s has no free IP addresses. Free up an address, or choose another subnet.", id)
+	}
+
+	table := effectiveRouteTable(tables, id)
+	if table == nil {
+		return fmt.Errorf("No route table found for subnet %s, and VPC %s has no main route table.", id, *subnet.VpcId)
+	}
+
+	if internetGatewayRoute(table, defaultRouteCidr) == nil {
+		return fmt.Errorf(
+			"Subnet %s is not a public subnet: route table %s has no active %s route to an internet gateway. "+
+				"Choose a subnet whose route table sends %s to an %s* gateway.",
+			id, *table.RouteTableId, defaultRouteCidr, defaultRouteCidr, internetGatewayPrefix,
+		)
+	}
+
+	return nil
+}
+
+// subnetHasIPv6 returns true if a subnet has an associated IPv6 CIDR block.
+func subnetHasIPv6(subnet *ec2.Subnet) bool {
+	for _, v := range subnet.Ipv6CidrBlockAssociationSet {
+		if v.Ipv6CidrBlockState == nil || aws.StringValue(v.Ipv6CidrBlockState.State) == ec2.SubnetCidrBlockStateCodeAssociated {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPublicSubnetIPv6 checks that a subnet that has passed
+// checkPublicSubnet can also be reached over IPv6: it must have an IPv6 CIDR
+// block, and its route table must send ::/0 to an internet gateway.
+func checkPublicSubnetIPv6(subnet *ec2.Subnet, tables []*ec2.RouteTable) error {
+	id := *subnet.SubnetId
+
+	if subnetHasIPv6(subnet) == false {
+		return fmt.Errorf("Subnet %s has no IPv6 CIDR block, so the bastion host cannot be given an IPv6 address.", id)
+	}
+
+	table := effectiveRouteTable(tables, id)
+	if internetGatewayRoute(table, defaultIPv6RouteCidr) == nil {
+		return fmt.Errorf(
+			"Subnet %s cannot be reached over IPv6: route table %s has no active %s route to an internet gateway. "+
+				"Add one, or do not request IPv6.",
+			id, *table.RouteTableId, defaultIPv6RouteCidr,
+		)
+	}
+
+	return nil
+}
+
+// ValidatePublicSubnet checks that the bastion host can be launched in a
+// subnet and reached from the internet: the subnet must be available, have a
+// free IP address, and its route table (either explicitly associated, or the
+// VPC main route table) must have an active default route to an internet
+// gateway.
+func ValidatePublicSubnet(conn *ec2.EC2, subnet string) error {
+	return ValidatePublicSubnetForInstance(conn, subnet, InstanceOptions{})
+}
+
+// ValidatePublicSubnetForInstance is ValidatePublicSubnet for a bastion host
+// launched with the supplied instance options. If an IPv6 address is
+// requested with AssignIPv6 or ConnectIPv6, the subnet must also have an
+// IPv6 CIDR block and an active ::/0 route to an internet gateway.
+func ValidatePublicSubnetForInstance(conn *ec2.EC2, subnet string, opts InstanceOptions) error {
+	s, err := describeSubnet(conn, subnet)
+	if err != nil {
+		return err
+	}
+
+	tables, err := describeRouteTables(conn, *s.VpcId)
+	if err != nil {
+		return err
+	}
+
+	err = checkPublicSubnet(s, tables)
+	if err != nil {
+		return err
+	}
+
+	if opts.AssignIPv6 == true || opts.ConnectIPv6 == true {
+		return checkPublicSubnetIPv6(s, tables)
+	}
+	return nil
+}
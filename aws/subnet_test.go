@@ -0,0 +1,374 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testDescribeRouteTablesOutput provides test data for the stub
+// DescribeRouteTables function. The main route table routes to an internet
+// gateway, and subnet-private is explicitly associated with a route table
+// that routes to a NAT gateway.
+func testDescribeRouteTablesOutput() *ec2.DescribeRouteTablesOutput {
+	return &ec2.DescribeRouteTablesOutput{
+		RouteTables: []*ec2.RouteTable{
+			&ec2.RouteTable{
+				Associations: []*ec2.RouteTableAssociation{
+					&ec2.RouteTableAssociation{
+						Main:                    aws.Bool(true),
+						RouteTableAssociationId: aws.String("rtbassoc-000001"),
+						RouteTableId:            aws.String("rtb-public"),
+					},
+				},
+				RouteTableId: aws.String("rtb-public"),
+				Routes: []*ec2.Route{
+					&ec2.Route{
+						DestinationCidrBlock: aws.String("10.0.0.0/16"),
+						GatewayId:            aws.String("local"),
+						State:                aws.String("active"),
+					},
+					&ec2.Route{
+						DestinationCidrBlock: aws.String("0.0.0.0/0"),
+						GatewayId:            aws.String("igw-123456"),
+						State:                aws.String("active"),
+					},
+				},
+				VpcId: aws.String("vpc-123456"),
+			},
+			&ec2.RouteTable{
+				Associations: []*ec2.RouteTableAssociation{
+					&ec2.RouteTableAssociation{
+						Main:                    aws.Bool(false),
+						RouteTableAssociationId: aws.String("rtbassoc-000002"),
+						RouteTableId:            aws.String("rtb-private"),
+						SubnetId:                aws.String("subnet-private"),
+					},
+				},
+				RouteTableId: aws.String("rtb-private"),
+				Routes: []*ec2.Route{
+					&ec2.Route{
+						DestinationCidrBlock: aws.String("10.0.0.0/16"),
+						GatewayId:            aws.String("local"),
+						State:                aws.String("active"),
+					},
+					&ec2.Route{
+						DestinationCidrBlock: aws.String("0.0.0.0/0"),
+						NatGatewayId:         aws.String("nat-123456"),
+						State:                aws.String("active"),
+					},
+				},
+				VpcId: aws.String("vpc-123456"),
+			},
+		},
+	}
+}
+
+// testDescribeRouteTables is a stub function for testing the
+// ec2.DescribeRouteTables function.
+func testDescribeRouteTables(input *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	if *input.Filters[0].Values[0] == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return testDescribeRouteTablesOutput(), nil
+}
+
+// testVPCSubnet returns a test subnet in vpc-123456.
+func testVPCSubnet(id, az, name string, free int64) *ec2.Subnet {
+	return &ec2.Subnet{
+		AvailabilityZone:        aws.String(az),
+		AvailableIpAddressCount: aws.Int64(free),
+		CidrBlock:               aws.String("10.0.0.0/24"),
+		State:                   aws.String("available"),
+		SubnetId:                aws.String(id),
+		Tags:                    []*ec2.Tag{&ec2.Tag{Key: aws.String("Name"), Value: aws.String(name)}},
+		VpcId:                   aws.String("vpc-123456"),
+	}
+}
+
+// testDescribeVPCSubnetsOutput provides test data for the stub
+// DescribeSubnets function when searching for all subnets in a VPC.
+//
+// Only subnet-123456 and subnet-public-b are eligible for the bastion host:
+// subnet-private routes to a NAT gateway, and subnet-full has no free IP
+// addresses.
+func testDescribeVPCSubnetsOutput() *ec2.DescribeSubnetsOutput {
+	return &ec2.DescribeSubnetsOutput{
+		Subnets: []*ec2.Subnet{
+			testVPCSubnet("subnet-private", "us-west-2b", "private-b", 200),
+			testVPCSubnet("subnet-full", "us-west-2b", "public-b-full", 0),
+			testVPCSubnet("subnet-public-b", "us-west-2b", "public-b", 200),
+			testVPCSubnet("subnet-123456", "us-west-2a", "public-a", 200),
+		},
+	}
+}
+
+// testDescribeSubnetInstances is a stub function for testing the
+// ec2.DescribeInstances function during subnet selection.
+func testDescribeSubnetInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	if *input.InstanceIds[0] == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	out := testDescribeInstancesOutput()
+	out.Reservations[0].Instances[0].VpcId = aws.String("vpc-123456")
+	out.Reservations[0].Instances[0].Placement = &ec2.Placement{AvailabilityZone: aws.String("us-west-2b")}
+	return out, nil
+}
+
+// testDescribeNetworkInterfaces is a stub function for testing the
+// ec2.DescribeNetworkInterfaces function.
+func testDescribeNetworkInterfaces(input *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	if *input.Filters[0].Values[0] == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []*ec2.NetworkInterface{
+			&ec2.NetworkInterface{
+				AvailabilityZone:   aws.String("us-west-2a"),
+				NetworkInterfaceId: aws.String("eni-123456"),
+				PrivateIpAddress:   aws.String(*input.Filters[0].Values[0]),
+				SubnetId:           aws.String("subnet-private"),
+				VpcId:              aws.String("vpc-123456"),
+			},
+		},
+	}, nil
+}
+
+// createTestEC2SubnetMock returns a mock EC2 service to use with the subnet
+// test functions.
+func createTestEC2SubnetMock() *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *ec2.DescribeSubnetsInput:
+			if len(p.SubnetIds) < 1 {
+				*r.Data.(*ec2.DescribeSubnetsOutput) = *testDescribeVPCSubnetsOutput()
+				return
+			}
+			out, err := testDescribeSubnets(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeSubnetsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DescribeInstancesInput:
+			out, err := testDescribeSubnetInstances(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeInstancesOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DescribeNetworkInterfacesInput:
+			out, err := testDescribeNetworkInterfaces(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeNetworkInterfacesOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DescribeRouteTablesInput:
+			out, err := testDescribeRouteTables(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeRouteTablesOutput) = *out
+			}
+			r.Error = err
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+func TestEffectiveRouteTable(t *testing.T) {
+	tables := testDescribeRouteTablesOutput().RouteTables
+
+	cases := map[string]string{
+		"subnet-private": "rtb-private",
+		"subnet-123456":  "rtb-public",
+	}
+	for subnet, expected := range cases {
+		actual := *effectiveRouteTable(tables, subnet).RouteTableId
+		if expected != actual {
+			t.Fatalf("Expected %v for %v, got %v", expected, subnet, actual)
+		}
+	}
+}
+
+func TestCheckPublicSubnet(t *testing.T) {
+	tables := testDescribeRouteTablesOutput().RouteTables
+
+	cases := []struct {
+		subnet   *ec2.Subnet
+		expected string
+	}{
+		{
+			subnet:   testDescribeSubnetsOutput().Subnets[0],
+			expected: "",
+		},
+		{
+			subnet: &ec2.Subnet{
+				AvailableIpAddressCount: aws.Int64(7),
+				State:                   aws.String("available"),
+				SubnetId:                aws.String("subnet-private"),
+				VpcId:                   aws.String("vpc-123456"),
+			},
+			expected: "not a public subnet: route table rtb-private",
+		},
+		{
+			subnet: &ec2.Subnet{
+				AvailableIpAddressCount: aws.Int64(0),
+				State:                   aws.String("available"),
+				SubnetId:                aws.String("subnet-123456"),
+				VpcId:                   aws.String("vpc-123456"),
+			},
+			expected: "no free IP addresses",
+		},
+		{
+			subnet: &ec2.Subnet{
+				AvailableIpAddressCount: aws.Int64(7),
+				State:                   aws.String("pending"),
+				SubnetId:                aws.String("subnet-123456"),
+				VpcId:                   aws.String("vpc-123456"),
+			},
+			expected: "in state \"pending\"",
+		},
+	}
+
+	for _, c := range cases {
+		err := checkPublicSubnet(c.subnet, tables)
+		switch {
+		case c.expected == "" && err != nil:
+			t.Fatalf("Bad: %s", err.Error())
+		case c.expected != "" && err == nil:
+			t.Fatalf("Expected error containing %q for %s, got none", c.expected, *c.subnet.SubnetId)
+		case c.expected != "":
+			matched, _ := regexp.MatchString(regexp.QuoteMeta(c.expected), err.Error())
+			if matched != true {
+				t.Fatalf("Expected error containing %q, got %q", c.expected, err.Error())
+			}
+		}
+	}
+}
+
+func TestValidatePublicSubnet(t *testing.T) {
+	conn := createTestEC2SubnetMock()
+
+	err := ValidatePublicSubnet(conn, "subnet-123456")
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+}
+
+func TestSelectPublicSubnet(t *testing.T) {
+	conn := createTestEC2SubnetMock()
+
+	cases := []struct {
+		target   SubnetTarget
+		expected string
+	}{
+		{target: SubnetTarget{VpcID: "vpc-123456"}, expected: "subnet-123456"},
+		{target: SubnetTarget{TargetInstanceID: "i-1234567890abcdef0"}, expected: "subnet-public-b"},
+		{target: SubnetTarget{TargetIP: "10.0.0.5"}, expected: "subnet-123456"},
+	}
+
+	for _, c := range cases {
+		out, err := SelectPublicSubnet(conn, c.target)
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if c.expected != out.SubnetID {
+			t.Fatalf("Expected %v for %#v, got %v:\n%s", c.expected, c.target, out.SubnetID, out.Explain())
+		}
+	}
+}
+
+func TestRankSubnets(t *testing.T) {
+	subnets := testDescribeVPCSubnetsOutput().Subnets
+	tables := testDescribeRouteTablesOutput().RouteTables
+
+	expected := []string{"subnet-public-b", "subnet-123456", "subnet-full", "subnet-private"}
+	candidates := rankSubnets(subnets, tables, "us-west-2b")
+	if len(candidates) != len(expected) {
+		t.Fatalf("Expected %d candidates, got %d", len(expected), len(candidates))
+	}
+	for i, v := range expected {
+		if candidates[i].SubnetID != v {
+			t.Fatalf("Expected candidate %d to be %v, got %v", i, v, candidates[i].SubnetID)
+		}
+	}
+	if candidates[2].Eligible != false || candidates[3].Eligible != false {
+		t.Fatalf("Expected subnet-full and subnet-private to be ineligible, got %#v", candidates)
+	}
+}
+
+func TestSubnetSelectionExplain(t *testing.T) {
+	selection := SubnetSelection{
+		VpcID: "vpc-123456",
+		Candidates: []SubnetCandidate{
+			SubnetCandidate{SubnetID: "subnet-private", AvailabilityZone: "us-west-2a", Reasons: []string{"no internet gateway route"}},
+		},
+	}
+
+	out := selection.Explain()
+	if strings.Contains(out, "Selected") == true {
+		t.Fatalf("Expected no selected subnet when none was chosen, got:\n%s", out)
+	}
+	if strings.Contains(out, "subnet-private (us-west-2a, ineligible)") == false {
+		t.Fatalf("Expected the candidate to be explained, got:\n%s", out)
+	}
+
+	selection.SubnetID = "subnet-123456"
+	out = selection.Explain()
+	if strings.HasPrefix(out, "Selected subnet subnet-123456 in VPC vpc-123456.") == false {
+		t.Fatalf("Expected the selected subnet first, got:\n%s", out)
+	}
+}
+
+func TestCheckPublicSubnetIPv6(t *testing.T) {
+	tables := testDescribeRouteTablesOutput().RouteTables
+	subnet := &ec2.Subnet{
+		SubnetId: aws.String("subnet-123456"),
+		VpcId:    aws.String("vpc-123456"),
+	}
+
+	err := checkPublicSubnetIPv6(subnet, tables)
+	if err == nil || strings.Contains(err.Error(), "no IPv6 CIDR block") == false {
+		t.Fatalf("Expected an error for a subnet with no IPv6 CIDR block, got %v", err)
+	}
+
+	subnet.Ipv6CidrBlockAssociationSet = []*ec2.SubnetIpv6CidrBlockAssociation{
+		&ec2.SubnetIpv6CidrBlockAssociation{
+			Ipv6CidrBlock:      aws.String("2001:db8:1234:1a00::/64"),
+			Ipv6CidrBlockState: &ec2.SubnetCidrBlockState{State: aws.String("associated")},
+		},
+	}
+	err = checkPublicSubnetIPv6(subnet, tables)
+	if err == nil || strings.Contains(err.Error(), "no active ::/0 route") == false {
+		t.Fatalf("Expected an error for a subnet with no IPv6 default route, got %v", err)
+	}
+
+	// An egress-only internet gateway does not let clients in.
+	tables[0].Routes = append(tables[0].Routes, &ec2.Route{
+		DestinationIpv6CidrBlock:    aws.String("::/0"),
+		EgressOnlyInternetGatewayId: aws.String("eigw-123456"),
+		State:                       aws.String("active"),
+	})
+	err = checkPublicSubnetIPv6(subnet, tables)
+	if err == nil {
+		t.Fatalf("Expected an error for an egress-only internet gateway route")
+	}
+
+	tables[0].Routes = append(tables[0].Routes, &ec2.Route{
+		DestinationIpv6CidrBlock: aws.String("::/0"),
+		GatewayId:                aws.String("igw-123456"),
+		State:                    aws.String("active"),
+	})
+	err = checkPublicSubnetIPv6(subnet, tables)
+	if err != nil {
+		t.Fatalf("Bad: %s", err)
+	}
+}
@@ -0,0 +1,198 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// TargetAccessOptions describes the private host that the bastion host
+// should be given access to. One of InstanceID or NetworkInterfaceID must be
+// set.
+type TargetAccessOptions struct {
+	_ struct{}
+
+	// The ID of the target instance. Access is granted to its primary
+	// network interface.
+	InstanceID string
+
+	// The ID of the target network interface.
+	NetworkInterfaceID string
+
+	// The port to allow access to. Defaults to 22.
+	Port int
+
+	// The placement strategy for network ACL entries added to the target
+	// subnet. Defaults to DefaultRulePlacement.
+	Placement RulePlacement
+
+	// The policy the rules are checked against. Defaults to DefaultPolicy.
+	Policy *Policy
+
+	// The network ACL rule pair a plan made for the target subnet, if access
+	// is being granted as planned (see ApplyPlan). The pair for the bastion
+	// host's address must have the same outcome, and its new entries get the
+	// planned rule numbers instead of using Placement.
+	Planned *NetworkACLRulePair
+}
+
+// accessTarget is the network location of an access target.
+type accessTarget struct {
+	// The subnet the target is in.
+	subnetID string
+
+	// The security groups of the target.
+	groupIDs []string
+}
+
+// findAccessTarget finds the subnet and security groups of an access target.
+func findAccessTarget(conn *ec2.EC2, opts TargetAccessOptions) (accessTarget, error) {
+	var target accessTarget
+
+	switch {
+	case opts.InstanceID != "":
+		params := &ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice([]string{opts.InstanceID}),
+		}
+		resp, err := conn.DescribeInstances(params)
+		if err != nil {
+			return target, err
+		}
+		if len(resp.Reservations) < 1 || len(resp.Reservations[0].Instances) < 1 {
+			return target, fmt.Errorf("Target instance %s not found.", opts.InstanceID)
+		}
+		i := resp.Reservations[0].Instances[0]
+		if i.SubnetId == nil {
+			return target, fmt.Errorf("Target instance %s is not in a VPC.", opts.InstanceID)
+		}
+		target.subnetID = *i.SubnetId
+		for _, g := range i.SecurityGroups {
+			target.groupIDs = append(target.groupIDs, *g.GroupId)
+		}
+	case opts.NetworkInterfaceID != "":
+		params := &ec2.DescribeNetworkInterfacesInput{
+			NetworkInterfaceIds: aws.StringSlice([]string{opts.NetworkInterfaceID}),
+		}
+		resp, err := conn.DescribeNetworkInterfaces(params)
+		if err != nil {
+			return target, err
+		}
+		if len(resp.NetworkInterfaces) < 1 {
+			return target, fmt.Errorf("Target network interface %s not found.", opts.NetworkInterfaceID)
+		}
+		eni := resp.NetworkInterfaces[0]
+		target.subnetID = *eni.SubnetId
+		for _, g := range eni.Groups {
+			target.groupIDs = append(target.groupIDs, *g.GroupId)
+		}
+	default:
+		return target, fmt.Errorf("A target instance ID or network interface ID is required.")
+	}
+
+	if len(target.groupIDs) < 1 {
+		return target, fmt.Errorf("Target has no security groups.")
+	}
+	sort.Strings(target.groupIDs)
+
+	return target, nil
+}
+
+// coveringTargetGroup returns the security group that a target access rule
+// should be added to. Security group rules are additive, so a rule in any one
+// of the target's groups is enough: if one of them already allows the
+// traffic, it is used, so that the rule is found pre-existing. Otherwise, the
+// lowest group ID is used so the choice is stable.
+func coveringTargetGroup(conn *ec2.EC2, groupIDs []string, rule SecurityGroupRule) (string, error) {
+	for _, v := range groupIDs {
+		perms, err := describeSecurityGroupPermissions(conn, v, rule.Egress)
+		if err != nil {
+			return "", err
+		}
+		rule.GroupID = v
+		if permissionsCoverRule(perms, rule) == true {
+			return v, nil
+		}
+	}
+
+	return groupIDs[0], nil
+}
+
+// GrantTargetAccess opens access from the bastion host to a private target:
+// an ingress rule is added to one of the target's security groups (see
+// coveringTargetGroup) that allows the bastion security group in on the
+// target port, and, if the target is in a different subnet to the bastion
+// host, a network ACL rule pair is added to the target subnet allowing the
+// bastion host in on the target port, and return traffic back out on
+// ephemeral ports.
+//
+// The rules are applied as a single RuleSet, so if any of them cannot be
+// created, the others are rolled back. The returned rules use the same
+// PreExisting semantics as the rest of the rules bastion creates, and should
+// be added to the session so that they are removed on teardown. Rules are
+// returned even in the event of errors, so that anything that could not be
+// rolled back can be cleaned up. The per-rule report from ApplyRuleSet is
+// returned along with them, including any policy violations that were
+// overridden.
+func GrantTargetAccess(conn *ec2.EC2, bastion Instance, opts TargetAccessOptions) ([]SecurityGroupRule, []NetworkACLRulePair, RuleSetResult, error) {
+	var sgrs []SecurityGroupRule
+	var pairs []NetworkACLRulePair
+	var result RuleSetResult
+
+	port := opts.Port
+	if port == 0 {
+		port = sshPort
+	}
+
+	target, err := findAccessTarget(conn, opts)
+	if err != nil {
+		return sgrs, pairs, result, err
+	}
+
+	sgr := SecurityGroupRule{
+		Peer:      SecurityGroupPeer(bastion.SecurityGroupID, ""),
+		StartPort: port,
+		EndPort:   port,
+	}
+	sgr.GroupID, err = coveringTargetGroup(conn, target.groupIDs, sgr)
+	if err != nil {
+		return sgrs, pairs, result, err
+	}
+
+	set := RuleSet{
+		SecurityGroupRules: []SecurityGroupRule{sgr},
+		Placement:          opts.Placement,
+		Policy:             opts.Policy,
+	}
+
+	// Network ACLs do not apply to traffic within a subnet.
+	if target.subnetID != bastion.SubnetID {
+		acl, err := FindNetworkACLForSubnet(conn, target.subnetID)
+		if err != nil {
+			return sgrs, pairs, result, err
+		}
+
+		pair := NewNetworkACLRulePair(NetworkACLRule{
+			NetworkAclID: acl,
+			CidrBlock:    bastion.PrivateIPAddress + "/32",
+			StartPort:    port,
+			EndPort:      port,
+		}, EphemeralPortsAny)
+		set.NetworkACLRules = []NetworkACLRule{pair.Forward, pair.Return}
+
+		if opts.Planned != nil {
+			set.Placement, err = plannedPairPlacement(conn, pair, *opts.Planned)
+			if err != nil {
+				return sgrs, pairs, result, err
+			}
+		}
+	}
+
+	set, result, err = ApplyRuleSet(conn, set)
+	sgrs = append(sgrs, set.SecurityGroupRules...)
+	if len(set.NetworkACLRules) > 0 {
+		pairs = append(pairs, NetworkACLRulePair{Forward: set.NetworkACLRules[0], Return: set.NetworkACLRules[1]})
+	}
+	return sgrs, pairs, result, err
+}
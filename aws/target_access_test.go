@@ -0,0 +1,193 @@
+package aws
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// testDescribeTargetInstances is a stub function for testing the
+// ec2.DescribeInstances function when looking up an access target.
+func testDescribeTargetInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	if *input.InstanceIds[0] == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	out := testDescribeInstancesOutput()
+	i := out.Reservations[0].Instances[0]
+	i.InstanceId = input.InstanceIds[0]
+	i.SubnetId = aws.String("subnet-123456")
+	i.SecurityGroups = []*ec2.GroupIdentifier{
+		&ec2.GroupIdentifier{GroupId: aws.String("sg-999999")},
+		&ec2.GroupIdentifier{GroupId: aws.String("sg-123456")},
+	}
+	return out, nil
+}
+
+// testDescribeTargetNetworkInterfaces is a stub function for testing the
+// ec2.DescribeNetworkInterfaces function when looking up an access target.
+func testDescribeTargetNetworkInterfaces(input *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	if *input.NetworkInterfaceIds[0] == "bad" {
+		return nil, fmt.Errorf("error")
+	}
+	return &ec2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []*ec2.NetworkInterface{
+			&ec2.NetworkInterface{
+				Groups:             []*ec2.GroupIdentifier{&ec2.GroupIdentifier{GroupId: aws.String("sg-123456")}},
+				NetworkInterfaceId: input.NetworkInterfaceIds[0],
+				PrivateIpAddress:   aws.String("10.0.0.5"),
+				SubnetId:           aws.String("subnet-1234567890abcdef0"),
+				VpcId:              aws.String("vpc-123456"),
+			},
+		},
+	}, nil
+}
+
+// createTestEC2TargetAccessMock returns a mock EC2 service to use with the
+// target access test functions. The names of the operations called are
+// appended to calls.
+func createTestEC2TargetAccessMock(calls *[]string) *ec2.EC2 {
+	conn := ec2.New(session.New(), nil)
+	conn.Handlers.Clear()
+
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		*calls = append(*calls, r.Operation.Name)
+		switch p := r.Params.(type) {
+		case *ec2.DescribeInstancesInput:
+			out, err := testDescribeTargetInstances(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeInstancesOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DescribeNetworkInterfacesInput:
+			out, err := testDescribeTargetNetworkInterfaces(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeNetworkInterfacesOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DescribeSecurityGroupsInput:
+			out, err := testDescribeSecurityGroups(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeSecurityGroupsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.AuthorizeSecurityGroupIngressInput:
+			out, err := testAuthorizeSecurityGroupIngress(p)
+			if out != nil {
+				*r.Data.(*ec2.AuthorizeSecurityGroupIngressOutput) = *out
+			}
+			r.Error = err
+		case *ec2.DescribeNetworkAclsInput:
+			out, err := testDescribeNetworkAcls(p)
+			if out != nil {
+				*r.Data.(*ec2.DescribeNetworkAclsOutput) = *out
+			}
+			r.Error = err
+		case *ec2.CreateNetworkAclEntryInput:
+			out, err := testCreateNetworkAclEntry(p)
+			if out != nil {
+				*r.Data.(*ec2.CreateNetworkAclEntryOutput) = *out
+			}
+			r.Error = err
+		default:
+			panic(fmt.Errorf("Unsupported input type %T", p))
+		}
+	})
+	return conn
+}
+
+func TestGrantTargetAccess(t *testing.T) {
+	var calls []string
+	conn := createTestEC2TargetAccessMock(&calls)
+	bastion := testInstance()
+
+	sgrs, pairs, _, err := GrantTargetAccess(conn, bastion, TargetAccessOptions{InstanceID: "i-0987654321"})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if len(sgrs) != 1 {
+		t.Fatalf("Expected 1 security group rule, got %d", len(sgrs))
+	}
+	if sgrs[0].GroupID != "sg-123456" || sgrs[0].Peer != SecurityGroupPeer(bastion.SecurityGroupID, "") || sgrs[0].StartPort != 22 {
+		t.Fatalf("Unexpected security group rule %#v", sgrs[0])
+	}
+
+	if len(pairs) != 1 {
+		t.Fatalf("Expected 1 network ACL rule pair, got %d", len(pairs))
+	}
+	in, out := pairs[0].Forward, pairs[0].Return
+	if in.Egress != false || in.CidrBlock != "10.0.0.1/32" || in.StartPort != 22 {
+		t.Fatalf("Unexpected inbound network ACL rule %#v", in)
+	}
+	if out.Egress != true || out.CidrBlock != "10.0.0.1/32" || out.StartPort != 1024 || out.EndPort != 65535 {
+		t.Fatalf("Unexpected outbound network ACL rule %#v", out)
+	}
+	for _, v := range []NetworkACLRule{in, out} {
+		if v.NetworkAclID != "nacl-123456" || v.Created != true {
+			t.Fatalf("Unexpected network ACL rule %#v", v)
+		}
+	}
+}
+
+func TestGrantTargetAccessSameSubnet(t *testing.T) {
+	var calls []string
+	conn := createTestEC2TargetAccessMock(&calls)
+	bastion := testInstance()
+
+	sgrs, pairs, _, err := GrantTargetAccess(conn, bastion, TargetAccessOptions{NetworkInterfaceID: "eni-123456", Port: 5432})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if len(sgrs) != 1 || sgrs[0].StartPort != 5432 {
+		t.Fatalf("Expected a single security group rule on port 5432, got %#v", sgrs)
+	}
+	if len(pairs) != 0 {
+		t.Fatalf("Expected no network ACL rules within the same subnet, got %#v", pairs)
+	}
+}
+
+func TestGrantTargetAccessCoveredByOtherGroup(t *testing.T) {
+	var calls []string
+	conn := createTestEC2TargetAccessMock(&calls)
+	bastion := testInstance()
+	bastion.SubnetID = "subnet-123456"
+
+	// Only the target's second group already lets the bastion host in.
+	conn.Handlers.Send.PushBack(func(r *request.Request) {
+		if p, ok := r.Params.(*ec2.DescribeSecurityGroupsInput); ok == true {
+			group := &ec2.SecurityGroup{GroupId: p.GroupIds[0]}
+			if *p.GroupIds[0] == "sg-999999" {
+				group.IpPermissions = []*ec2.IpPermission{
+					&ec2.IpPermission{
+						FromPort:         aws.Int64(22),
+						IpProtocol:       aws.String("tcp"),
+						ToPort:           aws.Int64(22),
+						UserIdGroupPairs: []*ec2.UserIdGroupPair{&ec2.UserIdGroupPair{GroupId: aws.String(bastion.SecurityGroupID)}},
+					},
+				}
+			}
+			*r.Data.(*ec2.DescribeSecurityGroupsOutput) = ec2.DescribeSecurityGroupsOutput{
+				SecurityGroups: []*ec2.SecurityGroup{group},
+			}
+		}
+	})
+
+	sgrs, _, _, err := GrantTargetAccess(conn, bastion, TargetAccessOptions{InstanceID: "i-0987654321"})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if len(sgrs) != 1 || sgrs[0].GroupID != "sg-999999" || sgrs[0].PreExisting == false {
+		t.Fatalf("Expected a pre-existing rule in sg-999999, got %#v", sgrs)
+	}
+	for _, v := range calls {
+		if v == "AuthorizeSecurityGroupIngress" {
+			t.Fatalf("Expected no rule to be authorized, got %v", calls)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Package clientip discovers the public IP address of the machine bastion is
+// being run from, so that access to the bastion host can be opened to it
+// alone.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultTimeout is the time allowed for all resolvers to answer.
+const defaultTimeout = 10 * time.Second
+
+// maxResponseSize is the largest HTTP response body that is read from an echo
+// endpoint. Addresses are much shorter than this.
+const maxResponseSize = 256
+
+// Resolver looks up the public IP address of the client.
+type Resolver interface {
+	// Source returns a short description of where the resolver gets the
+	// address from, for use in results and errors.
+	Source() string
+
+	// Resolve returns the public IP address of the client.
+	Resolve(ctx context.Context) (net.IP, error)
+}
+
+// HTTPResolver resolves the client address from an HTTP endpoint that echoes
+// the caller's address back as plain text, such as
+// https://checkip.amazonaws.com.
+type HTTPResolver struct {
+	_ struct{}
+
+	// The URL of the endpoint.
+	URL string
+
+	// The HTTP client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Source implements Resolver for HTTPResolver.
+func (r HTTPResolver) Source() string {
+	return r.URL
+}
+
+// Resolve implements Resolver for HTTPResolver.
+func (r HTTPResolver) Resolve(ctx context.Context) (net.IP, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("GET", r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Endpoint %s returned status %s.", r.URL, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseIP(r.URL, strings.TrimSpace(string(body)))
+}
+
+// DNSResolver resolves the client address with a DNS query that a name
+// server answers with the address of the caller, such as myip.opendns.com
+// against resolver1.opendns.com.
+type DNSResolver struct {
+	_ struct{}
+
+	// The name to look up.
+	Host string
+
+	// The name server to query, as host:port.
+	Server string
+
+	// true if the address is returned in a TXT record (as with Google's
+	// o-o.myaddr.l.google.com), rather than an A or AAAA record.
+	TXT bool
+}
+
+// Source implements Resolver for DNSResolver.
+func (r DNSResolver) Source() string {
+	return fmt.Sprintf("dns:%s@%s", r.Host, r.Server)
+}
+
+// Resolve implements Resolver for DNSResolver.
+func (r DNSResolver) Resolve(ctx context.Context) (net.IP, error) {
+	res := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, r.Server)
+		},
+	}
+
+	if r.TXT == true {
+		txts, err := res.LookupTXT(ctx, r.Host)
+		if err != nil {
+			return nil, err
+		}
+		if len(txts) < 1 {
+			return nil, fmt.Errorf("No TXT record returned for %s.", r.Source())
+		}
+		return parseIP(r.Source(), txts[0])
+	}
+
+	addrs, err := res.LookupIPAddr(ctx, r.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) < 1 {
+		return nil, fmt.Errorf("No address returned for %s.", r.Source())
+	}
+	return addrs[0].IP, nil
+}
+
+// StaticResolver always resolves to a fixed address. It is used for explicit
+// overrides.
+type StaticResolver struct {
+	_ struct{}
+
+	// The address to return.
+	Address string
+}
+
+// Source implements Resolver for StaticResolver.
+func (r StaticResolver) Source() string {
+	return "static"
+}
+
+// Resolve implements Resolver for StaticResolver.
+func (r StaticResolver) Resolve(ctx context.Context) (net.IP, error) {
+	return parseIP(r.Source(), r.Address)
+}
+
+// DefaultResolvers returns the resolvers used when none are supplied: the
+// AWS check IP endpoint, and the OpenDNS DNS lookup.
+func DefaultResolvers() []Resolver {
+	return []Resolver{
+		HTTPResolver{URL: "https://checkip.amazonaws.com/"},
+		DNSResolver{Host: "myip.opendns.com", Server: "resolver1.opendns.com:53"},
+	}
+}
+
+// parseIP parses an address returned by a resolver.
+func parseIP(source, s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%s returned %q, which is not an IP address.", source, s)
+	}
+	return ip, nil
+}
+
+// Options describes how the client address is discovered.
+type Options struct {
+	_ struct{}
+
+	// An explicit address or CIDR block to use. If this is set, no resolvers
+	// are queried.
+	Override string
+
+	// The resolvers to query. Defaults to DefaultResolvers.
+	Resolvers []Resolver
+
+	// The time allowed for all resolvers to answer. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Result is a discovered client address.
+type Result struct {
+	_ struct{}
+
+	// The client address.
+	IP net.IP `json:"ip"`
+
+	// The client address as a CIDR block: a /32 for IPv4, or a /128 for
+	// IPv6. If an override CIDR block was supplied, it is used as is.
+	CIDR string `json:"cidr"`
+
+	// The resolvers that returned the address.
+	Sources []string `json:"sources"`
+
+	// Anything about the address that the user should be told about, such as
+	// a resolver failing, or the address being shared.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// cgnatRange is the shared address space used for carrier-grade NAT
+// (RFC 6598).
+var cgnatRange = mustParseCIDR("100.64.0.0/10")
+
+// mustParseCIDR parses a CIDR block that is known to be valid.
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// hostCIDR returns the single-address CIDR block for an address.
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.To4().String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// addressWarnings returns warnings for addresses that are unlikely to work,
+// or that are shared with others.
+func addressWarnings(ip net.IP) []string {
+	var warnings []string
+	switch {
+	case cgnatRange.Contains(ip):
+		warnings = append(warnings, fmt.Sprintf("%s is in the carrier-grade NAT range 100.64.0.0/10. It is likely shared with other customers of your ISP, and is not what AWS will see as your address.", ip))
+	case ip.IsPrivate(), ip.IsLoopback(), ip.IsLinkLocalUnicast():
+		warnings = append(warnings, fmt.Sprintf("%s is not a public address, and is not what AWS will see as your address.", ip))
+	}
+	return warnings
+}
+
+// answer is the outcome of a single resolver.
+type answer struct {
+	source string
+	ip     net.IP
+	err    error
+}
+
+// Discover finds the public address of the client. Every resolver is queried
+// at once, and all of the addresses returned must agree. Resolvers that fail
+// are reported as warnings, as long as at least one succeeds.
+func Discover(ctx context.Context, opts Options) (Result, error) {
+	var result Result
+
+	if opts.Override != "" {
+		return override(opts.Override)
+	}
+
+	resolvers := opts.Resolvers
+	if len(resolvers) < 1 {
+		resolvers = DefaultResolvers()
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	answers := make(chan answer, len(resolvers))
+	for _, r := range resolvers {
+		go func(r Resolver) {
+			ip, err := r.Resolve(ctx)
+			answers <- answer{source: r.Source(), ip: ip, err: err}
+		}(r)
+	}
+
+	found := make(map[string][]string)
+	var failures []string
+	for range resolvers {
+		a := <-answers
+		if a.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", a.source, a.err))
+			continue
+		}
+		found[a.ip.String()] = append(found[a.ip.String()], a.source)
+	}
+	sort.Strings(failures)
+
+	switch {
+	case len(found) < 1:
+		return result, fmt.Errorf("Unable to discover the client address. Supply it explicitly instead.\n%s", strings.Join(failures, "\n"))
+	case len(found) > 1:
+		var seen []string
+		for ip, sources := range found {
+			sort.Strings(sources)
+			seen = append(seen, fmt.Sprintf("%s (%s)", ip, strings.Join(sources, ", ")))
+		}
+		sort.Strings(seen)
+		return result, fmt.Errorf("Resolvers returned different client addresses: %s. Supply the address explicitly instead.", strings.Join(seen, "; "))
+	}
+
+	for ip, sources := range found {
+		sort.Strings(sources)
+		result.IP = net.ParseIP(ip)
+		result.Sources = sources
+	}
+	result.CIDR = hostCIDR(result.IP)
+
+	for _, v := range failures {
+		result.Warnings = append(result.Warnings, "Resolver failed: "+v)
+	}
+	result.Warnings = append(result.Warnings, addressWarnings(result.IP)...)
+
+	return result, nil
+}
+
+// override returns the result for an explicit address or CIDR block.
+func override(s string) (Result, error) {
+	var result Result
+	result.Sources = []string{"override"}
+
+	if strings.Contains(s, "/") {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return result, fmt.Errorf("Invalid client address or CIDR block %q.", s)
+		}
+		result.IP = ip
+		result.CIDR = n.String()
+	} else {
+		ip, err := parseIP("override", s)
+		if err != nil {
+			return result, err
+		}
+		result.IP = ip
+		result.CIDR = hostCIDR(ip)
+	}
+
+	result.Warnings = addressWarnings(result.IP)
+	return result, nil
+}
@@ -0,0 +1,196 @@
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEchoServer returns a local stand-in for an HTTP echo endpoint that
+// always returns body.
+func testEchoServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprintln(w, body)
+	}))
+}
+
+func TestHTTPResolver(t *testing.T) {
+	ts := testEchoServer(http.StatusOK, "203.0.113.10")
+	defer ts.Close()
+
+	ip, err := HTTPResolver{URL: ts.URL}.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := "203.0.113.10"
+	actual := ip.String()
+	if expected != actual {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestHTTPResolverBadResponse(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+	}{
+		{status: http.StatusOK, body: "<html>not an address</html>"},
+		{status: http.StatusServiceUnavailable, body: "203.0.113.10"},
+	}
+
+	for _, c := range cases {
+		ts := testEchoServer(c.status, c.body)
+		_, err := HTTPResolver{URL: ts.URL}.Resolve(context.Background())
+		ts.Close()
+		if err == nil {
+			t.Fatalf("Expected error for status %d and body %q", c.status, c.body)
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	a := testEchoServer(http.StatusOK, "203.0.113.10")
+	defer a.Close()
+
+	out, err := Discover(context.Background(), Options{
+		Resolvers: []Resolver{
+			HTTPResolver{URL: a.URL},
+			StaticResolver{Address: "203.0.113.10"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	if out.CIDR != "203.0.113.10/32" {
+		t.Fatalf("Expected %v, got %v", "203.0.113.10/32", out.CIDR)
+	}
+	if len(out.Sources) != 2 {
+		t.Fatalf("Expected 2 sources, got %v", out.Sources)
+	}
+	if len(out.Warnings) != 0 {
+		t.Fatalf("Expected no warnings, got %v", out.Warnings)
+	}
+}
+
+func TestDiscoverIPv6(t *testing.T) {
+	out, err := Discover(context.Background(), Options{
+		Resolvers: []Resolver{StaticResolver{Address: "2001:db8::10"}},
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+
+	expected := "2001:db8::10/128"
+	if out.CIDR != expected {
+		t.Fatalf("Expected %v, got %v", expected, out.CIDR)
+	}
+}
+
+func TestDiscoverDisagreement(t *testing.T) {
+	a := testEchoServer(http.StatusOK, "203.0.113.10")
+	defer a.Close()
+	b := testEchoServer(http.StatusOK, "198.51.100.20")
+	defer b.Close()
+
+	_, err := Discover(context.Background(), Options{
+		Resolvers: []Resolver{HTTPResolver{URL: a.URL}, HTTPResolver{URL: b.URL}},
+	})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if strings.Contains(err.Error(), "203.0.113.10") == false || strings.Contains(err.Error(), "198.51.100.20") == false {
+		t.Fatalf("Expected both addresses in error, got %s", err.Error())
+	}
+}
+
+func TestDiscoverPartialFailure(t *testing.T) {
+	a := testEchoServer(http.StatusOK, "203.0.113.10")
+	defer a.Close()
+	b := testEchoServer(http.StatusInternalServerError, "")
+	defer b.Close()
+
+	out, err := Discover(context.Background(), Options{
+		Resolvers: []Resolver{HTTPResolver{URL: a.URL}, HTTPResolver{URL: b.URL}},
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if len(out.Warnings) != 1 || strings.Contains(out.Warnings[0], b.URL) == false {
+		t.Fatalf("Expected a warning for the failed resolver, got %v", out.Warnings)
+	}
+}
+
+func TestDiscoverAllFailed(t *testing.T) {
+	b := testEchoServer(http.StatusInternalServerError, "")
+	defer b.Close()
+
+	_, err := Discover(context.Background(), Options{
+		Resolvers: []Resolver{HTTPResolver{URL: b.URL}},
+	})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestDiscoverTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	_, err := Discover(context.Background(), Options{
+		Resolvers: []Resolver{HTTPResolver{URL: slow.URL}},
+		Timeout:   50 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestDiscoverCGNAT(t *testing.T) {
+	out, err := Discover(context.Background(), Options{
+		Resolvers: []Resolver{StaticResolver{Address: "100.72.1.2"}},
+	})
+	if err != nil {
+		t.Fatalf("Bad: %s", err.Error())
+	}
+	if len(out.Warnings) != 1 || strings.Contains(out.Warnings[0], "carrier-grade NAT") == false {
+		t.Fatalf("Expected a carrier-grade NAT warning, got %v", out.Warnings)
+	}
+}
+
+func TestDiscoverOverride(t *testing.T) {
+	cases := map[string]string{
+		"203.0.113.10":    "203.0.113.10/32",
+		"203.0.113.10/24": "203.0.113.0/24",
+		"2001:db8::10":    "2001:db8::10/128",
+	}
+
+	for in, expected := range cases {
+		out, err := Discover(context.Background(), Options{
+			Override:  in,
+			Resolvers: []Resolver{StaticResolver{Address: "bad"}},
+		})
+		if err != nil {
+			t.Fatalf("Bad: %s", err.Error())
+		}
+		if expected != out.CIDR {
+			t.Fatalf("Expected %v, got %v", expected, out.CIDR)
+		}
+	}
+
+	_, err := Discover(context.Background(), Options{Override: "not-an-address"})
+	if err == nil {
+		t.Fatalf("Expected error for invalid override")
+	}
+}